@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+/*
+runCommand runs the subcommand named by the first argument, it returns false
+if there is none and the server should be started
+*/
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "snapshot":
+		return true, runSnapshot(args[1:])
+	case "restore":
+		return true, runRestore(args[1:])
+	}
+	return false, nil
+}
+
+/*
+runSnapshot downloads a snapshot of a running server into a file or stdout
+*/
+func runSnapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:3596", "address of the server to snapshot")
+	out := flags.String("o", "", "file to write the snapshot to, stdout if empty")
+	flags.Parse(args)
+
+	resp, err := http.Get(strings.TrimRight(*addr, "/") + "/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+/*
+runRestore uploads a snapshot file to a running server and prints the result
+*/
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:3596", "address of the server to restore into")
+	onConflict := flags.String("on-conflict", "skip", "what to do with existing sketches: skip, overwrite or merge")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: skizze restore [-addr address] [-on-conflict mode] snapshot.tar")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	target := strings.TrimRight(*addr, "/") + "/restore?on_conflict=" + url.QueryEscape(*onConflict)
+	resp, err := http.Post(target, "application/x-tar", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("Server responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
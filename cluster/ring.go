@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/seiflotfy/skizze/sketches/hashing"
+)
+
+/*
+VirtualNodes is the number of points of each node on the ring, more points
+spread the keys more evenly
+*/
+const VirtualNodes = 128
+
+var hasher, _ = hashing.New(hashing.XXHash, 0)
+
+/*
+Ring assigns keys to nodes with consistent hashing: each node is placed at
+VirtualNodes points of a ring of hashes and a key belongs to the nodes of the
+first points following its hash. Adding or removing a node only moves the keys
+of its points.
+*/
+type Ring struct {
+	nodes  []string
+	points []uint64 // sorted
+	owners []string // owners[i] is the node of points[i]
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+type pointsByHash []point
+
+func (p pointsByHash) Len() int      { return len(p) }
+func (p pointsByHash) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pointsByHash) Less(i, j int) bool {
+	if p[i].hash == p[j].hash {
+		return p[i].node < p[j].node
+	}
+	return p[i].hash < p[j].hash
+}
+
+/*
+NewRing returns a ring of the given nodes, duplicates are ignored
+*/
+func NewRing(nodes []string) *Ring {
+	r := &Ring{}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if node == "" || seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+	}
+	sort.Strings(r.nodes)
+
+	points := make(pointsByHash, 0, len(r.nodes)*VirtualNodes)
+	for _, node := range r.nodes {
+		for i := 0; i < VirtualNodes; i++ {
+			points = append(points, point{hasher.Sum64([]byte(fmt.Sprintf("%s#%d", node, i))), node})
+		}
+	}
+	sort.Sort(points)
+	r.points = make([]uint64, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.node
+	}
+	return r
+}
+
+/*
+Nodes returns the nodes of the ring ordered by address
+*/
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+/*
+Owners returns the n distinct nodes owning key (all nodes if there are fewer),
+the first one is its primary owner
+*/
+func (r *Ring) Owners(key string, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	owners := make([]string, 0, n)
+	if n == 0 {
+		return owners
+	}
+	hash := hasher.Sum64([]byte(key))
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	for i := 0; len(owners) < n; i++ {
+		node := r.owners[(start+i)%len(r.points)]
+		if !contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+/*
+Owns returns whether node is one of the n owners of key
+*/
+func (r *Ring) Owns(node string, key string, n int) bool {
+	return contains(r.Owners(key, n), node)
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOwners(t *testing.T) {
+	ring := NewRing([]string{"c:3596", "a:3596", "b:3596", "a:3596", ""})
+	if nodes := ring.Nodes(); len(nodes) != 3 || nodes[0] != "a:3596" {
+		t.Fatalf("Expected the 3 distinct nodes ordered, got %v", nodes)
+	}
+
+	owners := ring.Owners("hllpp/marvel", 2)
+	if len(owners) != 2 || owners[0] == owners[1] {
+		t.Fatalf("Expected 2 distinct owners, got %v", owners)
+	}
+	if again := NewRing([]string{"b:3596", "a:3596", "c:3596"}).Owners("hllpp/marvel", 2); again[0] != owners[0] || again[1] != owners[1] {
+		t.Fatalf("Expected the owners not to depend on the order of the nodes, got %v and %v", owners, again)
+	}
+	if !ring.Owns(owners[1], "hllpp/marvel", 2) || ring.Owns(owners[1], "hllpp/marvel", 1) {
+		t.Fatalf("Expected %s to only be the secondary owner", owners[1])
+	}
+	if all := ring.Owners("hllpp/marvel", 5); len(all) != 3 {
+		t.Fatalf("Expected all 3 nodes as owners, got %v", all)
+	}
+	if none := NewRing(nil).Owners("hllpp/marvel", 1); len(none) != 0 {
+		t.Fatalf("Expected no owners on an empty ring, got %v", none)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	nodes := []string{"a:3596", "b:3596", "c:3596", "d:3596"}
+	ring := NewRing(nodes)
+	counts := make(map[string]int)
+	keys := 40000
+	for i := 0; i < keys; i++ {
+		counts[ring.Owners(fmt.Sprintf("hllpp/sketch-%d", i), 1)[0]]++
+	}
+	for _, node := range nodes {
+		if share := float64(counts[node]) / float64(keys); share < 0.15 || share > 0.35 {
+			t.Errorf("Expected node %s to own about a quarter of the keys, got %.2f", node, share)
+		}
+	}
+
+	// Adding a node only moves keys to it
+	grown := NewRing(append(nodes, "e:3596"))
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("hllpp/sketch-%d", i)
+		before, after := ring.Owners(key, 1)[0], grown.Owners(key, 1)[0]
+		if before == after {
+			continue
+		}
+		if after != "e:3596" {
+			t.Fatalf("Expected %s to move from %s to the new node, got %s", key, before, after)
+		}
+		moved++
+	}
+	if share := float64(moved) / float64(keys); share < 0.1 || share > 0.3 {
+		t.Errorf("Expected about a fifth of the keys to move, got %.2f", share)
+	}
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,18 +16,79 @@ import (
 
 // Config stores all configuration parameters for Go
 type Config struct {
-	InfoDir              string `toml:"info_dir"`
-	DataDir              string `toml:"data_dir"`
-	SliceSize            uint   `toml:"slice_size"`
-	CacheSize            uint   `toml:"cache_size"`
-	SliceCacheSize       uint   `toml:"slice_cache_size"`
-	Port                 uint   `toml:"port"`
-	SaveThresholdSeconds uint   `toml:"save_threshold_seconds"`
-	SaveThresholdOps     uint   `toml:"save_threshold_ops"`
+	InfoDir              string                        `toml:"info_dir"`
+	DataDir              string                        `toml:"data_dir"`
+	SliceSize            uint                          `toml:"slice_size"`
+	CacheSize            uint                          `toml:"cache_size"`
+	SliceCacheSize       uint                          `toml:"slice_cache_size"`
+	Port                 uint                          `toml:"port"`
+	SaveThresholdSeconds uint                          `toml:"save_threshold_seconds"`
+	SaveThresholdOps     uint                          `toml:"save_threshold_ops"`
+	AutoCreate           bool                          `toml:"auto_create"`
+	MemoryBudget         uint64                        `toml:"memory_budget"`
+	Compression          string                        `toml:"compression"`
+	Quarantine           bool                          `toml:"quarantine"`
+	Storage              string                        `toml:"storage"`
+	ReplicationRole      string                        `toml:"replication_role"`
+	ReplicationLeader    string                        `toml:"replication_leader"`
+	ReplicationLogSize   uint                          `toml:"replication_log_size"`
+	ReplicationMaxLag    uint64                        `toml:"replication_max_lag"`
+	ClusterNodes         []string                      `toml:"cluster_nodes"`
+	ClusterSelf          string                        `toml:"cluster_self"`
+	ClusterReplicas      uint                          `toml:"cluster_replicas"`
+	ClusterTimeout       uint                          `toml:"cluster_timeout"`
+	MultiMasterPeers     []string                      `toml:"multi_master_peers"`
+	MultiMasterID        string                        `toml:"multi_master_id"`
+	MultiMasterInterval  uint                          `toml:"multi_master_interval"`
+	ExpiryInterval       uint                          `toml:"expiry_interval"`
+	CompactInterval      uint                          `toml:"compact_interval"`
+	Defaults             map[string]map[string]float64 `toml:"defaults"`
+	Templates            map[string]*Template          `toml:"templates"`
+}
+
+// Template describes the shape of sketches whose id matches a glob pattern
+type Template struct {
+	Pattern    string             `toml:"pattern"`
+	Type       string             `toml:"type"`
+	Properties map[string]float64 `toml:"properties"`
 }
 
 var config *Config
 
+/*
+DefaultProperties returns a copy of the default properties configured for
+sketchType, or an empty map if there are none
+*/
+func (c *Config) DefaultProperties(sketchType string) map[string]float64 {
+	props := make(map[string]float64)
+	for k, v := range c.Defaults[sketchType] {
+		props[k] = v
+	}
+	return props
+}
+
+/*
+MatchTemplate returns the name and the template of the first template (ordered
+by name) for sketchType whose pattern matches sketchID, or nil if none matches
+*/
+func (c *Config) MatchTemplate(sketchType string, sketchID string) (string, *Template) {
+	names := make([]string, 0, len(c.Templates))
+	for name := range c.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		template := c.Templates[name]
+		if template.Type != sketchType {
+			continue
+		}
+		if ok, _ := path.Match(template.Pattern, sketchID); ok {
+			return name, template
+		}
+	}
+	return "", nil
+}
+
 // MaxKeySize ...
 const MaxKeySize int = 32768 // max key size BoltDB in bytes
 
@@ -90,6 +153,117 @@ func GetConfig() *Config {
 			saveThresholdSeconds = 3
 		}
 
+		autoCreate, err := strconv.ParseBool(strings.TrimSpace(os.Getenv("SKZ_AUTO_CREATE")))
+		if err != nil {
+			autoCreate = config.AutoCreate
+		}
+
+		memoryBudget, err := strconv.ParseUint(strings.TrimSpace(os.Getenv("SKZ_MEMORY_BUDGET")), 10, 64)
+		if err != nil {
+			memoryBudget = config.MemoryBudget
+		}
+
+		compression := strings.TrimSpace(os.Getenv("SKZ_COMPRESSION"))
+		if len(compression) == 0 {
+			compression = config.Compression
+		}
+
+		quarantine, err := strconv.ParseBool(strings.TrimSpace(os.Getenv("SKZ_QUARANTINE")))
+		if err != nil {
+			quarantine = config.Quarantine
+		}
+
+		storage := strings.TrimSpace(os.Getenv("SKZ_STORAGE"))
+		if len(storage) == 0 {
+			storage = config.Storage
+		}
+
+		replicationRole := strings.TrimSpace(os.Getenv("SKZ_REPLICATION_ROLE"))
+		if len(replicationRole) == 0 {
+			replicationRole = config.ReplicationRole
+		}
+
+		replicationLeader := strings.TrimSpace(os.Getenv("SKZ_REPLICATION_LEADER"))
+		if len(replicationLeader) == 0 {
+			replicationLeader = config.ReplicationLeader
+		}
+
+		replicationLogSizeInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_REPLICATION_LOG_SIZE")))
+		replicationLogSize := uint(replicationLogSizeInt)
+		if err != nil {
+			replicationLogSize = config.ReplicationLogSize
+		}
+
+		replicationMaxLag, err := strconv.ParseUint(strings.TrimSpace(os.Getenv("SKZ_REPLICATION_MAX_LAG")), 10, 64)
+		if err != nil {
+			replicationMaxLag = config.ReplicationMaxLag
+		}
+
+		clusterNodes := config.ClusterNodes
+		if nodes := strings.TrimSpace(os.Getenv("SKZ_CLUSTER_NODES")); len(nodes) > 0 {
+			clusterNodes = strings.Split(nodes, ",")
+			for i, node := range clusterNodes {
+				clusterNodes[i] = strings.TrimSpace(node)
+			}
+		}
+
+		clusterSelf := strings.TrimSpace(os.Getenv("SKZ_CLUSTER_SELF"))
+		if len(clusterSelf) == 0 {
+			clusterSelf = config.ClusterSelf
+		}
+
+		clusterReplicasInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_CLUSTER_REPLICAS")))
+		clusterReplicas := uint(clusterReplicasInt)
+		if err != nil {
+			clusterReplicas = config.ClusterReplicas
+		}
+		if clusterReplicas < 1 {
+			clusterReplicas = 1
+		}
+
+		clusterTimeoutInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_CLUSTER_TIMEOUT")))
+		clusterTimeout := uint(clusterTimeoutInt)
+		if err != nil || clusterTimeoutInt < 0 {
+			clusterTimeout = config.ClusterTimeout
+		}
+
+		multiMasterPeers := config.MultiMasterPeers
+		if peers := strings.TrimSpace(os.Getenv("SKZ_MULTI_MASTER_PEERS")); len(peers) > 0 {
+			multiMasterPeers = strings.Split(peers, ",")
+			for i, peer := range multiMasterPeers {
+				multiMasterPeers[i] = strings.TrimSpace(peer)
+			}
+		}
+
+		multiMasterID := strings.TrimSpace(os.Getenv("SKZ_MULTI_MASTER_ID"))
+		if len(multiMasterID) == 0 {
+			multiMasterID = config.MultiMasterID
+		}
+
+		multiMasterIntervalInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_MULTI_MASTER_INTERVAL")))
+		multiMasterInterval := uint(multiMasterIntervalInt)
+		if err != nil {
+			multiMasterInterval = config.MultiMasterInterval
+		}
+		if multiMasterInterval < 1 {
+			multiMasterInterval = 1
+		}
+
+		expiryIntervalInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_EXPIRY_INTERVAL")))
+		expiryInterval := uint(expiryIntervalInt)
+		if err != nil {
+			expiryInterval = config.ExpiryInterval
+		}
+		if expiryInterval < 1 {
+			expiryInterval = 1
+		}
+
+		compactIntervalInt, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SKZ_COMPACT_INTERVAL")))
+		compactInterval := uint(compactIntervalInt)
+		if err != nil || compactIntervalInt < 0 {
+			compactInterval = config.CompactInterval
+		}
+
 		config = &Config{
 			infoDir,
 			dataDir,
@@ -99,6 +273,26 @@ func GetConfig() *Config {
 			port,
 			saveThresholdSeconds,
 			saveThresholdOps,
+			autoCreate,
+			memoryBudget,
+			compression,
+			quarantine,
+			storage,
+			replicationRole,
+			replicationLeader,
+			replicationLogSize,
+			replicationMaxLag,
+			clusterNodes,
+			clusterSelf,
+			clusterReplicas,
+			clusterTimeout,
+			multiMasterPeers,
+			multiMasterID,
+			multiMasterInterval,
+			expiryInterval,
+			compactInterval,
+			config.Defaults,
+			config.Templates,
 		}
 	}
 	return config
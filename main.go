@@ -15,6 +15,14 @@ import (
 var logger = utils.GetLogger()
 
 func main() {
+	if handled, err := runCommand(os.Args[1:]); handled {
+		if err != nil {
+			logger.Error.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var port uint
 	flag.UintVar(&port, "p", 3596, "specifies the port for Counts to run on")
 	flag.Parse()
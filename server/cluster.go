@@ -0,0 +1,664 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/cluster"
+	"github.com/seiflotfy/skizze/sketches"
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+// forwardedHeader marks requests sent by another node of the cluster to be
+// served locally, routedHeader requests routed to an owner of their sketch by
+// a node not owning it. Their value is the node which sent them.
+// failedOwnersHeader lists the owners a write could not be passed on to.
+const (
+	forwardedHeader    = "X-Skizze-Forwarded"
+	routedHeader       = "X-Skizze-Routed"
+	failedOwnersHeader = "X-Skizze-Failed-Owners"
+)
+
+/*
+clusterState is the view of a node on the cluster: the ring assigning sketches
+to nodes and the progress of moving sketches to their owners
+*/
+type clusterState struct {
+	self     string
+	replicas int
+	client   *http.Client
+
+	lock        sync.RWMutex
+	ring        *cluster.Ring
+	rebalancing bool
+	moved       int
+	errors      int
+	lastError   string
+
+	rebalanceLock sync.Mutex // rebalances run one at a time
+}
+
+type clusterStatus struct {
+	Self        string   `json:"self"`
+	Nodes       []string `json:"nodes"`
+	Replicas    int      `json:"replicas"`
+	Rebalancing bool     `json:"rebalancing"`
+	Moved       int      `json:"moved"`
+	Errors      int      `json:"errors"`
+	LastError   string   `json:"last_error,omitempty"`
+}
+
+func newClusterState(nodes []string, self string, replicas uint, timeout time.Duration) (*clusterState, error) {
+	if self == "" {
+		return nil, errors.New("Nodes of a cluster need their own address (cluster_self)")
+	}
+	return &clusterState{
+		self:     self,
+		replicas: int(replicas),
+		client:   &http.Client{Timeout: timeout},
+		ring:     cluster.NewRing(nodes),
+	}, nil
+}
+
+func nodeURL(node string) string {
+	if !strings.Contains(node, "://") {
+		node = "http://" + node
+	}
+	return strings.TrimRight(node, "/")
+}
+
+func hasNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *clusterState) currentRing() *cluster.Ring {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring
+}
+
+func (c *clusterState) owners(key string) []string {
+	return c.currentRing().Owners(key, c.replicas)
+}
+
+func (c *clusterState) status() clusterStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return clusterStatus{
+		Self:        c.self,
+		Nodes:       c.ring.Nodes(),
+		Replicas:    c.replicas,
+		Rebalancing: c.rebalancing,
+		Moved:       c.moved,
+		Errors:      c.errors,
+		LastError:   c.lastError,
+	}
+}
+
+func (c *clusterState) fail(err error) {
+	logger.Error.Println(err)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors++
+	c.lastError = err.Error()
+}
+
+/*
+send sends a request to another node, marked as forwarded so it is served there
+*/
+func (c *clusterState) send(method string, node string, uri string, contentType string, body []byte) (*http.Response, error) {
+	return c.sendMarked(forwardedHeader, method, node, uri, contentType, body)
+}
+
+func (c *clusterState) sendMarked(header string, method string, node string, uri string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, nodeURL(node)+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(header, c.self)
+	return c.client.Do(req)
+}
+
+/*
+sendOK sends a request to another node and returns the body of its response,
+responses other than 200 are errors
+*/
+func (c *clusterState) sendOK(method string, node string, uri string, contentType string, body []byte) ([]byte, error) {
+	resp, err := c.send(method, node, uri, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Node %s returned %s: %s", node, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+/*
+clusterKey returns the key of the sketch (or domain) a request is about, which
+decides the nodes owning it, or "" for requests about a single node like
+listings, stats and snapshots
+*/
+func clusterKey(paths []string) string {
+	for i := range paths {
+		paths[i] = strings.TrimSpace(paths[i])
+	}
+	switch {
+	case len(paths) < 2:
+		return ""
+	case paths[0] == "domain":
+		if len(paths) == 2 {
+			return "domain/" + paths[1]
+		}
+		return ""
+	case len(paths) == 3 && (paths[2] == "info" || paths[2] == "expiry" || paths[2] == "export" || paths[2] == "import"):
+		return paths[0] + "/" + paths[1]
+	}
+	return strings.Join(paths, "/")
+}
+
+/*
+route serves requests about sketches this node does not own by forwarding
+them to the owners. Reads are served by any owner, writes by the first owner
+which passes them on to the other owners. Writes some owners missed are
+answered with 207 and the missed owners in failedOwnersHeader, they are not
+retried. Requests routed here by another node are not routed again, even if the
+nodes disagree on the owners while the cluster changes. It returns false if the
+request is to be served locally.
+*/
+func (srv *Server) route(w http.ResponseWriter, r *http.Request, paths []string) bool {
+	key := clusterKey(paths)
+	if key == "" {
+		return false
+	}
+	c := srv.cluster
+	owners := c.owners(key)
+	read := r.Method == "GET" || r.Method == "HEAD"
+	routed := r.Header.Get(routedHeader) != ""
+	owned := routed || len(owners) > 0 && (owners[0] == c.self || read && hasNode(owners, c.self))
+	if owned {
+		if domainKey := srv.domainKey(paths); domainKey != "" {
+			key = domainKey
+			owners = c.owners(key)
+			owned = len(owners) > 0 && (owners[0] == c.self || read && hasNode(owners, c.self))
+		}
+	}
+	if owned && (read || len(owners) == 1) {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	contentType := r.Header.Get("Content-Type")
+
+	if owned {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.Header.Set(forwardedHeader, c.self)
+		// The response waits for the other owners, which might have failed
+		local := newBufferedResponse()
+		srv.ServeHTTP(local, r)
+		if local.status != http.StatusOK {
+			local.writeTo(w)
+			return true
+		}
+		failed := []string{}
+		for _, owner := range owners {
+			if owner == c.self {
+				continue
+			}
+			if _, err := c.sendOK(r.Method, owner, r.URL.RequestURI(), contentType, body); err != nil {
+				c.fail(fmt.Errorf("Error passing %s on %s to %s: %s", r.Method, key, owner, err))
+				failed = append(failed, owner)
+			}
+		}
+		if len(failed) > 0 {
+			local.Header().Set(failedOwnersHeader, strings.Join(failed, ","))
+			local.status = http.StatusMultiStatus
+		}
+		local.writeTo(w)
+		return true
+	}
+
+	if !read {
+		owners = owners[:1]
+	}
+	var lastErr error = errors.New("No nodes in the cluster")
+	for _, owner := range owners {
+		resp, err := c.sendMarked(routedHeader, r.Method, owner, r.URL.RequestURI(), contentType, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			logger.Error.Printf("Error forwarding response of %s: %v", owner, err)
+		}
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Error forwarding %s on %s: %s", r.Method, key, lastErr), http.StatusBadGateway)
+	return true
+}
+
+/*
+domainKey returns the key of the domain a sketch request is about if the sketch
+is part of it. Sketches of domains live on the owners of their domain, so the
+owners of the sketch ask those if they do not hold it themselves.
+*/
+func (srv *Server) domainKey(paths []string) string {
+	if len(paths) < 2 || len(paths) > 3 || paths[0] == "domain" || len(paths) == 3 && clusterKey(paths) != paths[0]+"/"+paths[1] {
+		return ""
+	}
+	typ, id := paths[0], paths[1]
+	key := "domain/" + id
+	c := srv.cluster
+	domainOwners := c.owners(key)
+	if strings.Join(domainOwners, ",") == strings.Join(c.owners(typ+"/"+id), ",") {
+		return ""
+	}
+	if srv.manager.InDomain(id, typ) {
+		return key
+	}
+	if _, err := srv.manager.GetSketchInfo(id, typ); err == nil {
+		return ""
+	}
+	for _, owner := range domainOwners {
+		if owner == c.self {
+			continue
+		}
+		resp, err := c.send("GET", owner, "/"+typ+"/"+id+"/info", "", nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return key
+		}
+	}
+	return ""
+}
+
+// bufferedResponse holds a response until it is written with writeTo
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for name, values := range r.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(r.status)
+	if _, err := r.body.WriteTo(w); err != nil {
+		logger.Error.Println("Error writing response:", err)
+	}
+}
+
+/*
+listSketches lists the sketches of all nodes like ManagerStruct.ListSketches
+*/
+func (srv *Server) listSketches(data requestData) ([]*sketches.SketchEntry, string, error) {
+	entries, next, err := srv.manager.ListSketches(data.TypeFilter, data.Prefix, data.Cursor, data.Limit)
+	if err != nil {
+		return nil, "", err
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"type":   data.TypeFilter,
+		"prefix": data.Prefix,
+		"cursor": data.Cursor,
+		"limit":  data.Limit,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	c := srv.cluster
+	for _, node := range c.currentRing().Nodes() {
+		if node == c.self {
+			continue
+		}
+		body, err := c.sendOK("GET", node, "/sketches", "application/json", query)
+		if err != nil {
+			return nil, "", err
+		}
+		var result struct {
+			Result []*sketches.SketchEntry `json:"result"`
+			Next   string                  `json:"next"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, result.Result...)
+		if result.Next != "" {
+			next = result.Next
+		}
+	}
+
+	// Replicas are listed once
+	byKey := make(map[string]*sketches.SketchEntry)
+	keys := []string{}
+	for _, entry := range entries {
+		key := entry.Type + "/" + entry.ID
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = entry
+	}
+	sort.Strings(keys)
+	if data.Limit > 0 && len(keys) > data.Limit {
+		keys = keys[:data.Limit]
+		next = keys[data.Limit-1]
+	} else if next != "" && len(keys) > 0 {
+		next = keys[len(keys)-1]
+	}
+	entries = make([]*sketches.SketchEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = byKey[key]
+	}
+	return entries, next, nil
+}
+
+/*
+getDomains lists the domains of all nodes
+*/
+func (srv *Server) getDomains() ([]*abstract.Domain, error) {
+	domains, err := srv.manager.GetDomains()
+	if err != nil {
+		return nil, err
+	}
+	c := srv.cluster
+	for _, node := range c.currentRing().Nodes() {
+		if node == c.self {
+			continue
+		}
+		body, err := c.sendOK("GET", node, "/domain", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Result []*abstract.Domain `json:"result"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		domains = append(domains, result.Result...)
+	}
+
+	byID := make(map[string]*abstract.Domain)
+	ids := []string{}
+	for _, domain := range domains {
+		if _, ok := byID[domain.ID]; !ok {
+			ids = append(ids, domain.ID)
+		}
+		byID[domain.ID] = domain
+	}
+	sort.Strings(ids)
+	domains = make([]*abstract.Domain, len(ids))
+	for i, id := range ids {
+		domains[i] = byID[id]
+	}
+	return domains, nil
+}
+
+/*
+mergeSketches merges sketches into a sketch, sketches owned by other nodes are
+fetched from them as exports
+*/
+func (srv *Server) mergeSketches(data requestData) error {
+	if srv.cluster == nil {
+		return srv.manager.MergeSketches(data.id, data.typ, data.From)
+	}
+	if _, err := srv.manager.GetSketchInfo(data.id, data.typ); err != nil {
+		return err
+	}
+	c := srv.cluster
+	local := []string{}
+	for _, from := range data.From {
+		owners := c.owners(data.typ + "/" + from)
+		if hasNode(owners, c.self) {
+			local = append(local, from)
+			continue
+		}
+		var export []byte
+		err := errors.New("No nodes in the cluster")
+		for _, owner := range owners {
+			if export, err = c.sendOK("GET", owner, "/"+data.typ+"/"+from+"/export", "", nil); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error fetching sketch %s: %s", from, err)
+		}
+		if _, err := srv.manager.ImportSketch(data.id, data.typ, export, sketches.SketchOptions{}); err != nil {
+			return err
+		}
+	}
+	return srv.manager.MergeSketches(data.id, data.typ, local)
+}
+
+func (srv *Server) handleClusterRequest(w http.ResponseWriter, r *http.Request, paths []string) {
+	method := r.Method
+	c := srv.cluster
+	if c == nil {
+		http.Error(w, "Not running in cluster mode", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(paths) == 0 && method == "GET":
+		srv.writeJSON(w, sketchResult{c.status(), nil, nil})
+	case len(paths) == 0 && method == "PUT":
+		srv.handleMembershipRequest(w, r)
+	case len(paths) == 1 && paths[0] == "rebalance" && method == "POST":
+		logger.Info.Printf("[%v]: Rebalancing the cluster", method)
+		go srv.rebalance(nil)
+		srv.writeJSON(w, sketchResult{c.status(), nil, nil})
+	default:
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+	}
+}
+
+/*
+handleMembershipRequest changes the nodes of the cluster on all old and new
+nodes, which then move their sketches to the new owners
+*/
+func (srv *Server) handleMembershipRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var members struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := json.Unmarshal(body, &members); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(members.Nodes) == 0 {
+		http.Error(w, "A cluster needs at least one node", http.StatusBadRequest)
+		return
+	}
+	logger.Info.Printf("[%v]: Changing the nodes of the cluster to %v", r.Method, members.Nodes)
+
+	c := srv.cluster
+	c.lock.Lock()
+	previous := c.ring
+	c.ring = cluster.NewRing(members.Nodes)
+	c.lock.Unlock()
+	go srv.rebalance(previous)
+
+	var failed []string
+	if r.Header.Get(forwardedHeader) == "" {
+		nodes := cluster.NewRing(append(previous.Nodes(), members.Nodes...)).Nodes()
+		for _, node := range nodes {
+			if node == c.self {
+				continue
+			}
+			if _, err := c.sendOK("PUT", node, "/cluster", "application/json", body); err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+	}
+	if len(failed) > 0 {
+		http.Error(w, "Error changing the nodes of the cluster: "+strings.Join(failed, ", "), http.StatusBadGateway)
+		return
+	}
+	srv.writeJSON(w, sketchResult{c.status(), nil, nil})
+}
+
+/*
+rebalance moves the sketches of this node to their owners, and deletes them
+here if this node is no longer one of them and all owners took them. With the
+previous ring only sketches whose owners changed are moved, to the new owners.
+Sketches of domains stay with their domain.
+*/
+func (srv *Server) rebalance(previous *cluster.Ring) {
+	c := srv.cluster
+	c.rebalanceLock.Lock()
+	defer c.rebalanceLock.Unlock()
+	c.lock.Lock()
+	c.rebalancing = true
+	ring := c.ring
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.rebalancing = false
+		c.lock.Unlock()
+	}()
+
+	domains, err := srv.manager.GetDomains()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	inDomain := make(map[string]bool)
+	for _, domain := range domains {
+		for _, typ := range domain.Types {
+			inDomain[typ+"/"+domain.ID] = true
+		}
+	}
+	keys, err := srv.manager.GetSketches()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	for _, key := range keys {
+		if inDomain[key] {
+			continue
+		}
+		owners := ring.Owners(key, c.replicas)
+		var previousOwners []string
+		if previous != nil {
+			previousOwners = previous.Owners(key, c.replicas)
+			if strings.Join(previousOwners, ",") == strings.Join(owners, ",") {
+				continue
+			}
+		}
+		i := strings.Index(key, "/")
+		typ, id := key[:i], key[i+1:]
+		leaving := !ring.Owns(c.self, key, c.replicas)
+		moved := true
+		for _, owner := range owners {
+			// Previous owners got all writes as replicas
+			if owner == c.self || hasNode(previousOwners, owner) {
+				continue
+			}
+			if err := srv.transfer(owner, typ, id, leaving || previous != nil); err != nil {
+				c.fail(fmt.Errorf("Error moving sketch %s to %s: %s", key, owner, err))
+				moved = false
+			}
+		}
+		if !moved || !leaving {
+			continue
+		}
+		if err := srv.manager.DeleteSketch(id, typ); err != nil {
+			c.fail(err)
+			continue
+		}
+		c.lock.Lock()
+		c.moved++
+		c.lock.Unlock()
+	}
+}
+
+/*
+transfer copies a sketch to a node as an export (and when it expires). A copy
+the node holds already, e.g. created by writes reaching it during the move or
+left from an earlier move, is merged with the export if merge is set (hllpp
+and bloom only, others fail) and kept as it is otherwise.
+*/
+func (srv *Server) transfer(node string, typ string, id string, merge bool) error {
+	c := srv.cluster
+	if !merge {
+		resp, err := c.send("GET", node, "/"+typ+"/"+id+"/info", "", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+	export, err := srv.manager.ExportSketch(id, typ)
+	if err != nil {
+		return err
+	}
+	if _, err = c.sendOK("POST", node, "/"+typ+"/"+id+"/import", "application/octet-stream", export); err != nil {
+		return err
+	}
+	info, err := srv.manager.GetSketchInfo(id, typ)
+	if err != nil || info.ExpiresAt == 0 {
+		return err
+	}
+	expiry, err := json.Marshal(map[string]interface{}{"ttl": info.TTL, "expires_at": info.ExpiresAt, "reset_ttl": info.ResetTTL})
+	if err != nil {
+		return err
+	}
+	_, err = c.sendOK("PUT", node, "/"+typ+"/"+id+"/expiry", "application/json", expiry)
+	return err
+}
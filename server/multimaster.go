@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches"
+)
+
+// Most sketch states sent in one batch
+const maxSyncBatch = 500
+
+// syncBatch holds the states of changed sketches of a peer, gob encoded on
+// the wire. More is set if there are more changes after Last.
+type syncBatch struct {
+	Replica string
+	Epoch   int64
+	Last    uint64
+	More    bool
+	States  []*sketches.SyncState
+}
+
+type peerStatus struct {
+	Peer      string `json:"peer"`
+	Replica   string `json:"replica"`
+	Epoch     int64  `json:"epoch"`
+	Version   uint64 `json:"version"`
+	Merged    int    `json:"merged"`
+	LastSync  int64  `json:"last_sync"`
+	Errors    int    `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type syncStatus struct {
+	Replica  string       `json:"replica"`
+	Epoch    int64        `json:"epoch"`
+	Version  uint64       `json:"version"`
+	Peers    []peerStatus `json:"peers"`
+	Unsynced []string     `json:"unsynced"`
+}
+
+func (srv *Server) handleSyncRequest(w http.ResponseWriter, r *http.Request, paths []string) {
+	method := r.Method
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	if srv.syncer == nil {
+		http.Error(w, "Multi-master mode is not enabled", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(paths) == 0 || len(paths) == 1 && paths[0] == "":
+		srv.writeJSON(w, sketchResult{srv.syncer.status(), nil, nil})
+	case len(paths) == 1 && paths[0] == "state":
+		srv.handleSyncStateRequest(w, r)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (srv *Server) handleSyncStateRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var epoch int64
+	var after uint64
+	var err error
+	if e := query.Get("epoch"); e != "" {
+		if epoch, err = strconv.ParseInt(e, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid epoch %s: %s", e, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if a := query.Get("after"); a != "" {
+		if after, err = strconv.ParseUint(a, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid after %s: %s", a, err), http.StatusBadRequest)
+			return
+		}
+	}
+	max := maxSyncBatch
+	if m := query.Get("max"); m != "" {
+		if max, err = strconv.Atoi(m); err != nil || max < 1 {
+			http.Error(w, fmt.Sprintf("Invalid max %s", m), http.StatusBadRequest)
+			return
+		}
+	}
+
+	replica, current, _, err := srv.manager.SyncPosition()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	states, last, err := srv.manager.SyncStates(epoch, after, max)
+	if err != nil {
+		logger.Error.Printf("Error collecting sketch states: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _, version, _ := srv.manager.SyncPosition()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(syncBatch{replica, current, last, last < version, states}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-gob")
+	if _, err := buf.WriteTo(w); err != nil {
+		logger.Error.Printf("Error sending sketch states: %v", err)
+	}
+}
+
+/*
+syncer pulls the changed sketches of the peers of a multi-master node every
+interval and merges them into its manager
+*/
+type syncer struct {
+	manager  *sketches.ManagerStruct
+	peers    []*peerStatus
+	interval time.Duration
+	client   *http.Client
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSyncer(manager *sketches.ManagerStruct, peers []string, interval time.Duration) *syncer {
+	s := &syncer{
+		manager:  manager,
+		interval: interval,
+		client:   &http.Client{},
+	}
+	for _, peer := range peers {
+		if peer == "" {
+			continue
+		}
+		if !strings.Contains(peer, "://") {
+			peer = "http://" + peer
+		}
+		s.peers = append(s.peers, &peerStatus{Peer: strings.TrimRight(peer, "/")})
+	}
+	return s
+}
+
+/*
+start starts pulling from the peers
+*/
+func (s *syncer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.lock.Lock()
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	done := s.done
+	s.lock.Unlock()
+	go s.run(ctx, done)
+}
+
+/*
+stop stops pulling from the peers and waits for the current round
+*/
+func (s *syncer) stop() {
+	s.lock.Lock()
+	cancel, done := s.cancel, s.done
+	s.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (s *syncer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		s.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+/*
+round pulls from each peer once and saves the replica state
+*/
+func (s *syncer) round(ctx context.Context) {
+	for _, peer := range s.peers {
+		if err := s.pull(ctx, peer); err != nil && ctx.Err() == nil {
+			logger.Error.Printf("Error syncing with %s: %v", peer.Peer, err)
+			s.lock.Lock()
+			peer.Errors++
+			peer.LastError = err.Error()
+			s.lock.Unlock()
+		}
+	}
+	if err := s.manager.FlushReplicas(); err != nil {
+		logger.Error.Printf("Error saving replica state: %v", err)
+	}
+}
+
+/*
+pull merges all sketches of peer that changed since the last pull
+*/
+func (s *syncer) pull(ctx context.Context, peer *peerStatus) error {
+	for {
+		s.lock.Lock()
+		path := fmt.Sprintf("%s/sync/state?epoch=%d&after=%d&max=%d", peer.Peer, peer.Epoch, peer.Version, maxSyncBatch)
+		s.lock.Unlock()
+		batch, err := s.get(ctx, path)
+		if err != nil {
+			return err
+		}
+		merged, err := s.manager.MergeSyncStates(batch.States)
+
+		// Sketches that can not be merged are not retried
+		s.lock.Lock()
+		peer.Replica = batch.Replica
+		peer.Epoch = batch.Epoch
+		peer.Version = batch.Last
+		peer.Merged += merged
+		peer.LastSync = time.Now().Unix()
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if !batch.More {
+			return nil
+		}
+	}
+}
+
+func (s *syncer) get(ctx context.Context, url string) (*syncBatch, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Peer returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var batch syncBatch
+	if err := gob.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("Invalid sketch states: %s", err)
+	}
+	return &batch, nil
+}
+
+func (s *syncer) status() syncStatus {
+	status := syncStatus{Unsynced: s.manager.UnsyncedSketches()}
+	status.Replica, status.Epoch, status.Version, _ = s.manager.SyncPosition()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, peer := range s.peers {
+		status.Peers = append(status.Peers, *peer)
+	}
+	return status
+}
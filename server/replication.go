@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches"
+)
+
+/*
+Replication roles of a server, servers without a role neither keep an
+operation log nor follow a leader
+*/
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+const (
+	// Longest a request for the log waits for new operations
+	maxLogWait = 30 * time.Second
+	// How long followers ask the leader to wait for new operations
+	followerWait = 10 * time.Second
+	// Most operations sent in one batch
+	maxLogBatch = 1000
+	// Most time followers wait before retrying after an error
+	maxFollowerBackoff = 5 * time.Second
+)
+
+// opBatch holds operations of the log of a leader, gob encoded on the wire
+type opBatch struct {
+	Epoch int64
+	Last  uint64
+	Ops   []*sketches.Op
+}
+
+type replicationStatus struct {
+	Role       string  `json:"role"`
+	Leader     string  `json:"leader,omitempty"`
+	Epoch      int64   `json:"epoch"`
+	Seq        uint64  `json:"seq"`
+	LeaderSeq  uint64  `json:"leader_seq"`
+	Lag        uint64  `json:"lag"`
+	LagSeconds float64 `json:"lag_seconds"`
+	Resyncs    int     `json:"resyncs"`
+	Errors     int     `json:"errors"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+func (srv *Server) handleReplicationRequest(w http.ResponseWriter, r *http.Request, paths []string) {
+	method := r.Method
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(paths) == 0 || len(paths) == 1 && paths[0] == "":
+		srv.writeJSON(w, sketchResult{srv.replicationStatus(), nil, nil})
+	case len(paths) == 1 && paths[0] == "log":
+		srv.handleLogRequest(w, r)
+	case len(paths) == 1 && paths[0] == "snapshot":
+		srv.handleLeaderSnapshotRequest(w)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (srv *Server) replicationStatus() replicationStatus {
+	if srv.follower != nil {
+		return srv.follower.status()
+	}
+	status := replicationStatus{Role: srv.role}
+	if srv.role == RoleLeader {
+		status.Epoch, status.Seq, _ = srv.manager.OpLogPosition()
+		status.LeaderSeq = status.Seq
+	}
+	return status
+}
+
+func (srv *Server) handleLogRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	epoch, seq, err := srv.manager.OpLogPosition()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Followers of an earlier log have to resync
+	if e := query.Get("epoch"); e != "" && e != strconv.FormatInt(epoch, 10) {
+		http.Error(w, sketches.ErrOpsTruncated.Error(), http.StatusGone)
+		return
+	}
+	after := seq
+	if a := query.Get("after"); a != "" {
+		if after, err = strconv.ParseUint(a, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid after %s: %s", a, err), http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if d := query.Get("wait"); d != "" {
+		if wait, err = time.ParseDuration(d); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid wait %s: %s", d, err), http.StatusBadRequest)
+			return
+		}
+		if wait > maxLogWait {
+			wait = maxLogWait
+		}
+	}
+	max := maxLogBatch
+	if m := query.Get("max"); m != "" {
+		if max, err = strconv.Atoi(m); err != nil || max < 1 {
+			http.Error(w, fmt.Sprintf("Invalid max %s", m), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	ops, last, err := srv.manager.OpsSince(ctx, after, max)
+	if err == sketches.ErrOpsTruncated {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(opBatch{epoch, last, ops}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-gob")
+	if _, err := buf.WriteTo(w); err != nil {
+		logger.Error.Printf("Error sending operations: %v", err)
+	}
+}
+
+func (srv *Server) handleLeaderSnapshotRequest(w http.ResponseWriter) {
+	epoch, _, err := srv.manager.OpLogPosition()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info.Printf("[GET]: Taking snapshot for a follower")
+	var buf bytes.Buffer
+	seq, err := srv.manager.SnapshotAt(&buf)
+	if err != nil {
+		logger.Error.Printf("Error taking snapshot: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("X-Skizze-Epoch", strconv.FormatInt(epoch, 10))
+	w.Header().Set("X-Skizze-Seq", strconv.FormatUint(seq, 10))
+	if _, err := buf.WriteTo(w); err != nil {
+		logger.Error.Printf("Error sending snapshot: %v", err)
+	}
+}
+
+// errResync makes a follower resync from a snapshot of its leader
+var errResync = errors.New("Follower has to resync")
+
+/*
+follower streams the operation log of a leader into its manager, it resyncs
+from a snapshot of the leader when it starts, fell behind the log or lags more
+than maxLag operations behind
+*/
+type follower struct {
+	manager *sketches.ManagerStruct
+	leader  string
+	maxLag  uint64
+	client  *http.Client
+
+	lock      sync.Mutex
+	epoch     int64
+	seq       uint64
+	leaderSeq uint64
+	caughtUp  time.Time
+	resyncs   int
+	errors    int
+	lastError string
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func newFollower(manager *sketches.ManagerStruct, leader string, maxLag uint64) *follower {
+	if !strings.Contains(leader, "://") {
+		leader = "http://" + leader
+	}
+	return &follower{
+		manager: manager,
+		leader:  strings.TrimRight(leader, "/"),
+		maxLag:  maxLag,
+		client:  &http.Client{},
+	}
+}
+
+/*
+start starts following the leader, continuing where stop left off
+*/
+func (f *follower) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.lock.Lock()
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	done := f.done
+	f.lock.Unlock()
+	go f.run(ctx, done)
+}
+
+/*
+stop stops following the leader and waits for the operation being applied
+*/
+func (f *follower) stop() {
+	f.lock.Lock()
+	cancel, done := f.cancel, f.done
+	f.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (f *follower) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	f.lock.Lock()
+	resync := f.epoch == 0
+	f.lock.Unlock()
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		var err error
+		if resync {
+			err = f.resync(ctx)
+		} else {
+			err = f.poll(ctx)
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == errResync:
+			resync = true
+			backoff = 0
+		case err != nil:
+			f.fail(err)
+			backoff = backoff*2 + 100*time.Millisecond
+			if backoff > maxFollowerBackoff {
+				backoff = maxFollowerBackoff
+			}
+		default:
+			resync = false
+			backoff = 0
+		}
+	}
+}
+
+func (f *follower) fail(err error) {
+	logger.Error.Printf("Error following %s: %v", f.leader, err)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errors++
+	f.lastError = err.Error()
+}
+
+func (f *follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errResync
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Leader returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (f *follower) resync(ctx context.Context) error {
+	resp, err := f.get(ctx, "/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	epoch, err := strconv.ParseInt(resp.Header.Get("X-Skizze-Epoch"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid epoch of snapshot: %s", err)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get("X-Skizze-Seq"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid sequence number of snapshot: %s", err)
+	}
+	if err := f.manager.Resync(resp.Body); err != nil {
+		return err
+	}
+	logger.Info.Printf("Resynced from %s at operation %d", f.leader, seq)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.epoch, f.seq, f.leaderSeq = epoch, seq, seq
+	f.caughtUp = time.Now()
+	f.resyncs++
+	return nil
+}
+
+func (f *follower) poll(ctx context.Context) error {
+	f.lock.Lock()
+	path := fmt.Sprintf("/replication/log?epoch=%d&after=%d&wait=%s", f.epoch, f.seq, followerWait)
+	f.lock.Unlock()
+	resp, err := f.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var batch opBatch
+	if err := gob.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("Invalid operations: %s", err)
+	}
+
+	f.lock.Lock()
+	f.leaderSeq = batch.Last
+	lag := batch.Last - f.seq
+	f.lock.Unlock()
+	// Replaying a long backlog takes longer than loading a snapshot
+	if f.maxLag > 0 && lag > f.maxLag {
+		return errResync
+	}
+	for _, op := range batch.Ops {
+		if err := f.manager.ApplyOp(op); err != nil {
+			// The sketches differ from the leader now
+			f.fail(fmt.Errorf("Error applying operation %d (%s %s): %s", op.Seq, op.Kind, op.ID, err))
+			return errResync
+		}
+		f.lock.Lock()
+		f.seq = op.Seq
+		f.lock.Unlock()
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seq == f.leaderSeq {
+		f.caughtUp = time.Now()
+	}
+	return nil
+}
+
+func (f *follower) status() replicationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := replicationStatus{
+		Role:      RoleFollower,
+		Leader:    f.leader,
+		Epoch:     f.epoch,
+		Seq:       f.seq,
+		LeaderSeq: f.leaderSeq,
+		Resyncs:   f.resyncs,
+		Errors:    f.errors,
+		LastError: f.lastError,
+	}
+	if f.leaderSeq > f.seq {
+		status.Lag = f.leaderSeq - f.seq
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	return status
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/seiflotfy/skizze/sketches"
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+type requestData struct {
+	id          string
+	typ         string
+	Properties  map[string]float64            `json:"properties"`
+	Values      []sketches.WeightedValue      `json:"values"`
+	TypeFilter  string                        `json:"type"`
+	Prefix      string                        `json:"prefix"`
+	Cursor      string                        `json:"cursor"`
+	Limit       int                           `json:"limit"`
+	AutoCreate  *bool                         `json:"auto_create"`
+	Template    string                        `json:"template"`
+	Sketches    map[string]map[string]float64 `json:"sketches"`
+	InnerType   string                        `json:"inner_type"`
+	Keys        []string                      `json:"keys"`
+	Pairs       []sketches.Pair               `json:"pairs"`
+	Encoding    string                        `json:"encoding"`
+	Prehashed   bool                          `json:"prehashed"`
+	Hash        string                        `json:"hash"`
+	Seed        uint64                        `json:"seed"`
+	Compression string                        `json:"compression"`
+	From        []string                      `json:"from"`
+	N           int                           `json:"n"`
+	MinCount    int                           `json:"min_count"`
+	Guaranteed  bool                          `json:"guaranteed"`
+	Lookup      bool                          `json:"lookup"`
+	Timestamp   int64                         `json:"timestamp"`
+	Since       int64                         `json:"since"`
+	Until       int64                         `json:"until"`
+	Series      bool                          `json:"series"`
+	Resolution  string                        `json:"resolution"`
+	TTL         int64                         `json:"ttl"`
+	ExpiresAt   int64                         `json:"expires_at"`
+	ResetTTL    bool                          `json:"reset_ttl"`
+
+	// raw maps the decoded values to the values as they were sent
+	raw    map[string]string
+	hashes []uint64
+	// forwarded is set for requests forwarded by another node of the cluster
+	forwarded bool
+}
+
+/*
+values returns the plain values of the request as they were sent
+*/
+func (data requestData) values() []string {
+	values := make([]string, len(data.Values), len(data.Values))
+	for i, value := range data.Values {
+		values[i] = value.Value
+	}
+	return values
+}
+
+/*
+query returns the query parameters of the request
+*/
+func (data requestData) query() abstract.Query {
+	return abstract.Query{
+		N:          data.N,
+		MinCount:   data.MinCount,
+		Guaranteed: data.Guaranteed,
+		Lookup:     data.Lookup,
+		Prefix:     data.Prefix,
+		Cursor:     data.Cursor,
+		Limit:      data.Limit,
+		Since:      data.Since,
+		Until:      data.Until,
+		Series:     data.Series,
+		Resolution: data.Resolution,
+	}
+}
+
+/*
+weighted returns true if any value of the request comes with a count other than 1
+*/
+func (data requestData) weighted() bool {
+	for _, value := range data.Values {
+		if value.Count != 1 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+decode decodes the values and pair values of the request according to its
+encoding, or the hashes if the values are prehashed
+*/
+func (data *requestData) decode() error {
+	if data.Prehashed {
+		if data.weighted() || len(data.Pairs) > 0 {
+			return errors.New("Prehashed values can not be weighted or paired")
+		}
+		data.hashes = make([]uint64, len(data.Values), len(data.Values))
+		for i, value := range data.Values {
+			hash, err := sketches.DecodeHash(value.Value, data.Encoding)
+			if err != nil {
+				return err
+			}
+			data.hashes[i] = hash
+		}
+		return nil
+	}
+
+	data.raw = make(map[string]string)
+	for _, value := range data.Values {
+		raw, err := sketches.DecodeValue(value.Value, data.Encoding)
+		if err != nil {
+			return err
+		}
+		data.raw[raw] = value.Value
+	}
+	for i, pair := range data.Pairs {
+		raw, err := sketches.DecodeValue(pair.Value, data.Encoding)
+		if err != nil {
+			return err
+		}
+		data.Pairs[i].Value = raw
+	}
+	return nil
+}
+
+/*
+rawValues returns the decoded values of the request
+*/
+func (data requestData) rawValues() []string {
+	values := make([]string, len(data.Values), len(data.Values))
+	for i, value := range data.Values {
+		values[i], _ = sketches.DecodeValue(value.Value, data.Encoding)
+	}
+	return values
+}
+
+/*
+rawWeightedValues returns the decoded values of the request with their counts
+*/
+func (data requestData) rawWeightedValues() []sketches.WeightedValue {
+	values := make([]sketches.WeightedValue, len(data.Values), len(data.Values))
+	for i, value := range data.Values {
+		values[i].Value, _ = sketches.DecodeValue(value.Value, data.Encoding)
+		values[i].Count = value.Count
+	}
+	return values
+}
+
+/*
+encodeResult replaces decoded values used as keys in a result map with the
+values as they were sent, so binary values survive the JSON response
+*/
+func (data requestData) encodeResult(result interface{}) interface{} {
+	if data.Encoding == "" || data.Encoding == sketches.EncodingUTF8 {
+		return result
+	}
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return result
+	}
+	res := make(map[string]interface{})
+	for _, key := range v.MapKeys() {
+		sent, ok := data.raw[key.String()]
+		if !ok {
+			sent = key.String()
+		}
+		res[sent] = v.MapIndex(key).Interface()
+	}
+	return res
+}
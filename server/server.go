@@ -1,47 +1,69 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/facebookgo/grace/gracehttp"
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/sketches"
+	"github.com/seiflotfy/skizze/sketches/abstract"
 	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
 )
 
-type requestData struct {
-	id         string
-	typ        string
-	Properties map[string]float64 `json:"properties"`
-	Values     []string           `json:"values"`
-}
-
 var logger = utils.GetLogger()
 var sketchesManager *sketches.ManagerStruct
 
 /*
 Server manages the http connections and communciates with the sketches manager
 */
-type Server struct{}
+type Server struct {
+	manager  *sketches.ManagerStruct
+	role     string
+	follower *follower
+	cluster  *clusterState
+	syncer   *syncer
+}
 
 type sketchesResult struct {
 	Result []string `json:"result"`
 	Error  error    `json:"error"`
 }
 
+type sketchListResult struct {
+	Result []*sketches.SketchEntry `json:"result"`
+	Next   string                  `json:"next"`
+	Error  error                   `json:"error"`
+}
+
+type domainsResult struct {
+	Result []*abstract.Domain `json:"result"`
+	Error  error              `json:"error"`
+}
+
 type sketchResult struct {
 	Result interface{} `json:"result"`
 	Info   interface{} `json:"info"`
 	Error  error       `json:"error"`
 }
 
+// exportData is an exported sketch in JSON, data holds the whole export
+// (header included) and is base64 encoded
+type exportData struct {
+	storage.Header
+	Data []byte `json:"data"`
+}
+
 /*
 New returns a new Server
 */
@@ -51,20 +73,80 @@ func New() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	server := Server{}
+	return newServer(sketchesManager, config.GetConfig())
+}
+
+/*
+newServer returns a server for manager replicating as configured in conf
+*/
+func newServer(manager *sketches.ManagerStruct, conf *config.Config) (*Server, error) {
+	server := Server{manager: manager, role: conf.ReplicationRole}
+	if len(conf.ClusterNodes) > 0 {
+		var err error
+		if server.cluster, err = newClusterState(conf.ClusterNodes, conf.ClusterSelf, conf.ClusterReplicas, time.Duration(conf.ClusterTimeout)*time.Second); err != nil {
+			return nil, err
+		}
+	}
+	switch conf.ReplicationRole {
+	case "":
+	case RoleLeader:
+		manager.EnableOpLog(int(conf.ReplicationLogSize))
+	case RoleFollower:
+		if conf.ReplicationLeader == "" {
+			return nil, errors.New("Followers need the address of their leader (replication_leader)")
+		}
+		server.follower = newFollower(manager, conf.ReplicationLeader, conf.ReplicationMaxLag)
+		server.follower.start()
+	default:
+		return nil, fmt.Errorf("Invalid replication role %s, expected %s or %s", conf.ReplicationRole, RoleLeader, RoleFollower)
+	}
+	if len(conf.MultiMasterPeers) > 0 {
+		if server.follower != nil {
+			return nil, errors.New("Followers can not accept writes in multi-master mode")
+		}
+		replica := conf.MultiMasterID
+		if replica == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			replica = fmt.Sprintf("%s:%d", hostname, conf.Port)
+		}
+		if err := manager.EnableMultiMaster(replica); err != nil {
+			return nil, err
+		}
+		server.syncer = newSyncer(manager, conf.MultiMasterPeers, time.Duration(conf.MultiMasterInterval)*time.Second)
+		server.syncer.start()
+	}
+	// Followers delete expired sketches when their leader does
+	if server.follower == nil {
+		manager.StartReaper(time.Duration(conf.ExpiryInterval) * time.Second)
+	}
 	return &server, nil
 }
 
 func (srv *Server) handleTopRequest(w http.ResponseWriter, method string, data requestData) {
 	var err error
-	var sketches []string
+	var names []string
 	var js []byte
 
 	switch {
 	case method == "GET":
-		// Get all sketches
-		sketches, err = sketchesManager.GetSketches()
-		js, err = json.Marshal(sketchesResult{sketches, err})
+		// Get all sketches, of all nodes in a cluster
+		if srv.cluster != nil && !data.forwarded {
+			var entries []*sketches.SketchEntry
+			entries, _, err = srv.listSketches(requestData{})
+			names = make([]string, len(entries), len(entries))
+			for i, entry := range entries {
+				names[i] = entry.Type + "/" + entry.ID
+			}
+		} else {
+			names, err = srv.manager.GetSketches()
+		}
+		if err != nil {
+			break
+		}
+		js, err = json.Marshal(sketchesResult{names, err})
 		logger.Info.Printf("[%v]: Getting all available sketches", method)
 	case method == "MERGE":
 		// Reserved for merging hyper log log
@@ -86,35 +168,117 @@ func (srv *Server) handleTopRequest(w http.ResponseWriter, method string, data r
 
 }
 
+func (srv *Server) handleSketchListRequest(w http.ResponseWriter, method string, data requestData) {
+	if method != "GET" {
+		http.Error(w, "Invalid Method: "+method, http.StatusBadRequest)
+		return
+	}
+
+	// Get the sketches matching the filters with their info, of all nodes in a cluster
+	var entries []*sketches.SketchEntry
+	var next string
+	var err error
+	if srv.cluster != nil && !data.forwarded {
+		entries, next, err = srv.listSketches(data)
+	} else {
+		entries, next, err = srv.manager.ListSketches(data.TypeFilter, data.Prefix, data.Cursor, data.Limit)
+	}
+	logger.Info.Printf("[%v]: Listing sketches", method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(sketchListResult{entries, next, nil})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(js); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (srv *Server) handleSketchRequest(w http.ResponseWriter, method string, data requestData) {
 	var res sketchResult
 	var err error
 
-	// TODO (mb): handle errors from sketchesManager.*
+	// TODO (mb): handle errors from srv.manager.*
 	switch {
+	case method == "GET" && data.typ == abstract.Family:
+		// Get the counts for groups of a family sketch
+		count, err := srv.manager.GetCountForGroups(data.id, data.typ, data.Keys, data.rawValues())
+		logger.Info.Printf("[%v]: Getting state for groups of sketch: %v of type %s", method, data.id, data.typ)
+		res = sketchResult{count["result"], count["info"], err}
+	case method == "GET" && data.Prehashed:
+		// Get a count for already computed hashes
+		count, err := srv.manager.GetCountForHashes(data.id, data.typ, data.values(), data.hashes)
+		logger.Info.Printf("[%v]: Getting state for hashes of sketch: %v of type %s", method, data.id, data.typ)
+		res = sketchResult{count["result"], count["info"], err}
 	case method == "GET":
 		// Get a count for a specific sketch
-		count, err := sketchesManager.GetCountForSketch(data.id, data.typ, data.Values)
+		count, err := srv.manager.QuerySketch(data.id, data.typ, data.rawValues(), data.query())
 		logger.Info.Printf("[%v]: Getting state for sketch: %v of type %s", method, data.id, data.typ)
-		res = sketchResult{count["result"], count["info"], err}
+		res = sketchResult{data.encodeResult(count["result"]), count["info"], err}
 	case method == "POST":
 		// Create a new sketch counter
-		err = sketchesManager.CreateSketch(data.id, data.typ, data.Properties)
+		if data.Template != "" {
+			err = srv.manager.CreateSketchFromTemplate(data.id, data.typ, data.Template)
+		} else {
+			opts := sketches.SketchOptions{
+				InnerType:   data.InnerType,
+				Hash:        data.Hash,
+				Seed:        data.Seed,
+				Compression: data.Compression,
+				TTL:         data.TTL,
+				ExpiresAt:   data.ExpiresAt,
+				ResetTTL:    data.ResetTTL,
+			}
+			err = srv.manager.CreateSketchWithOptions(data.id, data.typ, data.Properties, opts)
+		}
 		logger.Info.Printf("[%v]: Creating new sketch: %v of type %s", method, data.id, data.typ)
 		res = sketchResult{nil, nil, err}
 	case method == "PUT":
-		// Add values to counter
-		err = sketchesManager.AddToSketch(data.id, data.typ, data.Values)
+		// Add values to counter, auto_create in the request overrides the config
+		autoCreate := config.GetConfig().AutoCreate
+		if data.AutoCreate != nil {
+			autoCreate = *data.AutoCreate
+		}
+		// Values of rollups are placed by time, with the timestamp or the clock
+		// of this node so replicas place them alike
+		if data.Timestamp != 0 && data.typ != abstract.Rollup {
+			err = fmt.Errorf("Sketches of type %s do not support timestamps, only %s", data.typ, abstract.Rollup)
+		} else if data.typ == abstract.Rollup && (len(data.Pairs) > 0 || data.weighted()) {
+			err = fmt.Errorf("Sketches of type %s only take values or prehashed values", abstract.Rollup)
+		} else if len(data.Pairs) > 0 {
+			err = srv.manager.AddPairsToSketch(data.id, data.typ, data.Pairs)
+		} else if data.Prehashed && data.typ == abstract.Rollup {
+			err = srv.manager.AddHashesToSketchAt(data.id, data.typ, data.hashes, data.Timestamp, autoCreate)
+		} else if data.Prehashed {
+			err = srv.manager.AddHashesToSketch(data.id, data.typ, data.hashes, autoCreate)
+		} else if data.weighted() {
+			err = srv.manager.AddWeightedToSketch(data.id, data.typ, data.rawWeightedValues(), autoCreate)
+		} else if data.typ == abstract.Rollup {
+			err = srv.manager.AddToSketchAt(data.id, data.typ, data.rawValues(), data.Timestamp, autoCreate)
+		} else {
+			err = srv.manager.AddToSketchAutoCreate(data.id, data.typ, data.rawValues(), autoCreate)
+		}
 		logger.Info.Printf("[%v]: Adding values to sketch: %v of type %s", method, data.id, data.typ)
 		res = sketchResult{nil, nil, err}
+	case method == "MERGE":
+		// Merge other sketches of the same type into the sketch
+		err = srv.mergeSketches(data)
+		logger.Info.Printf("[%v]: Merging %v into sketch: %v of type %s", method, data.From, data.id, data.typ)
+		res = sketchResult{nil, nil, err}
 	case method == "PURGE":
 		// Purges values from counter
-		err = sketchesManager.DeleteFromSketch(data.id, data.typ, data.Values)
+		notFound, err := srv.manager.PurgeFromSketch(data.id, data.typ, data.rawValues())
 		logger.Info.Printf("[%v]: Purging values from sketch: %v of type %s", method, data.id, data.typ)
-		res = sketchResult{nil, nil, err}
+		res = sketchResult{map[string]uint{"not_found": notFound}, nil, err}
 	case method == "DELETE":
 		// Delete Counter
-		err := sketchesManager.DeleteSketch(data.id, data.typ)
+		err := srv.manager.DeleteSketch(data.id, data.typ)
 		logger.Info.Printf("[%v]: Deleting sketch: %v of type %s", method, data.id, data.typ)
 		res = sketchResult{nil, nil, err}
 	default:
@@ -139,9 +303,319 @@ func (srv *Server) handleSketchRequest(w http.ResponseWriter, method string, dat
 	}
 }
 
+func (srv *Server) handleDomainRequest(w http.ResponseWriter, method string, data requestData) {
+	var res sketchResult
+	var err error
+
+	switch {
+	case method == "GET" && data.id == "":
+		// Get all domains, of all nodes in a cluster
+		var domains []*abstract.Domain
+		if srv.cluster != nil && !data.forwarded {
+			domains, err = srv.getDomains()
+		} else {
+			domains, err = srv.manager.GetDomains()
+		}
+		logger.Info.Printf("[%v]: Getting all available domains", method)
+		srv.writeJSON(w, domainsResult{domains, err})
+		return
+	case method == "GET":
+		// Get the results of all sketches in a domain
+		count, err := srv.manager.GetCountForDomain(data.id, data.rawValues())
+		logger.Info.Printf("[%v]: Getting state for domain: %v", method, data.id)
+		res = sketchResult{count, nil, err}
+	case method == "POST":
+		// Create a new domain
+		err = srv.manager.CreateDomain(data.id, data.Sketches)
+		logger.Info.Printf("[%v]: Creating new domain: %v", method, data.id)
+		res = sketchResult{nil, nil, err}
+	case method == "PUT":
+		// Add values to all sketches of a domain
+		if data.weighted() {
+			err = srv.manager.AddWeightedToDomain(data.id, data.rawWeightedValues())
+		} else {
+			err = srv.manager.AddToDomain(data.id, data.rawValues())
+		}
+		logger.Info.Printf("[%v]: Adding values to domain: %v", method, data.id)
+		res = sketchResult{nil, nil, err}
+	case method == "DELETE":
+		// Delete a domain and its sketches
+		err = srv.manager.DeleteDomain(data.id)
+		logger.Info.Printf("[%v]: Deleting domain: %v", method, data.id)
+		res = sketchResult{nil, nil, err}
+	default:
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+
+	if res.Error != nil {
+		http.Error(w, fmt.Sprintf("Error with operation %s on domain %s: %s", method, data.id, res.Error.Error()), http.StatusBadRequest)
+		return
+	}
+	srv.writeJSON(w, res)
+}
+
+func (srv *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(js); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (srv *Server) handleStatsRequest(w http.ResponseWriter, method string) {
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	logger.Info.Printf("[%v]: Getting memory stats", method)
+	srv.writeJSON(w, sketchResult{srv.manager.GetMemoryStats(), nil, nil})
+}
+
+func (srv *Server) handleSnapshotRequest(w http.ResponseWriter, method string) {
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	logger.Info.Printf("[%v]: Taking snapshot", method)
+	// Buffer the archive so errors can still be reported with a status code
+	var buf bytes.Buffer
+	if err := srv.manager.Snapshot(&buf); err != nil {
+		logger.Error.Printf("Error taking snapshot: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"skizze-snapshot.tar\"")
+	if _, err := buf.WriteTo(w); err != nil {
+		logger.Error.Printf("Error sending snapshot: %v", err)
+	}
+}
+
+func (srv *Server) handleRestoreRequest(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if method != "POST" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = sketches.RestoreSkip
+	}
+	logger.Info.Printf("[%v]: Restoring snapshot (on conflict %s)", method, onConflict)
+	result, err := srv.manager.Restore(r.Body, onConflict)
+	if err != nil {
+		logger.Error.Printf("Error restoring snapshot: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.writeJSON(w, sketchResult{result, nil, nil})
+}
+
+func (srv *Server) handleExportRequest(w http.ResponseWriter, r *http.Request, id string, typ string) {
+	method := r.Method
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	logger.Info.Printf("[%v]: Exporting sketch: %v of type %s", method, id, typ)
+	var data []byte
+	var err error
+	switch format {
+	case "", "binary", "base64":
+		data, err = srv.manager.ExportSketch(id, typ)
+	default:
+		data, err = srv.manager.ExportSketchFormat(id, typ, format, query.Get("lossy") == "true")
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error with operation %s on %s: %s", method, id, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	switch format {
+	case "base64":
+		header, _, err := storage.Unwrap(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		srv.writeJSON(w, sketchResult{exportData{header, data}, nil, nil})
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"."+typ))
+		if _, err := w.Write(data); err != nil {
+			logger.Error.Printf("Error sending export: %v", err)
+		}
+	}
+}
+
+func (srv *Server) handleImportRequest(w http.ResponseWriter, r *http.Request, id string, typ string) {
+	method := r.Method
+	if method != "POST" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// JSON bodies carry the export base64 encoded like the base64 export
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var export exportData
+		if err := json.Unmarshal(data, &export); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data = export.Data
+	}
+
+	query := r.URL.Query()
+	opts, err := importOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info.Printf("[%v]: Importing sketch: %v of type %s", method, id, typ)
+	var merged bool
+	if format := query.Get("format"); format == "" {
+		merged, err = srv.manager.ImportSketch(id, typ, data, opts)
+	} else {
+		merged, err = srv.manager.ImportSketchFormat(id, typ, format, data, query.Get("lossy") == "true", opts)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error with operation %s on %s: %s", method, id, err.Error()), http.StatusBadRequest)
+		return
+	}
+	srv.writeJSON(w, sketchResult{map[string]bool{"merged": merged}, nil, nil})
+}
+
+/*
+importOptions returns the compression and expiry of a sketch created by an
+import, which exports do not hold, from the query of the request
+*/
+func importOptions(query url.Values) (sketches.SketchOptions, error) {
+	opts := sketches.SketchOptions{
+		Compression: query.Get("compression"),
+		ResetTTL:    query.Get("reset_ttl") == "true",
+	}
+	for name, value := range map[string]*int64{"ttl": &opts.TTL, "expires_at": &opts.ExpiresAt} {
+		if v := query.Get(name); v != "" {
+			var err error
+			if *value, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return opts, fmt.Errorf("Invalid %s %s: %s", name, v, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func (srv *Server) handleSketchInfoRequest(w http.ResponseWriter, method string, data requestData) {
+	if method != "GET" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+
+	info, err := srv.manager.GetSketchInfo(data.id, data.typ)
+	logger.Info.Printf("[%v]: Getting info for sketch: %v of type %s", method, data.id, data.typ)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error with operation %s on %s: %s", method, data.id, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(sketchResult{nil, info, nil})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(js); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (srv *Server) handleSketchExpiryRequest(w http.ResponseWriter, method string, data requestData) {
+	if method != "PUT" {
+		logger.Error.Printf("[%v]: Invalid Method: %v", method, http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid Method: %s", method), http.StatusBadRequest)
+		return
+	}
+
+	err := srv.manager.SetExpiry(data.id, data.typ, data.TTL, data.ExpiresAt, data.ResetTTL)
+	logger.Info.Printf("[%v]: Setting expiry of sketch: %v of type %s", method, data.id, data.typ)
+	var info *abstract.Info
+	if err == nil {
+		info, err = srv.manager.GetSketchInfo(data.id, data.typ)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error with operation %s on %s: %s", method, data.id, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(sketchResult{nil, info, nil})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(js); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	method := r.Method
 	paths := strings.Split(r.URL.Path[1:], "/")
+
+	if paths[0] == "replication" {
+		srv.handleReplicationRequest(w, r, paths[1:])
+		return
+	} else if paths[0] == "cluster" {
+		srv.handleClusterRequest(w, r, paths[1:])
+		return
+	} else if paths[0] == "sync" {
+		srv.handleSyncRequest(w, r, paths[1:])
+		return
+	}
+	// Requests about sketches of other nodes are forwarded to them
+	forwarded := r.Header.Get(forwardedHeader) != ""
+	if srv.cluster != nil && !forwarded && srv.route(w, r, append([]string(nil), paths...)) {
+		return
+	}
+	// Followers only change their sketches through the leader
+	if srv.follower != nil && method != "GET" && method != "HEAD" {
+		http.Error(w, "Followers are read only, send writes to the leader "+srv.follower.leader, http.StatusForbidden)
+		return
+	}
+
+	// Snapshots and exports are binary, not JSON
+	if len(paths) == 1 && paths[0] == "snapshot" {
+		srv.handleSnapshotRequest(w, method)
+		return
+	} else if len(paths) == 1 && paths[0] == "restore" {
+		srv.handleRestoreRequest(w, r)
+		return
+	} else if len(paths) == 3 && paths[2] == "export" {
+		srv.handleExportRequest(w, r, strings.TrimSpace(paths[1]), strings.TrimSpace(paths[0]))
+		return
+	} else if len(paths) == 3 && paths[2] == "import" {
+		srv.handleImportRequest(w, r, strings.TrimSpace(paths[1]), strings.TrimSpace(paths[0]))
+		return
+	}
+
 	body, _ := ioutil.ReadAll(r.Body)
 	var data requestData
 
@@ -159,13 +633,39 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if data.Properties == nil {
 		data.Properties = make(map[string]float64)
 	}
+	data.forwarded = forwarded
 
-	if len(paths) == 1 {
+	if err := data.decode(); err != nil {
+		logger.Error.Printf("An error has ocurred: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if paths[0] == "domain" && len(paths) <= 2 {
+		if len(paths) == 2 {
+			data.id = strings.TrimSpace(string(paths[1]))
+		}
+		srv.handleDomainRequest(w, method, data)
+	} else if paths[0] == "stats" && len(paths) == 1 {
+		srv.handleStatsRequest(w, method)
+	} else if paths[0] == "sketches" && len(paths) == 1 {
+		srv.handleSketchListRequest(w, method, data)
+	} else if len(paths) == 1 {
 		srv.handleTopRequest(w, method, data)
 	} else if len(paths) == 2 {
 		data.typ = strings.TrimSpace(string(paths[0]))
 		data.id = strings.TrimSpace(strings.Join(paths[1:], "/"))
 		srv.handleSketchRequest(w, method, data)
+	} else if len(paths) == 3 && paths[2] == "info" {
+		data.typ = strings.TrimSpace(string(paths[0]))
+		data.id = strings.TrimSpace(string(paths[1]))
+		srv.handleSketchInfoRequest(w, method, data)
+	} else if len(paths) == 3 && paths[2] == "expiry" {
+		data.typ = strings.TrimSpace(string(paths[0]))
+		data.id = strings.TrimSpace(string(paths[1]))
+		srv.handleSketchExpiryRequest(w, method, data)
+	} else {
+		http.Error(w, "Not Found", http.StatusNotFound)
 	}
 }
 
@@ -176,6 +676,10 @@ func (srv *Server) Run() {
 	conf := config.GetConfig()
 	port := int(conf.Port)
 	logger.Info.Println("Server up and running on port: " + strconv.Itoa(port))
+	if srv.cluster != nil {
+		// The nodes might have changed since the last start
+		go srv.rebalance(nil)
+	}
 	err := gracehttp.Serve(&http.Server{Addr: ":" + strconv.Itoa(port), Handler: srv})
 	utils.PanicOnError(err)
 }
@@ -186,7 +690,17 @@ Stop ...
 func (srv *Server) Stop() {
 	//FIXME make sure everything is written to disk
 	logger.Info.Println("Stopping server...")
-	err := storage.CloseInfoDB()
+	if srv.follower != nil {
+		srv.follower.stop()
+	}
+	srv.manager.StopReaper()
+	if srv.syncer != nil {
+		srv.syncer.stop()
+		if err := srv.manager.FlushReplicas(); err != nil {
+			logger.Error.Println(err)
+		}
+	}
+	err := storage.Close()
 	utils.PanicOnError(err)
 	os.Exit(0)
 }
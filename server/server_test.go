@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,8 +10,11 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/seiflotfy/skizze/cluster"
 	"github.com/seiflotfy/skizze/config"
+	"github.com/seiflotfy/skizze/sketches"
 	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
 )
@@ -31,7 +35,7 @@ func tearDownTests() {
 	os.RemoveAll(config.GetConfig().InfoDir)
 	os.Mkdir(config.GetConfig().DataDir, 0777)
 	os.Mkdir(config.GetConfig().InfoDir, 0777)
-	storage.CloseInfoDB()
+	storage.Close()
 	sketchesManager.Destroy()
 }
 
@@ -54,6 +58,13 @@ func unmarshalSketchsResult(resp *httptest.ResponseRecorder) sketchesResult {
 	return r
 }
 
+func unmarshalSketchListResult(resp *httptest.ResponseRecorder) sketchListResult {
+	body, _ := ioutil.ReadAll(resp.Body)
+	var r sketchListResult
+	json.Unmarshal(body, &r)
+	return r
+}
+
 func unmarshalSketchResult(resp *httptest.ResponseRecorder) sketchResult {
 	body, _ := ioutil.ReadAll(resp.Body)
 	var r sketchResult
@@ -100,6 +111,9 @@ func TestPost(t *testing.T) {
 	if len(result.Result) != 1 {
 		t.Fatalf("after add resultCount != 1. Got %d", len(result.Result))
 	}
+	if result.Result[0] != "hllpp/marvel" {
+		t.Fatalf("Expected hllpp/marvel, got %s", result.Result[0])
+	}
 }
 
 func TestHLL(t *testing.T) {
@@ -210,4 +224,1237 @@ func TestTopK(t *testing.T) {
 		t.Fatalf("Expected \"magneto\" in first position, got, %s", v.(string))
 	}
 
+	resp = httpRequest(s, t, "GET", "topk/x-force", `{"n": 2, "min_count": 1}`)
+	if result2 := unmarshalSketchResult(resp).Result.([]interface{}); len(result2) != 2 {
+		t.Fatalf("Expected the top 2 values, got %v", result2)
+	}
+	resp = httpRequest(s, t, "GET", "topk/x-force", `{"min_count": 2}`)
+	if result2 := unmarshalSketchResult(resp).Result.([]interface{}); len(result2) != 1 {
+		t.Fatalf("Expected 1 value counted at least twice, got %v", result2)
+	}
+	resp = httpRequest(s, t, "GET", "topk/x-force", `{"n": 1, "guaranteed": true}`)
+	if result2 := unmarshalSketchResult(resp).Result.([]interface{}); len(result2) != 1 {
+		t.Fatalf("Expected magneto to be guaranteed, got %v", result2)
+	}
+
+	resp = httpRequest(s, t, "GET", "topk/x-force", `{"values": ["magneto", "storm"], "lookup": true}`)
+	lookups := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if v := lookups["magneto"].(map[string]interface{})["Count"].(float64); v != 2 {
+		t.Fatalf("Expected magneto count 2, got %v", v)
+	}
+	if v := lookups["storm"].(map[string]interface{})["Count"].(float64); v != 0 {
+		t.Fatalf("Expected storm count 0, got %v", v)
+	}
+
+	resp = httpRequest(s, t, "GET", "topk/x-force", `{"n": -1}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for a negative n, got %d", resp.Code)
+	}
+}
+
+func TestSketchInfo(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "topk/x-force", `{
+		"properties": {"capacity": 10}
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "topk/x-force/info", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	info := unmarshalSketchResult(resp).Info.(map[string]interface{})
+	if info["type"].(string) != "topk" {
+		t.Fatalf("Expected type topk, got %v", info["type"])
+	}
+
+	resp = httpRequest(s, t, "GET", "topk/wolverine/info", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for unknown sketch, got %d", resp.Code)
+	}
+
+	resp = httpRequest(s, t, "GET", "stats", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	stats := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if stats["resident"].(float64) != 1 {
+		t.Fatalf("Expected 1 sketch in memory, got %v", stats["resident"])
+	}
+
+	resp = httpRequest(s, t, "GET", "sketches", `{"type": "hllpp"}`)
+	result := unmarshalSketchListResult(resp)
+	if len(result.Result) != 0 {
+		t.Fatalf("Expected no hllpp sketches. Got %d", len(result.Result))
+	}
+}
+
+func TestAutoCreate(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "PUT", "hllpp/marvel", `{
+		"values": ["magneto", "wasp"]
+	}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for unknown sketch, got %d", resp.Code)
+	}
+
+	resp = httpRequest(s, t, "PUT", "hllpp/marvel", `{
+		"values": ["magneto", "wasp"],
+		"auto_create": true
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "hllpp/marvel", `{}`)
+	result := unmarshalSketchResult(resp)
+	if result.Result.(float64) != 2 {
+		t.Fatalf("Expected cardinality 2, got %v", result.Result)
+	}
+}
+
+func TestDomain(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "domain/marvel", `{
+		"sketches": {"hllpp": {}, "cml": {"capacity": 1000}}
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "domain/marvel", `{
+		"values": ["magneto", "wasp", "magneto"]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "domain/marvel", `{
+		"values": [{"value": "magneto", "count": 3}]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "PUT", "domain/marvel", `{
+		"values": [{"value": "magneto", "count": -1}]
+	}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for negative count, got %d", resp.Code)
+	}
+
+	resp = httpRequest(s, t, "GET", "domain/marvel", `{"values": ["magneto"]}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	hll := result["hllpp"].(map[string]interface{})["result"].(float64)
+	if hll != 2 {
+		t.Fatalf("Expected cardinality 2, got %v", hll)
+	}
+	cml := result["cml"].(map[string]interface{})["result"].(map[string]interface{})["magneto"].(float64)
+	if cml != 5 {
+		t.Fatalf("Expected magneto count 5, got %v", cml)
+	}
+
+	resp = httpRequest(s, t, "GET", "domain", "")
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), `"id":"marvel"`) {
+		t.Fatalf("Expected domain marvel in listing, got %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "DELETE", "domain/marvel", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "", "")
+	if len(unmarshalSketchsResult(resp).Result) != 0 {
+		t.Fatalf("Expected no sketches after deleting domain")
+	}
+}
+
+func TestFamily(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "family/referrers", `{
+		"inner_type": "topk",
+		"properties": {"capacity": 5}
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "family/referrers", `{
+		"pairs": [
+			{"key": "/home", "value": "google"},
+			{"key": "/home", "value": "google"},
+			{"key": "/about", "value": "bing"}
+		]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "family/referrers", `{"keys": ["/home"]}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	top := result["/home"].([]interface{})
+	if len(top) != 1 || top[0].(map[string]interface{})["Key"] != "google" {
+		t.Fatalf("Expected google as top referrer of /home, got %v", top)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "rollup/visitors", `{"inner_type": "hllpp"}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	now := time.Now().Unix()
+	for _, add := range []string{
+		`{"values": ["hulk", "thor"]}`,
+		fmt.Sprintf(`{"values": ["thor", "loki"], "timestamp": %d}`, now-3*24*3600),
+	} {
+		resp = httpRequest(s, t, "PUT", "rollup/visitors", add)
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+
+	resp = httpRequest(s, t, "GET", "rollup/visitors", fmt.Sprintf(`{"since": %d}`, now-24*3600))
+	if count := unmarshalSketchResult(resp).Result; count != 2.0 {
+		t.Errorf("Expected 2 visitors in the last day, got %v", count)
+	}
+	resp = httpRequest(s, t, "GET", "rollup/visitors", `{"series": true, "resolution": "day"}`)
+	series := unmarshalSketchResult(resp).Result.([]interface{})
+	if len(series) != 2 || series[0].(map[string]interface{})["result"] != 2.0 {
+		t.Fatalf("Expected 2 days with 2 visitors each, got %v", series)
+	}
+	resp = httpRequest(s, t, "GET", "rollup/visitors", `{"series": true, "resolution": "week"}`)
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "hour, day or month") {
+		t.Fatalf("Expected 400 listing the resolutions, got %d - %s", resp.Code, resp.Body.String())
+	}
+
+	// Timestamps only apply to rollups, which can be auto-created with them
+	resp = httpRequest(s, t, "POST", "hllpp/heroes", `{}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "PUT", "hllpp/heroes", fmt.Sprintf(`{"values": ["thor"], "timestamp": %d}`, now))
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "do not support timestamps") {
+		t.Fatalf("Expected 400 rejecting the timestamp, got %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "PUT", "rollup/villains", fmt.Sprintf(`{"values": ["loki"], "timestamp": %d}`, now))
+	if resp.Code == 200 {
+		t.Fatal("Expected error adding to a missing rollup without auto_create")
+	}
+	resp = httpRequest(s, t, "PUT", "rollup/villains", fmt.Sprintf(`{"values": ["loki"], "timestamp": %d, "auto_create": true}`, now))
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "rollup/villains", `{}`)
+	if count := unmarshalSketchResult(resp).Result; count != 1.0 {
+		t.Errorf("Expected 1 villain, got %v", count)
+	}
+
+	// Timestamps are checked whatever values come with them
+	for path, body := range map[string]string{"dict/heroes": `{}`, "family/heroes": `{"inner_type": "hllpp"}`} {
+		resp = httpRequest(s, t, "POST", path, body)
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+	for _, put := range []struct{ path, body, err string }{
+		{"hllpp/heroes", `{"values": ["11400714819323198485"], "prehashed": true, "timestamp": %d}`, "do not support timestamps"},
+		{"dict/heroes", `{"values": [{"value": "thor", "count": 2}], "timestamp": %d}`, "do not support timestamps"},
+		{"family/heroes", `{"pairs": [{"key": "asgard", "value": "thor"}], "timestamp": %d}`, "do not support timestamps"},
+		{"rollup/villains", `{"values": [{"value": "loki", "count": 2}], "timestamp": %d}`, "only take values"},
+		{"rollup/villains", `{"pairs": [{"key": "asgard", "value": "loki"}], "timestamp": %d}`, "only take values"},
+	} {
+		resp = httpRequest(s, t, "PUT", put.path, fmt.Sprintf(put.body, now))
+		if resp.Code != 400 || !strings.Contains(resp.Body.String(), put.err) {
+			t.Errorf("Expected 400 for %s %s, got %d - %s", put.path, put.body, resp.Code, resp.Body.String())
+		}
+	}
+	resp = httpRequest(s, t, "PUT", "rollup/villains", fmt.Sprintf(`{"values": ["11400714819323198485", "4354685564936845355"], "prehashed": true, "timestamp": %d}`, now-3*24*3600))
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "rollup/villains", fmt.Sprintf(`{"until": %d}`, now-24*3600))
+	if count := unmarshalSketchResult(resp).Result; count != 2.0 {
+		t.Errorf("Expected 2 villains 3 days ago, got %v", count)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "hllpp/campaign", `{"ttl": 3600}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "sketches", "")
+	entries := unmarshalSketchListResult(resp).Result
+	if len(entries) != 1 || entries[0].ExpiresAt != entries[0].LastModified+3600 {
+		t.Fatalf("Expected campaign to expire in an hour, got %v", entries)
+	}
+
+	expiresAt := time.Now().Unix() - 1
+	resp = httpRequest(s, t, "PUT", "hllpp/campaign/expiry", fmt.Sprintf(`{"expires_at": %d}`, expiresAt))
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	info := unmarshalSketchResult(resp).Info.(map[string]interface{})
+	if info["expires_at"] != float64(expiresAt) {
+		t.Fatalf("Expected campaign to expire at %d, got %v", expiresAt, info["expires_at"])
+	}
+	resp = httpRequest(s, t, "PUT", "hllpp/wolverine/expiry", `{"ttl": 60}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for unknown sketch, got %d", resp.Code)
+	}
+
+	s.manager.StartReaper(10 * time.Millisecond)
+	waitFor(t, "campaign to expire", func() bool {
+		resp := httpRequest(s, t, "GET", "hllpp/campaign/info", "")
+		return resp.Code == 400
+	})
+}
+
+func TestWeightedAdd(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "cml/x-force", `{
+		"properties": {"capacity": 1000}
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "cml/x-force", `{
+		"values": ["wasp", {"value": "magneto", "count": 3}]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "cml/x-force", `{"values": ["magneto", "wasp"]}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if v := uint(result["magneto"].(float64)); v != 3 {
+		t.Fatalf("Expected magneto count 3, got %d", v)
+	}
+	if v := uint(result["wasp"].(float64)); v != 1 {
+		t.Fatalf("Expected wasp count 1, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "PUT", "cml/x-force", `{
+		"values": [{"value": "magneto", "count": -1}]
+	}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for negative count, got %d", resp.Code)
+	}
+}
+
+func TestEncodedValues(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "cml/binary", `{
+		"properties": {"capacity": 1000}
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "cml/binary", `{
+		"encoding": "base64",
+		"values": ["AAEC", "AAEC", "/w=="]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "cml/binary", `{"encoding": "hex", "values": ["000102", "ff"]}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if v := uint(result["000102"].(float64)); v != 2 {
+		t.Fatalf("Expected 000102 count 2, got %d", v)
+	}
+	if v := uint(result["ff"].(float64)); v != 1 {
+		t.Fatalf("Expected ff count 1, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "PUT", "cml/binary", `{"encoding": "hex", "values": ["xyz"]}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for invalid hex value, got %d", resp.Code)
+	}
+}
+
+func TestPrehashedValues(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "hllpp/hashed", `{}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "PUT", "hllpp/hashed", `{
+		"prehashed": true,
+		"values": ["11400714819323198485", "4354685564936845355", "14029467366897019727", "4354685564936845355"]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httpRequest(s, t, "GET", "hllpp/hashed", `{}`)
+	if v := uint(unmarshalSketchResult(resp).Result.(float64)); v != 3 {
+		t.Fatalf("Expected cardinality 3, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "POST", "bloom/hashed", `{}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "PUT", "bloom/hashed", `{
+		"prehashed": true,
+		"encoding": "hex",
+		"values": ["00000000deadbeef"]
+	}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "bloom/hashed", `{
+		"prehashed": true,
+		"encoding": "hex",
+		"values": ["00000000deadbeef", "00000000cafebabe"]
+	}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if !result["00000000deadbeef"].(bool) {
+		t.Fatalf("Expected deadbeef to be in the filter")
+	}
+	if result["00000000cafebabe"].(bool) {
+		t.Fatalf("Expected cafebabe not to be in the filter")
+	}
+
+	resp = httpRequest(s, t, "PUT", "bloom/hashed", `{
+		"prehashed": true,
+		"encoding": "hex",
+		"values": ["beef"]
+	}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 for a short hash, got %d", resp.Code)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	for _, id := range []string{"marvel", "dc"} {
+		resp := httpRequest(s, t, "POST", "bloom/"+id, `{"hash": "fnv", "seed": 7}`)
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+	resp := httpRequest(s, t, "POST", "bloom/image", `{"hash": "murmur3", "seed": 7}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	httpRequest(s, t, "PUT", "bloom/marvel", `{"values": ["hulk"]}`)
+	httpRequest(s, t, "PUT", "bloom/dc", `{"values": ["flash"]}`)
+
+	resp = httpRequest(s, t, "MERGE", "bloom/marvel", `{"from": ["dc"]}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "bloom/marvel", `{"values": ["hulk", "flash", "spawn"]}`)
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if !result["hulk"].(bool) || !result["flash"].(bool) || result["spawn"].(bool) {
+		t.Fatalf("Expected hulk and flash but not spawn in the merged filter, got %v", result)
+	}
+
+	resp = httpRequest(s, t, "MERGE", "bloom/marvel", `{"from": ["image"]}`)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 merging sketches with different hash functions, got %d", resp.Code)
+	}
+}
+
+func TestDictQueries(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	resp := httpRequest(s, t, "POST", "dict/heroes", `{}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	httpRequest(s, t, "PUT", "dict/heroes", `{"values": ["x-havoc", "x-storm", "hulk", "hulk"]}`)
+
+	resp = httpRequest(s, t, "PURGE", "dict/heroes", `{"values": ["hulk", "thor"]}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if v := uint(result["not_found"].(float64)); v != 1 {
+		t.Fatalf("Expected 1 value not found, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "GET", "dict/heroes", `{"prefix": "x-", "limit": 1}`)
+	page := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	entries := page["entries"].([]interface{})
+	if len(entries) != 1 || entries[0].(map[string]interface{})["key"] != "x-havoc" {
+		t.Fatalf("Expected x-havoc on the first page, got %v", page)
+	}
+	if page["next"] != "x-havoc" {
+		t.Fatalf("Expected next cursor x-havoc, got %v", page["next"])
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	httpRequest(s, t, "POST", "dict/heroes", `{}`)
+	httpRequest(s, t, "PUT", "dict/heroes", `{"values": ["hulk", "hulk"]}`)
+
+	resp := httpRequest(s, t, "POST", "snapshot", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 posting to snapshot, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "GET", "snapshot", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	if ct := resp.Header().Get("Content-Type"); ct != "application/x-tar" {
+		t.Fatalf("Expected content type application/x-tar, got %s", ct)
+	}
+	snapshot := resp.Body.String()
+
+	httpRequest(s, t, "DELETE", "dict/heroes", "")
+	resp = httpRequest(s, t, "POST", "restore?on_conflict=replace", snapshot)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 restoring with unknown conflict mode, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "POST", "restore", snapshot)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	result := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if restored := result["restored"].([]interface{}); len(restored) != 1 {
+		t.Fatalf("Expected 1 restored sketch, got %v", result)
+	}
+
+	resp = httpRequest(s, t, "GET", "dict/heroes", `{"values": ["hulk"]}`)
+	counts := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if v := uint(counts["hulk"].(float64)); v != 2 {
+		t.Fatalf("Expected hulk to have count 2, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "POST", "restore?on_conflict=overwrite", "not a snapshot")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 restoring an invalid snapshot, got %d", resp.Code)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	httpRequest(s, t, "POST", "hllpp/marvel", `{}`)
+	httpRequest(s, t, "PUT", "hllpp/marvel", `{"values": ["wolverine", "storm"]}`)
+
+	resp := httpRequest(s, t, "GET", "hllpp/marvel/export", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	binary := resp.Body.String()
+	resp = httpRequest(s, t, "GET", "hllpp/marvel/export?format=base64", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var export struct {
+		Result exportData `json:"result"`
+	}
+	if err := json.Unmarshal(body, &export); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+	if export.Result.Type != "hllpp" || string(export.Result.Data) != binary {
+		t.Fatalf("Expected the base64 export to match the binary export, got %v", export.Result.Header)
+	}
+
+	// Create a new sketch from the binary export
+	resp = httpRequest(s, t, "POST", "hllpp/dc/import", binary)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	if merged := unmarshalSketchResult(resp).Result.(map[string]interface{})["merged"]; merged != false {
+		t.Fatalf("Expected dc to be created, got merged %v", merged)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/dc", "")
+	if v := uint(unmarshalSketchResult(resp).Result.(float64)); v != 2 {
+		t.Fatalf("Expected dc to have count 2, got %d", v)
+	}
+
+	// Merge the JSON export into an existing sketch
+	httpRequest(s, t, "PUT", "hllpp/dc", `{"values": ["batman"]}`)
+	js, _ := json.Marshal(export.Result)
+	req, _ := http.NewRequest("POST", "http://skizze.io/hllpp/dc/import", strings.NewReader(string(js)))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	if merged := unmarshalSketchResult(resp).Result.(map[string]interface{})["merged"]; merged != true {
+		t.Fatalf("Expected dc to be merged, got merged %v", merged)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/dc", "")
+	if v := uint(unmarshalSketchResult(resp).Result.(float64)); v != 3 {
+		t.Fatalf("Expected dc to have count 3, got %d", v)
+	}
+
+	resp = httpRequest(s, t, "POST", "bloom/dc/import", binary)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 importing a sketch of another type, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "POST", "hllpp/image/import", binary[:len(binary)-10])
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 importing truncated data, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/image/export", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 exporting a missing sketch, got %d", resp.Code)
+	}
+}
+
+func TestRedisExportImport(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	httpRequest(s, t, "POST", "hllpp/marvel", `{"hash": "redis"}`)
+	httpRequest(s, t, "PUT", "hllpp/marvel", `{"values": ["wolverine", "storm"]}`)
+	httpRequest(s, t, "POST", "hllpp/dc", `{}`)
+	httpRequest(s, t, "PUT", "hllpp/dc", `{"values": ["batman"]}`)
+	httpRequest(s, t, "POST", "dict/image", `{}`)
+
+	resp := httpRequest(s, t, "GET", "hllpp/marvel/export?format=redis", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	hll := resp.Body.String()
+	if !strings.HasPrefix(hll, "HYLL") {
+		t.Fatalf("Expected a Redis HyperLogLog, got %q", hll[:4])
+	}
+
+	resp = httpRequest(s, t, "POST", "hllpp/x-men/import?format=redis", hll)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/x-men", "")
+	if v := uint(unmarshalSketchResult(resp).Result.(float64)); v != 2 {
+		t.Fatalf("Expected x-men to have count 2, got %d", v)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/x-men/info", "")
+	if info := unmarshalSketchResult(resp).Info.(map[string]interface{}); info["hash"] != "redis" {
+		t.Fatalf("Expected x-men to be hashed like Redis, got %v", info["hash"])
+	}
+
+	// dc is not hashed like Redis
+	resp = httpRequest(s, t, "GET", "hllpp/dc/export?format=redis", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 exporting a lossy Redis HyperLogLog, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/dc/export?format=redis&lossy=true", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(s, t, "POST", "hllpp/dc/import?format=redis", hll)
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 merging a Redis HyperLogLog lossy, got %d", resp.Code)
+	}
+
+	resp = httpRequest(s, t, "GET", "dict/image/export?format=redis", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 exporting a dict as Redis HyperLogLog, got %d", resp.Code)
+	}
+	resp = httpRequest(s, t, "GET", "hllpp/marvel/export?format=druid", "")
+	if resp.Code != 400 {
+		t.Fatalf("Expected 400 exporting to an unknown format, got %d", resp.Code)
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	for start := time.Now(); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	// Both instances share the storage, keep it in memory
+	conf := config.GetConfig()
+	defer func(backend string) { conf.Storage = backend }(conf.Storage)
+	conf.Storage = storage.MemoryBackend
+	storage.Close()
+
+	leaderManager, err := sketches.GetManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	sketchesManager = leaderManager
+	followerManager, err := sketches.NewManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	defer followerManager.Destroy()
+
+	leaderConf := *conf
+	leaderConf.ReplicationRole = RoleLeader
+	leaderConf.ReplicationLogSize = 5
+	leader, err := newServer(leaderManager, &leaderConf)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	httpRequest(leader, t, "POST", "hllpp/marvel", `{}`)
+	httpRequest(leader, t, "PUT", "hllpp/marvel", `{"values": ["wolverine", "storm"]}`)
+	ts := httptest.NewServer(leader)
+	defer ts.Close()
+
+	followerConf := *conf
+	followerConf.ReplicationRole = RoleFollower
+	followerConf.ReplicationLeader = ts.URL
+	follower, err := newServer(followerManager, &followerConf)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	defer follower.follower.stop()
+
+	caughtUp := func() bool {
+		_, seq, _ := leaderManager.OpLogPosition()
+		status := follower.follower.status()
+		return status.Seq == seq && status.Lag == 0
+	}
+	countOn := func(s *Server, sketch string, value string) float64 {
+		resp := httpRequest(s, t, "GET", sketch, `{"values": ["`+value+`"]}`)
+		if resp.Code != 200 {
+			return -1
+		}
+		switch result := unmarshalSketchResult(resp).Result.(type) {
+		case float64:
+			return result
+		case map[string]interface{}:
+			return result[value].(float64)
+		}
+		return -1
+	}
+	count := func(sketch string, value string) float64 {
+		return countOn(follower, sketch, value)
+	}
+
+	// The sketches created before the follower started come with the snapshot
+	waitFor(t, "the initial resync", func() bool { return follower.follower.status().Resyncs == 1 })
+	if v := count("hllpp/marvel", ""); v != 2 {
+		t.Fatalf("Expected marvel to have count 2 on the follower, got %v", v)
+	}
+
+	httpRequest(leader, t, "POST", "dict/heroes", `{}`)
+	httpRequest(leader, t, "PUT", "dict/heroes", `{"values": ["hulk", "hulk", "thor"]}`)
+	httpRequest(leader, t, "PURGE", "dict/heroes", `{"values": ["thor"]}`)
+	httpRequest(leader, t, "POST", "domain/dc", `{"sketches": {"hllpp": {}}}`)
+	httpRequest(leader, t, "PUT", "domain/dc", `{"values": ["batman"]}`)
+	httpRequest(leader, t, "DELETE", "hllpp/marvel", "")
+	waitFor(t, "the follower to catch up", caughtUp)
+
+	if v := count("dict/heroes", "hulk"); v != 2 {
+		t.Fatalf("Expected hulk to have count 2 on the follower, got %v", v)
+	}
+	if v := count("dict/heroes", "thor"); v != 0 {
+		t.Fatalf("Expected thor to be purged on the follower, got %v", v)
+	}
+	if v := count("hllpp/dc", ""); v != 1 {
+		t.Fatalf("Expected dc to have count 1 on the follower, got %v", v)
+	}
+	if v := count("hllpp/marvel", ""); v != -1 {
+		t.Fatalf("Expected marvel to be deleted on the follower, got %v", v)
+	}
+	resp := httpRequest(follower, t, "GET", "domain", "")
+	if !strings.Contains(resp.Body.String(), `"id":"dc"`) {
+		t.Fatalf("Expected domain dc on the follower, got %s", resp.Body.String())
+	}
+
+	resp = httpRequest(follower, t, "PUT", "dict/heroes", `{"values": ["loki"]}`)
+	if resp.Code != 403 {
+		t.Fatalf("Expected 403 writing to a follower, got %d", resp.Code)
+	}
+	resp = httpRequest(follower, t, "GET", "replication", "")
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	status := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if status["role"] != RoleFollower || status["lag"].(float64) != 0 {
+		t.Fatalf("Expected a follower without lag, got %v", status)
+	}
+
+	// A follower falling behind the log resyncs from a snapshot
+	follower.follower.stop()
+	for i := 0; i < 10; i++ {
+		httpRequest(leader, t, "PUT", "dict/heroes", `{"values": ["hulk"]}`)
+	}
+	follower.follower.start()
+	waitFor(t, "the follower to resync", func() bool { return follower.follower.status().Resyncs == 2 })
+	waitFor(t, "the follower to catch up", caughtUp)
+	if v := count("dict/heroes", "hulk"); v != 12 {
+		t.Fatalf("Expected hulk to have count 12 on the follower, got %v", v)
+	}
+
+	// Batches failing part way keep the values before the failure on the
+	// leader and the follower, counts the sketch type never takes fail the
+	// whole batch
+	resp = httpRequest(leader, t, "PUT", "dict/heroes", `{"values": [{"value": "thor", "count": 3}, {"value": "hulk", "count": -100}]}`)
+	if resp.Code == 200 {
+		t.Fatalf("Expected decreasing hulk below 0 to fail, got %d", resp.Code)
+	}
+	httpRequest(leader, t, "POST", "hllpp/avengers", `{}`)
+	resp = httpRequest(leader, t, "PUT", "hllpp/avengers", `{"values": [{"value": "thor", "count": 1}, {"value": "loki", "count": 0}]}`)
+	if resp.Code == 200 {
+		t.Fatalf("Expected a count of 0 to fail, got %d", resp.Code)
+	}
+	waitFor(t, "the follower to catch up", caughtUp)
+	for _, c := range []struct {
+		sketch, value string
+		expected      float64
+	}{{"dict/heroes", "thor", 3}, {"dict/heroes", "hulk", 12}, {"hllpp/avengers", "", 0}} {
+		if v := countOn(leader, c.sketch, c.value); v != c.expected {
+			t.Fatalf("Expected %s of %s to be %v on the leader, got %v", c.value, c.sketch, c.expected, v)
+		}
+		if v := count(c.sketch, c.value); v != c.expected {
+			t.Fatalf("Expected %s of %s to be %v on the follower, got %v", c.value, c.sketch, c.expected, v)
+		}
+	}
+
+	// Writes to count-min-log sketches draw random numbers, followers get
+	// their results instead of replaying them
+	httpRequest(leader, t, "POST", "cml/visits", `{}`)
+	for i := 0; i < 3; i++ {
+		httpRequest(leader, t, "PUT", "cml/visits", `{"values": [{"value": "hulk", "count": 100000}]}`)
+	}
+	waitFor(t, "the follower to catch up", caughtUp)
+	resp = httpRequest(leader, t, "GET", "cml/visits", `{"values": ["hulk"]}`)
+	expected := unmarshalSketchResult(resp).Result.(map[string]interface{})["hulk"].(float64)
+	if v := count("cml/visits", "hulk"); v != expected {
+		t.Fatalf("Expected hulk to have count %v on the follower like on the leader, got %v", expected, v)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	defer func(backend string) { conf.Storage = backend }(conf.Storage)
+	conf.Storage = storage.MemoryBackend
+	storage.Close()
+
+	var servers [3]*Server
+	var managers [3]*sketches.ManagerStruct
+	var stores [3]storage.Backend
+	var nodes []string
+	for i := range servers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			servers[i].ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		nodes = append(nodes, ts.URL)
+		// Each node keeps its sketches in its own storage
+		store, err := storage.NewBackend(storage.MemoryBackend)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		manager, err := sketches.NewManagerWithStorage(store)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		defer manager.Destroy()
+		managers[i] = manager
+		stores[i] = store
+	}
+	// The third node is not part of the cluster yet but forwards requests
+	for i := range servers {
+		nodeConf := *conf
+		nodeConf.ClusterNodes = nodes[:2]
+		nodeConf.ClusterSelf = nodes[i]
+		nodeConf.ClusterReplicas = 2
+		server, err := newServer(managers[i], &nodeConf)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		servers[i] = server
+	}
+
+	sketchCount := 20
+	for i := 0; i < sketchCount; i++ {
+		id := fmt.Sprintf("hllpp/sketch-%d", i)
+		httpRequest(servers[2], t, "POST", id, `{}`)
+		resp := httpRequest(servers[2], t, "PUT", id, fmt.Sprintf(`{"values": ["hero-%d", "shared"]}`, i))
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+	// Each sketch is held by exactly its owners
+	placed := func() bool {
+		for i := 0; i < sketchCount; i++ {
+			key := fmt.Sprintf("hllpp/sketch-%d", i)
+			owners := servers[0].cluster.owners(key)
+			for n, manager := range managers {
+				_, err := manager.GetSketchInfo(fmt.Sprintf("sketch-%d", i), "hllpp")
+				if (err == nil) != hasNode(owners, nodes[n]) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if !placed() {
+		t.Fatal("Expected each sketch to be held by its 2 owners")
+	}
+
+	resp := httpRequest(servers[1], t, "GET", "hllpp/sketch-7", "")
+	if v := unmarshalSketchResult(resp).Result.(float64); v != 2 {
+		t.Fatalf("Expected sketch-7 to have count 2, got %v", v)
+	}
+	httpRequest(servers[0], t, "POST", "hllpp/all", `{}`)
+	from := []string{}
+	for i := 0; i < sketchCount; i++ {
+		from = append(from, fmt.Sprintf(`"sketch-%d"`, i))
+	}
+	resp = httpRequest(servers[1], t, "MERGE", "hllpp/all", `{"from": [`+strings.Join(from, ",")+`]}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(servers[2], t, "GET", "hllpp/all", "")
+	if v := unmarshalSketchResult(resp).Result.(float64); v != float64(sketchCount+1) {
+		t.Fatalf("Expected all to have count %d, got %v", sketchCount+1, v)
+	}
+
+	// A stale copy on the new owner is merged with the moved sketch
+	stale := ""
+	for i := 0; i < sketchCount && stale == ""; i++ {
+		if hasNode(cluster.NewRing(nodes).Owners(fmt.Sprintf("hllpp/sketch-%d", i), 2), nodes[2]) {
+			stale = fmt.Sprintf("sketch-%d", i)
+		}
+	}
+	if err := managers[2].CreateSketch(stale, "hllpp", nil); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	if err := managers[2].AddToSketch(stale, "hllpp", []string{"stale"}); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+
+	// Adding the third node moves sketches to it
+	resp = httpRequest(servers[0], t, "PUT", "cluster", `{"nodes": ["`+strings.Join(nodes, `", "`)+`"]}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	waitFor(t, "the sketches to move", placed)
+	held, _ := managers[2].GetSketches()
+	if len(held) == 0 {
+		t.Fatal("Expected the new node to hold sketches")
+	}
+	resp = httpRequest(servers[0], t, "GET", "hllpp/sketch-3", `{}`)
+	if v := unmarshalSketchResult(resp).Result.(float64); v != 2 {
+		t.Fatalf("Expected sketch-3 to have count 2 after moving, got %v", v)
+	}
+	resp = httpRequest(servers[2], t, "GET", "hllpp/"+stale, `{}`)
+	if v := unmarshalSketchResult(resp).Result.(float64); v != 3 {
+		t.Fatalf("Expected %s to have count 3 after merging the stale copy, got %v", stale, v)
+	}
+	// Each node stored exactly the sketches it holds
+	for n, store := range stores {
+		reloaded, err := sketches.NewManagerWithStorage(store)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		stored, _ := reloaded.GetSketches()
+		held, _ := managers[n].GetSketches()
+		reloaded.Destroy()
+		if strings.Join(stored, ",") != strings.Join(held, ",") {
+			t.Fatalf("Expected node %d to have stored %v, got %v", n, held, stored)
+		}
+	}
+
+	// Listings hold the sketches of all nodes once, paginated across nodes
+	seen := make(map[string]bool)
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		resp = httpRequest(servers[1], t, "GET", "sketches", `{"limit": 8, "cursor": "`+cursor+`"}`)
+		result := unmarshalSketchListResult(resp)
+		for _, entry := range result.Result {
+			if seen[entry.ID] {
+				t.Fatalf("Expected %s to be listed once", entry.ID)
+			}
+			seen[entry.ID] = true
+		}
+		if cursor = result.Next; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != sketchCount+1 {
+		t.Fatalf("Expected %d sketches in the listing, got %d", sketchCount+1, len(seen))
+	}
+	resp = httpRequest(servers[1], t, "GET", "", "")
+	if names := unmarshalSketchsResult(resp).Result; len(names) != sketchCount+1 {
+		t.Fatalf("Expected %d sketch names, got %d", sketchCount+1, len(names))
+	}
+
+	resp = httpRequest(servers[2], t, "POST", "domain/dc", `{"sketches": {"hllpp": {}}}`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+	resp = httpRequest(servers[0], t, "GET", "domain", "")
+	if !strings.Contains(resp.Body.String(), `"id":"dc"`) {
+		t.Fatalf("Expected domain dc in the listing, got %s", resp.Body.String())
+	}
+	// Sketches of domains are reachable through their own routes on all nodes
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("dc%d", i)
+		resp = httpRequest(servers[i%3], t, "POST", "domain/"+id, `{"sketches": {"hllpp": {}}}`)
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+		resp = httpRequest(servers[(i+1)%3], t, "PUT", "hllpp/"+id, `{"values": ["storm"]}`)
+		if resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+		for _, server := range servers {
+			resp = httpRequest(server, t, "GET", "hllpp/"+id, "")
+			if resp.Code != 200 || unmarshalSketchResult(resp).Result.(float64) != 1 {
+				t.Fatalf("Expected %s to have count 1, got %d - %s", id, resp.Code, resp.Body.String())
+			}
+		}
+	}
+	resp = httpRequest(servers[1], t, "GET", "cluster", "")
+	status := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	if len(status["nodes"].([]interface{})) != 3 || status["errors"].(float64) != 0 {
+		t.Fatalf("Expected a cluster of 3 nodes without errors, got %v", status)
+	}
+}
+
+func TestClusterFailures(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	defer func(backend string) { conf.Storage = backend }(conf.Storage)
+	conf.Storage = storage.MemoryBackend
+	storage.Close()
+
+	var s *Server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	// The other node never answers
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	store, err := storage.NewBackend(storage.MemoryBackend)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	manager, err := sketches.NewManagerWithStorage(store)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	defer manager.Destroy()
+	nodeConf := *conf
+	nodeConf.ClusterNodes = []string{ts.URL, hung.URL}
+	nodeConf.ClusterSelf = ts.URL
+	nodeConf.ClusterReplicas = 2
+	nodeConf.ClusterTimeout = 1
+	if s, err = newServer(manager, &nodeConf); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+
+	first := map[string]string{}
+	for i := 0; len(first) < 2 && i < 100; i++ {
+		id := fmt.Sprintf("sketch-%d", i)
+		first[s.cluster.owners("hllpp/" + id)[0]] = id
+	}
+	// Writes the other owner missed are reported
+	resp := httpRequest(s, t, "POST", "hllpp/"+first[ts.URL], `{}`)
+	if resp.Code != http.StatusMultiStatus || resp.Header().Get(failedOwnersHeader) != hung.URL {
+		t.Fatalf("Expected 207 naming the hung node, got %d - %v", resp.Code, resp.Header())
+	}
+	if _, err := manager.GetSketchInfo(first[ts.URL], "hllpp"); err != nil {
+		t.Error("Expected the sketch to be created locally, got", err)
+	}
+	// Forwarded requests time out
+	resp = httpRequest(s, t, "POST", "hllpp/"+first[hung.URL], `{}`)
+	if resp.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 forwarding to the hung node, got %d - %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestMultiMaster(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	// All nodes share the storage, keep it in memory
+	conf := config.GetConfig()
+	defer func(backend string) { conf.Storage = backend }(conf.Storage)
+	conf.Storage = storage.MemoryBackend
+	storage.Close()
+
+	var servers [3]*Server
+	var managers [3]*sketches.ManagerStruct
+	var nodes []string
+	for i := range servers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			servers[i].ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		nodes = append(nodes, ts.URL)
+		manager, err := sketches.NewManager()
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		defer manager.Destroy()
+		managers[i] = manager
+	}
+	for i := range servers {
+		nodeConf := *conf
+		nodeConf.MultiMasterPeers = nil
+		for n, node := range nodes {
+			if n != i {
+				nodeConf.MultiMasterPeers = append(nodeConf.MultiMasterPeers, node)
+			}
+		}
+		nodeConf.MultiMasterID = fmt.Sprintf("node-%d", i)
+		nodeConf.MultiMasterInterval = 1
+		server, err := newServer(managers[i], &nodeConf)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		defer server.syncer.stop()
+		servers[i] = server
+	}
+	request := func(n int, method string, sketch string, body string) {
+		if resp := httpRequest(servers[n], t, method, sketch, body); resp.Code != 200 {
+			t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+	counts := func(sketchType string, values []string) func(n int) interface{} {
+		return func(n int) interface{} {
+			res, err := managers[n].GetCountForSketch("heroes", sketchType, values)
+			if err != nil {
+				return err.Error()
+			}
+			return fmt.Sprint(res["result"])
+		}
+	}
+	converged := func(count func(n int) interface{}, expected string) func() bool {
+		return func() bool {
+			for n := range managers {
+				if count(n) != expected {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// Every node accepts writes, the sketches are merged
+	request(0, "POST", "hllpp/heroes", `{}`)
+	request(0, "POST", "dict/heroes", `{}`)
+	waitFor(t, "the sketches to be created on all nodes", converged(counts("dict", []string{"thor"}), "map[thor:0]"))
+	request(0, "PUT", "hllpp/heroes", `{"values": ["hulk", "thor"]}`)
+	request(1, "PUT", "hllpp/heroes", `{"values": ["thor", "loki"]}`)
+	request(2, "PUT", "hllpp/heroes", `{"values": ["wasp"]}`)
+	waitFor(t, "the hllpp sketches to converge", converged(counts("hllpp", nil), "4"))
+
+	request(0, "PUT", "dict/heroes", `{"values": ["thor", "thor", "thor"]}`)
+	request(1, "PUT", "dict/heroes", `{"values": ["thor", "thor"]}`)
+	waitFor(t, "the dicts to converge", converged(counts("dict", []string{"thor"}), "map[thor:5]"))
+	// Concurrent purges on two nodes both count
+	request(1, "PURGE", "dict/heroes", `{"values": ["thor"]}`)
+	request(2, "PURGE", "dict/heroes", `{"values": ["thor"]}`)
+	request(0, "PUT", "dict/heroes", `{"values": ["loki"]}`)
+	waitFor(t, "the purges to converge", converged(counts("dict", []string{"thor", "loki"}), "map[loki:1 thor:3]"))
+
+	// Sketches that can not converge are not created
+	if resp := httpRequest(servers[1], t, "POST", "cml/heroes", `{}`); resp.Code == 200 {
+		t.Fatal("Expected creating a cml sketch to fail in multi-master mode")
+	}
+
+	// Deletions reach all nodes
+	request(2, "DELETE", "hllpp/heroes", `{}`)
+	waitFor(t, "the deletion to reach all nodes", converged(counts("hllpp", nil), "No such sketch heroes of type hllpp found"))
+
+	resp := httpRequest(servers[0], t, "GET", "sync", "")
+	status := unmarshalSketchResult(resp).Result.(map[string]interface{})
+	peers := status["peers"].([]interface{})
+	if status["replica"] != "node-0" || len(peers) != 2 {
+		t.Fatalf("Expected node-0 to sync with 2 peers, got %v", status)
+	}
+	for _, peer := range peers {
+		if peer.(map[string]interface{})["errors"].(float64) != 0 {
+			t.Fatalf("Expected no errors syncing, got %v", peer)
+		}
+	}
 }
@@ -6,13 +6,17 @@ CML		=> Count-min-log sketch
 TopK	=> Top-K
 Dict  => dictionary
 Bloom => Bloom Filter
+Family => one sketch of an inner type per group key
+Rollup => one sketch of an inner type per time bucket
 */
 const (
-	HLLPP = "hllpp"
-	CML   = "cml"
-	TopK  = "topk"
-	Dict  = "dict"
-	Bloom = "bloom"
+	HLLPP  = "hllpp"
+	CML    = "cml"
+	TopK   = "topk"
+	Dict   = "dict"
+	Bloom  = "bloom"
+	Family = "family"
+	Rollup = "rollup"
 )
 
 /*
@@ -21,6 +25,7 @@ Sketch ...
 type Sketch interface {
 	Add([]byte) (bool, error)
 	AddMultiple([][]byte) (bool, error)
+	AddWeighted([]byte, int64) (bool, error)
 	Remove([]byte) (bool, error)
 	RemoveMultiple([][]byte) (bool, error)
 	GetCount() uint
@@ -30,11 +35,102 @@ type Sketch interface {
 }
 
 /*
-Info ...
+HashedSketch is implemented by sketches that hash values internally and can
+be fed already computed 64-bit hashes instead
+*/
+type HashedSketch interface {
+	AddHash(uint64) (bool, error)
+	GetFrequencyForHash(uint64) interface{}
+}
+
+/*
+MergeableSketch is implemented by sketches that can be merged with another
+sketch of the same type and shape
+*/
+type MergeableSketch interface {
+	Merge(Sketch) error
+}
+
+/*
+Query holds the optional parameters shaping the result of a sketch: N limits
+the result to the top n values, MinCount drops values counted less often and
+Guaranteed only keeps values whose rank is certain, Lookup returns the
+estimates of the given values instead. Prefix, Cursor and Limit page through
+the values of sketches storing them. Since and Until (unix seconds) select the
+time buckets of rollups, Series returns them one by one merged to Resolution.
+*/
+type Query struct {
+	N          int
+	MinCount   int
+	Guaranteed bool
+	Lookup     bool
+	Prefix     string
+	Cursor     string
+	Limit      int
+	Since      int64
+	Until      int64
+	Series     bool
+	Resolution string
+}
+
+/*
+QueriedSketch is implemented by sketches whose result can be shaped by a Query
+*/
+type QueriedSketch interface {
+	GetResult([][]byte, Query) interface{}
+}
+
+/*
+ExportableSketch is implemented by sketches whose serialized form does not
+hold all of their data (e.g. disk backed dicts), Export returns a serialized
+form holding everything that Unmarshal of the sketch type accepts
+*/
+type ExportableSketch interface {
+	Export() ([]byte, error)
+}
+
+/*
+CountingRemover is implemented by sketches that can tell how many of the
+values to remove were not found
+*/
+type CountingRemover interface {
+	RemoveAndCount([][]byte) (uint, error)
+}
+
+/*
+SizedSketch is implemented by sketches that take notably more memory than
+their serialized form, e.g. maps of values. MemorySize returns an estimate in
+bytes, other sketches take about the size of their serialized form.
+*/
+type SizedSketch interface {
+	MemorySize() uint64
+}
+
+/*
+Info describes a sketch. ExpiresAt (unix seconds) is when it is deleted, each
+write moves it TTL seconds ahead if ResetTTL is set.
 */
 type Info struct {
-	ID         string             `json:"id"`
-	Type       string             `json:"type"`
-	State      map[string]uint64  `json:"state"`
-	Properties map[string]float64 `json:"properties"`
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	State        map[string]uint64  `json:"state"`
+	Properties   map[string]float64 `json:"properties"`
+	LastModified int64              `json:"last_modified"`
+	InnerType    string             `json:"inner_type,omitempty"`
+	Hash         string             `json:"hash,omitempty"`
+	Seed         uint64             `json:"seed,omitempty"`
+	Compression  string             `json:"compression,omitempty"`
+	TTL          int64              `json:"ttl,omitempty"`
+	ExpiresAt    int64              `json:"expires_at,omitempty"`
+	ResetTTL     bool               `json:"reset_ttl,omitempty"`
+	Template     string             `json:"template,omitempty"`
+}
+
+/*
+Domain is a named group of sketches of different types sharing the same id,
+which are created, fed, listed and deleted as a unit
+*/
+type Domain struct {
+	ID    string   `json:"id"`
+	Types []string `json:"types"`
 }
@@ -0,0 +1,691 @@
+package sketches
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+/*
+Types of sketches that converge in multi-master mode: hllpp and bloom sketches
+are merged exactly (maximum of registers, union of bits) and dict counts are
+kept per replica. Count-min-log sketches increment at random and top-k sketches
+drop values, merging their replicas would not give the same state everywhere.
+*/
+var convergentTypes = []string{abstract.Bloom, abstract.Dict, abstract.HLLPP}
+
+/*
+Converges tells if replicas of sketches of the given type can be merged into
+the same state in any order
+*/
+func Converges(sketchType string) bool {
+	for _, typ := range convergentTypes {
+		if typ == sketchType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+PNCounter holds the increments (P) and decrements (N) of the values of a dict
+made by one replica. The count of a value is the sum of its increments of all
+replicas minus the sum of their decrements, counts below 0 show as 0.
+*/
+type PNCounter struct {
+	P map[string]uint64
+	N map[string]uint64
+}
+
+func newPNCounter() *PNCounter {
+	return &PNCounter{make(map[string]uint64), make(map[string]uint64)}
+}
+
+/*
+SyncState is the state of a sketch exchanged by multi-master peers. Deleted
+sketches only carry their creation and deletion time, a sketch is alive if it
+was created after it was last deleted.
+*/
+type SyncState struct {
+	ID       string
+	Type     string
+	Created  int64                 // unix nanoseconds, 0 if created before multi-master mode
+	Deleted  int64                 // unix nanoseconds, 0 if never deleted
+	Info     *abstract.Info        // nil for deleted sketches
+	Data     []byte                // hllpp and bloom, the data file of the sketch
+	Counters map[string]*PNCounter // dict, by replica
+}
+
+/*
+countTable is implemented by dict sketches
+*/
+type countTable interface {
+	Range(fn func(value string, count uint) bool) error
+	SetCount(value []byte, count uint) error
+}
+
+/*
+replicaRecord is what a multi-master node keeps about a sketch besides its
+data. Created and Deleted are guarded by the lock of the replica set, Counters
+by the lock of the sketch.
+*/
+type replicaRecord struct {
+	ID       string
+	Created  int64
+	Deleted  int64
+	Counters map[string]*PNCounter
+	version  uint64 // position in the changes of this node
+}
+
+/*
+alive tells if a sketch created at created survives a deletion at deleted
+*/
+func alive(created int64, deleted int64) bool {
+	return deleted == 0 || created > deleted
+}
+
+/*
+total returns the count of value summed over all replicas
+*/
+func (rec *replicaRecord) total(value string) int64 {
+	var total int64
+	for _, counter := range rec.Counters {
+		total += int64(counter.P[value]) - int64(counter.N[value])
+	}
+	return total
+}
+
+func visible(total int64) uint {
+	if total < 0 {
+		return 0
+	}
+	return uint(total)
+}
+
+/*
+reconcile accounts the difference between the counts of a dict and its
+counters to replica self, which makes the local writes since the last call
+part of the counters. The caller must hold the lock of the sketch.
+*/
+func (rec *replicaRecord) reconcile(table countTable, self string) error {
+	if rec.Counters == nil {
+		rec.Counters = make(map[string]*PNCounter)
+	}
+	own, ok := rec.Counters[self]
+	if !ok {
+		own = newPNCounter()
+		rec.Counters[self] = own
+	}
+	adjust := func(value string, count uint) {
+		total := rec.total(value)
+		if visible(total) == count {
+			return
+		}
+		if int64(count) > total {
+			own.P[value] += uint64(int64(count) - total)
+		} else {
+			own.N[value] += uint64(total - int64(count))
+		}
+	}
+
+	seen := make(map[string]bool)
+	err := table.Range(func(value string, count uint) bool {
+		seen[value] = true
+		adjust(value, count)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// Values dropped from the dict
+	for _, counter := range rec.Counters {
+		for value := range counter.P {
+			if !seen[value] {
+				seen[value] = true
+				adjust(value, 0)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+replicaSet keeps the records of all sketches of a multi-master node and
+numbers their changes, peers ask for the changes after the last one they saw
+*/
+type replicaSet struct {
+	self    string
+	epoch   int64 // changes when the node starts, the numbers start over
+	lock    sync.Mutex
+	version uint64
+	records map[string]*replicaRecord
+	dirty   map[string]bool // records to save
+}
+
+type recordsByVersion []*replicaRecord
+
+func (r recordsByVersion) Len() int           { return len(r) }
+func (r recordsByVersion) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r recordsByVersion) Less(i, j int) bool { return r[i].version < r[j].version }
+
+/*
+get returns the record of a sketch, the caller must hold the lock
+*/
+func (rs *replicaSet) get(id string) *replicaRecord {
+	rec, ok := rs.records[id]
+	if !ok {
+		rec = &replicaRecord{ID: id}
+		rs.records[id] = rec
+	}
+	return rec
+}
+
+/*
+bump marks a record as changed, the caller must hold the lock
+*/
+func (rs *replicaSet) bump(rec *replicaRecord) {
+	rs.version++
+	rec.version = rs.version
+	rs.dirty[rec.ID] = true
+}
+
+/*
+changed marks a sketch as changed locally, it does nothing without a replica
+set. Deleting a sketch drops its counters, a sketch changed after it was
+deleted is a new one.
+*/
+func (rs *replicaSet) changed(id string, deleted bool) {
+	if rs == nil {
+		return
+	}
+	if _, typ := splitID(id); !Converges(typ) {
+		return
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rec := rs.get(id)
+	now := time.Now().UnixNano()
+	if deleted {
+		// Deletions merged from peers already set the time
+		if alive(rec.Created, rec.Deleted) {
+			rec.Deleted = now
+		}
+		rec = &replicaRecord{ID: id, Created: rec.Created, Deleted: rec.Deleted}
+		rs.records[id] = rec
+	} else if !alive(rec.Created, rec.Deleted) {
+		rec.Created = now
+	}
+	rs.bump(rec)
+}
+
+/*
+splitID splits the internal id of a sketch into its name and type
+*/
+func splitID(id string) (string, string) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return id, ""
+	}
+	return id[:i], id[i+1:]
+}
+
+/*
+EnableMultiMaster makes the manager keep the replica state of its sketches
+under the name replica, which must be unique among the peers, and number their
+changes for SyncStates
+*/
+func (m *ManagerStruct) EnableMultiMaster(replica string) error {
+	if replica == "" {
+		return errors.New("Multi-master nodes need a replica name")
+	}
+	rs := &replicaSet{
+		self:    replica,
+		epoch:   time.Now().UnixNano(),
+		records: make(map[string]*replicaRecord),
+		dirty:   make(map[string]bool),
+	}
+	stored, err := m.store.LoadAllReplicas()
+	if err != nil {
+		return err
+	}
+	for _, data := range stored {
+		var rec replicaRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+			return fmt.Errorf("Error loading replica state: %s", err)
+		}
+		rs.records[rec.ID] = &rec
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id := range m.sketches {
+		if _, typ := splitID(id); Converges(typ) {
+			rs.get(id)
+		}
+	}
+	// Peers see everything as changed after a restart
+	for _, rec := range rs.records {
+		rs.bump(rec)
+	}
+	m.replicas = rs
+	return nil
+}
+
+/*
+SyncPosition returns the replica name of a multi-master node, the epoch of its
+change numbers and the number of its last change
+*/
+func (m *ManagerStruct) SyncPosition() (string, int64, uint64, error) {
+	rs := m.replicas
+	if rs == nil {
+		return "", 0, 0, errors.New("Multi-master mode is not enabled")
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.self, rs.epoch, rs.version, nil
+}
+
+/*
+SyncStates returns the states of up to max sketches changed after the change
+numbered after and the number of the last change they include. All changes
+are returned if epoch is not the current one.
+*/
+func (m *ManagerStruct) SyncStates(epoch int64, after uint64, max int) ([]*SyncState, uint64, error) {
+	rs := m.replicas
+	if rs == nil {
+		return nil, 0, errors.New("Multi-master mode is not enabled")
+	}
+	rs.lock.Lock()
+	if epoch != rs.epoch {
+		after = 0
+	}
+	var changed recordsByVersion
+	for _, rec := range rs.records {
+		if rec.version > after {
+			changed = append(changed, rec)
+		}
+	}
+	sort.Sort(changed)
+	last := rs.version
+	if max > 0 && len(changed) > max {
+		changed = changed[:max]
+		last = changed[max-1].version
+	}
+	states := make([]*SyncState, 0, len(changed))
+	for _, rec := range changed {
+		name, typ := splitID(rec.ID)
+		states = append(states, &SyncState{ID: name, Type: typ, Created: rec.Created, Deleted: rec.Deleted})
+	}
+	rs.lock.Unlock()
+
+	synced := states[:0]
+	for _, state := range states {
+		if !Converges(state.Type) {
+			continue
+		}
+		m.lock.RLock()
+		sketch := m.sketches[fmt.Sprintf("%s.%s", state.ID, state.Type)]
+		m.lock.RUnlock()
+		if sketch != nil {
+			if err := m.syncState(sketch, state); err != nil {
+				return nil, 0, err
+			}
+		}
+		synced = append(synced, state)
+	}
+	return synced, last, nil
+}
+
+/*
+syncState fills in the info and the data or counters of a live sketch
+*/
+func (m *ManagerStruct) syncState(sketch *SketchProxy, state *SyncState) error {
+	sketch.lock.Lock()
+	defer sketch.lock.Unlock()
+	if err := sketch.load(); err != nil {
+		return err
+	}
+	state.Info = opInfo(sketch.Info)
+	table, ok := sketch.sketch.(countTable)
+	if !ok {
+		data, err := sketch.encode(storage.CompressionSnappy)
+		state.Data = data
+		return err
+	}
+
+	m.replicas.lock.Lock()
+	rec := m.replicas.get(sketch.ID)
+	m.replicas.lock.Unlock()
+	if err := rec.reconcile(table, m.replicas.self); err != nil {
+		return err
+	}
+	state.Counters = make(map[string]*PNCounter, len(rec.Counters))
+	for replica, counter := range rec.Counters {
+		c := newPNCounter()
+		for value, n := range counter.P {
+			c.P[value] = n
+		}
+		for value, n := range counter.N {
+			c.N[value] = n
+		}
+		state.Counters[replica] = c
+	}
+	return nil
+}
+
+/*
+MergeSyncStates merges the states of sketches of a peer: deletions newer than
+a sketch delete it, sketches unknown so far are created and the others are
+merged. It returns the number of sketches that changed, sketches that can not
+be merged are skipped and reported in the error.
+*/
+func (m *ManagerStruct) MergeSyncStates(states []*SyncState) (int, error) {
+	if m.replicas == nil {
+		return 0, errors.New("Multi-master mode is not enabled")
+	}
+	defer m.hold()()
+	changed := 0
+	var failed []string
+	for _, state := range states {
+		ok, err := m.mergeSyncState(state)
+		if err != nil {
+			logger.Error.Printf("Error merging sketch %s of type %s: %s", state.ID, state.Type, err)
+			failed = append(failed, state.Type+"/"+state.ID)
+		}
+		if ok {
+			changed++
+		}
+	}
+	if len(failed) > 0 {
+		return changed, fmt.Errorf("Could not merge sketches %s", strings.Join(failed, ", "))
+	}
+	return changed, nil
+}
+
+func (m *ManagerStruct) mergeSyncState(state *SyncState) (bool, error) {
+	if !Converges(state.Type) {
+		return false, fmt.Errorf("Sketches of type %s do not converge", state.Type)
+	}
+	id := fmt.Sprintf("%s.%s", state.ID, state.Type)
+	rs := m.replicas
+
+	m.lock.Lock()
+	rs.lock.Lock()
+	rec := rs.get(id)
+	advanced := state.Deleted > rec.Deleted
+	if advanced {
+		rec.Deleted = state.Deleted
+	}
+	tombstone := rec.Deleted
+	deleted := !alive(rec.Created, rec.Deleted)
+	rs.lock.Unlock()
+	sketch, exists := m.sketches[id]
+	if advanced && exists && deleted {
+		if domain := m.domainOf(state.ID, state.Type); domain != nil {
+			m.lock.Unlock()
+			return false, fmt.Errorf("Sketch is part of domain %s", domain.ID)
+		}
+		// The peer might hold a sketch created after the deletion
+		if err := m.deleteSketch(state.ID, state.Type); err != nil {
+			m.lock.Unlock()
+			return false, err
+		}
+		exists = false
+	} else if advanced {
+		// Pass the deletion on to peers of this node
+		rs.lock.Lock()
+		rs.bump(rec)
+		rs.lock.Unlock()
+	}
+	if state.Info == nil || !alive(state.Created, tombstone) {
+		m.lock.Unlock()
+		return advanced, nil
+	}
+
+	if !exists {
+		var err error
+		if sketch, err = m.syncSketch(state); err != nil {
+			m.lock.Unlock()
+			return false, err
+		}
+		rs.lock.Lock()
+		rs.records[id] = &replicaRecord{ID: id, Created: state.Created, Deleted: tombstone}
+		rs.lock.Unlock()
+		m.lock.Unlock()
+		if state.Counters == nil {
+			m.recordState(sketch)
+			return true, nil
+		}
+	} else {
+		// Concurrent creations of the sketch are one sketch
+		rs.lock.Lock()
+		if state.Created > rec.Created {
+			rec.Created = state.Created
+			rs.dirty[id] = true
+		}
+		rs.lock.Unlock()
+		m.lock.Unlock()
+		if !sameHash(sketch.Info, state.Info) {
+			return false, errors.New("The sketches use different hash functions")
+		}
+	}
+
+	var changed bool
+	var err error
+	if state.Counters != nil {
+		changed, err = m.mergeCounters(sketch, state.Counters)
+	} else {
+		changed, err = sketch.mergeState(state.Info, state.Data)
+	}
+	if changed || !exists {
+		m.recordState(sketch)
+	}
+	return changed, err
+}
+
+/*
+syncSketch creates a sketch of a peer, dicts start empty and get their counts
+from the counters. The caller must hold the write lock.
+*/
+func (m *ManagerStruct) syncSketch(state *SyncState) (*SketchProxy, error) {
+	info := opInfo(state.Info)
+	info.ID = fmt.Sprintf("%s.%s", state.ID, state.Type)
+	info.State = make(map[string]uint64)
+	info.LastModified = time.Now().Unix()
+	var sketch *SketchProxy
+	var err error
+	if state.Counters != nil {
+		sketch, err = createSketch(m.store, info)
+	} else {
+		sketch, err = restoreSketch(m.store, info, state.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.addSketch(sketch)
+	return sketch, nil
+}
+
+/*
+mergeState merges the data file of a sketch of a peer, it returns whether the
+sketch changed
+*/
+func (sp *SketchProxy) mergeState(info *abstract.Info, data []byte) (bool, error) {
+	data, _, err := migrate(info, data)
+	if err != nil {
+		return false, err
+	}
+	// Only mergeable sketches get here, they are never disk backed
+	other, err := decodeSketch(nil, info, data)
+	if err != nil {
+		return false, err
+	}
+
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	mergeable, ok := sp.sketch.(abstract.MergeableSketch)
+	if !ok {
+		return false, fmt.Errorf("Sketches of type %s can not be merged", sp.Type)
+	}
+	before, err := exportSketch(sp.sketch)
+	if err != nil {
+		return false, err
+	}
+	if err := mergeable.Merge(other); err != nil {
+		return false, err
+	}
+	after, err := exportSketch(sp.sketch)
+	if err != nil || bytes.Equal(before, after) {
+		return false, err
+	}
+	sp.ops++
+	sp.touch()
+	sp.save(false)
+	return true, nil
+}
+
+/*
+mergeCounters merges the counters of a dict of a peer by taking the larger
+increments and decrements of each replica and sets the counts that changed
+*/
+func (m *ManagerStruct) mergeCounters(sketch *SketchProxy, counters map[string]*PNCounter) (bool, error) {
+	sketch.lock.Lock()
+	defer sketch.lock.Unlock()
+	if err := sketch.load(); err != nil {
+		return false, err
+	}
+	table, ok := sketch.sketch.(countTable)
+	if !ok {
+		return false, fmt.Errorf("Sketches of type %s have no counters", sketch.Type)
+	}
+	m.replicas.lock.Lock()
+	rec := m.replicas.get(sketch.ID)
+	m.replicas.lock.Unlock()
+	// Local writes count for this replica before the counts change
+	if err := rec.reconcile(table, m.replicas.self); err != nil {
+		return false, err
+	}
+
+	changed := make(map[string]bool)
+	for replica, counter := range counters {
+		own, ok := rec.Counters[replica]
+		if !ok {
+			own = newPNCounter()
+			rec.Counters[replica] = own
+		}
+		for value, n := range counter.P {
+			if n > own.P[value] {
+				own.P[value] = n
+				changed[value] = true
+			}
+		}
+		for value, n := range counter.N {
+			if n > own.N[value] {
+				own.N[value] = n
+				changed[value] = true
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return false, nil
+	}
+	for value := range changed {
+		if err := table.SetCount([]byte(value), visible(rec.total(value))); err != nil {
+			return false, err
+		}
+	}
+	sketch.ops++
+	sketch.touch()
+	sketch.save(false)
+	return true, nil
+}
+
+/*
+FlushReplicas saves the replica state of the sketches that changed since the
+last call, the data of changed dicts is saved first so it is never older than
+their counters
+*/
+func (m *ManagerStruct) FlushReplicas() error {
+	rs := m.replicas
+	if rs == nil {
+		return nil
+	}
+	rs.lock.Lock()
+	dirty := rs.dirty
+	rs.dirty = make(map[string]bool)
+	rs.lock.Unlock()
+
+	for id := range dirty {
+		if err := m.flushReplica(id); err != nil {
+			// Try again with the next flush
+			rs.lock.Lock()
+			rs.dirty[id] = true
+			rs.lock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ManagerStruct) flushReplica(id string) error {
+	m.lock.RLock()
+	sketch := m.sketches[id]
+	m.lock.RUnlock()
+	if sketch != nil {
+		sketch.lock.Lock()
+		defer sketch.lock.Unlock()
+	}
+
+	rs := m.replicas
+	rs.lock.Lock()
+	rec := rs.get(id)
+	stored := replicaRecord{ID: id, Created: rec.Created, Deleted: rec.Deleted}
+	rs.lock.Unlock()
+	if sketch != nil {
+		if err := sketch.load(); err != nil {
+			return err
+		}
+		if table, ok := sketch.sketch.(countTable); ok {
+			if err := rec.reconcile(table, rs.self); err != nil {
+				return err
+			}
+			stored.Counters = rec.Counters
+			sketch.save(true)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&stored); err != nil {
+		return err
+	}
+	return m.store.SaveReplicas(id, buf.Bytes())
+}
+
+/*
+UnsyncedSketches returns the sketches of a multi-master node that are not
+exchanged with its peers as "type/id", they were created before multi-master
+mode was enabled with a type that does not converge
+*/
+func (m *ManagerStruct) UnsyncedSketches() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	unsynced := []string{}
+	for _, info := range m.info {
+		if !Converges(info.Type) {
+			unsynced = append(unsynced, info.Type+"/"+sketchName(info))
+		}
+	}
+	sort.Strings(unsynced)
+	return unsynced
+}
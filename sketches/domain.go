@@ -0,0 +1,272 @@
+package sketches
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+/*
+CreateDomain creates a domain with one sketch per type in props, each sketch
+uses the domainID as id and the properties given for its type. Either all
+sketches are created or none.
+*/
+func (m *ManagerStruct) CreateDomain(domainID string, props map[string]map[string]float64) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.domains[domainID]; ok {
+		return fmt.Errorf("Domain %s already exists", domainID)
+	}
+	if len(props) == 0 {
+		return errors.New("No sketch types were given for domain " + domainID)
+	}
+
+	types := make([]string, 0, len(props))
+	for typ := range props {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	created := []string{}
+	for _, typ := range types {
+		sketchProps := props[typ]
+		if sketchProps == nil {
+			sketchProps = make(map[string]float64)
+		}
+		if _, err := m.createSketch(domainID, typ, sketchProps, SketchOptions{}); err != nil {
+			// Roll back the sketches created so far
+			for _, createdType := range created {
+				if err := m.deleteSketch(domainID, createdType); err != nil {
+					logger.Error.Println(err)
+				}
+			}
+			return err
+		}
+		created = append(created, typ)
+	}
+
+	domain := &abstract.Domain{ID: domainID, Types: types}
+	m.domains[domainID] = domain
+	m.oplog.append(&Op{Kind: OpCreateDomain, ID: domainID, Domain: domain})
+	return m.dumpDomain(domain)
+}
+
+/*
+DeleteDomain deletes a domain and all its sketches
+*/
+func (m *ManagerStruct) DeleteDomain(domainID string) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	domain, ok := m.domains[domainID]
+	if !ok {
+		return errors.New("No such domain " + domainID)
+	}
+	for _, typ := range domain.Types {
+		if err := m.deleteSketch(domainID, typ); err != nil {
+			logger.Error.Println(err)
+		}
+	}
+	delete(m.domains, domainID)
+	m.oplog.append(&Op{Kind: OpDeleteDomain, ID: domainID})
+	return m.store.DeleteDomain(domainID)
+}
+
+/*
+GetDomains returns all domains sorted by id
+*/
+func (m *ManagerStruct) GetDomains() ([]*abstract.Domain, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ids := make([]string, 0, len(m.domains))
+	for id := range m.domains {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	domains := make([]*abstract.Domain, len(ids), len(ids))
+	for i, id := range ids {
+		domains[i] = m.domains[id]
+	}
+	return domains, nil
+}
+
+/*
+AddToDomain adds values to all sketches of a domain. All sketches are loaded
+before any of them is written, a sketch failing after others took the values
+leaves them there and the error names them.
+*/
+func (m *ManagerStruct) AddToDomain(domainID string, values []string) error {
+	defer m.hold()()
+	sketches, err := m.getDomainSketches(domainID)
+	if err != nil {
+		return err
+	}
+	if err := checkDomainSketches(sketches, nil); err != nil {
+		return err
+	}
+
+	bytes := make([][]byte, len(values), len(values))
+	for i, value := range values {
+		bytes[i] = []byte(value)
+	}
+	return feedDomain(domainID, sketches, func(sketch *SketchProxy) error {
+		op := &Op{Kind: OpAdd, ID: domainID, Type: sketch.Type, Values: values}
+		_, err := sketch.Add(bytes, op)
+		return err
+	})
+}
+
+/*
+AddWeightedToDomain adds each value with its count to all sketches of a
+domain, sketches which do not count values add them once. The counts have to
+suit every sketch of the domain, only dicts take negative counts.
+*/
+func (m *ManagerStruct) AddWeightedToDomain(domainID string, values []WeightedValue) error {
+	defer m.hold()()
+	sketches, err := m.getDomainSketches(domainID)
+	if err != nil {
+		return err
+	}
+	if err := checkDomainSketches(sketches, values); err != nil {
+		return err
+	}
+	return feedDomain(domainID, sketches, func(sketch *SketchProxy) error {
+		op := &Op{Kind: OpAddWeighted, ID: domainID, Type: sketch.Type, Weighted: values}
+		_, err := sketch.AddWeighted(values, op)
+		return err
+	})
+}
+
+/*
+checkDomainSketches loads all sketches of a domain and checks the counts of
+weighted values against each of them, so a sketch that can not be read or
+take the counts fails the write before any sketch took it
+*/
+func checkDomainSketches(sketches []*SketchProxy, weighted []WeightedValue) error {
+	for _, sketch := range sketches {
+		if err := sketch.ready(); err != nil {
+			return err
+		}
+		if err := checkWeights(sketch.Type, weighted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+feedDomain applies add to the sketches of a domain in order and stops at the
+first error, which names the sketches that were already written
+*/
+func feedDomain(domainID string, sketches []*SketchProxy, add func(*SketchProxy) error) error {
+	written := []string{}
+	for _, sketch := range sketches {
+		if err := add(sketch); err != nil {
+			if len(written) == 0 {
+				return err
+			}
+			return fmt.Errorf("Adding to %s of domain %s failed after %s took the values: %v",
+				sketch.Type, domainID, strings.Join(written, ", "), err)
+		}
+		written = append(written, sketch.Type)
+	}
+	return nil
+}
+
+/*
+GetCountForDomain returns the result of each sketch of a domain by type
+*/
+func (m *ManagerStruct) GetCountForDomain(domainID string, values []string) (map[string]interface{}, error) {
+	sketches, err := m.getDomainSketches(domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	for _, sketch := range sketches {
+		result[sketch.Type] = sketch.Count(values)
+	}
+	return result, nil
+}
+
+func (m *ManagerStruct) getDomainSketches(domainID string) ([]*SketchProxy, error) {
+	m.lock.RLock()
+	domain, ok := m.domains[domainID]
+	if !ok {
+		m.lock.RUnlock()
+		return nil, errors.New("No such domain " + domainID)
+	}
+	sketches := make([]*SketchProxy, len(domain.Types), len(domain.Types))
+	for i, typ := range domain.Types {
+		id := fmt.Sprintf("%s.%s", domainID, typ)
+		sketch, ok := m.sketches[id]
+		if !ok {
+			m.lock.RUnlock()
+			return nil, fmt.Errorf("No such sketch %s of type %s found in domain %s", domainID, typ, domainID)
+		}
+		sketches[i] = sketch
+	}
+	m.lock.RUnlock()
+
+	for _, sketch := range sketches {
+		m.memory.use(sketch)
+	}
+	return sketches, nil
+}
+
+/*
+InDomain returns true if the sketch is part of a domain
+*/
+func (m *ManagerStruct) InDomain(sketchID string, sketchType string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.domainOf(sketchID, sketchType) != nil
+}
+
+/*
+domainOf returns the domain the sketch is part of, or nil
+*/
+func (m *ManagerStruct) domainOf(sketchID string, sketchType string) *abstract.Domain {
+	domain, ok := m.domains[sketchID]
+	if !ok {
+		return nil
+	}
+	for _, typ := range domain.Types {
+		if typ == sketchType {
+			return domain
+		}
+	}
+	return nil
+}
+
+func (m *ManagerStruct) dumpDomain(domain *abstract.Domain) error {
+	domainData, err := json.Marshal(domain)
+	if err != nil {
+		return err
+	}
+	return m.store.SaveDomain(domain.ID, domainData)
+}
+
+func (m *ManagerStruct) loadDomains() error {
+	domains, err := m.store.LoadAllDomains()
+	if err != nil {
+		return err
+	}
+	for _, domainData := range domains {
+		var domain abstract.Domain
+		if err := json.Unmarshal(domainData, &domain); err != nil {
+			return err
+		}
+		m.domains[domain.ID] = &domain
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package sketches
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+func TestDomain(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	props := map[string]map[string]float64{
+		abstract.HLLPP: nil,
+		abstract.TopK:  {"capacity": 10},
+		abstract.CML:   nil,
+	}
+	if err := m1.CreateDomain("marvel", props); err != nil {
+		t.Fatal("Expected no errors while creating domain, got", err)
+	}
+	if err := m1.CreateDomain("marvel", props); err == nil {
+		t.Error("Expected error while creating duplicate domain, got", err)
+	}
+
+	sketches, _ := m1.GetSketches()
+	if len(sketches) != 3 {
+		t.Error("Expected 3 sketches, got", len(sketches))
+	}
+
+	err = m1.AddToDomain("marvel", []string{"hulk", "thor", "hulk"})
+	if err != nil {
+		t.Error("Expected no errors while adding to domain, got", err)
+	}
+	res, err := m1.GetCountForDomain("marvel", []string{"hulk"})
+	if err != nil {
+		t.Error("Expected no errors while counting domain, got", err)
+	}
+	hll := res[abstract.HLLPP].(map[string]interface{})["result"].(uint)
+	if hll != 2 {
+		t.Error("Expected cardinality 2, got", hll)
+	}
+	freq := res[abstract.CML].(map[string]interface{})["result"].(map[string]uint)
+	if freq["hulk"] != 2 {
+		t.Error("Expected hulk count 2, got", freq["hulk"])
+	}
+
+	if err := m1.DeleteSketch("marvel", abstract.TopK); err == nil {
+		t.Error("Expected error deleting sketch that is part of a domain, got", err)
+	}
+
+	// Domains are reloaded from the info DB
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	domains, _ := m2.GetDomains()
+	if len(domains) != 1 || len(domains[0].Types) != 3 {
+		t.Fatal("Expected 1 domain with 3 types, got", domains)
+	}
+
+	if err := m2.DeleteDomain("marvel"); err != nil {
+		t.Error("Expected no errors while deleting domain, got", err)
+	}
+	sketches, _ = m2.GetSketches()
+	if len(sketches) != 0 {
+		t.Error("Expected 0 sketches, got", len(sketches))
+	}
+}
+
+func TestDomainRollback(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	props := map[string]map[string]float64{
+		abstract.HLLPP: nil,
+		"wrong":        nil,
+	}
+	if err := m1.CreateDomain("marvel", props); err == nil {
+		t.Error("Expected error while creating domain with invalid type, got", err)
+	}
+	sketches, _ := m1.GetSketches()
+	if len(sketches) != 0 {
+		t.Error("Expected 0 sketches, got", len(sketches))
+	}
+}
+
+func TestDomainFailingAdd(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	props := map[string]map[string]float64{
+		abstract.HLLPP: nil,
+		abstract.TopK:  {"capacity": 10},
+		abstract.CML:   nil,
+	}
+	if err := m1.CreateDomain("marvel", props); err != nil {
+		t.Fatal("Expected no errors while creating domain, got", err)
+	}
+	if err := m1.AddToDomain("avengers", []string{"hulk"}); err == nil {
+		t.Error("Expected error adding to missing domain, got", err)
+	}
+
+	// Sketches are written in the order of their types, the topk comes last
+	topk := m1.sketches["marvel."+abstract.TopK]
+	topk.sketch = failingSketch{topk.sketch}
+	err = m1.AddToDomain("marvel", []string{"hulk"})
+	if err == nil || !strings.Contains(err.Error(), "after cml, hllpp took the values") {
+		t.Error("Expected error naming the written sketches, got", err)
+	}
+}
+
+func TestDomainWeighted(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	if err := m1.CreateDomain("marvel", map[string]map[string]float64{abstract.Dict: nil}); err != nil {
+		t.Fatal("Expected no errors while creating domain, got", err)
+	}
+	values := []WeightedValue{{"hulk", 3}, {"thor", 1}}
+	if err := m1.AddWeightedToDomain("marvel", values); err != nil {
+		t.Error("Expected no errors while adding to domain, got", err)
+	}
+	// Dicts take negative counts like they do on their own
+	if err := m1.AddWeightedToDomain("marvel", []WeightedValue{{"hulk", -1}}); err != nil {
+		t.Error("Expected no errors while adding negative count to dict domain, got", err)
+	}
+	res, err := m1.GetCountForDomain("marvel", []string{"hulk"})
+	if err != nil {
+		t.Error("Expected no errors while counting domain, got", err)
+	}
+	if v := res[abstract.Dict].(map[string]interface{})["result"].(map[string]uint)["hulk"]; v != 2 {
+		t.Error("Expected hulk count 2, got", v)
+	}
+
+	props := map[string]map[string]float64{
+		abstract.Dict:  nil,
+		abstract.HLLPP: nil,
+	}
+	if err := m1.CreateDomain("avengers", props); err != nil {
+		t.Fatal("Expected no errors while creating domain, got", err)
+	}
+	// The hllpp rejects the negative count before the dict takes it
+	if err := m1.AddWeightedToDomain("avengers", []WeightedValue{{"hulk", -1}}); err == nil {
+		t.Error("Expected error adding negative count to hllpp domain, got", err)
+	}
+	sketch := m1.sketches["avengers."+abstract.Dict]
+	if adds := sketch.State["adds"]; adds != 0 {
+		t.Error("Expected no adds to the dict, got", adds)
+	}
+}
@@ -0,0 +1,184 @@
+package sketches
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+/*
+reaper deletes the expired sketches of a manager and ages its rollups every
+interval
+*/
+type reaper struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+/*
+expiry returns when a sketch created (or written with resetTTL) at now expires
+for the given ttl and expiresAt, or 0 if it never does. An explicit expiresAt
+wins over the ttl.
+*/
+func expiry(ttl int64, expiresAt int64, resetTTL bool, now int64) (int64, error) {
+	if ttl < 0 || expiresAt < 0 {
+		return 0, errors.New("TTL and expiry time must not be negative")
+	}
+	if resetTTL && ttl == 0 {
+		return 0, errors.New("Resetting the TTL on writes needs a TTL")
+	}
+	if expiresAt != 0 {
+		return expiresAt, nil
+	}
+	if ttl != 0 {
+		return now + ttl, nil
+	}
+	return 0, nil
+}
+
+/*
+SetExpiry changes when a sketch expires, ttl counts from now (e.g. to extend
+it) unless expiresAt is set. A sketch with neither is kept forever.
+*/
+func (m *ManagerStruct) SetExpiry(sketchID string, sketchType string, ttl int64, expiresAt int64, resetTTL bool) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	sketch, ok := m.sketches[id]
+	if !ok {
+		return fmt.Errorf("No such sketch %s of type %s found", sketchID, sketchType)
+	}
+	if domain := m.domainOf(sketchID, sketchType); domain != nil {
+		return fmt.Errorf("Sketch %s of type %s is part of domain %s and can not expire", sketchID, sketchType, domain.ID)
+	}
+	expires, err := expiry(ttl, expiresAt, resetTTL, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	sketch.lock.Lock()
+	sketch.TTL, sketch.ExpiresAt, sketch.ResetTTL = ttl, expires, resetTTL
+	m.record(&Op{Kind: OpExpire, ID: sketchID, Type: sketchType, Info: opInfo(sketch.Info)})
+	data, err := json.Marshal(sketch.Info)
+	sketch.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.store.SaveInfo(id, data)
+}
+
+/*
+expired returns the sketches that expired by now, sketches of domains are
+deleted with their domain only
+*/
+func (m *ManagerStruct) expired(now int64) []*SketchProxy {
+	expired := []*SketchProxy{}
+	for _, sketch := range m.sketches {
+		sketch.lock.RLock()
+		expiresAt := sketch.ExpiresAt
+		sketch.lock.RUnlock()
+		if expiresAt == 0 || expiresAt > now {
+			continue
+		}
+		if m.domainOf(sketchName(sketch.Info), sketch.Type) != nil {
+			continue
+		}
+		expired = append(expired, sketch)
+	}
+	return expired
+}
+
+/*
+ReapExpired deletes the sketches (their info and data) that expired by now and
+returns how many were deleted
+*/
+func (m *ManagerStruct) ReapExpired(now time.Time) int {
+	// Most runs find nothing, so look without blocking writes first
+	m.lock.RLock()
+	found := len(m.expired(now.Unix())) > 0
+	m.lock.RUnlock()
+	if !found {
+		return 0
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	deleted := 0
+	for _, sketch := range m.expired(now.Unix()) {
+		if err := m.deleteSketch(sketchName(sketch.Info), sketch.Type); err != nil {
+			logger.Error.Printf("Error deleting expired sketch %s: %v", sketch.ID, err)
+			continue
+		}
+		logger.Info.Printf("Deleted expired sketch %s", sketch.ID)
+		deleted++
+	}
+	return deleted
+}
+
+/*
+AgeRollups merges and drops the buckets of all rollup sketches that fell out of
+their retention by now. Reads leave the buckets as they are, so rollups that are
+not written age here.
+*/
+func (m *ManagerStruct) AgeRollups(now time.Time) {
+	defer m.hold()()
+	m.lock.RLock()
+	rollups := []*SketchProxy{}
+	for _, sketch := range m.sketches {
+		if sketch.Type == abstract.Rollup {
+			rollups = append(rollups, sketch)
+		}
+	}
+	m.lock.RUnlock()
+	for _, sketch := range rollups {
+		if err := sketch.age(now); err != nil {
+			logger.Error.Printf("Error aging rollup %s: %v", sketch.ID, err)
+		}
+	}
+}
+
+/*
+StartReaper deletes expired sketches and ages rollups every interval until
+StopReaper is called
+*/
+func (m *ManagerStruct) StartReaper(interval time.Duration) {
+	m.StopReaper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &reaper{cancel, make(chan struct{})}
+	m.lock.Lock()
+	m.reaper = r
+	m.lock.Unlock()
+	go func() {
+		defer close(r.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+				m.ReapExpired(time.Now())
+				m.AgeRollups(time.Now())
+			}
+		}
+	}()
+}
+
+/*
+StopReaper stops deleting expired sketches and waits for the current run
+*/
+func (m *ManagerStruct) StopReaper() {
+	m.lock.Lock()
+	r := m.reaper
+	m.reaper = nil
+	m.lock.Unlock()
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
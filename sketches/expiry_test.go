@@ -0,0 +1,113 @@
+package sketches
+
+import (
+	"testing"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+func TestExpiry(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	m1, err := newManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	now := time.Now()
+
+	if err := m1.CreateSketchWithOptions("daily", abstract.HLLPP, nil, SketchOptions{TTL: -1}); err == nil {
+		t.Error("Expected error creating sketch with a negative TTL, got", err)
+	}
+	if err := m1.CreateSketchWithOptions("daily", abstract.HLLPP, nil, SketchOptions{ResetTTL: true}); err == nil {
+		t.Error("Expected error resetting the TTL of sketch without one, got", err)
+	}
+	if err := m1.CreateSketchWithOptions("daily", abstract.HLLPP, nil, SketchOptions{TTL: 3600}); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	campaign := now.Add(2 * time.Hour).Unix()
+	if err := m1.CreateSketchWithOptions("campaign", abstract.CML, nil, SketchOptions{ExpiresAt: campaign}); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	if err := m1.CreateSketchWithOptions("active", abstract.Dict, nil, SketchOptions{TTL: 3600, ResetTTL: true}); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	if err := m1.CreateSketch("forever", abstract.Bloom, nil); err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+
+	entries, _, err := m1.ListSketches("", "", "", 0)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	for _, entry := range entries {
+		expected := int64(0)
+		switch entry.ID {
+		case "daily", "active":
+			expected = entry.LastModified + 3600
+		case "campaign":
+			expected = campaign
+		}
+		if entry.ExpiresAt != expected {
+			t.Errorf("Expected %s to expire at %d, got %d", entry.ID, expected, entry.ExpiresAt)
+		}
+	}
+
+	// Writes only move the expiry of sketches resetting their TTL
+	if err := m1.SetExpiry("active", abstract.Dict, 3600, now.Unix()+3000, true); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if err := m1.AddToSketch("active", abstract.Dict, []string{"a"}); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if info, _ := m1.GetSketchInfo("active", abstract.Dict); info.ExpiresAt != info.LastModified+3600 {
+		t.Errorf("Expected the TTL of active to be reset by the write, got %d", info.ExpiresAt-info.LastModified)
+	}
+	if err := m1.AddToSketch("daily", abstract.HLLPP, []string{"a"}); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if info, _ := m1.GetSketchInfo("daily", abstract.HLLPP); info.ExpiresAt > now.Unix()+3600 {
+		t.Error("Expected the TTL of daily not to be reset by the write")
+	}
+
+	if n := m1.ReapExpired(now); n != 0 {
+		t.Error("Expected no expired sketches, got", n)
+	}
+	daily := m1.sketches["daily.hllpp"]
+	if n := m1.ReapExpired(now.Add(90 * time.Minute)); n != 2 {
+		t.Error("Expected 2 expired sketches, got", n)
+	}
+	// Unsaved changes of reaped sketches are not saved afterwards
+	daily.lock.Lock()
+	if !daily.closed() {
+		t.Error("Expected the reaped sketch to be closed")
+	}
+	daily.dirty = true
+	daily.save(true)
+	daily.lock.Unlock()
+	if err := m1.SetExpiry("campaign", abstract.CML, 86400, 0, false); err != nil {
+		t.Error("Expected no errors extending the TTL, got", err)
+	}
+	if err := m1.SetExpiry("forever", abstract.Bloom, 0, 0, true); err == nil {
+		t.Error("Expected error resetting the TTL of sketch without one, got", err)
+	}
+	if err := m1.SetExpiry("daily", abstract.HLLPP, 60, 0, false); err == nil {
+		t.Error("Expected error setting the expiry of an expired sketch, got", err)
+	}
+	if n := m1.ReapExpired(now.Add(3 * time.Hour)); n != 0 {
+		t.Error("Expected the extended sketch not to expire, got", n)
+	}
+
+	// Expired sketches are gone from storage, extended ones expire later
+	m2, err := newManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	sketches, _ := m2.GetSketches()
+	if len(sketches) != 2 || sketches[0] != "bloom/forever" || sketches[1] != "cml/campaign" {
+		t.Error("Expected bloom/forever and cml/campaign to be left, got", sketches)
+	}
+	if info, err := m2.GetSketchInfo("campaign", abstract.CML); err != nil || info.ExpiresAt < now.Unix()+86400 {
+		t.Error("Expected the extended expiry of campaign to be saved, got", info, err)
+	}
+}
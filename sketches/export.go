@@ -0,0 +1,220 @@
+package sketches
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/seiflotfy/skizze/config"
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
+	"github.com/seiflotfy/skizze/sketches/wrappers/hllpp"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+/*
+ExportSketch returns a portable copy of a sketch: a data file holding its type,
+hash function, properties and all of its data. The data is not compressed so
+other tools only need to understand the envelope and the sketch format.
+*/
+func (m *ManagerStruct) ExportSketch(sketchID string, sketchType string) ([]byte, error) {
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return nil, err
+	}
+	sketch.lock.Lock()
+	defer sketch.lock.Unlock()
+	data, err := sketch.encode(storage.CompressionNone)
+	if err != nil {
+		return nil, fmt.Errorf("Error exporting sketch %s: %s", sketchID, err)
+	}
+	return data, nil
+}
+
+/*
+ImportSketch creates a sketch from data written by ExportSketch, or merges it
+into the sketch if it already exists. It returns whether the data was merged.
+New sketches are validated like created ones and get the compression and
+expiry of opts, the rest of their options comes from data.
+*/
+func (m *ManagerStruct) ImportSketch(sketchID string, sketchType string, data []byte, opts SketchOptions) (bool, error) {
+	info, err := importInfo(sketchID, sketchType, data)
+	if err != nil {
+		return false, err
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing, ok := m.sketches[info.ID]; ok {
+		if err := mergeSnapshot(existing, info, data); err != nil {
+			return false, err
+		}
+		m.recordState(existing)
+		return true, nil
+	}
+	opts.InnerType, opts.Hash, opts.Seed = info.InnerType, info.Hash, info.Seed
+	if info, err = m.newInfo(sketchID, sketchType, info.Properties, opts); err != nil {
+		return false, err
+	}
+	sketch, err := restoreSketch(m.store, info, data)
+	if err != nil {
+		return false, err
+	}
+	m.addSketch(sketch)
+	m.recordState(sketch)
+	return false, nil
+}
+
+/*
+importInfo builds the info of an imported sketch from the header of its data
+*/
+func importInfo(sketchID string, sketchType string, data []byte) (*abstract.Info, error) {
+	if sketchType == "" {
+		return nil, errors.New("No sketch type was given!")
+	}
+	header, _, err := storage.Unwrap(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sketch export: %s", err)
+	}
+	if header.Type != sketchType {
+		return nil, fmt.Errorf("Export holds a sketch of type %s, expected %s", header.Type, sketchType)
+	}
+	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	if len([]byte(id)) > config.MaxKeySize {
+		return nil, fmt.Errorf("Invalid length of sketch ID: %d. Max length allowed: %d", len(id), config.MaxKeySize)
+	}
+	props := header.Properties
+	if props == nil {
+		props = make(map[string]float64)
+	}
+	return &abstract.Info{ID: id,
+		Type:         sketchType,
+		Properties:   props,
+		State:        make(map[string]uint64),
+		LastModified: time.Now().Unix(),
+		InnerType:    header.InnerType,
+		Hash:         header.Hash,
+		Seed:         header.Seed}, nil
+}
+
+/*
+Formats of other tools sketches can be exported to and imported from
+*/
+const (
+	FormatRedis = "redis"
+)
+
+/*
+format converts sketches of one type to and from the format of another tool,
+lossy allows conversions which lose precision or can not be merged reliably
+*/
+type format struct {
+	sketchType string
+	// setup sets the properties of sketches created from the format
+	setup  func(info *abstract.Info)
+	encode func(sketch abstract.Sketch, lossy bool) ([]byte, error)
+	decode func(info *abstract.Info, data []byte, lossy bool) (abstract.Sketch, error)
+}
+
+var formats = map[string]format{
+	// Redis HyperLogLogs as returned by GET and accepted by SET
+	FormatRedis: {
+		sketchType: abstract.HLLPP,
+		setup: func(info *abstract.Info) {
+			info.Properties["precision"] = hllpp.RedisPrecision
+			info.Hash = hashing.Redis
+		},
+		encode: func(sketch abstract.Sketch, lossy bool) ([]byte, error) {
+			return sketch.(*hllpp.Sketch).MarshalRedis(lossy)
+		},
+		decode: func(info *abstract.Info, data []byte, lossy bool) (abstract.Sketch, error) {
+			sketch, err := hllpp.UnmarshalRedis(info, data, lossy)
+			if err != nil {
+				return nil, err
+			}
+			return sketch, nil
+		},
+	},
+}
+
+func getFormat(name string, sketchType string) (format, error) {
+	f, ok := formats[name]
+	if !ok {
+		return f, fmt.Errorf("Unknown format %s", name)
+	}
+	if f.sketchType != sketchType {
+		return f, fmt.Errorf("Format %s only holds sketches of type %s", name, f.sketchType)
+	}
+	return f, nil
+}
+
+/*
+ExportSketchFormat returns a sketch in the format of another tool
+*/
+func (m *ManagerStruct) ExportSketchFormat(sketchID string, sketchType string, formatName string, lossy bool) ([]byte, error) {
+	f, err := getFormat(formatName, sketchType)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return nil, err
+	}
+	sketch.lock.Lock()
+	defer sketch.lock.Unlock()
+	if err := sketch.load(); err != nil {
+		return nil, err
+	}
+	return f.encode(sketch.sketch, lossy)
+}
+
+/*
+ImportSketchFormat creates a sketch from data in the format of another tool,
+or merges it into the sketch if it already exists. It returns whether the
+data was merged. New sketches are validated like created ones and get the
+compression and expiry of opts.
+*/
+func (m *ManagerStruct) ImportSketchFormat(sketchID string, sketchType string, formatName string, data []byte, lossy bool, opts SketchOptions) (bool, error) {
+	f, err := getFormat(formatName, sketchType)
+	if err != nil {
+		return false, err
+	}
+	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	if len([]byte(id)) > config.MaxKeySize {
+		return false, fmt.Errorf("Invalid length of sketch ID: %d. Max length allowed: %d", len(id), config.MaxKeySize)
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing, ok := m.sketches[id]; ok {
+		sketch, err := f.decode(existing.Info, data, lossy)
+		if err != nil {
+			return false, err
+		}
+		if _, err := existing.mergeSketch(sketch, 0); err != nil {
+			return false, err
+		}
+		m.recordState(existing)
+		return true, nil
+	}
+
+	info := &abstract.Info{Properties: make(map[string]float64)}
+	f.setup(info)
+	opts.InnerType, opts.Hash, opts.Seed = info.InnerType, info.Hash, info.Seed
+	if info, err = m.newInfo(sketchID, sketchType, info.Properties, opts); err != nil {
+		return false, err
+	}
+	sketch, err := f.decode(info, data, lossy)
+	if err != nil {
+		return false, err
+	}
+	sp, err := storeSketch(m.store, info, sketch)
+	if err != nil {
+		return false, err
+	}
+	m.addSketch(sp)
+	m.recordState(sp)
+	return false, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -22,170 +23,832 @@ SketchProxy ...
 */
 type SketchProxy struct {
 	*abstract.Info
-	sketch abstract.Sketch
+	sketch abstract.Sketch // nil while the sketch is evicted from memory
 	lock   sync.RWMutex
 	ops    uint
 	dirty  bool
+	memory *memoryTracker
+	store  storage.Backend
+	stop   chan struct{} // closed with the sketch, stops saving it
+
+	// recorder records the operation of a write in the operation log, it is
+	// called with the lock held so writes are recorded in the order they ran
+	recorder func(sp *SketchProxy, op *Op)
+	pending  *Op // OpSet of the sketch in the operation log not read yet
 }
 
 /*
-Add ...
+Add adds values, op is recorded if it succeeds
 */
-func (sp *SketchProxy) Add(values [][]byte) (bool, error) {
+func (sp *SketchProxy) Add(values [][]byte, op *Op) (bool, error) {
 	sp.lock.Lock()
 	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
 	sp.ops++
-	sp.Properties["adds"]++
-	sp.dirty = true
+	sp.State["adds"]++
+	sp.touch()
 	defer sp.save(false)
-	return sp.sketch.AddMultiple(values)
+	ok, err := sp.sketch.AddMultiple(values)
+	sp.record(op, err)
+	return ok, err
 }
 
 /*
-Remove ...
+AddWeighted adds each value with its count, op is recorded if it succeeds.
+Counts the sketch type never takes fail the write before any value is added.
 */
-func (sp *SketchProxy) Remove(values [][]byte) (bool, error) {
+func (sp *SketchProxy) AddWeighted(values []WeightedValue, op *Op) (bool, error) {
 	sp.lock.Lock()
 	defer sp.lock.Unlock()
-	sp.Properties["remove"]++
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	if err := checkWeights(sp.Type, values); err != nil {
+		return false, err
+	}
 	sp.ops++
-	sp.dirty = true
+	sp.State["adds"]++
+	sp.touch()
 	defer sp.save(false)
-	return sp.sketch.RemoveMultiple(values)
+	for i, value := range values {
+		if ok, err := sp.sketch.AddWeighted([]byte(value.Value), value.Count); !ok || err != nil {
+			sp.recordPartial(i)
+			return ok, err
+		}
+	}
+	sp.record(op, nil)
+	return true, nil
 }
 
 /*
-Count ...
+AddHashes adds already computed 64-bit hashes, sketches that do not hash
+values internally get the 8 bytes of each hash as value. op is recorded if it
+succeeds.
 */
-func (sp *SketchProxy) Count(values []string) map[string]interface{} {
+func (sp *SketchProxy) AddHashes(hashes []uint64, op *Op) (bool, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	sp.ops++
+	sp.State["adds"]++
+	sp.touch()
+	defer sp.save(false)
+	hashed, ok := sp.sketch.(abstract.HashedSketch)
+	if !ok {
+		values := make([][]byte, len(hashes), len(hashes))
+		for i, hash := range hashes {
+			values[i] = hashBytes(hash)
+		}
+		ok, err := sp.sketch.AddMultiple(values)
+		sp.record(op, err)
+		return ok, err
+	}
+	for i, hash := range hashes {
+		if ok, err := hashed.AddHash(hash); !ok || err != nil {
+			sp.recordPartial(i)
+			return ok, err
+		}
+	}
+	sp.record(op, nil)
+	return true, nil
+}
+
+/*
+CountHashes is like Count for already computed 64-bit hashes, the result is
+keyed by the values the hashes were sent as
+*/
+func (sp *SketchProxy) CountHashes(values []string, hashes []uint64) map[string]interface{} {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
 	result := make(map[string]interface{})
 	result["info"] = sp.Info.Properties
-	if sp.Type == abstract.CML {
-		bvalues := make([][]byte, len(values), len(values))
-		for i, value := range values {
-			bvalues[i] = []byte(value)
-		}
-		result["result"] = sp.sketch.GetFrequency(bvalues)
-		return result
-	} else if sp.Type == abstract.TopK {
-		result["result"] = sp.sketch.GetFrequency(nil)
+	if err := sp.load(); err != nil {
+		logger.Error.Println(err)
 		return result
-	} else if sp.Type == abstract.Bloom {
-		bvalues := make([][]byte, len(values), len(values))
-		for i, value := range values {
-			bvalues[i] = []byte(value)
+	}
+	hashed, ok := sp.sketch.(abstract.HashedSketch)
+	if ok && (sp.Type == abstract.CML || sp.Type == abstract.Bloom) {
+		res := make(map[string]interface{})
+		for i, hash := range hashes {
+			res[values[i]] = hashed.GetFrequencyForHash(hash)
 		}
-		result["result"] = sp.sketch.GetFrequency(bvalues)
+		result["result"] = res
+		return result
+	}
+	bvalues := make([]string, len(hashes), len(hashes))
+	for i, hash := range hashes {
+		bvalues[i] = string(hashBytes(hash))
+	}
+	result["result"] = getResult(sp.Type, sp.sketch, bvalues, abstract.Query{})
+	return result
+}
+
+/*
+Remove removes values and returns the number of values that were not found,
+if the sketch can tell. op is recorded if it succeeds.
+*/
+func (sp *SketchProxy) Remove(values [][]byte, op *Op) (uint, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return 0, err
+	}
+	sp.State["removes"]++
+	sp.ops++
+	sp.touch()
+	defer sp.save(false)
+	if remover, ok := sp.sketch.(abstract.CountingRemover); ok {
+		notFound, err := remover.RemoveAndCount(values)
+		sp.record(op, err)
+		return notFound, err
+	}
+	_, err := sp.sketch.RemoveMultiple(values)
+	sp.record(op, err)
+	return 0, err
+}
+
+/*
+Count ...
+*/
+func (sp *SketchProxy) Count(values []string) map[string]interface{} {
+	return sp.Query(values, abstract.Query{})
+}
+
+/*
+Query returns the result of the sketch for values shaped by query
+*/
+func (sp *SketchProxy) Query(values []string, query abstract.Query) map[string]interface{} {
+	// Some sketches (e.g. hllpp) update their internal state when counting
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	result := make(map[string]interface{})
+	result["info"] = sp.Info.Properties
+	if err := sp.load(); err != nil {
+		logger.Error.Println(err)
 		return result
 	}
-	result["result"] = sp.sketch.GetCount()
+	result["result"] = getResult(sp.Type, sp.sketch, values, query)
 	return result
 }
 
+/*
+Merge merges a copy of the other sketch into this one, the copy is taken so
+both sketches are never locked at the same time
+*/
+func (sp *SketchProxy) Merge(other *SketchProxy) (bool, error) {
+	// Marshaling may flush internal buffers (e.g. hllpp), so take the write lock
+	other.lock.Lock()
+	err := other.load()
+	var data []byte
+	if err == nil {
+		data, err = other.sketch.Marshal()
+	}
+	adds := other.State["adds"]
+	other.lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	// Disk backed sketches can not be merged, the copy has no storage
+	otherSketch, err := unmarshalSketch(nil, other.Info, data)
+	if err != nil {
+		return false, err
+	}
+	return sp.mergeSketch(otherSketch, adds)
+}
+
+/*
+mergeSketch merges a sketch that is not shared with anyone into this one
+*/
+func (sp *SketchProxy) mergeSketch(otherSketch abstract.Sketch, adds uint64) (bool, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	mergeable, ok := sp.sketch.(abstract.MergeableSketch)
+	if !ok {
+		return false, fmt.Errorf("Sketches of type %s can not be merged", sp.Type)
+	}
+	if err := mergeable.Merge(otherSketch); err != nil {
+		return false, err
+	}
+	sp.ops++
+	sp.State["adds"] += adds
+	sp.touch()
+	defer sp.save(false)
+	return true, nil
+}
+
+/*
+mergeable tells if other sketches can be merged into the sketch
+*/
+func (sp *SketchProxy) mergeable() bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		logger.Error.Println(err)
+		return false
+	}
+	_, ok := sp.sketch.(abstract.MergeableSketch)
+	return ok
+}
+
+/*
+AddPairs adds values to the groups of a family sketch, op is recorded if it
+succeeds
+*/
+func (sp *SketchProxy) AddPairs(pairs []Pair, op *Op) (bool, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	family, ok := sp.sketch.(*familySketch)
+	if !ok {
+		return false, fmt.Errorf("Sketch %s of type %s does not support pairs", sp.ID, sp.Type)
+	}
+	ok, err := family.AddPairs(pairs)
+	if err != nil {
+		return ok, err
+	}
+	sp.ops++
+	sp.State["adds"]++
+	sp.touch()
+	sp.save(false)
+	sp.record(op, nil)
+	return ok, nil
+}
+
+/*
+AddAt adds values to the bucket of t of a rollup sketch, op is recorded if it
+succeeds
+*/
+func (sp *SketchProxy) AddAt(values [][]byte, t time.Time, op *Op) (bool, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	rollup, ok := sp.sketch.(*rollupSketch)
+	if !ok {
+		return false, fmt.Errorf("Sketch %s of type %s does not support timestamps", sp.ID, sp.Type)
+	}
+	sp.ops++
+	sp.State["adds"]++
+	sp.touch()
+	defer sp.save(false)
+	ok, err := rollup.AddMultipleAt(values, t)
+	sp.record(op, err)
+	return ok, err
+}
+
+/*
+AddHashesAt adds already computed 64-bit hashes to the bucket of t of a rollup
+sketch, op is recorded if it succeeds
+*/
+func (sp *SketchProxy) AddHashesAt(hashes []uint64, t time.Time, op *Op) (bool, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return false, err
+	}
+	rollup, ok := sp.sketch.(*rollupSketch)
+	if !ok {
+		return false, fmt.Errorf("Sketch %s of type %s does not support timestamps", sp.ID, sp.Type)
+	}
+	sp.ops++
+	sp.State["adds"]++
+	sp.touch()
+	defer sp.save(false)
+	ok, err := rollup.AddHashesAt(hashes, t)
+	if err != nil {
+		// Some hashes might be in the bucket already
+		sp.recordPartial(len(hashes))
+		return ok, err
+	}
+	sp.record(op, nil)
+	return ok, nil
+}
+
+/*
+age merges and drops the buckets of a rollup sketch that fell out of their
+retention by now, a change is saved and recorded as the whole sketch
+*/
+func (sp *SketchProxy) age(now time.Time) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return err
+	}
+	rollup, ok := sp.sketch.(*rollupSketch)
+	if !ok {
+		return nil
+	}
+	if err := rollup.age(now); err != nil || !rollup.aged {
+		return err
+	}
+	sp.ops++
+	sp.dirty = true
+	defer sp.save(false)
+	sp.record(nil, nil)
+	return nil
+}
+
+/*
+CountGroups returns the results of the given groups of a family sketch (all
+groups if keys is empty) for values
+*/
+func (sp *SketchProxy) CountGroups(keys []string, values []string) (map[string]interface{}, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if err := sp.load(); err != nil {
+		return nil, err
+	}
+	family, ok := sp.sketch.(*familySketch)
+	if !ok {
+		return nil, fmt.Errorf("Sketch %s of type %s has no groups", sp.ID, sp.Type)
+	}
+	result := make(map[string]interface{})
+	result["info"] = sp.Info.Properties
+	result["result"] = family.GetGroups(keys, values)
+	return result, nil
+}
+
+/*
+getResult returns the result of a sketch of the given type for values, this is
+the frequency of values for sketches supporting it or else the count
+*/
+func getResult(sketchType string, sketch abstract.Sketch, values []string, query abstract.Query) interface{} {
+	bvalues := make([][]byte, len(values), len(values))
+	for i, value := range values {
+		bvalues[i] = []byte(value)
+	}
+	if queried, ok := sketch.(abstract.QueriedSketch); ok {
+		return queried.GetResult(bvalues, query)
+	}
+	switch sketchType {
+	case abstract.CML, abstract.Bloom, abstract.Family:
+		return sketch.GetFrequency(bvalues)
+	}
+	return sketch.GetCount()
+}
+
+/*
+record records op for a write that ended with err, unless it failed. The
+caller must hold the lock.
+*/
+func (sp *SketchProxy) record(op *Op, err error) {
+	if sp.recorder == nil {
+		return
+	}
+	if sp.aged() {
+		// The buckets changed even if the write failed
+		sp.recorder(sp, nil)
+		return
+	}
+	if err == nil {
+		sp.recorder(sp, op)
+	}
+}
+
+/*
+aged tells if a write aged the buckets of a rollup sketch, replaying it on
+another clock could age them differently so it is recorded as the whole sketch
+*/
+func (sp *SketchProxy) aged() bool {
+	rollup, ok := sp.sketch.(*rollupSketch)
+	if !ok || !rollup.aged {
+		return false
+	}
+	rollup.aged = false
+	return true
+}
+
+/*
+recordPartial records a write that failed after applying some of its values
+as the whole resulting sketch, so peers keep the values that stayed applied.
+The caller must hold the lock.
+*/
+func (sp *SketchProxy) recordPartial(applied int) {
+	if applied > 0 && sp.recorder != nil {
+		sp.recorder(sp, nil)
+	}
+}
+
+/*
+close releases the resources held by the sketch, e.g. the KV of a disk
+backed dict
+*/
+func (sp *SketchProxy) close() error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.closed() {
+		return nil
+	}
+	// The state can not be read after the sketch is gone
+	if sp.pending != nil {
+		sp.fillState(sp.pending)
+	}
+	close(sp.stop)
+	if sp.memory != nil {
+		sp.memory.remove(sp)
+	}
+	if closer, ok := sp.sketch.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+/*
+touch marks the sketch as dirty and updates its modification time, and its
+expiry time if it is reset on writes
+*/
+func (sp *SketchProxy) touch() {
+	sp.dirty = true
+	sp.LastModified = time.Now().Unix()
+	if sp.ResetTTL && sp.TTL > 0 {
+		sp.ExpiresAt = sp.LastModified + sp.TTL
+	}
+}
+
+/*
+randomized returns if writes to the sketch draw random numbers, like the
+counters of count-min-log sketches do, so replaying them gives other counts
+*/
+func (sp *SketchProxy) randomized() bool {
+	return sp.Type == abstract.CML || sp.InnerType == abstract.CML
+}
+
+/*
+snapshot returns a copy of the info of the sketch, which writes keep changing
+*/
+func (sp *SketchProxy) snapshot() *abstract.Info {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	return copyInfo(sp.Info)
+}
+
+/*
+copyInfo returns a copy of info sharing none of its maps
+*/
+func copyInfo(info *abstract.Info) *abstract.Info {
+	copied := *info
+	copied.State = make(map[string]uint64, len(info.State))
+	for k, v := range info.State {
+		copied.State[k] = v
+	}
+	copied.Properties = make(map[string]float64, len(info.Properties))
+	for k, v := range info.Properties {
+		copied.Properties[k] = v
+	}
+	return &copied
+}
+
+/*
+closed returns if the sketch was closed, the caller must hold the lock
+*/
+func (sp *SketchProxy) closed() bool {
+	select {
+	case <-sp.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+autosave saves the changes of the sketch every SaveThresholdSeconds until the
+sketch is closed
+*/
 func (sp *SketchProxy) autosave() {
+	interval := time.Duration(config.GetConfig().SaveThresholdSeconds) * time.Second
 	for {
-		time.Sleep(time.Duration(config.GetConfig().SaveThresholdSeconds) * time.Second)
-		if sp.dirty {
-			sp.save(true)
-			sp.dirty = false
+		select {
+		case <-sp.stop:
+			return
+		case <-time.After(interval):
 		}
+		sp.lock.Lock()
+		sp.save(true)
+		sp.lock.Unlock()
 	}
 }
 
 /*
-save ...
+save writes the changed sketch and its info to storage, closed sketches are
+not saved anymore so deleted ones stay deleted
 */
 func (sp *SketchProxy) save(force bool) {
-	if !sp.dirty {
+	if !sp.dirty || sp.closed() {
 		return
 	}
 
 	if sp.ops%config.GetConfig().SaveThresholdOps == 0 || force {
 		sp.ops++
 		sp.dirty = false
-		manager := storage.Manager()
+		manager := sp.store
 		serialized, err := sp.sketch.Marshal()
 		if err != nil {
 			logger.Error.Println(err)
 		}
-		err = manager.SaveData(sp.Info.ID, serialized, 0)
+		sp.State["size"] = uint64(len(serialized))
+		sp.State["memory_size"] = memorySize(sp.sketch, len(serialized))
+		codec := sp.compression()
+		// A change shifts all compressed data after it, data spanning several
+		// slices is stored raw so saving it only rewrites the changed slices
+		if len(serialized) > storage.SliceSize() {
+			codec = storage.CompressionNone
+		}
+		stored, err := storage.Compress(codec, serialized)
+		if err != nil {
+			logger.Error.Println(err)
+			stored = serialized
+		}
+		stored, err = storage.Wrap(envelopeHeader(sp.Info), stored)
 		if err != nil {
 			logger.Error.Println(err)
+			return
 		}
+		sp.State["stored_size"] = uint64(len(stored))
 		info, _ := json.Marshal(sp.Info)
-		err = manager.SaveInfo(sp.Info.ID, info)
+		_, err = manager.Save(sp.Info.ID, stored, info)
 		if err != nil {
 			logger.Error.Println(err)
 		}
 	}
 }
 
-func createSketch(info *abstract.Info) (*SketchProxy, error) {
-	var sketch abstract.Sketch
-	var err error
-	manager := storage.Manager()
-	err = manager.Create(info.ID)
+/*
+compression returns the codec the sketch is stored with
+*/
+func (sp *SketchProxy) compression() string {
+	if sp.Compression != "" {
+		return sp.Compression
+	}
+	return config.GetConfig().Compression
+}
+
+func createSketch(store storage.Backend, info *abstract.Info) (*SketchProxy, error) {
+	err := store.Create(info.ID)
 	if err != nil {
 		return nil, errors.New("Error creating new sketch")
 	}
 
-	switch info.Type {
-	case abstract.HLLPP:
-		sketch, err = hllpp.NewSketch(info)
-	case abstract.TopK:
-		sketch, err = topk.NewSketch(info)
-	case abstract.CML:
-		sketch, err = cml.NewSketch(info)
-	case abstract.Dict:
-		sketch, err = dict.NewSketch(info)
-	case abstract.Bloom:
-		sketch, err = bloom.NewSketch(info)
-	default:
-		return nil, errors.New("Invalid sketch type: " + info.Type)
+	sketch, err := newSketch(store, info)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new sketch: %s", err)
 	}
+
+	sp := SketchProxy{Info: info, sketch: sketch, dirty: true, store: store, stop: make(chan struct{})}
+	sp.save(true)
+	go sp.autosave()
+	return &sp, nil
+}
+
+func loadSketch(store storage.Backend, info *abstract.Info) (*SketchProxy, error) {
+	sketch, err := readSketch(store, info)
 	if err != nil {
-		return nil, errors.New("Error creating new sketch")
+		return nil, err
 	}
+	sp := SketchProxy{Info: info, sketch: sketch, store: store, stop: make(chan struct{})}
+
+	go sp.autosave()
+	return &sp, nil
+}
 
-	sp := SketchProxy{info, sketch, sync.RWMutex{}, 0, true}
-	err = storage.Manager().Create(info.ID)
+/*
+readSketch reads the sketch of info back from storage
+*/
+func readSketch(store storage.Backend, info *abstract.Info) (abstract.Sketch, error) {
+	data, err := store.LoadSlices(info.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading data for sketch: %s", info.ID)
+	}
+	data, migrated, err := migrate(info, data)
 	if err != nil {
 		return nil, err
 	}
+	sketch, err := decodeSketch(store, info, data)
+	if err != nil {
+		return nil, err
+	}
+	// Upgrade the file in place once it is known to load
+	if migrated {
+		if _, err := store.SaveSlices(info.ID, data); err != nil {
+			return nil, err
+		}
+		logger.Info.Printf("Migrated data of sketch %s to format version %d", info.ID, storage.FormatVersion)
+	}
+	return sketch, nil
+}
 
+/*
+decodeSketch unmarshals the sketch of info from a data file of the current
+format version, disk backed sketches keep their data in store
+*/
+func decodeSketch(store storage.Backend, info *abstract.Info, data []byte) (abstract.Sketch, error) {
+	header, payload, err := storage.Unwrap(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading data of sketch %s: %s", info.ID, err)
+	}
+	if err := checkHeader(info, header); err != nil {
+		return nil, err
+	}
+	payload, err = storage.Decompress(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing data for sketch %s: %s", info.ID, err)
+	}
+	sketch, err := unmarshalSketch(store, info, payload)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading data for sketch %s: %s", info.ID, err)
+	}
+	return sketch, nil
+}
+
+/*
+exportSketch serializes all data of a sketch, unlike Marshal which leaves
+out what the sketch keeps on disk by itself
+*/
+func exportSketch(sketch abstract.Sketch) ([]byte, error) {
+	if exportable, ok := sketch.(abstract.ExportableSketch); ok {
+		return exportable.Export()
+	}
+	return sketch.Marshal()
+}
+
+/*
+encodeSketch returns a data file of the current format version holding all
+data of a sketch, compressed with codec
+*/
+func encodeSketch(info *abstract.Info, sketch abstract.Sketch, codec string) ([]byte, error) {
+	data, err := exportSketch(sketch)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = storage.Compress(codec, data); err != nil {
+		return nil, err
+	}
+	return storage.Wrap(envelopeHeader(info), data)
+}
+
+/*
+encode returns a data file holding all data of the sketch compressed with
+codec, the caller must hold the lock. Evicted sketches are read from storage
+without keeping them.
+*/
+func (sp *SketchProxy) encode(codec string) ([]byte, error) {
+	sketch := sp.sketch
+	if sketch == nil {
+		var err error
+		if sketch, err = readSketch(sp.store, sp.Info); err != nil {
+			return nil, err
+		}
+		if closer, ok := sketch.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+	return encodeSketch(sp.Info, sketch, codec)
+}
+
+/*
+restoreSketch creates a sketch with the given info from a data file written
+by encodeSketch
+*/
+func restoreSketch(store storage.Backend, info *abstract.Info, data []byte) (*SketchProxy, error) {
+	data, _, err := migrate(info, data)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := decodeSketch(store, info, data)
+	if err != nil {
+		return nil, err
+	}
+	return storeSketch(store, info, sketch)
+}
+
+/*
+storeSketch creates a sketch with the given info from an already built sketch
+implementation and saves it
+*/
+func storeSketch(store storage.Backend, info *abstract.Info, sketch abstract.Sketch) (*SketchProxy, error) {
+	if err := store.Create(info.ID); err != nil {
+		return nil, err
+	}
+	sp := SketchProxy{Info: info, sketch: sketch, dirty: true, store: store, stop: make(chan struct{})}
 	sp.save(true)
 	go sp.autosave()
 	return &sp, nil
 }
 
-func loadSketch(info *abstract.Info) (*SketchProxy, error) {
-	var sketch abstract.Sketch
-
-	data, err := storage.Manager().LoadData(info.ID, 0, 0)
+/*
+load reads an evicted sketch back from storage, the caller must hold the lock
+*/
+func (sp *SketchProxy) load() error {
+	if sp.sketch != nil {
+		return nil
+	}
+	sketch, err := readSketch(sp.store, sp.Info)
 	if err != nil {
-		return nil, fmt.Errorf("Error loading data for sketch: %s", info.ID)
+		return err
+	}
+	sp.sketch = sketch
+	if sp.memory != nil {
+		sp.memory.loaded()
 	}
+	return nil
+}
 
+/*
+ready loads an evicted sketch back from storage
+*/
+func (sp *SketchProxy) ready() error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	return sp.load()
+}
+
+/*
+evict drops the sketch from memory keeping only its info, sketches with
+changes that were not saved yet are not evicted
+*/
+func (sp *SketchProxy) evict() bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.dirty || sp.sketch == nil {
+		return false
+	}
+	if closer, ok := sp.sketch.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error.Println(err)
+			return false
+		}
+	}
+	sp.sketch = nil
+	return true
+}
+
+/*
+size returns the estimated memory size of the sketch when it was last saved,
+sketches saved before it was estimated give their serialized size
+*/
+func (sp *SketchProxy) size() uint64 {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	if size, ok := sp.State["memory_size"]; ok {
+		return size
+	}
+	return sp.State["size"]
+}
+
+/*
+newSketch creates the sketch implementation for the type of info, disk backed
+sketches keep their data in store
+*/
+func newSketch(store storage.Backend, info *abstract.Info) (abstract.Sketch, error) {
 	switch info.Type {
 	case abstract.HLLPP:
-		sketch, err = hllpp.Unmarshal(info, data)
+		return hllpp.NewSketch(info)
 	case abstract.TopK:
-		sketch, err = topk.Unmarshal(info, data)
+		return topk.NewSketch(info)
 	case abstract.CML:
-		sketch, err = cml.Unmarshal(info, data)
+		return cml.NewSketch(info)
 	case abstract.Dict:
-		sketch, err = dict.Unmarshal(info, data)
+		return dict.NewSketch(info, store)
 	case abstract.Bloom:
-		sketch, err = bloom.Unmarshal(info, data)
-	default:
-		logger.Info.Println("Invalid sketch type", info.Type)
+		return bloom.NewSketch(info)
+	case abstract.Family:
+		return newFamilySketch(info)
+	case abstract.Rollup:
+		return newRollupSketch(info)
 	}
-	sp := SketchProxy{info, sketch, sync.RWMutex{}, 0, false}
+	return nil, errors.New("Invalid sketch type: " + info.Type)
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("Error loading data for sketch: %s", info.ID)
+/*
+unmarshalSketch loads the sketch implementation for the type of info from data,
+disk backed sketches from store
+*/
+func unmarshalSketch(store storage.Backend, info *abstract.Info, data []byte) (abstract.Sketch, error) {
+	switch info.Type {
+	case abstract.HLLPP:
+		return hllpp.Unmarshal(info, data)
+	case abstract.TopK:
+		return topk.Unmarshal(info, data)
+	case abstract.CML:
+		return cml.Unmarshal(info, data)
+	case abstract.Dict:
+		return dict.Unmarshal(info, data, store)
+	case abstract.Bloom:
+		return bloom.Unmarshal(info, data)
+	case abstract.Family:
+		return unmarshalFamilySketch(info, data)
+	case abstract.Rollup:
+		return unmarshalRollupSketch(info, data)
 	}
-
-	go sp.autosave()
-	return &sp, nil
+	logger.Info.Println("Invalid sketch type", info.Type)
+	return nil, errors.New("Invalid sketch type: " + info.Type)
 }
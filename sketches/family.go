@@ -0,0 +1,256 @@
+package sketches
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+const defaultMaxGroups = 10000.0
+
+/*
+Pair is a value to be added to the group with the given key of a family sketch
+*/
+type Pair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+/*
+familySketch maintains one sketch of its inner type per group key, the
+group sketches are created lazily on the first value added to them
+*/
+type familySketch struct {
+	*abstract.Info
+	groups map[string]abstract.Sketch
+	size   uint64 // estimated memory size as of the last Marshal
+}
+
+/*
+familyData is the serialized form of a family, all groups are stored in one
+blob instead of one storage file per group
+*/
+type familyData struct {
+	Keys   []string
+	Groups [][]byte
+}
+
+func newFamilySketch(info *abstract.Info) (*familySketch, error) {
+	switch info.InnerType {
+	case abstract.HLLPP, abstract.CML, abstract.TopK, abstract.Dict, abstract.Bloom:
+	default:
+		return nil, fmt.Errorf("Invalid inner sketch type for family: %s", info.InnerType)
+	}
+	if info.InnerType == abstract.Dict && info.Properties["disk"] != 0 {
+		return nil, errors.New("Family sketches can not hold disk backed dicts")
+	}
+	if info.Properties["max_groups"] == 0 {
+		info.Properties["max_groups"] = defaultMaxGroups
+	}
+	return &familySketch{Info: info, groups: make(map[string]abstract.Sketch)}, nil
+}
+
+func unmarshalFamilySketch(info *abstract.Info, data []byte) (*familySketch, error) {
+	var fd familyData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&fd); err != nil {
+		return nil, err
+	}
+	family, err := newFamilySketch(info)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range fd.Keys {
+		// Groups are never disk backed, they need no storage
+		group, err := unmarshalSketch(nil, family.groupInfo(key), fd.Groups[i])
+		if err != nil {
+			return nil, err
+		}
+		family.groups[key] = group
+	}
+	return family, nil
+}
+
+/*
+groupInfo returns the info for the inner sketch of a group, inner sketches use
+the properties of the family
+*/
+func (f *familySketch) groupInfo(key string) *abstract.Info {
+	props := make(map[string]float64)
+	for k, v := range f.Properties {
+		if k != "max_groups" {
+			props[k] = v
+		}
+	}
+	return &abstract.Info{
+		ID:         fmt.Sprintf("%s[%s]", f.ID, key),
+		Type:       f.InnerType,
+		Properties: props,
+		State:      make(map[string]uint64),
+		Hash:       f.Hash,
+		Seed:       f.Seed,
+	}
+}
+
+/*
+AddPairs adds each value to the group of its key. Pairs creating more groups
+than max_groups allows are rejected as a whole, without adding any of them.
+New groups only join the family once all values were added, so a failing add
+leaves no groups behind.
+*/
+func (f *familySketch) AddPairs(pairs []Pair) (bool, error) {
+	created := make(map[string]abstract.Sketch)
+	values := make(map[string][][]byte)
+	for _, pair := range pairs {
+		if _, ok := f.groups[pair.Key]; !ok {
+			created[pair.Key] = nil
+		}
+		values[pair.Key] = append(values[pair.Key], []byte(pair.Value))
+	}
+	if max := uint(f.Properties["max_groups"]); uint(len(f.groups)+len(created)) > max {
+		return false, fmt.Errorf("Family %s can not hold %d new groups besides its %d, max is %d groups", f.ID, len(created), len(f.groups), max)
+	}
+
+	for key := range created {
+		group, err := newSketch(nil, f.groupInfo(key))
+		if err != nil {
+			return false, err
+		}
+		if _, err := group.AddMultiple(values[key]); err != nil {
+			return false, err
+		}
+		created[key] = group
+	}
+	for key, vals := range values {
+		if group, ok := f.groups[key]; ok {
+			if _, err := group.AddMultiple(vals); err != nil {
+				return false, err
+			}
+		}
+	}
+	for key, group := range created {
+		f.groups[key] = group
+	}
+	return true, nil
+}
+
+/*
+GetGroups returns the result of the inner sketch for each key (all groups if
+keys is empty), unknown keys are left out
+*/
+func (f *familySketch) GetGroups(keys []string, values []string) map[string]interface{} {
+	if len(keys) == 0 {
+		keys = f.keys()
+	}
+	res := make(map[string]interface{})
+	for _, key := range keys {
+		if group, ok := f.groups[key]; ok {
+			res[key] = getResult(f.InnerType, group, values, abstract.Query{})
+		}
+	}
+	return res
+}
+
+func (f *familySketch) keys() []string {
+	keys := make([]string, 0, len(f.groups))
+	for key := range f.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Add ...
+*/
+func (f *familySketch) Add(value []byte) (bool, error) {
+	return false, errors.New("Family sketches only support adding pairs")
+}
+
+/*
+AddMultiple ...
+*/
+func (f *familySketch) AddMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("Family sketches only support adding pairs")
+}
+
+/*
+AddWeighted ...
+*/
+func (f *familySketch) AddWeighted(value []byte, count int64) (bool, error) {
+	return false, errors.New("Family sketches only support adding pairs")
+}
+
+/*
+Remove ...
+*/
+func (f *familySketch) Remove(value []byte) (bool, error) {
+	return false, errors.New("This Sketch type does not support deletion")
+}
+
+/*
+RemoveMultiple ...
+*/
+func (f *familySketch) RemoveMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("This Sketch type does not support deletion")
+}
+
+/*
+GetCount returns the number of groups
+*/
+func (f *familySketch) GetCount() uint {
+	return uint(len(f.groups))
+}
+
+/*
+Clear ...
+*/
+func (f *familySketch) Clear() (bool, error) {
+	f.groups = make(map[string]abstract.Sketch)
+	return true, nil
+}
+
+/*
+GetFrequency returns the result of each group for the given keys
+*/
+func (f *familySketch) GetFrequency(keys [][]byte) interface{} {
+	skeys := make([]string, len(keys), len(keys))
+	for i, key := range keys {
+		skeys[i] = string(key)
+	}
+	return f.GetGroups(skeys, nil)
+}
+
+/*
+Marshal ...
+*/
+func (f *familySketch) Marshal() ([]byte, error) {
+	fd := familyData{Keys: f.keys()}
+	fd.Groups = make([][]byte, len(fd.Keys), len(fd.Keys))
+	size := uint64(0)
+	for i, key := range fd.Keys {
+		data, err := f.groups[key].Marshal()
+		if err != nil {
+			return nil, err
+		}
+		fd.Groups[i] = data
+		size += uint64(len(key)) + memorySize(f.groups[key], len(data))
+	}
+	var network bytes.Buffer
+	if err := gob.NewEncoder(&network).Encode(fd); err != nil {
+		return nil, err
+	}
+	f.size = size
+	return network.Bytes(), nil
+}
+
+/*
+MemorySize estimates the bytes the groups take in memory, it is computed while
+marshalling since the groups only tell the size of their serialized form
+*/
+func (f *familySketch) MemorySize() uint64 {
+	return f.size
+}
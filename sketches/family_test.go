@@ -0,0 +1,98 @@
+package sketches
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+func TestFamily(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	if err := m1.CreateFamily("visitors", "wrong", nil); err == nil {
+		t.Error("Expected error creating family with invalid inner type, got", err)
+	}
+	props := map[string]float64{"max_groups": 2}
+	if err := m1.CreateFamily("visitors", abstract.HLLPP, props); err != nil {
+		t.Fatal("Expected no errors while creating family, got", err)
+	}
+
+	pairs := []Pair{
+		{"de", "hulk"}, {"de", "thor"}, {"de", "hulk"},
+		{"fr", "wasp"},
+	}
+	if err := m1.AddPairsToSketch("visitors", abstract.Family, pairs); err != nil {
+		t.Error("Expected no errors while adding pairs, got", err)
+	}
+	// Batches exceeding max groups are rejected without adding any pair
+	err = m1.AddPairsToSketch("visitors", abstract.Family, []Pair{{"it", "loki"}, {"fr", "ant"}})
+	if err == nil {
+		t.Error("Expected error when exceeding max groups, got", err)
+	}
+	if err := m1.AddPairsToSketch("visitors", abstract.Family, []Pair{{"fr", "wolverine"}}); err != nil {
+		t.Error("Expected no errors while adding pairs to existing groups, got", err)
+	}
+
+	// Groups are persisted in one blob and reloaded
+	m2, err := newManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	res, err := m2.GetCountForGroups("visitors", abstract.Family, nil, nil)
+	if err != nil {
+		t.Error("Expected no errors while counting groups, got", err)
+	}
+	groups := res["result"].(map[string]interface{})
+	if len(groups) != 2 {
+		t.Fatal("Expected 2 groups, got", len(groups))
+	}
+	if groups["de"].(uint) != 2 {
+		t.Error("Expected 2 visitors from de, got", groups["de"])
+	}
+	if groups["fr"].(uint) != 2 {
+		t.Error("Expected 2 visitors from fr, got", groups["fr"])
+	}
+
+	res, err = m2.GetCountForGroups("visitors", abstract.Family, []string{"fr", "it"}, nil)
+	groups = res["result"].(map[string]interface{})
+	if len(groups) != 1 {
+		t.Error("Expected only fr to be returned, got", groups)
+	}
+}
+
+// failingSketch fails every add
+type failingSketch struct {
+	abstract.Sketch
+}
+
+func (s failingSketch) AddMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("Failing on purpose")
+}
+
+func TestFamilyFailingAdd(t *testing.T) {
+	info := &abstract.Info{ID: "visitors", Type: abstract.Family, InnerType: abstract.HLLPP,
+		Properties: map[string]float64{"max_groups": 2}, State: make(map[string]uint64)}
+	family, err := newFamilySketch(info)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	family.groups["de"] = failingSketch{}
+	// The new group is added to before the failing one, it must not stay
+	if _, err := family.AddPairs([]Pair{{"fr", "wasp"}, {"de", "hulk"}}); err == nil {
+		t.Error("Expected error adding to a failing group")
+	}
+	if _, ok := family.groups["fr"]; ok {
+		t.Error("Expected no group fr after a failing add, got", family.keys())
+	}
+	delete(family.groups, "de")
+	if _, err := family.AddPairs([]Pair{{"fr", "wasp"}, {"it", "ant"}}); err != nil {
+		t.Error("Expected the failed add to leave max_groups free, got", err)
+	}
+}
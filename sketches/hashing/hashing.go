@@ -0,0 +1,62 @@
+package hashing
+
+import "fmt"
+
+/*
+Murmur3 => MurmurHash3 x64 128, first 64 bits
+XXHash  => xxHash64
+FNV     => FNV-1a 64
+Redis   => MurmurHash64A as used by Redis HyperLogLogs, bit reversed
+*/
+const (
+	Murmur3 = "murmur3"
+	XXHash  = "xxhash"
+	FNV     = "fnv"
+	Redis   = "redis"
+)
+
+/*
+Hasher computes the 64-bit hash of a value
+*/
+type Hasher interface {
+	Sum64([]byte) uint64
+}
+
+/*
+New returns the hasher with the given name using seed. An empty name returns a
+nil Hasher, meaning the sketch uses its own built-in hash.
+*/
+func New(name string, seed uint64) (Hasher, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case Murmur3:
+		return murmur3(seed), nil
+	case XXHash:
+		return xxhash(seed), nil
+	case FNV:
+		return fnv(seed), nil
+	case Redis:
+		return redis(seed), nil
+	}
+	return nil, fmt.Errorf("Invalid hash function: %s", name)
+}
+
+type fnv uint64
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+/*
+Sum64 returns the FNV-1a hash of data, the seed is mixed into the offset basis
+*/
+func (seed fnv) Sum64(data []byte) uint64 {
+	hash := uint64(fnvOffset64) ^ uint64(seed)
+	for _, c := range data {
+		hash ^= uint64(c)
+		hash *= fnvPrime64
+	}
+	return hash
+}
@@ -0,0 +1,58 @@
+package hashing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKnownHashes(t *testing.T) {
+	long := []byte(strings.Repeat("skizze", 20))
+	tests := []struct {
+		name  string
+		seed  uint64
+		value []byte
+		hash  uint64
+	}{
+		{Murmur3, 0, []byte(""), 0},
+		{Murmur3, 0, []byte("hello"), 0xcbd8a7b341bd9b02},
+		{XXHash, 0, []byte(""), 0xef46db3751d8e999},
+		{XXHash, 0, []byte("abc"), 0x44bc2cf5ad770999},
+		{XXHash, 0, []byte("Nobody inspects the spammish repetition"), 0xfbcea83c8a378bf1},
+		{FNV, 0, []byte("a"), 0xaf63dc4c8601ec8c},
+		{Redis, 0, []byte(""), 0x4ce93da1a657fb1b},
+		{Redis, 0, []byte("hello"), 0x0027f37780f6a6f0},
+		{Redis, 0, []byte("Nobody inspects the spammish repetition"), 0xfb6e92fe98c9cee3},
+	}
+	for _, test := range tests {
+		hasher, err := New(test.name, test.seed)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if hash := hasher.Sum64(test.value); hash != test.hash {
+			t.Errorf("Expected %s(%q) = %x, got %x", test.name, test.value, test.hash, hash)
+		}
+		if hasher.Sum64(long) != hasher.Sum64(long) {
+			t.Errorf("Expected %s to be deterministic", test.name)
+		}
+	}
+}
+
+func TestSeeds(t *testing.T) {
+	for _, name := range []string{Murmur3, XXHash, FNV, Redis} {
+		h1, _ := New(name, 1)
+		h2, _ := New(name, 2)
+		value := []byte("rick grimes")
+		if h1.Sum64(value) == h2.Sum64(value) {
+			t.Errorf("Expected different seeds of %s to give different hashes", name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if hasher, err := New("", 42); hasher != nil || err != nil {
+		t.Errorf("Expected no hasher and no error for the built-in hash, got %v, %v", hasher, err)
+	}
+	if _, err := New("md5", 0); err == nil {
+		t.Error("Expected an error for an unknown hash function")
+	}
+}
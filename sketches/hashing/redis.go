@@ -0,0 +1,59 @@
+package hashing
+
+import "encoding/binary"
+
+const (
+	murmur64AM   = 0xc6a4a7935bd1e995
+	murmur64AR   = 47
+	redisHLLSeed = 0xadc83b19
+)
+
+type redis uint64
+
+/*
+Sum64 returns the MurmurHash64A hash of data Redis uses for its HyperLogLogs
+with its bits reversed. Redis takes the register index from the low bits of
+the hash and counts trailing zeros, the reversal lets sketches that take the
+index from the high bits and count leading zeros see the same registers. The
+seed is mixed into the one of Redis, only seed 0 gives the hashes of Redis.
+*/
+func (seed redis) Sum64(data []byte) uint64 {
+	return reverse64(murmur64A(data, redisHLLSeed^uint64(seed)))
+}
+
+func murmur64A(data []byte, seed uint64) uint64 {
+	h := seed ^ (uint64(len(data)) * murmur64AM)
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		data = data[8:]
+
+		k *= murmur64AM
+		k ^= k >> murmur64AR
+		k *= murmur64AM
+
+		h ^= k
+		h *= murmur64AM
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= murmur64AM
+	}
+
+	h ^= h >> murmur64AR
+	h *= murmur64AM
+	h ^= h >> murmur64AR
+	return h
+}
+
+func reverse64(x uint64) uint64 {
+	x = x>>1&0x5555555555555555 | x&0x5555555555555555<<1
+	x = x>>2&0x3333333333333333 | x&0x3333333333333333<<2
+	x = x>>4&0x0f0f0f0f0f0f0f0f | x&0x0f0f0f0f0f0f0f0f<<4
+	x = x>>8&0x00ff00ff00ff00ff | x&0x00ff00ff00ff00ff<<8
+	x = x>>16&0x0000ffff0000ffff | x&0x0000ffff0000ffff<<16
+	return x>>32 | x<<32
+}
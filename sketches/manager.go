@@ -4,9 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
 	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
 )
@@ -17,140 +23,683 @@ ManagerStruct is responsible for manipulating the sketches and syncing to disk
 type ManagerStruct struct {
 	sketches map[string]*SketchProxy
 	info     map[string]*abstract.Info
+	domains  map[string]*abstract.Domain
+	memory   *memoryTracker
+	oplog    *opLog      // only kept by leaders
+	replicas *replicaSet // only kept by multi-master nodes
+	reaper   *reaper
+	store    storage.Backend
+	lock     sync.RWMutex
+	gate     sync.RWMutex // held for reading by writes, see hold
+}
+
+/*
+SketchEntry describes a sketch in a listing without computing its result
+*/
+type SketchEntry struct {
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	Properties   map[string]float64 `json:"properties"`
+	Adds         uint64             `json:"adds"`
+	Removes      uint64             `json:"removes"`
+	Size         uint64             `json:"size"`
+	StoredSize   uint64             `json:"stored_size"`
+	LastModified int64              `json:"last_modified"`
+	ExpiresAt    int64              `json:"expires_at,omitempty"`
 }
 
 var manager *ManagerStruct
 var logger = utils.GetLogger()
 
+/*
+SketchOptions are the settings of a new sketch besides its properties:
+InnerType is the type of the group sketches of a family, Hash and Seed select
+the hash function (the sketch's built-in one if Hash is empty), Compression
+the codec its data is stored with (the configured one if empty). The sketch is
+deleted TTL seconds after its creation (and after each write with ResetTTL) or
+at ExpiresAt (unix seconds), it is kept forever if neither is set. Template
+names the template the sketch is created from, its properties are checked
+against that one instead of the first template matching its id.
+*/
+type SketchOptions struct {
+	InnerType   string
+	Hash        string
+	Seed        uint64
+	Compression string
+	TTL         int64
+	ExpiresAt   int64
+	ResetTTL    bool
+	Template    string
+}
+
 /*
 CreateSketch ...
 */
 func (m *ManagerStruct) CreateSketch(sketchID string, sketchType string, props map[string]float64) error {
+	return m.CreateSketchWithOptions(sketchID, sketchType, props, SketchOptions{})
+}
+
+/*
+CreateFamily creates a family sketch holding one sketch of innerType per group
+key, the properties are used for each group sketch
+*/
+func (m *ManagerStruct) CreateFamily(sketchID string, innerType string, props map[string]float64) error {
+	return m.CreateSketchWithOptions(sketchID, abstract.Family, props, SketchOptions{InnerType: innerType})
+}
+
+/*
+CreateSketchWithOptions creates a new sketch with the given properties and options
+*/
+func (m *ManagerStruct) CreateSketchWithOptions(sketchID string, sketchType string, props map[string]float64, opts SketchOptions) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err := m.createSketch(sketchID, sketchType, props, opts)
+	return err
+}
+
+/*
+CreateSketchFromTemplate creates a new sketch using the type and properties of
+the template with the given name from the config
+*/
+func (m *ManagerStruct) CreateSketchFromTemplate(sketchID string, sketchType string, templateName string) error {
+	template, ok := config.GetConfig().Templates[templateName]
+	if !ok {
+		return fmt.Errorf("No such template %s", templateName)
+	}
+	if sketchType != "" && sketchType != template.Type {
+		return fmt.Errorf("Template %s is for sketches of type %s, not %s", templateName, template.Type, sketchType)
+	}
+	if ok, _ := path.Match(template.Pattern, sketchID); !ok {
+		return fmt.Errorf("Sketch ID %s does not match pattern %s of template %s", sketchID, template.Pattern, templateName)
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// The properties are filled in from the template
+	_, err := m.createSketch(sketchID, template.Type, nil, SketchOptions{Template: templateName})
+	return err
+}
+
+/*
+applyTemplate validates props against the template with the given name, or the
+one matching the sketch if name is empty (if any), and returns a copy of props
+with the properties the template defines but props does not filled in, props
+belongs to the caller and is left as is
+*/
+func applyTemplate(sketchID string, sketchType string, name string, props map[string]float64) (map[string]float64, error) {
+	merged := make(map[string]float64, len(props))
+	for k, v := range props {
+		merged[k] = v
+	}
+	var template *config.Template
+	if name != "" {
+		var ok bool
+		if template, ok = config.GetConfig().Templates[name]; !ok {
+			return nil, fmt.Errorf("No such template %s", name)
+		}
+	} else {
+		name, template = config.GetConfig().MatchTemplate(sketchType, sketchID)
+	}
+	if template == nil {
+		return merged, nil
+	}
+	for k, v := range template.Properties {
+		if pv, ok := props[k]; ok && pv != v {
+			return nil, fmt.Errorf("Property %s of sketch %s must be %v as defined by template %s, got %v", k, sketchID, v, name, pv)
+		}
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+/*
+createSketch creates a new sketch, the caller must hold the write lock
+*/
+func (m *ManagerStruct) createSketch(sketchID string, sketchType string, props map[string]float64, opts SketchOptions) (*SketchProxy, error) {
+	info, err := m.newInfo(sketchID, sketchType, props, opts)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := createSketch(m.store, info)
+	if err != nil {
+		errTxt := fmt.Sprint("Could not load sketch ", info, ". Err:", err)
+		return nil, errors.New(errTxt)
+	}
+	m.addSketch(sketch)
+	m.record(&Op{Kind: OpCreate, ID: sketchID, Type: sketchType, Info: opInfo(info)})
+	return sketch, nil
+}
+
+/*
+newInfo validates a new sketch and returns its info, every way of creating a
+sketch goes through it. The caller must hold the write lock.
+*/
+func (m *ManagerStruct) newInfo(sketchID string, sketchType string, props map[string]float64, opts SketchOptions) (*abstract.Info, error) {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
 
 	// Check if sketch with ID already exists
 	if info, ok := m.info[id]; ok {
 		errStr := fmt.Sprintf("Sketch %s of type %s already exists", sketchID, info.Type)
-		return errors.New(errStr)
+		return nil, errors.New(errStr)
 	}
 
 	// Check that id length does not exceed MaxKeySize
 	if len([]byte(id)) > config.MaxKeySize {
 		errStr := fmt.Sprintf("Invalid length of sketch ID: %d. Max length allowed: %d", len(id), config.MaxKeySize)
-		return errors.New(errStr)
+		return nil, errors.New(errStr)
 	}
 
 	// Make sure sketchType is set
 	if sketchType == "" {
 		logger.Error.Println("SketchType is mandatory and must be set!")
-		return errors.New("No sketch type was given!")
+		return nil, errors.New("No sketch type was given!")
 	}
 
-	info := &abstract.Info{ID: id,
-		Type:       sketchType,
-		Properties: props,
-		State:      make(map[string]uint64)}
+	if err := checkOptions(sketchType, opts); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	expiresAt, err := expiry(opts.TTL, opts.ExpiresAt, opts.ResetTTL, now)
+	if err != nil {
+		return nil, err
+	}
 
-	sketch, err := createSketch(info)
+	// Peers could never agree on the state of the sketch
+	if m.replicas != nil && !Converges(sketchType) {
+		return nil, fmt.Errorf("Sketches of type %s can not be created in multi-master mode, only %s", sketchType, strings.Join(convergentTypes, ", "))
+	}
+
+	// Make sure the sketch is shaped like the template it matches
+	props, err = applyTemplate(sketchID, sketchType, opts.Template, props)
 	if err != nil {
-		errTxt := fmt.Sprint("Could not load sketch ", info, ". Err:", err)
-		return errors.New(errTxt)
+		return nil, err
 	}
-	m.sketches[id] = sketch
-	m.dumpInfo(info)
-	return nil
+
+	return &abstract.Info{ID: id,
+		Type:         sketchType,
+		Properties:   props,
+		State:        make(map[string]uint64),
+		LastModified: now,
+		InnerType:    opts.InnerType,
+		Hash:         opts.Hash,
+		Seed:         opts.Seed,
+		Compression:  opts.Compression,
+		TTL:          opts.TTL,
+		ExpiresAt:    expiresAt,
+		ResetTTL:     opts.ResetTTL,
+		Template:     opts.Template}, nil
+}
+
+/*
+addSketch makes a new sketch known to the manager, the caller must hold the
+write lock
+*/
+func (m *ManagerStruct) addSketch(sketch *SketchProxy) {
+	sketch.memory = m.memory
+	sketch.recorder = m.recordWrite
+	m.sketches[sketch.ID] = sketch
+	m.dumpInfo(sketch.Info)
+	m.memory.use(sketch)
+}
+
+/*
+checkOptions makes sure the options apply to the sketch type
+*/
+func checkOptions(sketchType string, opts SketchOptions) error {
+	if opts.InnerType != "" && sketchType != abstract.Family && sketchType != abstract.Rollup {
+		return fmt.Errorf("Sketches of type %s have no inner type", sketchType)
+	}
+	if err := storage.ValidCompression(opts.Compression); err != nil {
+		return err
+	}
+	if opts.Hash == "" {
+		if opts.Seed != 0 {
+			return errors.New("A seed needs a hash function, the built-in ones take none")
+		}
+		return nil
+	}
+	hashedType := sketchType
+	if sketchType == abstract.Family || sketchType == abstract.Rollup {
+		hashedType = opts.InnerType
+	}
+	switch hashedType {
+	case abstract.HLLPP, abstract.CML, abstract.Bloom:
+	default:
+		return fmt.Errorf("Sketches of type %s do not support choosing a hash function", hashedType)
+	}
+	_, err := hashing.New(opts.Hash, opts.Seed)
+	return err
+}
+
+/*
+sameHash tells if two sketches hash values alike, the seed of sketches using
+their built-in hash function has no effect
+*/
+func sameHash(a *abstract.Info, b *abstract.Info) bool {
+	return a.Hash == b.Hash && (a.Hash == "" || a.Seed == b.Seed)
 }
 
 /*
 DeleteSketch ...
 */
 func (m *ManagerStruct) DeleteSketch(sketchID string, sketchType string) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if domain := m.domainOf(sketchID, sketchType); domain != nil {
+		return fmt.Errorf("Sketch %s of type %s is part of domain %s", sketchID, sketchType, domain.ID)
+	}
+	return m.deleteSketch(sketchID, sketchType)
+}
+
+/*
+deleteSketch deletes a sketch, the caller must hold the write lock
+*/
+func (m *ManagerStruct) deleteSketch(sketchID string, sketchType string) error {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
 
-	if _, ok := m.sketches[id]; !ok {
+	sketch, ok := m.sketches[id]
+	if !ok {
 		return errors.New("No such sketch " + sketchID)
 	}
+	if err := sketch.close(); err != nil {
+		logger.Error.Println(err)
+	}
 	delete(m.sketches, id)
 	delete(m.info, id)
-	manager := storage.Manager()
-	err := manager.DeleteInfo(id)
-	if err != nil {
+	m.record(&Op{Kind: OpDelete, ID: sketchID, Type: sketchType})
+	if err := m.store.DeleteInfo(id); err != nil {
 		return err
 	}
-	return manager.DeleteData(id)
+	return m.store.DeleteData(id)
 }
 
 /*
-GetSketches ...
+GetSketches returns all sketches as "type/id" sorted alphabetically
 */
 func (m *ManagerStruct) GetSketches() ([]string, error) {
-	// TODO: Remove dummy data and implement proper result
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	sketches := make([]string, len(m.sketches), len(m.sketches))
 	i := 0
 	for _, v := range m.sketches {
-		typ := v.Type
-		id := v.ID
-		sketches[i] = fmt.Sprintf("%s/%s", typ, id[:len(id)-len(typ)-1])
+		sketches[i] = fmt.Sprintf("%s/%s", v.Type, sketchName(v.Info))
 		i++
 	}
+	sort.Strings(sketches)
 	return sketches, nil
 }
 
 /*
-AddToSketch ...
+ListSketches returns the sketches matching sketchType (if set) and whose id
+starts with prefix, ordered by "type/id". Only sketches ordered after cursor are
+returned, at most limit of them (no limit if limit <= 0). The second return
+value is the cursor to pass for the next page, or "" if there are no more.
 */
-func (m *ManagerStruct) AddToSketch(sketchID string, sketchType string, values []string) error {
-	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+func (m *ManagerStruct) ListSketches(sketchType string, prefix string, cursor string, limit int) ([]*SketchEntry, string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := []string{}
+	sketches := make(map[string]*SketchProxy)
+	for _, sketch := range m.sketches {
+		info := sketch.Info // ID and Type never change
+		if sketchType != "" && info.Type != sketchType {
+			continue
+		}
+		name := sketchName(info)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", info.Type, name)
+		if cursor != "" && key <= cursor {
+			continue
+		}
+		keys = append(keys, key)
+		sketches[key] = sketch
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	entries := make([]*SketchEntry, len(keys), len(keys))
+	for i, key := range keys {
+		info := sketches[key].snapshot()
+		entries[i] = &SketchEntry{
+			ID:           sketchName(info),
+			Type:         info.Type,
+			Properties:   info.Properties,
+			Adds:         info.State["adds"],
+			Removes:      info.State["removes"],
+			Size:         info.State["size"],
+			StoredSize:   info.State["stored_size"],
+			LastModified: info.LastModified,
+			ExpiresAt:    info.ExpiresAt,
+		}
+	}
+	return entries, next, nil
+}
 
-	var val, ok = m.sketches[id]
-	if ok == false {
+/*
+GetSketchInfo returns a copy of the info of a sketch without computing its
+result
+*/
+func (m *ManagerStruct) GetSketchInfo(sketchID string, sketchType string) (*abstract.Info, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	sketch, ok := m.sketches[id]
+	if !ok {
 		errStr := fmt.Sprintf("No such sketch %s of type %s found", sketchID, sketchType)
-		return errors.New(errStr)
+		return nil, errors.New(errStr)
+	}
+	return sketch.snapshot(), nil
+}
+
+/*
+AddToSketch adds values to a sketch, creating it first if auto_create is
+enabled in the config
+*/
+func (m *ManagerStruct) AddToSketch(sketchID string, sketchType string, values []string) error {
+	return m.AddToSketchAutoCreate(sketchID, sketchType, values, config.GetConfig().AutoCreate)
+}
+
+/*
+AddToSketchAutoCreate adds values to a sketch. If autoCreate is set and the
+sketch does not exist it is created with the default properties of its type.
+*/
+func (m *ManagerStruct) AddToSketchAutoCreate(sketchID string, sketchType string, values []string, autoCreate bool) error {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, autoCreate)
+	if err != nil {
+		return err
+	}
+
+	bytes := make([][]byte, len(values), len(values))
+	for i, value := range values {
+		bytes[i] = []byte(value)
+	}
+	op := &Op{Kind: OpAdd, ID: sketchID, Type: sketchType, Values: values}
+	_, err = sketch.Add(bytes, op)
+	return err
+}
+
+/*
+AddToSketchAt adds values to the bucket of timestamp (unix seconds, the
+current time if 0) of a rollup sketch. If autoCreate is set and the sketch does
+not exist it is created like in AddToSketchAutoCreate.
+*/
+func (m *ManagerStruct) AddToSketchAt(sketchID string, sketchType string, values []string, timestamp int64, autoCreate bool) error {
+	defer m.hold()()
+	if sketchType != abstract.Rollup {
+		return fmt.Errorf("Sketches of type %s do not support timestamps, only %s", sketchType, abstract.Rollup)
+	}
+	sketch, err := m.getSketch(sketchID, sketchType, autoCreate)
+	if err != nil {
+		return err
+	}
+	if timestamp == 0 {
+		timestamp = clock().Unix()
 	}
-	var sketch *SketchProxy
-	sketch = val
 
 	bytes := make([][]byte, len(values), len(values))
 	for i, value := range values {
 		bytes[i] = []byte(value)
 	}
-	_, err := sketch.Add(bytes)
+	op := &Op{Kind: OpAdd, ID: sketchID, Type: sketchType, Values: values, Timestamp: timestamp}
+	_, err = sketch.AddAt(bytes, time.Unix(timestamp, 0), op)
 	return err
 }
 
+/*
+AddWeightedToSketch adds each value with its count to a sketch. If autoCreate
+is set and the sketch does not exist it is created like in AddToSketchAutoCreate.
+*/
+func (m *ManagerStruct) AddWeightedToSketch(sketchID string, sketchType string, values []WeightedValue, autoCreate bool) error {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, autoCreate)
+	if err != nil {
+		return err
+	}
+	op := &Op{Kind: OpAddWeighted, ID: sketchID, Type: sketchType, Weighted: values}
+	_, err = sketch.AddWeighted(values, op)
+	return err
+}
+
+/*
+AddHashesToSketch adds already computed 64-bit hashes to a sketch. If
+autoCreate is set and the sketch does not exist it is created like in
+AddToSketchAutoCreate.
+*/
+func (m *ManagerStruct) AddHashesToSketch(sketchID string, sketchType string, hashes []uint64, autoCreate bool) error {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, autoCreate)
+	if err != nil {
+		return err
+	}
+	op := &Op{Kind: OpAddHashes, ID: sketchID, Type: sketchType, Hashes: hashes}
+	_, err = sketch.AddHashes(hashes, op)
+	return err
+}
+
+/*
+AddHashesToSketchAt adds already computed 64-bit hashes to the bucket of
+timestamp (unix seconds, the current time if 0) of a rollup sketch. If
+autoCreate is set and the sketch does not exist it is created like in
+AddToSketchAutoCreate.
+*/
+func (m *ManagerStruct) AddHashesToSketchAt(sketchID string, sketchType string, hashes []uint64, timestamp int64, autoCreate bool) error {
+	defer m.hold()()
+	if sketchType != abstract.Rollup {
+		return fmt.Errorf("Sketches of type %s do not support timestamps, only %s", sketchType, abstract.Rollup)
+	}
+	sketch, err := m.getSketch(sketchID, sketchType, autoCreate)
+	if err != nil {
+		return err
+	}
+	if timestamp == 0 {
+		timestamp = clock().Unix()
+	}
+	op := &Op{Kind: OpAddHashes, ID: sketchID, Type: sketchType, Hashes: hashes, Timestamp: timestamp}
+	_, err = sketch.AddHashesAt(hashes, time.Unix(timestamp, 0), op)
+	return err
+}
+
+/*
+MergeSketches merges the sketches with the ids in fromIDs into the sketch with
+sketchID, all of the same type. Sketches built with different hash functions
+or seeds can not be merged.
+*/
+func (m *ManagerStruct) MergeSketches(sketchID string, sketchType string, fromIDs []string) error {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return err
+	}
+	if !sketch.mergeable() {
+		return fmt.Errorf("Sketches of type %s can not be merged", sketchType)
+	}
+
+	others := make([]*SketchProxy, len(fromIDs), len(fromIDs))
+	for i, fromID := range fromIDs {
+		if fromID == sketchID {
+			return fmt.Errorf("Can not merge sketch %s into itself", sketchID)
+		}
+		other, err := m.getSketch(fromID, sketchType, false)
+		if err != nil {
+			return err
+		}
+		if !sameHash(other.Info, sketch.Info) {
+			return fmt.Errorf("Can not merge sketch %s into %s, they use different hash functions", fromID, sketchID)
+		}
+		others[i] = other
+	}
+
+	defer m.recordState(sketch)
+	for _, other := range others {
+		if _, err := sketch.Merge(other); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*
 DeleteFromSketch ...
 */
 func (m *ManagerStruct) DeleteFromSketch(sketchID string, sketchType string, values []string) error {
-	var val, ok = m.sketches[sketchID]
-	if ok == false {
-		return errors.New("No such sketch: " + sketchID)
+	_, err := m.PurgeFromSketch(sketchID, sketchType, values)
+	return err
+}
+
+/*
+PurgeFromSketch removes values from a sketch and returns the number of values
+that were not found (always 0 for sketches that can not tell)
+*/
+func (m *ManagerStruct) PurgeFromSketch(sketchID string, sketchType string, values []string) (uint, error) {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return 0, err
 	}
-	var sketch *SketchProxy
-	sketch = val
 
 	bytes := make([][]byte, len(values), len(values))
 	for i, value := range values {
 		bytes[i] = []byte(value)
 	}
-	ok, err := sketch.Remove(bytes)
-	return err
+	op := &Op{Kind: OpPurge, ID: sketchID, Type: sketchType, Values: values}
+	notFound, err := sketch.Remove(bytes, op)
+	if err != nil {
+		return 0, err
+	}
+	return notFound, nil
 }
 
 /*
 GetCountForSketch ...
 */
 func (m *ManagerStruct) GetCountForSketch(sketchID string, sketchType string, values []string) (map[string]interface{}, error) {
+	return m.QuerySketch(sketchID, sketchType, values, abstract.Query{})
+}
+
+/*
+QuerySketch returns the result of a sketch for values shaped by query, e.g.
+only the top n values of a topk sketch
+*/
+func (m *ManagerStruct) QuerySketch(sketchID string, sketchType string, values []string, query abstract.Query) (map[string]interface{}, error) {
+	if query.N < 0 || query.MinCount < 0 || query.Limit < 0 {
+		return nil, errors.New("Query parameters n, min_count and limit must not be negative")
+	}
+	if _, err := resolution(query.Resolution); err != nil {
+		return nil, err
+	}
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return nil, err
+	}
+	count := sketch.Query(values, query)
+	return count, nil
+}
+
+/*
+GetCountForHashes returns the result of a sketch for already computed 64-bit
+hashes, keyed by the values the hashes were sent as
+*/
+func (m *ManagerStruct) GetCountForHashes(sketchID string, sketchType string, values []string, hashes []uint64) (map[string]interface{}, error) {
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return nil, err
+	}
+	return sketch.CountHashes(values, hashes), nil
+}
+
+/*
+AddPairsToSketch adds each value to the group of its key in a family sketch
+*/
+func (m *ManagerStruct) AddPairsToSketch(sketchID string, sketchType string, pairs []Pair) error {
+	defer m.hold()()
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return err
+	}
+	op := &Op{Kind: OpAddPairs, ID: sketchID, Type: sketchType, Pairs: pairs}
+	_, err = sketch.AddPairs(pairs, op)
+	return err
+}
+
+/*
+GetCountForGroups returns the results of the given groups (all if keys is
+empty) of a family sketch for values
+*/
+func (m *ManagerStruct) GetCountForGroups(sketchID string, sketchType string, keys []string, values []string) (map[string]interface{}, error) {
+	sketch, err := m.getSketch(sketchID, sketchType, false)
+	if err != nil {
+		return nil, err
+	}
+	return sketch.CountGroups(keys, values)
+}
+
+/*
+getSketch returns the sketch for sketchID and sketchType. If autoCreate is set
+a missing sketch is created with the properties of the template it matches or
+else the default properties of its type, concurrent callers will all get the
+same sketch.
+*/
+func (m *ManagerStruct) getSketch(sketchID string, sketchType string, autoCreate bool) (*SketchProxy, error) {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
-	var val, ok = m.sketches[id]
-	if ok == false {
+
+	m.lock.RLock()
+	sketch, ok := m.sketches[id]
+	m.lock.RUnlock()
+	if !ok && !autoCreate {
 		errStr := fmt.Sprintf("No such sketch %s of type %s found", sketchID, sketchType)
 		return nil, errors.New(errStr)
 	}
-	var sketch *SketchProxy
-	sketch = val
-	count := sketch.Count(values)
-	return count, nil
+	if !ok {
+		var err error
+		if sketch, err = m.autoCreateSketch(sketchID, sketchType); err != nil {
+			return nil, err
+		}
+	}
+	m.memory.use(sketch)
+	return sketch, nil
+}
+
+/*
+autoCreateSketch creates a missing sketch with the properties of the template
+it matches or else the default properties of its type
+*/
+func (m *ManagerStruct) autoCreateSketch(sketchID string, sketchType string) (*SketchProxy, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// Check again, the sketch might have been created while waiting for the lock
+	if sketch, ok := m.sketches[fmt.Sprintf("%s.%s", sketchID, sketchType)]; ok {
+		return sketch, nil
+	}
+	// Properties of a matching template are applied by createSketch
+	props := config.GetConfig().DefaultProperties(sketchType)
+	if _, template := config.GetConfig().MatchTemplate(sketchType, sketchID); template != nil {
+		props = make(map[string]float64)
+	}
+	// Rollups need an inner type, auto-created ones count distinct values
+	var opts SketchOptions
+	if sketchType == abstract.Rollup {
+		opts.InnerType = abstract.HLLPP
+	}
+	logger.Info.Printf("Auto-creating sketch %s of type %s", sketchID, sketchType)
+	return m.createSketch(sketchID, sketchType, props, opts)
+}
+
+/*
+GetMemoryStats returns how much memory the sketches held in memory use
+*/
+func (m *ManagerStruct) GetMemoryStats() MemoryStats {
+	return m.memory.stats()
 }
 
 /*
@@ -167,9 +716,36 @@ func GetManager() (*ManagerStruct, error) {
 	return manager, nil
 }
 
+/*
+NewManager returns a new manager besides the one of GetManager, to run several
+instances in one process. It loads and saves its sketches with the storage
+backend of the config.
+*/
+func NewManager() (*ManagerStruct, error) {
+	return newManager()
+}
+
+/*
+NewManagerWithStorage returns a new manager like NewManager which loads and
+saves its sketches with its own storage backend
+*/
+func NewManagerWithStorage(store storage.Backend) (*ManagerStruct, error) {
+	return newManagerWithStorage(store)
+}
+
 func newManager() (*ManagerStruct, error) {
+	return newManagerWithStorage(storage.Manager())
+}
+
+func newManagerWithStorage(store storage.Backend) (*ManagerStruct, error) {
 	sketches := make(map[string]*SketchProxy)
-	m := &ManagerStruct{sketches, make(map[string]*abstract.Info)}
+	m := &ManagerStruct{
+		sketches: sketches,
+		info:     make(map[string]*abstract.Info),
+		domains:  make(map[string]*abstract.Domain),
+		memory:   newMemoryTracker(config.GetConfig().MemoryBudget),
+		store:    store,
+	}
 	err := m.loadInfo()
 	if err != nil {
 		return nil, err
@@ -178,22 +754,24 @@ func newManager() (*ManagerStruct, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = m.loadDomains()
+	if err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
 func (m *ManagerStruct) dumpInfo(info *abstract.Info) {
 	// FIXME: Should we panic here?
 	m.info[info.ID] = info
-	manager := storage.Manager()
 	infoData, err := json.Marshal(info)
 	utils.PanicOnError(err)
-	err = manager.SaveInfo(info.ID, infoData)
+	err = m.store.SaveInfo(info.ID, infoData)
 	utils.PanicOnError(err)
 }
 
 func (m *ManagerStruct) loadInfo() error {
-	manager := storage.Manager()
-	infos, err := manager.LoadAllInfo()
+	infos, err := m.store.LoadAllInfo()
 	if err != nil {
 		return err
 	}
@@ -203,6 +781,9 @@ func (m *ManagerStruct) loadInfo() error {
 		if err != nil {
 			return err
 		}
+		if infoStruct.State == nil {
+			infoStruct.State = make(map[string]uint64)
+		}
 		m.info[infoStruct.ID] = &infoStruct
 	}
 	return nil
@@ -210,19 +791,62 @@ func (m *ManagerStruct) loadInfo() error {
 
 func (m *ManagerStruct) loadSketches() error {
 	for _, info := range m.info {
-		sketch, err := loadSketch(info)
+		sketch, err := loadSketch(m.store, info)
+		if err != nil && config.GetConfig().Quarantine {
+			logger.Error.Printf("Quarantining sketch %s: %s", info.ID, err)
+			if err := m.quarantine(info); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			errTxt := fmt.Sprint("Could not load sketch ", info, ". Err: ", err)
 			return errors.New(errTxt)
 		}
+		sketch.memory = m.memory
+		sketch.recorder = m.recordWrite
 		m.sketches[info.ID] = sketch
+		m.memory.use(sketch)
 	}
 	return nil
 }
 
 /*
-Destroy ...
+quarantine moves a sketch that can not be loaded out of the way, it is
+forgotten but its data and info are kept in the quarantine directory
+*/
+func (m *ManagerStruct) quarantine(info *abstract.Info) error {
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := m.store.QuarantineData(info.ID, infoData); err != nil {
+		return err
+	}
+	delete(m.info, info.ID)
+	return m.store.DeleteInfo(info.ID)
+}
+
+/*
+sketchName strips the type suffix from the internal id of a sketch
+*/
+func sketchName(info *abstract.Info) string {
+	return info.ID[:len(info.ID)-len(info.Type)-1]
+}
+
+/*
+Destroy closes all sketches and resets the singleton manager
 */
 func (m *ManagerStruct) Destroy() {
+	if m != nil {
+		m.StopReaper()
+		m.lock.Lock()
+		for _, sketch := range m.sketches {
+			if err := sketch.close(); err != nil {
+				logger.Error.Println(err)
+			}
+		}
+		m.lock.Unlock()
+	}
 	manager = nil
 }
@@ -2,13 +2,19 @@ package sketches
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
 	"github.com/seiflotfy/skizze/sketches/wrappers/topk"
 	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
@@ -38,7 +44,7 @@ func setupTests() {
 }
 
 func tearDownTests() {
-	storage.CloseInfoDB()
+	storage.Close()
 	os.RemoveAll(config.GetConfig().DataDir)
 	os.RemoveAll(config.GetConfig().InfoDir)
 	os.Mkdir(config.GetConfig().DataDir, 0777)
@@ -448,3 +454,887 @@ func TestCMLCounter(t *testing.T) {
 		t.Error("expected 'havoc' count == 2, got", v)
 	}
 }
+
+func TestOpLogCopiesInfo(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	m.EnableOpLog(100)
+	props := map[string]float64{"epsilon": 0.5}
+	if err := m.CreateSketch("avengers", abstract.CML, props); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if err := m.AddToSketch("avengers", abstract.CML, []string{"havoc"}); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	ops, _, err := m.OpsSince(context.Background(), 0, 100)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	op := ops[len(ops)-1]
+	if op.Kind != OpSet {
+		t.Fatal("expected last op to be OpSet, got", op.Kind)
+	}
+	if err := m.AddToSketch("avengers", abstract.CML, []string{"cyclops"}); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if adds := op.Info.State["adds"]; adds != 1 {
+		t.Error("expected logged adds == 1, got", adds)
+	}
+}
+
+func TestOpLogOrder(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	m1.EnableOpLog(10000)
+	if err := m1.CreateSketch("avengers", abstract.Dict, nil); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	// Whether a hero is left depends on the order of the adds and purges
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				var err error
+				value := []string{fmt.Sprintf("hero%d", j%4)}
+				if i%2 == 0 {
+					err = m1.AddToSketch("avengers", abstract.Dict, value)
+				} else {
+					err = m1.DeleteFromSketch("avengers", abstract.Dict, value)
+				}
+				if err != nil {
+					t.Error("Expected no errors, got", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	store, err := storage.NewBackend(storage.MemoryBackend)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	m2, err := newManagerWithStorage(store)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	ops, _, err := m1.OpsSince(context.Background(), 0, 10000)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	for _, op := range ops {
+		if err := m2.ApplyOp(op); err != nil {
+			t.Error("Expected no errors, got", err)
+		}
+	}
+
+	heroes := []string{"hero0", "hero1", "hero2", "hero3"}
+	res1, err := m1.GetCountForSketch("avengers", abstract.Dict, heroes)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	res2, err := m2.GetCountForSketch("avengers", abstract.Dict, heroes)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(res1["result"], res2["result"]) {
+		t.Errorf("expected replayed counts %v, got %v", res1["result"], res2["result"])
+	}
+}
+
+func TestOpLogCoalescesStates(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	m.EnableOpLog(100)
+	props := map[string]float64{"epsilon": 0.5}
+	if err := m.CreateSketch("avengers", abstract.CML, props); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := m.AddToSketch("avengers", abstract.CML, []string{"havoc"}); err != nil {
+			t.Error("Expected no errors, got", err)
+		}
+	}
+	ops, last, err := m.OpsSince(context.Background(), 0, 100)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if len(ops) != 2 || ops[1].Kind != OpSet {
+		t.Fatal("expected a create and a single set op, got", len(ops))
+	}
+	if adds := ops[1].Info.State["adds"]; adds != 10 {
+		t.Error("expected logged adds == 10, got", adds)
+	}
+
+	// Writes after the state was read are recorded in a new OpSet
+	if err := m.AddToSketch("avengers", abstract.CML, []string{"havoc"}); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	ops, _, err = m.OpsSince(context.Background(), last, 100)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if len(ops) != 1 || ops[0].Kind != OpSet {
+		t.Fatal("expected a single set op, got", len(ops))
+	}
+	if adds := ops[0].Info.State["adds"]; adds != 11 {
+		t.Error("expected logged adds == 11, got", adds)
+	}
+}
+
+func TestListSketches(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	props := map[string]float64{"capacity": 100.0}
+	for _, id := range []string{"x-men", "avengers", "x-force", "defenders"} {
+		if err := m1.CreateSketch(id, "hllpp", props); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m1.CreateSketch("x-factor", "topk", props); err != nil {
+		t.Fatal(err)
+	}
+	m1.AddToSketch("x-men", "hllpp", []string{"cyclops", "storm"})
+
+	entries, next, err := m1.ListSketches("hllpp", "x-", "", 0)
+	if err != nil {
+		t.Error("Expected no errors while listing sketches, got", err)
+	}
+	if next != "" {
+		t.Error("Expected no next cursor, got", next)
+	}
+	if len(entries) != 2 {
+		t.Fatal("Expected 2 sketches, got", len(entries))
+	}
+	if entries[0].ID != "x-force" || entries[1].ID != "x-men" {
+		t.Error("Expected [x-force x-men], got", entries[0].ID, entries[1].ID)
+	}
+	if entries[1].Adds != 1 {
+		t.Error("Expected 1 add on x-men, got", entries[1].Adds)
+	}
+
+	entries, next, err = m1.ListSketches("", "", "", 2)
+	if err != nil {
+		t.Error("Expected no errors while listing sketches, got", err)
+	}
+	if len(entries) != 2 || next != "hllpp/defenders" {
+		t.Fatal("Expected 2 sketches and cursor hllpp/defenders, got", len(entries), next)
+	}
+	entries, next, err = m1.ListSketches("", "", next, 2)
+	if len(entries) != 2 || entries[0].ID != "x-force" {
+		t.Fatal("Expected x-force to start the 2nd page, got", entries)
+	}
+	entries, next, err = m1.ListSketches("", "", next, 2)
+	if len(entries) != 1 || next != "" || entries[0].Type != "topk" {
+		t.Error("Expected last page to hold topk/x-factor only, got", entries, next)
+	}
+
+	// Listing and reading the info of sketches does not race with writes
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m1.AddToSketch("x-men", "hllpp", []string{"wolverine"})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		m1.ListSketches("", "", "", 0)
+		if info, err := m1.GetSketchInfo("x-men", "hllpp"); err != nil || info.State["adds"] == 0 {
+			t.Fatal("Expected the info of x-men, got", info, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestAutoCreateSketch(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	err = m1.AddToSketchAutoCreate("avengers", "topk", []string{"hulk"}, false)
+	if err == nil {
+		t.Error("Expected error adding to unknown sketch without auto-create, got", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m1.AddToSketchAutoCreate("avengers", "topk", []string{"hulk"}, true); err != nil {
+				t.Error("Expected no errors while auto-creating sketch, got", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sketches, _ := m1.GetSketches()
+	if len(sketches) != 1 {
+		t.Fatal("Expected exactly 1 sketch, got", len(sketches))
+	}
+	info, err := m1.GetSketchInfo("avengers", "topk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State["adds"] != 50 {
+		t.Error("Expected 50 adds, got", info.State["adds"])
+	}
+	if info.Properties["capacity"] != 100 {
+		t.Error("Expected default capacity 100, got", info.Properties["capacity"])
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	conf := config.GetConfig()
+	conf.Templates = map[string]*config.Template{
+		"seen": {
+			Pattern:    "seen-*",
+			Type:       abstract.TopK,
+			Properties: map[string]float64{"capacity": 10},
+		},
+		"seen-more": {
+			Pattern:    "seen-more-*",
+			Type:       abstract.TopK,
+			Properties: map[string]float64{"capacity": 20},
+		},
+	}
+	defer func() { conf.Templates = nil }()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	err = m1.CreateSketch("seen-marvel", abstract.TopK, map[string]float64{"capacity": 20})
+	if err == nil {
+		t.Error("Expected error creating sketch not matching its template, got", err)
+	}
+	props := make(map[string]float64)
+	err = m1.CreateSketch("seen-marvel", abstract.TopK, props)
+	if err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	if len(props) != 0 {
+		t.Error("Expected the properties given to be left as is, got", props)
+	}
+	info, _ := m1.GetSketchInfo("seen-marvel", abstract.TopK)
+	if info.Properties["capacity"] != 10 {
+		t.Error("Expected capacity 10 from template, got", info.Properties["capacity"])
+	}
+
+	err = m1.CreateSketchFromTemplate("dc", abstract.TopK, "seen")
+	if err == nil {
+		t.Error("Expected error creating sketch not matching template pattern, got", err)
+	}
+	err = m1.CreateSketchFromTemplate("seen-dc", abstract.TopK, "seen")
+	if err != nil {
+		t.Error("Expected no errors while creating sketch from template, got", err)
+	}
+	// Only the template given counts, not the first one matching
+	err = m1.CreateSketchFromTemplate("seen-more-dc", abstract.TopK, "seen-more")
+	if err != nil {
+		t.Error("Expected no errors while creating sketch from overlapping template, got", err)
+	}
+	info, _ = m1.GetSketchInfo("seen-more-dc", abstract.TopK)
+	if info.Properties["capacity"] != 20 || info.Template != "seen-more" {
+		t.Error("Expected capacity 20 from template seen-more, got", info)
+	}
+
+	err = m1.AddToSketchAutoCreate("seen-image", abstract.TopK, []string{"spawn"}, true)
+	if err != nil {
+		t.Error("Expected no errors while auto-creating sketch, got", err)
+	}
+	info, _ = m1.GetSketchInfo("seen-image", abstract.TopK)
+	if info.Properties["capacity"] != 10 {
+		t.Error("Expected capacity 10 from template, got", info.Properties["capacity"])
+	}
+}
+
+func TestHashedSketches(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+
+	xx1 := SketchOptions{Hash: hashing.XXHash, Seed: 1}
+	if err := m1.CreateSketchWithOptions("marvel", abstract.HLLPP, nil, xx1); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	if err := m1.CreateSketchWithOptions("x-men", abstract.HLLPP, nil, xx1); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	opts := SketchOptions{Hash: hashing.XXHash, Seed: 2}
+	if err := m1.CreateSketchWithOptions("dc", abstract.HLLPP, nil, opts); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	if err := m1.CreateSketch("image", abstract.HLLPP, nil); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	opts = SketchOptions{Hash: hashing.Murmur3}
+	if err := m1.CreateSketchWithOptions("avengers", abstract.TopK, nil, opts); err == nil {
+		t.Error("Expected error choosing the hash function of a topk sketch")
+	}
+	opts = SketchOptions{Hash: "md5"}
+	if err := m1.CreateSketchWithOptions("avengers", abstract.CML, nil, opts); err == nil {
+		t.Error("Expected error choosing an unknown hash function")
+	}
+	opts = SketchOptions{Seed: 3}
+	if err := m1.CreateSketchWithOptions("avengers", abstract.HLLPP, nil, opts); err == nil {
+		t.Error("Expected error choosing a seed without a hash function")
+	}
+
+	m1.AddToSketch("marvel", abstract.HLLPP, []string{"wolverine", "storm", "deadpool"})
+	m1.AddToSketch("x-men", abstract.HLLPP, []string{"wolverine", "cyclops"})
+	m1.AddToSketch("dc", abstract.HLLPP, []string{"batman"})
+	m1.AddToSketch("image", abstract.HLLPP, []string{"spawn"})
+
+	if err := m1.MergeSketches("marvel", abstract.HLLPP, []string{"x-men"}); err != nil {
+		t.Error("Expected no errors while merging sketches, got", err)
+	}
+	if err := m1.MergeSketches("marvel", abstract.HLLPP, []string{"dc"}); err == nil {
+		t.Error("Expected error merging sketches with different seeds")
+	}
+	if err := m1.MergeSketches("marvel", abstract.HLLPP, []string{"image"}); err == nil {
+		t.Error("Expected error merging sketches with different hash functions")
+	}
+
+	// The hash function must survive a reload
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	info, _ := m2.GetSketchInfo("marvel", abstract.HLLPP)
+	if info.Hash != hashing.XXHash || info.Seed != 1 {
+		t.Errorf("Expected hash xxhash with seed 1, got %s with seed %d", info.Hash, info.Seed)
+	}
+	m2.AddToSketch("marvel", abstract.HLLPP, []string{"storm"})
+	res, err := m2.GetCountForSketch("marvel", abstract.HLLPP, nil)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if res["result"].(uint) != 4 {
+		t.Error("Expected marvel to have count 4, got", res["result"].(uint))
+	}
+}
+
+func TestDiskDict(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	err = m1.CreateSketch("avengers", abstract.Dict, map[string]float64{"disk": 1})
+	if err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	m1.AddToSketch("avengers", abstract.Dict, []string{"hulk", "thor", "hulk"})
+	m1.Destroy()
+
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	res, err := m2.GetCountForSketch("avengers", abstract.Dict, []string{"hulk"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if v := res["result"].(map[string]uint)["hulk"]; v != 2 {
+		t.Error("Expected hulk to have count 2, got", v)
+	}
+
+	if err := m2.DeleteSketch("avengers", abstract.Dict); err != nil {
+		t.Error("Expected no errors while deleting sketch, got", err)
+	}
+	path := filepath.Join(config.GetConfig().DataDir, "avengers.dict.db")
+	if ok, _ := exists(path); ok {
+		t.Error("Expected the database of the sketch to be deleted")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	conf.MemoryBudget = 1
+	defer func() { conf.MemoryBudget = 0 }()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	for _, id := range []string{"marvel", "dc", "image"} {
+		if err := m1.CreateSketch(id, abstract.Dict, nil); err != nil {
+			t.Error("Expected no errors while creating sketch, got", err)
+		}
+		if err := m1.AddToSketch(id, abstract.Dict, []string{id, id}); err != nil {
+			t.Error("Expected no errors while adding to sketch, got", err)
+		}
+	}
+
+	stats := m1.GetMemoryStats()
+	if stats.Evictions == 0 {
+		t.Error("Expected sketches to be evicted, got", stats)
+	}
+	if stats.Resident != 1 {
+		t.Error("Expected 1 sketch in memory, got", stats.Resident)
+	}
+
+	res, err := m1.GetCountForSketch("marvel", abstract.Dict, []string{"marvel"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if v := res["result"].(map[string]uint)["marvel"]; v != 2 {
+		t.Error("Expected marvel to have count 2, got", v)
+	}
+	if stats := m1.GetMemoryStats(); stats.Loads == 0 {
+		t.Error("Expected the evicted sketch to be loaded again, got", stats)
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if err := m1.CreateSketch("marvel", abstract.Dict, nil); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = fmt.Sprintf("hero-%d", i)
+	}
+	if err := m1.AddToSketch("marvel", abstract.Dict, values); err != nil {
+		t.Error("Expected no errors while adding to sketch, got", err)
+	}
+
+	// A dict takes more memory than its serialized counts
+	sketch := m1.sketches["marvel."+abstract.Dict]
+	sketch.lock.Lock()
+	sketch.save(true)
+	sketch.lock.Unlock()
+	if size, serialized := sketch.size(), sketch.State["size"]; size <= serialized {
+		t.Errorf("Expected a memory size above the serialized %d bytes, got %d", serialized, size)
+	}
+	if _, err := m1.GetCountForSketch("marvel", abstract.Dict, nil); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if stats := m1.GetMemoryStats(); stats.Used != sketch.size() {
+		t.Error("Expected the memory size to be used, got", stats)
+	}
+}
+
+func TestCompressedSketch(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	opts := SketchOptions{Compression: "gzip"}
+	if err := m1.CreateSketchWithOptions("marvel", abstract.Bloom, nil, opts); err == nil {
+		t.Error("Expected error creating sketch with unknown compression")
+	}
+	opts = SketchOptions{Compression: storage.CompressionSnappy}
+	if err := m1.CreateSketchWithOptions("marvel", abstract.Bloom, map[string]float64{"capacity": 100000}, opts); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	m1.AddToSketch("marvel", abstract.Bloom, []string{"wolverine", "storm"})
+
+	info, _ := m1.GetSketchInfo("marvel", abstract.Bloom)
+	if info.State["stored_size"] == 0 || info.State["stored_size"] >= info.State["size"]/10 {
+		t.Errorf("Expected a mostly empty bloom to compress well, got %d of %d bytes", info.State["stored_size"], info.State["size"])
+	}
+
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	res, err := m2.GetCountForSketch("marvel", abstract.Bloom, []string{"wolverine", "cyclops"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	result := res["result"].(map[string]bool)
+	if !result["wolverine"] || result["cyclops"] {
+		t.Error("Expected only wolverine to be a member, got", result)
+	}
+
+	// Compressing would make saving a sketch spanning several slices rewrite
+	// all of them
+	conf := config.GetConfig()
+	conf.SliceSize = 1
+	defer func() { conf.SliceSize = 0 }()
+	if err := m2.CreateSketchWithOptions("xmen", abstract.Bloom, map[string]float64{"capacity": 16 << 20}, opts); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	m2.AddToSketch("xmen", abstract.Bloom, []string{"wolverine"})
+	info, _ = m2.GetSketchInfo("xmen", abstract.Bloom)
+	if info.State["stored_size"] < info.State["size"] {
+		t.Errorf("Expected a bloom of several slices to be stored raw, got %d of %d bytes", info.State["stored_size"], info.State["size"])
+	}
+}
+
+func TestMigrateAndQuarantine(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	for _, id := range []string{"marvel", "dc"} {
+		if err := m1.CreateSketch(id, abstract.HLLPP, nil); err != nil {
+			t.Error("Expected no errors while creating sketch, got", err)
+		}
+		m1.AddToSketch(id, abstract.HLLPP, []string{"wolverine", "storm"})
+	}
+	m1.Destroy()
+
+	// Strip the envelope of marvel as if it was written by an older version
+	// and corrupt dc
+	path := filepath.Join(config.GetConfig().DataDir, "marvel.hllpp")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := storage.Unwrap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, payload, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dcPath := filepath.Join(config.GetConfig().DataDir, "dc.hllpp")
+	if err := ioutil.WriteFile(dcPath, []byte("batman"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.GetConfig()
+	conf.Quarantine = false
+	if _, err := newManager(); err == nil {
+		t.Error("Expected error loading a corrupted sketch without quarantine")
+	}
+	conf.Quarantine = true
+	defer func() { conf.Quarantine = false }()
+
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	res, err := m2.GetCountForSketch("marvel", abstract.HLLPP, nil)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if res["result"].(uint) != 2 {
+		t.Error("Expected 2 values in migrated sketch, got", res["result"])
+	}
+	data, _ = ioutil.ReadFile(path)
+	if v := storage.Version(data); v != storage.FormatVersion {
+		t.Errorf("Expected data migrated to format version %d, got %d", storage.FormatVersion, v)
+	}
+
+	if _, err := m2.GetSketchInfo("dc", abstract.HLLPP); err == nil {
+		t.Error("Expected the corrupted sketch to be quarantined")
+	}
+	quarantined := filepath.Join(config.GetConfig().DataDir, "quarantine", "dc.hllpp")
+	if ok, _ := exists(quarantined); !ok {
+		t.Error("Expected the data of the corrupted sketch in", quarantined)
+	}
+	if ok, _ := exists(quarantined + ".info"); !ok {
+		t.Error("Expected the info of the corrupted sketch next to its data")
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	defer func() { conf.Storage = "" }()
+
+	for _, name := range []string{storage.BoltBackend, storage.MemoryBackend} {
+		storage.Close()
+		conf.Storage = name
+
+		m1, err := newManager()
+		if err != nil {
+			t.Error("Expected no errors, got", err)
+		}
+		if err := m1.CreateSketch("marvel", abstract.Dict, nil); err != nil {
+			t.Error("Expected no errors while creating sketch, got", err)
+		}
+		m1.AddToSketch("marvel", abstract.Dict, []string{"wolverine", "wolverine"})
+		if err := m1.CreateSketch("avengers", abstract.Dict, map[string]float64{"disk": 1}); err != nil {
+			t.Errorf("Expected no errors creating a disk backed dict with %s storage, got %s", name, err)
+		}
+		m1.AddToSketch("avengers", abstract.Dict, []string{"hulk", "hulk", "hulk"})
+		m1.Destroy()
+
+		m2, err := newManager()
+		if err != nil {
+			t.Error("Expected no errors, got", err)
+		}
+		res, err := m2.GetCountForSketch("marvel", abstract.Dict, []string{"wolverine"})
+		if err != nil {
+			t.Errorf("Expected no errors with %s storage, got %s", name, err)
+			continue
+		}
+		if v := res["result"].(map[string]uint)["wolverine"]; v != 2 {
+			t.Errorf("Expected wolverine to have count 2 with %s storage, got %d", name, v)
+		}
+		res, err = m2.GetCountForSketch("avengers", abstract.Dict, []string{"hulk"})
+		if err != nil {
+			t.Errorf("Expected no errors with %s storage, got %s", name, err)
+		} else if v := res["result"].(map[string]uint)["hulk"]; v != 3 {
+			t.Errorf("Expected hulk to have count 3 with %s storage, got %d", name, v)
+		}
+		m2.Destroy()
+	}
+	storage.Close()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if err := m1.CreateSketch("marvel", abstract.HLLPP, nil); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	if err := m1.CreateSketch("marvel", abstract.Dict, nil); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	if err := m1.CreateDomain("dc", map[string]map[string]float64{abstract.HLLPP: nil}); err != nil {
+		t.Error("Expected no errors while creating domain, got", err)
+	}
+	m1.AddToSketch("marvel", abstract.HLLPP, []string{"wolverine", "storm"})
+	m1.AddToSketch("marvel", abstract.Dict, []string{"wolverine", "wolverine"})
+	m1.AddToSketch("dc", abstract.HLLPP, []string{"batman"})
+
+	var buf bytes.Buffer
+	if err := m1.Snapshot(&buf); err != nil {
+		t.Error("Expected no errors while taking snapshot, got", err)
+	}
+	snapshot := buf.Bytes()
+
+	// Restore into an empty instance
+	tearDownTests()
+	m2, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	result, err := m2.Restore(bytes.NewReader(snapshot), RestoreSkip)
+	if err != nil {
+		t.Error("Expected no errors while restoring, got", err)
+	}
+	if len(result.Restored) != 3 || len(result.Failed) != 0 {
+		t.Error("Expected 3 restored sketches, got", result)
+	}
+	res, err := m2.GetCountForSketch("marvel", abstract.HLLPP, nil)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if res["result"].(uint) != 2 {
+		t.Error("Expected marvel to have count 2, got", res["result"].(uint))
+	}
+	res, err = m2.GetCountForSketch("marvel", abstract.Dict, []string{"wolverine"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if v := res["result"].(map[string]uint)["wolverine"]; v != 2 {
+		t.Error("Expected wolverine to have count 2, got", v)
+	}
+	if domains, _ := m2.GetDomains(); len(domains) != 1 || domains[0].ID != "dc" {
+		t.Error("Expected domain dc to be restored, got", domains)
+	}
+
+	// The restored sketches must survive a reload
+	m3, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if res, err := m3.GetCountForSketch("dc", abstract.HLLPP, nil); err != nil || res["result"].(uint) != 1 {
+		t.Error("Expected dc to have count 1, got", res, err)
+	}
+
+	// Restore into an existing instance
+	m3.AddToSketch("marvel", abstract.HLLPP, []string{"cyclops"})
+	result, err = m3.Restore(bytes.NewReader(snapshot), RestoreSkip)
+	if err != nil || len(result.Skipped) != 3 {
+		t.Error("Expected 3 skipped sketches, got", result, err)
+	}
+	result, err = m3.Restore(bytes.NewReader(snapshot), RestoreMerge)
+	if err != nil {
+		t.Error("Expected no errors while restoring, got", err)
+	}
+	if len(result.Merged) != 2 || len(result.Failed) != 1 {
+		t.Error("Expected 2 merged and 1 failed sketch, got", result)
+	}
+	if res, _ := m3.GetCountForSketch("marvel", abstract.HLLPP, nil); res["result"].(uint) != 3 {
+		t.Error("Expected marvel to have count 3, got", res["result"].(uint))
+	}
+	result, err = m3.Restore(bytes.NewReader(snapshot), RestoreOverwrite)
+	if err != nil || len(result.Restored) != 3 {
+		t.Error("Expected 3 restored sketches, got", result, err)
+	}
+	if res, _ := m3.GetCountForSketch("marvel", abstract.HLLPP, nil); res["result"].(uint) != 2 {
+		t.Error("Expected marvel to have count 2, got", res["result"].(uint))
+	}
+
+	if _, err := m3.Restore(bytes.NewReader(snapshot), "replace"); err == nil {
+		t.Error("Expected error restoring with unknown conflict mode")
+	}
+	corrupted := append([]byte(nil), snapshot...)
+	// Flip a byte of a file listed in the manifest
+	corrupted[bytes.LastIndex(corrupted, []byte(`"id"`))+1] = 'x'
+	if _, err := m3.Restore(bytes.NewReader(corrupted), RestoreSkip); err == nil {
+		t.Error("Expected error restoring a corrupted snapshot")
+	}
+
+	// Replacements are decoded before the sketch is deleted
+	info, _ := m3.GetSketchInfo("marvel", abstract.HLLPP)
+	if err := m3.setSketch(info, []byte("garbage")); err == nil {
+		t.Error("Expected error replacing a sketch with invalid data")
+	}
+	if res, err := m3.GetCountForSketch("marvel", abstract.HLLPP, nil); err != nil || res["result"].(uint) != 2 {
+		t.Error("Expected marvel to be kept with count 2, got", res, err)
+	}
+	if err := m3.CreateSketch("avengers", abstract.Dict, map[string]float64{"disk": 1}); err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	m3.AddToSketch("avengers", abstract.Dict, []string{"hulk"})
+	data, err := m3.ExportSketch("avengers", abstract.Dict)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	m3.AddToSketch("avengers", abstract.Dict, []string{"hulk"})
+	info, _ = m3.GetSketchInfo("avengers", abstract.Dict)
+	if err := m3.setSketch(info, data); err != nil {
+		t.Error("Expected no errors replacing a disk backed dict, got", err)
+	}
+	res, err = m3.GetCountForSketch("avengers", abstract.Dict, []string{"hulk"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if v := res["result"].(map[string]uint)["hulk"]; v != 1 {
+		t.Error("Expected hulk to have count 1 after replacing avengers, got", v)
+	}
+}
+
+func TestExportImportSketch(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	m1, err := newManager()
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	err = m1.CreateSketch("avengers", abstract.Dict, map[string]float64{"disk": 1})
+	if err != nil {
+		t.Error("Expected no errors while creating sketch, got", err)
+	}
+	m1.AddToSketch("avengers", abstract.Dict, []string{"hulk", "thor", "hulk"})
+
+	data, err := m1.ExportSketch("avengers", abstract.Dict)
+	if err != nil {
+		t.Error("Expected no errors while exporting sketch, got", err)
+	}
+	if _, err := m1.ImportSketch("avengers", abstract.HLLPP, data, SketchOptions{}); err == nil {
+		t.Error("Expected error importing a dict as hllpp")
+	}
+	if _, err := m1.ImportSketch("avengers", abstract.Dict, data, SketchOptions{}); err == nil {
+		t.Error("Expected error merging into a dict")
+	}
+	merged, err := m1.ImportSketch("defenders", abstract.Dict, data, SketchOptions{})
+	if err != nil || merged {
+		t.Error("Expected defenders to be created, got", merged, err)
+	}
+
+	info, _ := m1.GetSketchInfo("defenders", abstract.Dict)
+	if info.Properties["disk"] != 1 {
+		t.Error("Expected the imported dict to be kept on disk, got", info.Properties)
+	}
+	res, err := m1.GetCountForSketch("defenders", abstract.Dict, []string{"hulk", "thor"})
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if v := res["result"].(map[string]uint); v["hulk"] != 2 || v["thor"] != 1 {
+		t.Error("Expected hulk to have count 2 and thor 1, got", v)
+	}
+
+	// New sketches are checked like created ones
+	conf := config.GetConfig()
+	conf.Templates = map[string]*config.Template{
+		"small": {Pattern: "small-*", Type: abstract.Dict, Properties: map[string]float64{"disk": 0}},
+	}
+	defer func() { conf.Templates = nil }()
+	if _, err := m1.ImportSketch("small-avengers", abstract.Dict, data, SketchOptions{}); err == nil {
+		t.Error("Expected error importing a sketch not matching its template")
+	}
+	if _, err := m1.ImportSketch("x-men", abstract.Dict, data, SketchOptions{ResetTTL: true}); err == nil {
+		t.Error("Expected error importing a sketch resetting its TTL without one")
+	}
+	if _, err := m1.ImportSketch("x-men", abstract.Dict, data, SketchOptions{TTL: 3600}); err != nil {
+		t.Error("Expected no errors importing a sketch with a TTL, got", err)
+	}
+	if info, _ := m1.GetSketchInfo("x-men", abstract.Dict); info.ExpiresAt == 0 {
+		t.Error("Expected x-men to expire, got", info)
+	}
+
+	store, _ := storage.NewBackend(storage.MemoryBackend)
+	m2, err := NewManagerWithStorage(store)
+	if err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if err := m2.EnableMultiMaster("m2"); err != nil {
+		t.Error("Expected no errors, got", err)
+	}
+	if _, err := m2.ImportSketch("avengers", abstract.Dict, data, SketchOptions{}); err != nil {
+		t.Error("Expected no errors importing a dict in multi-master mode, got", err)
+	}
+	m1.CreateSketch("villains", abstract.TopK, nil)
+	data, _ = m1.ExportSketch("villains", abstract.TopK)
+	if _, err := m2.ImportSketch("villains", abstract.TopK, data, SketchOptions{}); err == nil {
+		t.Error("Expected error importing a topk in multi-master mode")
+	}
+}
@@ -0,0 +1,142 @@
+package sketches
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+/*
+MemoryStats describes the memory used by the sketches held in memory
+*/
+type MemoryStats struct {
+	Budget    uint64 `json:"budget"`
+	Used      uint64 `json:"used"`
+	Resident  int    `json:"resident"`
+	Evictions uint64 `json:"evictions"`
+	Loads     uint64 `json:"loads"`
+}
+
+/*
+memoryTracker keeps the sketches held in memory in least recently used order
+and evicts the least recently used ones once their estimated memory size
+exceeds the budget. A budget of 0 disables eviction.
+*/
+type memoryTracker struct {
+	lock      sync.Mutex
+	budget    uint64
+	used      uint64
+	lru       *list.List // of *SketchProxy, most recently used first
+	elements  map[*SketchProxy]*list.Element
+	sizes     map[*SketchProxy]uint64
+	evictions uint64
+	loads     uint64
+}
+
+func newMemoryTracker(budget uint64) *memoryTracker {
+	return &memoryTracker{
+		budget:   budget,
+		lru:      list.New(),
+		elements: make(map[*SketchProxy]*list.Element),
+		sizes:    make(map[*SketchProxy]uint64),
+	}
+}
+
+/*
+use marks sp as most recently used and evicts the least recently used sketches
+while the budget is exceeded. The caller must not hold the lock of any sketch.
+*/
+func (mt *memoryTracker) use(sp *SketchProxy) {
+	size := sp.size()
+
+	mt.lock.Lock()
+	if elem, ok := mt.elements[sp]; ok {
+		mt.lru.MoveToFront(elem)
+		mt.used -= mt.sizes[sp]
+	} else {
+		mt.elements[sp] = mt.lru.PushFront(sp)
+	}
+	mt.sizes[sp] = size
+	mt.used += size
+
+	victims := make(map[*SketchProxy]uint64)
+	for elem := mt.lru.Back(); elem != nil && mt.budget > 0 && mt.used > mt.budget; {
+		victim := elem.Value.(*SketchProxy)
+		elem = elem.Prev()
+		if victim == sp {
+			continue
+		}
+		victims[victim] = mt.sizes[victim]
+		mt.removeLocked(victim)
+	}
+	mt.lock.Unlock()
+
+	// Sketches are locked while evicting, so this happens outside of mt.lock
+	for victim, size := range victims {
+		evicted := victim.evict()
+		mt.lock.Lock()
+		if evicted {
+			mt.evictions++
+		} else if _, ok := mt.elements[victim]; !ok {
+			// Dirty sketches stay in memory until they are saved
+			mt.elements[victim] = mt.lru.PushBack(victim)
+			mt.sizes[victim] = size
+			mt.used += size
+		}
+		mt.lock.Unlock()
+	}
+}
+
+/*
+loaded counts a sketch read back from storage
+*/
+func (mt *memoryTracker) loaded() {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	mt.loads++
+}
+
+/*
+remove stops tracking sp, e.g. when it is deleted
+*/
+func (mt *memoryTracker) remove(sp *SketchProxy) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	mt.removeLocked(sp)
+}
+
+func (mt *memoryTracker) removeLocked(sp *SketchProxy) {
+	if elem, ok := mt.elements[sp]; ok {
+		mt.lru.Remove(elem)
+		mt.used -= mt.sizes[sp]
+		delete(mt.elements, sp)
+		delete(mt.sizes, sp)
+	}
+}
+
+/*
+stats returns the current memory stats
+*/
+func (mt *memoryTracker) stats() MemoryStats {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	return MemoryStats{
+		Budget:    mt.budget,
+		Used:      mt.used,
+		Resident:  mt.lru.Len(),
+		Evictions: mt.evictions,
+		Loads:     mt.loads,
+	}
+}
+
+/*
+memorySize estimates the bytes sketch takes in memory, sketches which do not
+tell take about the size of their serialized form
+*/
+func memorySize(sketch abstract.Sketch, serialized int) uint64 {
+	if sized, ok := sketch.(abstract.SizedSketch); ok {
+		return sized.MemorySize()
+	}
+	return uint64(serialized)
+}
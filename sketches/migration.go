@@ -0,0 +1,71 @@
+package sketches
+
+import (
+	"fmt"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+/*
+migrations upgrade a data file from the format version they are keyed by to
+the next version, every change of the envelope or of how a sketch type is
+marshaled needs a new format version and a migration
+*/
+var migrations = map[int]func(info *abstract.Info, data []byte) ([]byte, error){
+	// Files written before the envelope hold the (maybe compressed) sketch
+	0: func(info *abstract.Info, data []byte) ([]byte, error) {
+		return storage.Wrap(envelopeHeader(info), data)
+	},
+}
+
+/*
+envelopeHeader returns the header of the data file of a sketch
+*/
+func envelopeHeader(info *abstract.Info) storage.Header {
+	return storage.Header{
+		Type:       info.Type,
+		InnerType:  info.InnerType,
+		Hash:       info.Hash,
+		Seed:       info.Seed,
+		Properties: info.Properties,
+	}
+}
+
+/*
+migrate upgrades a data file to the current format version, it returns
+whether the data was changed
+*/
+func migrate(info *abstract.Info, data []byte) ([]byte, bool, error) {
+	version := storage.Version(data)
+	if version > storage.FormatVersion {
+		return nil, false, fmt.Errorf("Format version %d of sketch %s is newer than %d", version, info.ID, storage.FormatVersion)
+	}
+	migrated := version < storage.FormatVersion
+	for ; version < storage.FormatVersion; version++ {
+		migration, ok := migrations[version]
+		if !ok {
+			return nil, false, fmt.Errorf("No migration of sketch %s from format version %d", info.ID, version)
+		}
+		var err error
+		if data, err = migration(info, data); err != nil {
+			return nil, false, fmt.Errorf("Error migrating sketch %s from format version %d: %s", info.ID, version, err)
+		}
+	}
+	return data, migrated, nil
+}
+
+/*
+checkHeader makes sure a data file belongs to the sketch described by info
+*/
+func checkHeader(info *abstract.Info, header storage.Header) error {
+	expected := envelopeHeader(info)
+	if header.Type != expected.Type || header.InnerType != expected.InnerType {
+		return fmt.Errorf("Data of sketch %s is of type %s, expected %s", info.ID, header.Type, info.Type)
+	}
+	if header.Hash != expected.Hash || header.Seed != expected.Seed {
+		return fmt.Errorf("Data of sketch %s was hashed with %s (seed %d), expected %s (seed %d)",
+			info.ID, header.Hash, header.Seed, info.Hash, info.Seed)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package sketches
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+/*
+Kinds of operations in the operation log. OpSet replaces a sketch with its
+whole state, it is recorded for changes which are not worth replaying like
+merges, imports and restores. The state is encoded when followers first read
+the OpSet, the changes of the sketch until then are part of it.
+*/
+const (
+	OpCreate       = "create"
+	OpDelete       = "delete"
+	OpAdd          = "add"
+	OpAddWeighted  = "add_weighted"
+	OpAddHashes    = "add_hashes"
+	OpAddPairs     = "add_pairs"
+	OpPurge        = "purge"
+	OpSet          = "set"
+	OpExpire       = "expire"
+	OpCreateDomain = "create_domain"
+	OpDeleteDomain = "delete_domain"
+)
+
+/*
+ErrOpsTruncated is returned for operations which are no longer in the log
+*/
+var ErrOpsTruncated = errors.New("Operations are no longer in the log")
+
+/*
+Op is a change of the sketches recorded in the operation log of a leader,
+followers apply it with ApplyOp
+*/
+type Op struct {
+	Seq       uint64
+	Kind      string
+	ID        string
+	Type      string
+	Info      *abstract.Info // OpCreate, OpSet and OpExpire
+	Data      []byte         // OpSet, the data file of the sketch
+	Values    []string
+	Timestamp int64 // OpAdd and OpAddHashes to rollups
+	Weighted  []WeightedValue
+	Hashes    []uint64
+	Pairs     []Pair
+	Domain    *abstract.Domain
+
+	sketch *SketchProxy // OpSet whose state is not encoded yet
+	state  *Op          // the encoded OpSet, guarded by the lock of sketch
+}
+
+/*
+opLog keeps the last operations of a leader
+*/
+type opLog struct {
+	epoch   int64
+	ops     []*Op // ring buffer
+	seq     uint64
+	lock    sync.Mutex
+	changed chan struct{} // closed when an operation is recorded
+}
+
+func newOpLog(size int) *opLog {
+	if size < 1 {
+		size = 1
+	}
+	return &opLog{
+		epoch:   time.Now().UnixNano(),
+		ops:     make([]*Op, size),
+		changed: make(chan struct{}),
+	}
+}
+
+/*
+hold is called by writes for their whole duration as defer m.hold()(). Writes
+hold the gate for reading while they change sketches and record their
+operations, which lets snapshots wait for them and match exactly one position
+in the operation log.
+*/
+func (m *ManagerStruct) hold() func() {
+	m.gate.RLock()
+	return m.gate.RUnlock
+}
+
+func (l *opLog) append(op *Op) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.seq++
+	op.Seq = l.seq
+	l.ops[l.seq%uint64(len(l.ops))] = op
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+/*
+holds tells if op is still in the log
+*/
+func (l *opLog) holds(op *Op) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.ops[op.Seq%uint64(len(l.ops))] == op
+}
+
+/*
+since returns up to max operations recorded after seq and the sequence number
+of the last recorded operation
+*/
+func (l *opLog) since(seq uint64, max int) ([]*Op, uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if seq > l.seq {
+		return nil, l.seq, fmt.Errorf("Sequence number %d is ahead of the log at %d", seq, l.seq)
+	}
+	if l.seq-seq > uint64(len(l.ops)) {
+		return nil, l.seq, ErrOpsTruncated
+	}
+	n := int(l.seq - seq)
+	if n > max {
+		n = max
+	}
+	ops := make([]*Op, n)
+	for i := range ops {
+		ops[i] = l.ops[(seq+uint64(i)+1)%uint64(len(l.ops))]
+	}
+	return ops, l.seq, nil
+}
+
+/*
+wait blocks until an operation after seq is recorded or ctx is done
+*/
+func (l *opLog) wait(ctx context.Context, seq uint64) {
+	l.lock.Lock()
+	changed := l.changed
+	recorded := l.seq > seq
+	l.lock.Unlock()
+	if recorded {
+		return
+	}
+	select {
+	case <-changed:
+	case <-ctx.Done():
+	}
+}
+
+/*
+EnableOpLog makes the manager record its changes in an operation log keeping
+the last size operations, which followers read with OpsSince
+*/
+func (m *ManagerStruct) EnableOpLog(size int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.oplog = newOpLog(size)
+}
+
+/*
+OpLogPosition returns the epoch of the operation log, which changes whenever
+the log is created, and the sequence number of its last operation
+*/
+func (m *ManagerStruct) OpLogPosition() (int64, uint64, error) {
+	if m.oplog == nil {
+		return 0, 0, errors.New("No operation log, the manager is not a leader")
+	}
+	m.oplog.lock.Lock()
+	defer m.oplog.lock.Unlock()
+	return m.oplog.epoch, m.oplog.seq, nil
+}
+
+/*
+OpsSince returns up to max operations recorded after seq, waiting until ctx is
+done for one if there are none yet, and the sequence number of the last
+operation. ErrOpsTruncated is returned if operations after seq were dropped
+from the log.
+*/
+func (m *ManagerStruct) OpsSince(ctx context.Context, seq uint64, max int) ([]*Op, uint64, error) {
+	if m.oplog == nil {
+		return nil, 0, errors.New("No operation log, the manager is not a leader")
+	}
+	m.oplog.wait(ctx, seq)
+	ops, last, err := m.oplog.since(seq, max)
+	for i, op := range ops {
+		if op.sketch != nil {
+			ops[i] = op.sketch.encodeState(op)
+		}
+	}
+	return ops, last, err
+}
+
+/*
+SnapshotAt writes a snapshot like Snapshot and returns the sequence number of
+the last operation of the log it contains, no write is running meanwhile
+*/
+func (m *ManagerStruct) SnapshotAt(w io.Writer) (uint64, error) {
+	if m.oplog == nil {
+		return 0, errors.New("No operation log, the manager is not a leader")
+	}
+	m.gate.Lock()
+	defer m.gate.Unlock()
+	_, seq, _ := m.OpLogPosition()
+	return seq, m.writeSnapshot(w)
+}
+
+/*
+record records an operation in the operation log and marks its sketch as
+changed for the peers of a multi-master node
+*/
+func (m *ManagerStruct) record(op *Op) {
+	m.oplog.append(op)
+	m.replicas.changed(fmt.Sprintf("%s.%s", op.ID, op.Type), op.Kind == OpDelete)
+}
+
+/*
+recordWrite records a write to a sketch as op, or as the whole resulting
+sketch if replaying op would not give the same sketch or the state of the
+sketch is about to be read anyway. Writes that only partly succeeded have no
+op to replay. The caller must hold the lock of the sketch.
+*/
+func (m *ManagerStruct) recordWrite(sketch *SketchProxy, op *Op) {
+	if op == nil || sketch.randomized() || sketch.pending != nil {
+		m.logState(sketch)
+		return
+	}
+	m.record(op)
+}
+
+/*
+recordState records the whole state of a sketch as OpSet
+*/
+func (m *ManagerStruct) recordState(sketch *SketchProxy) {
+	sketch.lock.Lock()
+	defer sketch.lock.Unlock()
+	m.logState(sketch)
+}
+
+/*
+logState is recordState for callers holding the lock of the sketch. The
+state is only encoded once followers read it, until then the OpSet already
+in the log covers the change.
+*/
+func (m *ManagerStruct) logState(sketch *SketchProxy) {
+	m.replicas.changed(sketch.ID, false)
+	if m.oplog == nil {
+		return
+	}
+	if sketch.pending != nil && m.oplog.holds(sketch.pending) {
+		return
+	}
+	sketch.pending = &Op{Kind: OpSet, ID: sketchName(sketch.Info), Type: sketch.Type, sketch: sketch}
+	m.oplog.append(sketch.pending)
+}
+
+/*
+encodeState returns the OpSet of op with the state of the sketch, it is
+encoded when op is first read. Later changes of the sketch are recorded in
+another OpSet.
+*/
+func (sp *SketchProxy) encodeState(op *Op) *Op {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.fillState(op)
+	return op.state
+}
+
+/*
+fillState encodes the state of the sketch for op if it was not yet, the
+caller must hold the lock. Followers failing to apply an OpSet without data
+resync.
+*/
+func (sp *SketchProxy) fillState(op *Op) {
+	if op.state != nil {
+		return
+	}
+	if sp.pending == op {
+		sp.pending = nil
+	}
+	data, err := sp.encode(storage.CompressionSnappy)
+	if err != nil {
+		logger.Error.Printf("Error recording sketch %s: %s", sp.ID, err)
+	}
+	op.state = &Op{Seq: op.Seq, Kind: OpSet, ID: op.ID, Type: op.Type, Info: copyInfo(sp.Info), Data: data}
+}
+
+/*
+ApplyOp applies an operation recorded by a leader
+*/
+func (m *ManagerStruct) ApplyOp(op *Op) error {
+	switch op.Kind {
+	case OpCreate:
+		opts := SketchOptions{op.Info.InnerType, op.Info.Hash, op.Info.Seed, op.Info.Compression,
+			op.Info.TTL, op.Info.ExpiresAt, op.Info.ResetTTL, op.Info.Template}
+		props := make(map[string]float64)
+		for k, v := range op.Info.Properties {
+			props[k] = v
+		}
+		return m.CreateSketchWithOptions(op.ID, op.Type, props, opts)
+	case OpDelete:
+		// Sketches of domains are deleted one by one before the domain
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.deleteSketch(op.ID, op.Type)
+	case OpAdd:
+		if op.Timestamp != 0 {
+			return m.AddToSketchAt(op.ID, op.Type, op.Values, op.Timestamp, false)
+		}
+		return m.AddToSketchAutoCreate(op.ID, op.Type, op.Values, false)
+	case OpAddWeighted:
+		return m.AddWeightedToSketch(op.ID, op.Type, op.Weighted, false)
+	case OpAddHashes:
+		if op.Timestamp != 0 {
+			return m.AddHashesToSketchAt(op.ID, op.Type, op.Hashes, op.Timestamp, false)
+		}
+		return m.AddHashesToSketch(op.ID, op.Type, op.Hashes, false)
+	case OpAddPairs:
+		return m.AddPairsToSketch(op.ID, op.Type, op.Pairs)
+	case OpPurge:
+		_, err := m.PurgeFromSketch(op.ID, op.Type, op.Values)
+		return err
+	case OpSet:
+		return m.setSketch(op.Info, op.Data)
+	case OpExpire:
+		return m.SetExpiry(op.ID, op.Type, op.Info.TTL, op.Info.ExpiresAt, op.Info.ResetTTL)
+	case OpCreateDomain:
+		// The sketches of the domain were created by operations before
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.domains[op.Domain.ID] = op.Domain
+		return m.dumpDomain(op.Domain)
+	case OpDeleteDomain:
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.domains, op.ID)
+		return m.store.DeleteDomain(op.ID)
+	}
+	return fmt.Errorf("Unknown operation %s", op.Kind)
+}
+
+/*
+setSketch replaces a sketch (or creates it) with the given info and data
+*/
+func (m *ManagerStruct) setSketch(info *abstract.Info, data []byte) error {
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err := m.replaceSketch(info, data)
+	return err
+}
+
+/*
+opInfo copies what OpCreate needs of the info of a new sketch
+*/
+func opInfo(info *abstract.Info) *abstract.Info {
+	props := make(map[string]float64)
+	for k, v := range info.Properties {
+		props[k] = v
+	}
+	return &abstract.Info{
+		ID:          info.ID,
+		Type:        info.Type,
+		Properties:  props,
+		InnerType:   info.InnerType,
+		Hash:        info.Hash,
+		Seed:        info.Seed,
+		Compression: info.Compression,
+		TTL:         info.TTL,
+		ExpiresAt:   info.ExpiresAt,
+		ResetTTL:    info.ResetTTL,
+		Template:    info.Template,
+	}
+}
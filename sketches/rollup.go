@@ -0,0 +1,569 @@
+package sketches
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+/*
+Resolutions of the buckets of a rollup sketch, from fine to coarse
+*/
+const (
+	hourly = iota
+	daily
+	monthly
+)
+
+var resolutionNames = []string{"hour", "day", "month"}
+
+/*
+resolution returns the resolution with the given name, or -1 if name is empty
+*/
+func resolution(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	for res, resName := range resolutionNames {
+		if resName == name {
+			return res, nil
+		}
+	}
+	return -1, fmt.Errorf("Invalid resolution %s, expected %s, %s or %s", name,
+		resolutionNames[hourly], resolutionNames[daily], resolutionNames[monthly])
+}
+
+// Properties holding the number of buckets kept per resolution
+var retentionProperties = []string{"hours", "days", "months"}
+
+var defaultRetention = []float64{48, 90, 24}
+
+// clock returns the current time, bucket retention is relative to it
+var clock = time.Now
+
+// Values may be this far ahead of the end of the current hour, to allow for
+// the clocks of the clients
+const clockSkew = 5 * time.Minute
+
+/*
+rollupSketch keeps one sketch of its inner type per time bucket. Values are
+added to the bucket of their timestamp at the finest resolution that still
+keeps it, and buckets falling out of the retention of their resolution are
+merged into the bucket of the next coarser one (or dropped after the last).
+Every value is in exactly one bucket.
+*/
+type rollupSketch struct {
+	*abstract.Info
+	buckets [3]map[int64]abstract.Sketch // by resolution and start in unix seconds
+	aged    bool                         // buckets were aged since the last write was recorded
+	size    uint64                       // estimated memory size as of the last Marshal
+}
+
+/*
+rollupData is the serialized form of a rollup, all buckets are stored in one
+blob like the groups of a family
+*/
+type rollupData struct {
+	Resolutions []int
+	Starts      []int64
+	Buckets     [][]byte
+}
+
+/*
+RollupPoint is the result of a bucket (or of buckets merged to a coarser
+resolution) of a rollup sketch
+*/
+type RollupPoint struct {
+	Start      int64       `json:"start"`
+	Resolution string      `json:"resolution"`
+	Result     interface{} `json:"result"`
+}
+
+type pointsByStart []RollupPoint
+
+func (p pointsByStart) Len() int      { return len(p) }
+func (p pointsByStart) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pointsByStart) Less(i, j int) bool {
+	if p[i].Start == p[j].Start {
+		return p[i].Resolution < p[j].Resolution
+	}
+	return p[i].Start < p[j].Start
+}
+
+func newRollupSketch(info *abstract.Info) (*rollupSketch, error) {
+	// Buckets are merged as they age
+	switch info.InnerType {
+	case abstract.HLLPP, abstract.Bloom:
+	default:
+		return nil, fmt.Errorf("Invalid inner sketch type for rollup: %s, expected %s or %s", info.InnerType, abstract.HLLPP, abstract.Bloom)
+	}
+	for res, prop := range retentionProperties {
+		if info.Properties[prop] < 0 {
+			return nil, fmt.Errorf("Property %s of rollup must not be negative", prop)
+		}
+		if info.Properties[prop] == 0 {
+			info.Properties[prop] = defaultRetention[res]
+		}
+	}
+	r := &rollupSketch{Info: info}
+	for res := range r.buckets {
+		r.buckets[res] = make(map[int64]abstract.Sketch)
+	}
+	return r, nil
+}
+
+func unmarshalRollupSketch(info *abstract.Info, data []byte) (*rollupSketch, error) {
+	var rd rollupData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rd); err != nil {
+		return nil, err
+	}
+	r, err := newRollupSketch(info)
+	if err != nil {
+		return nil, err
+	}
+	for i, res := range rd.Resolutions {
+		if res < hourly || res > monthly {
+			return nil, fmt.Errorf("Invalid resolution %d of rollup bucket", res)
+		}
+		// Buckets are never disk backed, they need no storage
+		bucket, err := unmarshalSketch(nil, r.bucketInfo(res, rd.Starts[i]), rd.Buckets[i])
+		if err != nil {
+			return nil, err
+		}
+		r.buckets[res][rd.Starts[i]] = bucket
+	}
+	return r, nil
+}
+
+/*
+bucketInfo returns the info for the inner sketch of a bucket, inner sketches
+use the properties of the rollup
+*/
+func (r *rollupSketch) bucketInfo(res int, start int64) *abstract.Info {
+	props := make(map[string]float64)
+	for k, v := range r.Properties {
+		props[k] = v
+	}
+	for _, prop := range retentionProperties {
+		delete(props, prop)
+	}
+	return &abstract.Info{
+		ID:         fmt.Sprintf("%s[%s %d]", r.ID, resolutionNames[res], start),
+		Type:       r.InnerType,
+		Properties: props,
+		State:      make(map[string]uint64),
+		Hash:       r.Hash,
+		Seed:       r.Seed,
+	}
+}
+
+/*
+bucketStart returns the start of the bucket of resolution res holding t, in UTC
+*/
+func bucketStart(t time.Time, res int) time.Time {
+	t = t.UTC()
+	switch res {
+	case hourly:
+		return t.Truncate(time.Hour)
+	case daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+/*
+bucketEnd returns the start of the bucket following the one starting at start
+*/
+func bucketEnd(start int64, res int) int64 {
+	t := time.Unix(start, 0).UTC()
+	switch res {
+	case hourly:
+		return t.Add(time.Hour).Unix()
+	case daily:
+		return t.AddDate(0, 0, 1).Unix()
+	}
+	return t.AddDate(0, 1, 0).Unix()
+}
+
+/*
+cutoff returns the start of the oldest bucket of resolution res that is kept
+*/
+func (r *rollupSketch) cutoff(res int, now time.Time) int64 {
+	n := int(r.Properties[retentionProperties[res]]) - 1
+	start := bucketStart(now, res)
+	switch res {
+	case hourly:
+		return start.Add(-time.Duration(n) * time.Hour).Unix()
+	case daily:
+		return start.AddDate(0, 0, -n).Unix()
+	}
+	return start.AddDate(0, -n, 0).Unix()
+}
+
+/*
+place returns the finest resolution from res on that still keeps the bucket
+holding t and the start of that bucket, ok is false if t is too old for all
+*/
+func (r *rollupSketch) place(t time.Time, res int, now time.Time) (int, int64, bool) {
+	for ; res <= monthly; res++ {
+		if start := bucketStart(t, res).Unix(); start >= r.cutoff(res, now) {
+			return res, start, true
+		}
+	}
+	return 0, 0, false
+}
+
+/*
+bucket returns the bucket of resolution res starting at start, creating it
+*/
+func (r *rollupSketch) bucket(res int, start int64) (abstract.Sketch, error) {
+	if bucket, ok := r.buckets[res][start]; ok {
+		return bucket, nil
+	}
+	bucket, err := newSketch(nil, r.bucketInfo(res, start))
+	if err != nil {
+		return nil, err
+	}
+	r.buckets[res][start] = bucket
+	return bucket, nil
+}
+
+/*
+age merges the buckets that fell out of the retention of their resolution into
+the next coarser resolution keeping them
+*/
+func (r *rollupSketch) age(now time.Time) error {
+	for res := hourly; res <= monthly; res++ {
+		cutoff := r.cutoff(res, now)
+		for start, old := range r.buckets[res] {
+			if start >= cutoff {
+				continue
+			}
+			delete(r.buckets[res], start)
+			r.aged = true
+			if res == monthly {
+				continue
+			}
+			to, toStart, ok := r.place(time.Unix(start, 0), res+1, now)
+			if !ok {
+				continue
+			}
+			if err := r.mergeInto(to, toStart, old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rollupSketch) mergeInto(res int, start int64, other abstract.Sketch) error {
+	bucket, err := r.bucket(res, start)
+	if err != nil {
+		return err
+	}
+	mergeable, ok := bucket.(abstract.MergeableSketch)
+	if !ok {
+		return fmt.Errorf("Sketches of type %s can not be merged", r.InnerType)
+	}
+	return mergeable.Merge(other)
+}
+
+/*
+bucketAt ages the buckets and returns the bucket of t for n values, values
+older than the retention of all resolutions or ahead of the current hour are
+dropped and reported in the returned error
+*/
+func (r *rollupSketch) bucketAt(t time.Time, n int) (abstract.Sketch, error) {
+	now := clock()
+	if err := r.age(now); err != nil {
+		return nil, err
+	}
+	end := time.Unix(bucketEnd(bucketStart(now, hourly).Unix(), hourly), 0)
+	if !t.Before(end.Add(clockSkew)) {
+		return nil, fmt.Errorf("Rollup %s does not keep buckets for %s yet, dropped %d values", r.ID, t.UTC().Format(time.RFC3339), n)
+	}
+	res, start, ok := r.place(t, hourly, now)
+	if !ok {
+		return nil, fmt.Errorf("Rollup %s does not keep buckets for %s anymore, dropped %d values", r.ID, t.UTC().Format(time.RFC3339), n)
+	}
+	return r.bucket(res, start)
+}
+
+/*
+AddMultipleAt adds values to the bucket of t
+*/
+func (r *rollupSketch) AddMultipleAt(values [][]byte, t time.Time) (bool, error) {
+	bucket, err := r.bucketAt(t, len(values))
+	if err != nil {
+		return false, err
+	}
+	return bucket.AddMultiple(values)
+}
+
+/*
+AddHashesAt adds already computed 64-bit hashes to the bucket of t
+*/
+func (r *rollupSketch) AddHashesAt(hashes []uint64, t time.Time) (bool, error) {
+	bucket, err := r.bucketAt(t, len(hashes))
+	if err != nil {
+		return false, err
+	}
+	hashed, ok := bucket.(abstract.HashedSketch)
+	if !ok {
+		values := make([][]byte, len(hashes), len(hashes))
+		for i, hash := range hashes {
+			values[i] = hashBytes(hash)
+		}
+		return bucket.AddMultiple(values)
+	}
+	for _, hash := range hashes {
+		if ok, err := hashed.AddHash(hash); !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+/*
+selected returns the buckets overlapping the time range of query, an empty
+Since or Until leaves the range open
+*/
+func (r *rollupSketch) selected(query abstract.Query) map[int]map[int64]abstract.Sketch {
+	selected := make(map[int]map[int64]abstract.Sketch)
+	for res, buckets := range r.buckets {
+		selected[res] = make(map[int64]abstract.Sketch)
+		for start, bucket := range buckets {
+			if query.Until != 0 && start >= query.Until {
+				continue
+			}
+			if query.Since != 0 && bucketEnd(start, res) <= query.Since {
+				continue
+			}
+			selected[res][start] = bucket
+		}
+	}
+	return selected
+}
+
+/*
+merged returns a new sketch holding all given buckets
+*/
+func (r *rollupSketch) merged(buckets []abstract.Sketch) (abstract.Sketch, error) {
+	merged, err := newSketch(nil, r.bucketInfo(hourly, 0))
+	if err != nil {
+		return nil, err
+	}
+	mergeable, ok := merged.(abstract.MergeableSketch)
+	if !ok {
+		return nil, fmt.Errorf("Sketches of type %s can not be merged", r.InnerType)
+	}
+	for _, bucket := range buckets {
+		if err := mergeable.Merge(bucket); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+/*
+GetResult returns the result of the buckets in the time range of the query
+merged into one sketch or, if Series is set, a series of the results of each
+bucket ordered by start. Series with a Resolution merge the finer buckets into
+buckets of that resolution. Buckets only partly in the range count fully.
+*/
+func (r *rollupSketch) GetResult(values [][]byte, query abstract.Query) interface{} {
+	svalues := make([]string, len(values), len(values))
+	for i, value := range values {
+		svalues[i] = string(value)
+	}
+	inner := query
+	inner.Since, inner.Until, inner.Series, inner.Resolution = 0, 0, false, ""
+	selected := r.selected(query)
+
+	if !query.Series {
+		all := []abstract.Sketch{}
+		for _, buckets := range selected {
+			for _, bucket := range buckets {
+				all = append(all, bucket)
+			}
+		}
+		merged, err := r.merged(all)
+		if err != nil {
+			logger.Error.Println(err)
+			return nil
+		}
+		return getResult(r.InnerType, merged, svalues, inner)
+	}
+
+	// QuerySketch rejects unknown resolutions
+	target, _ := resolution(query.Resolution)
+	type seriesKey struct {
+		res   int
+		start int64
+	}
+	groups := make(map[seriesKey][]abstract.Sketch)
+	for res, buckets := range selected {
+		for start, bucket := range buckets {
+			key := seriesKey{res, start}
+			if res < target {
+				key = seriesKey{target, bucketStart(time.Unix(start, 0), target).Unix()}
+			}
+			groups[key] = append(groups[key], bucket)
+		}
+	}
+	series := []RollupPoint{}
+	for key, buckets := range groups {
+		merged, err := r.merged(buckets)
+		if err != nil {
+			logger.Error.Println(err)
+			return nil
+		}
+		result := getResult(r.InnerType, merged, svalues, inner)
+		series = append(series, RollupPoint{key.start, resolutionNames[key.res], result})
+	}
+	sort.Sort(pointsByStart(series))
+	return series
+}
+
+/*
+Merge merges the buckets of another rollup of the same inner type into this one
+*/
+func (r *rollupSketch) Merge(other abstract.Sketch) error {
+	o, ok := other.(*rollupSketch)
+	if !ok || o.InnerType != r.InnerType {
+		return errors.New("Can only merge rollups of the same inner type")
+	}
+	now := clock()
+	for res, buckets := range o.buckets {
+		for start, bucket := range buckets {
+			to, toStart, ok := r.place(time.Unix(start, 0), res, now)
+			if !ok {
+				continue
+			}
+			if err := r.mergeInto(to, toStart, bucket); err != nil {
+				return err
+			}
+		}
+	}
+	return r.age(now)
+}
+
+/*
+Add adds value to the bucket of the current time
+*/
+func (r *rollupSketch) Add(value []byte) (bool, error) {
+	return r.AddMultipleAt([][]byte{value}, clock())
+}
+
+/*
+AddMultiple adds values to the bucket of the current time
+*/
+func (r *rollupSketch) AddMultiple(values [][]byte) (bool, error) {
+	return r.AddMultipleAt(values, clock())
+}
+
+/*
+AddWeighted ...
+*/
+func (r *rollupSketch) AddWeighted(value []byte, count int64) (bool, error) {
+	return false, errors.New("Rollup sketches do not support weighted values")
+}
+
+/*
+Remove ...
+*/
+func (r *rollupSketch) Remove(value []byte) (bool, error) {
+	return false, errors.New("This Sketch type does not support deletion")
+}
+
+/*
+RemoveMultiple ...
+*/
+func (r *rollupSketch) RemoveMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("This Sketch type does not support deletion")
+}
+
+/*
+GetCount returns the count of all buckets merged
+*/
+func (r *rollupSketch) GetCount() uint {
+	all := []abstract.Sketch{}
+	for _, buckets := range r.buckets {
+		for _, bucket := range buckets {
+			all = append(all, bucket)
+		}
+	}
+	merged, err := r.merged(all)
+	if err != nil {
+		logger.Error.Println(err)
+		return 0
+	}
+	return merged.GetCount()
+}
+
+/*
+Clear ...
+*/
+func (r *rollupSketch) Clear() (bool, error) {
+	for res := range r.buckets {
+		r.buckets[res] = make(map[int64]abstract.Sketch)
+	}
+	return true, nil
+}
+
+/*
+GetFrequency returns the result of all buckets merged for values
+*/
+func (r *rollupSketch) GetFrequency(values [][]byte) interface{} {
+	return r.GetResult(values, abstract.Query{})
+}
+
+/*
+Marshal ...
+*/
+func (r *rollupSketch) Marshal() ([]byte, error) {
+	var rd rollupData
+	size := uint64(0)
+	for res, buckets := range r.buckets {
+		starts := make([]int64, 0, len(buckets))
+		for start := range buckets {
+			starts = append(starts, start)
+		}
+		sort.Sort(int64s(starts))
+		for _, start := range starts {
+			data, err := buckets[start].Marshal()
+			if err != nil {
+				return nil, err
+			}
+			rd.Resolutions = append(rd.Resolutions, res)
+			rd.Starts = append(rd.Starts, start)
+			rd.Buckets = append(rd.Buckets, data)
+			size += memorySize(buckets[start], len(data))
+		}
+	}
+	var network bytes.Buffer
+	if err := gob.NewEncoder(&network).Encode(rd); err != nil {
+		return nil, err
+	}
+	r.size = size
+	return network.Bytes(), nil
+}
+
+/*
+MemorySize estimates the bytes the buckets take in memory like the one of a
+family
+*/
+func (r *rollupSketch) MemorySize() uint64 {
+	return r.size
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,111 @@
+package sketches
+
+import (
+	"testing"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+func TestRollup(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	now := time.Date(2016, 3, 10, 12, 30, 0, 0, time.UTC)
+	defer func() { clock = time.Now }()
+	clock = func() time.Time { return now }
+
+	m1, err := newManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	if err := m1.CreateSketchWithOptions("visitors", abstract.Rollup, nil, SketchOptions{InnerType: abstract.CML}); err == nil {
+		t.Error("Expected error creating rollup of sketches that can not be merged, got", err)
+	}
+	props := map[string]float64{"hours": 2, "days": 3, "months": 2}
+	if err := m1.CreateSketchWithOptions("visitors", abstract.Rollup, props, SketchOptions{InnerType: abstract.HLLPP}); err != nil {
+		t.Fatal("Expected no errors while creating rollup, got", err)
+	}
+
+	adds := []struct {
+		at     time.Time
+		values []string
+	}{
+		{now, []string{"hulk", "thor"}},
+		{now.Add(-time.Hour), []string{"loki", "thor"}},
+		{now.Add(-5 * time.Hour), []string{"wasp"}},  // too old for hours
+		{now.AddDate(0, 0, -2), []string{"ant"}},     // oldest day
+		{now.AddDate(0, 0, -20), []string{"vision"}}, // too old for days
+		{now.AddDate(0, 0, -80), []string{"ultron"}}, // too old for months
+	}
+	for i, add := range adds {
+		err := m1.AddToSketchAt("visitors", abstract.Rollup, add.values, add.at.Unix(), false)
+		if (err != nil) != (i == len(adds)-1) {
+			t.Errorf("Expected only the last add to fail, got %v for add %d", err, i)
+		}
+	}
+
+	query := func(q abstract.Query) interface{} {
+		res, err := m1.QuerySketch("visitors", abstract.Rollup, nil, q)
+		if err != nil {
+			t.Fatal("Expected no errors while querying, got", err)
+		}
+		return res["result"]
+	}
+	if count := query(abstract.Query{}); count != uint(6) {
+		t.Error("Expected 6 visitors in all buckets, got", count)
+	}
+	today := time.Date(2016, 3, 10, 0, 0, 0, 0, time.UTC).Unix()
+	if count := query(abstract.Query{Since: today}); count != uint(4) {
+		t.Error("Expected 4 visitors today, got", count)
+	}
+
+	series := query(abstract.Query{Since: today - 2*24*3600, Series: true, Resolution: "day"}).([]RollupPoint)
+	if len(series) != 2 {
+		t.Fatal("Expected 2 days with visitors, got", series)
+	}
+	if series[0].Start != today-2*24*3600 || series[0].Result != uint(1) {
+		t.Error("Expected 1 visitor 2 days ago, got", series[0])
+	}
+	if series[1].Start != today || series[1].Resolution != "day" || series[1].Result != uint(4) {
+		t.Error("Expected the hours of today merged with the day, got", series[1])
+	}
+
+	if _, err := m1.QuerySketch("visitors", abstract.Rollup, nil, abstract.Query{Series: true, Resolution: "week"}); err == nil {
+		t.Error("Expected error querying an unknown resolution, got", err)
+	}
+
+	// Values can not be ahead of the current hour
+	if err := m1.AddToSketchAt("visitors", abstract.Rollup, []string{"kang"}, now.Add(2*time.Hour).Unix(), false); err == nil {
+		t.Error("Expected error adding values from the future")
+	}
+
+	// Hours falling out of retention are merged into their day by writes and
+	// the reaper, not by reads
+	now = now.Add(2 * time.Hour)
+	series = query(abstract.Query{Since: today, Series: true}).([]RollupPoint)
+	if len(series) != 3 {
+		t.Error("Expected reads to leave the buckets as they are, got", series)
+	}
+	m1.AgeRollups(now)
+	series = query(abstract.Query{Since: today, Series: true}).([]RollupPoint)
+	if len(series) != 1 || series[0].Resolution != "day" || series[0].Result != uint(4) {
+		t.Error("Expected one day bucket with 4 visitors, got", series)
+	}
+	if err := m1.AddToSketchAt("visitors", abstract.Rollup, []string{"hulk", "falcon"}, 0, false); err != nil {
+		t.Error("Expected no errors adding at the current time, got", err)
+	}
+
+	// Buckets are persisted in one blob and reloaded
+	m2, err := newManager()
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	res, err := m2.QuerySketch("visitors", abstract.Rollup, nil, abstract.Query{Series: true})
+	if err != nil {
+		t.Fatal("Expected no errors while querying, got", err)
+	}
+	series = res["result"].([]RollupPoint)
+	if len(series) != 4 || series[3].Resolution != "hour" || series[3].Result != uint(2) {
+		t.Error("Expected buckets of 2 days, a month and an hour, got", series)
+	}
+}
@@ -0,0 +1,414 @@
+package sketches
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+/*
+Ways to restore a sketch of a snapshot whose id is already taken: skip it,
+overwrite the existing sketch or merge it into the existing sketch
+*/
+const (
+	RestoreSkip      = "skip"
+	RestoreOverwrite = "overwrite"
+	RestoreMerge     = "merge"
+)
+
+const (
+	snapshotVersion  = 1
+	snapshotManifest = "manifest.json"
+)
+
+/*
+manifest lists the sketches and domains of a snapshot and the checksums of
+all other files in it
+*/
+type manifest struct {
+	Version  int             `json:"version"`
+	Created  int64           `json:"created"`
+	Sketches []string        `json:"sketches"`
+	Domains  []string        `json:"domains"`
+	Files    []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+/*
+RestoreResult lists what happened to each sketch of a restored snapshot
+*/
+type RestoreResult struct {
+	Restored []string          `json:"restored"`
+	Skipped  []string          `json:"skipped"`
+	Merged   []string          `json:"merged"`
+	Failed   map[string]string `json:"failed"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func infoFile(id string) string {
+	return "info/" + url.PathEscape(id) + ".json"
+}
+
+func dataFile(id string) string {
+	return "data/" + url.PathEscape(id)
+}
+
+func domainFile(id string) string {
+	return "domains/" + url.PathEscape(id) + ".json"
+}
+
+/*
+Snapshot writes a tar archive of all sketches and domains taken at a single
+point in time, writes wait until it is written.
+*/
+func (m *ManagerStruct) Snapshot(w io.Writer) error {
+	m.gate.Lock()
+	defer m.gate.Unlock()
+	return m.writeSnapshot(w)
+}
+
+/*
+writeSnapshot writes the sketches and domains as a tar archive, one sketch at
+a time so evicted sketches are read back one by one. The manifest comes last
+as it holds the checksums of all other files. The caller must hold the gate.
+*/
+func (m *ManagerStruct) writeSnapshot(w io.Writer) error {
+	m.lock.RLock()
+	ids := make([]string, 0, len(m.sketches))
+	sketches := make(map[string]*SketchProxy, len(m.sketches))
+	for id, sketch := range m.sketches {
+		ids = append(ids, id)
+		sketches[id] = sketch
+	}
+	domains := make(map[string][]byte, len(m.domains))
+	for id, domain := range m.domains {
+		data, err := json.Marshal(domain)
+		if err != nil {
+			m.lock.RUnlock()
+			return err
+		}
+		domains[id] = data
+	}
+	m.lock.RUnlock()
+	sort.Strings(ids)
+
+	man := &manifest{Version: snapshotVersion, Created: time.Now().Unix(), Sketches: ids}
+	tw := tar.NewWriter(w)
+	modTime := time.Unix(man.Created, 0)
+	write := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	add := func(name string, data []byte) error {
+		man.Files = append(man.Files, manifestEntry{name, len(data), checksum(data)})
+		return write(name, data)
+	}
+
+	for _, id := range ids {
+		info, data, err := sketches[id].snapshotFiles()
+		if err != nil {
+			return fmt.Errorf("Error snapshotting sketch %s: %s", id, err)
+		}
+		if err := add(infoFile(id), info); err != nil {
+			return err
+		}
+		if err := add(dataFile(id), data); err != nil {
+			return err
+		}
+	}
+	for id := range domains {
+		man.Domains = append(man.Domains, id)
+	}
+	sort.Strings(man.Domains)
+	for _, id := range man.Domains {
+		if err := add(domainFile(id), domains[id]); err != nil {
+			return err
+		}
+	}
+
+	manData, err := json.Marshal(man)
+	if err != nil {
+		return err
+	}
+	if err := write(snapshotManifest, manData); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+/*
+snapshotFiles returns the info and data files of a sketch in a snapshot
+*/
+func (sp *SketchProxy) snapshotFiles() ([]byte, []byte, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	info, err := json.Marshal(sp.Info)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := sp.encode(storage.CompressionSnappy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, data, nil
+}
+
+/*
+Restore loads the sketches and domains of a snapshot written by Snapshot,
+onConflict (RestoreSkip, RestoreOverwrite or RestoreMerge) decides what
+happens to sketches whose id is already taken. Domains are only restored if
+their id is free.
+*/
+func (m *ManagerStruct) Restore(r io.Reader, onConflict string) (*RestoreResult, error) {
+	switch onConflict {
+	case RestoreSkip, RestoreOverwrite, RestoreMerge:
+	default:
+		return nil, fmt.Errorf("Invalid conflict mode %s, expected %s, %s or %s", onConflict, RestoreSkip, RestoreOverwrite, RestoreMerge)
+	}
+	files, man, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.restore(files, man, onConflict)
+}
+
+/*
+restore loads the files of a snapshot, the caller must hold the write lock
+*/
+func (m *ManagerStruct) restore(files map[string][]byte, man *manifest, onConflict string) (*RestoreResult, error) {
+	result := &RestoreResult{[]string{}, []string{}, []string{}, make(map[string]string)}
+	for _, id := range man.Sketches {
+		var info abstract.Info
+		if err := json.Unmarshal(files[infoFile(id)], &info); err != nil {
+			result.Failed[id] = err.Error()
+			continue
+		}
+		if info.ID != id {
+			result.Failed[id] = fmt.Sprintf("Info of sketch %s has id %s", id, info.ID)
+			continue
+		}
+		data := files[dataFile(id)]
+
+		if existing, ok := m.sketches[id]; ok {
+			switch onConflict {
+			case RestoreSkip:
+				result.Skipped = append(result.Skipped, id)
+				continue
+			case RestoreMerge:
+				if err := mergeSnapshot(existing, &info, data); err != nil {
+					result.Failed[id] = err.Error()
+				} else {
+					m.recordState(existing)
+					result.Merged = append(result.Merged, id)
+				}
+				continue
+			}
+		}
+
+		if _, err := m.replaceSketch(&info, data); err != nil {
+			result.Failed[id] = err.Error()
+			continue
+		}
+		result.Restored = append(result.Restored, id)
+	}
+
+	for _, id := range man.Domains {
+		if _, ok := m.domains[id]; ok {
+			continue
+		}
+		var domain abstract.Domain
+		if err := json.Unmarshal(files[domainFile(id)], &domain); err != nil {
+			return result, err
+		}
+		m.domains[id] = &domain
+		m.oplog.append(&Op{Kind: OpCreateDomain, ID: id, Domain: &domain})
+		if err := m.dumpDomain(&domain); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+/*
+Resync replaces all sketches and domains with those of a snapshot, followers
+use it to catch up with their leader
+*/
+func (m *ManagerStruct) Resync(r io.Reader) error {
+	files, man, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	defer m.hold()()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keep := make(map[string]bool)
+	for _, id := range man.Sketches {
+		keep[id] = true
+	}
+	for id, sketch := range m.sketches {
+		if keep[id] {
+			continue
+		}
+		if err := m.deleteSketch(sketchName(sketch.Info), sketch.Type); err != nil {
+			return err
+		}
+	}
+	for id := range m.domains {
+		delete(m.domains, id)
+		m.oplog.append(&Op{Kind: OpDeleteDomain, ID: id})
+		if err := m.store.DeleteDomain(id); err != nil {
+			return err
+		}
+	}
+
+	result, err := m.restore(files, man, RestoreOverwrite)
+	if err != nil {
+		return err
+	}
+	for id, reason := range result.Failed {
+		return fmt.Errorf("Error resyncing sketch %s: %s", id, reason)
+	}
+	return nil
+}
+
+/*
+replaceSketch restores a sketch from a data file written by encodeSketch in
+place of the sketch with the same id, if there is one. The data is decoded
+before the existing sketch is deleted, which is kept if the data is invalid.
+The caller must hold the write lock.
+*/
+func (m *ManagerStruct) replaceSketch(info *abstract.Info, data []byte) (*SketchProxy, error) {
+	data, _, err := migrate(info, data)
+	if err != nil {
+		return nil, err
+	}
+	var sketch abstract.Sketch
+	_, exists := m.sketches[info.ID]
+	if exists && info.Properties["disk"] != 0 {
+		// Disk backed sketches decode into the KV of their id, which the
+		// existing sketch still uses, so only check their data for now
+		probe := *info
+		probe.Properties = map[string]float64{}
+		if _, err := decodeSketch(nil, &probe, data); err != nil {
+			return nil, err
+		}
+	} else if sketch, err = decodeSketch(m.store, info, data); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if err := m.deleteSketch(sketchName(info), info.Type); err != nil {
+			return nil, err
+		}
+	}
+	if sketch == nil {
+		if sketch, err = decodeSketch(m.store, info, data); err != nil {
+			return nil, err
+		}
+	}
+	sp, err := storeSketch(m.store, info, sketch)
+	if err != nil {
+		return nil, err
+	}
+	m.addSketch(sp)
+	m.recordState(sp)
+	return sp, nil
+}
+
+/*
+mergeSnapshot merges the sketch of a snapshot into an existing sketch built
+the same way
+*/
+func mergeSnapshot(existing *SketchProxy, info *abstract.Info, data []byte) error {
+	if existing.Type != info.Type || !sameHash(existing.Info, info) {
+		return fmt.Errorf("Can not merge sketch %s, it was built differently", info.ID)
+	}
+	if !existing.mergeable() {
+		return fmt.Errorf("Sketches of type %s can not be merged", info.Type)
+	}
+	data, _, err := migrate(info, data)
+	if err != nil {
+		return err
+	}
+	// Disk backed sketches can not be merged, the copy has no storage
+	sketch, err := decodeSketch(nil, info, data)
+	if err != nil {
+		return err
+	}
+	_, err = existing.mergeSketch(sketch, info.State["adds"])
+	return err
+}
+
+/*
+readSnapshot reads all files of a snapshot and verifies them against its
+manifest
+*/
+func readSnapshot(r io.Reader) (map[string][]byte, *manifest, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid snapshot: %s", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid snapshot: %s", err)
+		}
+		files[header.Name] = data
+	}
+
+	manData, ok := files[snapshotManifest]
+	if !ok {
+		return nil, nil, errors.New("Invalid snapshot: no manifest")
+	}
+	var man manifest
+	if err := json.Unmarshal(manData, &man); err != nil {
+		return nil, nil, fmt.Errorf("Invalid snapshot manifest: %s", err)
+	}
+	if man.Version > snapshotVersion {
+		return nil, nil, fmt.Errorf("Snapshot version %d is newer than %d", man.Version, snapshotVersion)
+	}
+	for _, entry := range man.Files {
+		data, ok := files[entry.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid snapshot: %s is missing", entry.Name)
+		}
+		if len(data) != entry.Size || checksum(data) != entry.SHA256 {
+			return nil, nil, fmt.Errorf("Invalid snapshot: checksum of %s does not match", entry.Name)
+		}
+	}
+	return files, &man, nil
+}
@@ -0,0 +1,111 @@
+package sketches
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+)
+
+/*
+Encodings of values sent by clients
+*/
+const (
+	EncodingUTF8   = "utf8"
+	EncodingBase64 = "base64"
+	EncodingHex    = "hex"
+)
+
+/*
+WeightedValue is a value to be added count times to a sketch
+*/
+type WeightedValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+/*
+UnmarshalJSON accepts either a plain string (counted once) or an object
+{"value": string, "count": int}
+*/
+func (v *WeightedValue) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		v.Value = value
+		v.Count = 1
+		return nil
+	}
+	type weightedValue WeightedValue
+	wv := weightedValue{Count: 1}
+	if err := json.Unmarshal(data, &wv); err != nil {
+		return err
+	}
+	*v = WeightedValue(wv)
+	return nil
+}
+
+/*
+checkWeights makes sure sketches of the given type take the counts of all
+values, only dicts take counts below 1
+*/
+func checkWeights(sketchType string, values []WeightedValue) error {
+	if sketchType == abstract.Dict {
+		return nil
+	}
+	for _, value := range values {
+		if value.Count <= 0 {
+			return fmt.Errorf("Sketches of type %s only support positive counts, got %d for %s",
+				sketchType, value.Count, value.Value)
+		}
+	}
+	return nil
+}
+
+/*
+DecodeValue returns the raw bytes of a value sent with the given encoding
+*/
+func DecodeValue(value string, encoding string) (string, error) {
+	switch encoding {
+	case "", EncodingUTF8:
+		return value, nil
+	case EncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(value)
+		return string(data), err
+	case EncodingHex:
+		data, err := hex.DecodeString(value)
+		return string(data), err
+	}
+	return "", fmt.Errorf("Invalid encoding %s", encoding)
+}
+
+/*
+DecodeHash returns the 64-bit hash sent with the given encoding, utf8 hashes
+are decimal numbers while base64 and hex hashes are 8 bytes in big endian order
+*/
+func DecodeHash(value string, encoding string) (uint64, error) {
+	if encoding == "" || encoding == EncodingUTF8 {
+		return strconv.ParseUint(value, 10, 64)
+	}
+	data, err := DecodeValue(value, encoding)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("Invalid hash %s, expected 8 bytes got %d", value, len(data))
+	}
+	return binary.BigEndian.Uint64([]byte(data)), nil
+}
+
+/*
+hashBytes returns the 8 bytes of a hash in big endian order, used as value
+for sketches that can not be fed hashes directly
+*/
+func hashBytes(hash uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, hash)
+	return data
+}
@@ -53,6 +53,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"math"
 
@@ -93,6 +94,32 @@ func baseHashes(data []byte) []uint64 {
 	}
 }
 
+// mix64 is the finalizer of splitmix64, used to derive independent hash
+// values from a single 64-bit hash
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// golden is the splitmix64 increment, the base hashes are taken from
+// consecutive steps of its sequence
+const golden uint64 = 0x9e3779b97f4a7c15
+
+// hashBaseHashes returns the four base hash values derived from an already
+// computed 64-bit hash
+func hashBaseHashes(hash uint64) []uint64 {
+	h := make([]uint64, 4)
+	for i := range h {
+		h[i] = mix64(hash)
+		hash += golden
+	}
+	return h
+}
+
 // location returns the ith hashed location using the four base hash values
 func (f *Filter) location(h []uint64, i uint) (location uint) {
 	ii := uint64(i)
@@ -135,6 +162,16 @@ func (f *Filter) Add(data []byte) *Filter {
 	return f
 }
 
+// AddHash adds an already computed 64-bit hash to the Bloom Filter. Returns
+// the filter (allows chaining)
+func (f *Filter) AddHash(hash uint64) *Filter {
+	h := hashBaseHashes(hash)
+	for i := uint(0); i < f.k; i++ {
+		f.b.Set(f.location(h, i))
+	}
+	return f
+}
+
 // AddString to the Bloom Filter. Returns the filter (allows chaining)
 func (f *Filter) AddString(data string) *Filter {
 	return f.Add([]byte(data))
@@ -153,6 +190,18 @@ func (f *Filter) Test(data []byte) bool {
 	return true
 }
 
+// TestHash returns true if the already computed 64-bit hash is in the
+// Filter, false otherwise.
+func (f *Filter) TestHash(hash uint64) bool {
+	h := hashBaseHashes(hash)
+	for i := uint(0); i < f.k; i++ {
+		if !f.b.Test(f.location(h, i)) {
+			return false
+		}
+	}
+	return true
+}
+
 // TestString returns true if the string is in the Filter, false otherwise.
 // If true, the result might be a false positive. If false, the data
 // is definitely not in the set.
@@ -181,6 +230,15 @@ func (f *Filter) TestAndAddString(data string) bool {
 	return f.TestAndAdd([]byte(data))
 }
 
+// Merge turns f into the union of f and other, both must have the same m and k
+func (f *Filter) Merge(other *Filter) error {
+	if f.m != other.m || f.k != other.k {
+		return errors.New("Bloom filters have different parameters")
+	}
+	f.b.InPlaceUnion(other.b)
+	return nil
+}
+
 // ClearAll clears all the data in a Bloom filter, removing all keys
 func (f *Filter) ClearAll() *Filter {
 	f.b.ClearAll()
@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
 	"github.com/seiflotfy/skizze/sketches/wrappers/bloom/bloom"
 	"github.com/seiflotfy/skizze/utils"
 )
@@ -17,18 +18,28 @@ Sketch is the toplevel Sketch to control the count-min-log implementation
 */
 type Sketch struct {
 	*abstract.Info
-	impl *bloom.Filter
+	impl   *bloom.Filter
+	hasher hashing.Hasher
 }
 
 /*
 NewSketch ...
 */
 func NewSketch(info *abstract.Info) (*Sketch, error) {
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
 	if info.Properties["capacity"] == 0 {
 		info.Properties["capacity"] = defaultCapacity
 	}
-	sketch := bloom.New(uint(info.Properties["capacity"]), 4)
-	d := Sketch{info, sketch}
+	var sketch *bloom.Filter
+	if errorRate := info.Properties["error_rate"]; errorRate > 0 && errorRate < 1 {
+		sketch = bloom.NewWithEstimates(uint(info.Properties["capacity"]), errorRate)
+	} else {
+		sketch = bloom.New(uint(info.Properties["capacity"]), 4)
+	}
+	d := Sketch{info, sketch, hasher}
 	return &d, nil
 }
 
@@ -36,7 +47,11 @@ func NewSketch(info *abstract.Info) (*Sketch, error) {
 Add ...
 */
 func (d *Sketch) Add(value []byte) (bool, error) {
-	d.impl.Add(value)
+	if d.hasher != nil {
+		d.impl.AddHash(d.hasher.Sum64(value))
+	} else {
+		d.impl.Add(value)
+	}
 	return true, nil
 }
 
@@ -45,11 +60,36 @@ AddMultiple ...
 */
 func (d *Sketch) AddMultiple(values [][]byte) (bool, error) {
 	for _, value := range values {
-		d.impl.Add(value)
+		d.Add(value)
 	}
 	return true, nil
 }
 
+/*
+AddWeighted adds value once, the count does not matter for this sketch type
+*/
+func (d *Sketch) AddWeighted(value []byte, count int64) (bool, error) {
+	if count <= 0 {
+		return false, errors.New("This Sketch type only supports positive counts")
+	}
+	return d.Add(value)
+}
+
+/*
+AddHash adds an already computed 64-bit hash
+*/
+func (d *Sketch) AddHash(hash uint64) (bool, error) {
+	d.impl.AddHash(hash)
+	return true, nil
+}
+
+/*
+GetFrequencyForHash returns true if the hash is in the filter
+*/
+func (d *Sketch) GetFrequencyForHash(hash uint64) interface{} {
+	return d.impl.TestHash(hash)
+}
+
 /*
 Remove ...
 */
@@ -94,20 +134,39 @@ GetFrequency ...
 func (d *Sketch) GetFrequency(values [][]byte) interface{} {
 	res := make(map[string]bool)
 	for _, value := range values {
-		res[string(value)] = d.impl.Test(value)
+		if d.hasher != nil {
+			res[string(value)] = d.impl.TestHash(d.hasher.Sum64(value))
+		} else {
+			res[string(value)] = d.impl.Test(value)
+		}
 	}
 	return res
 }
 
+/*
+Merge merges the bits of another bloom filter into this one
+*/
+func (d *Sketch) Merge(other abstract.Sketch) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Can only merge sketches of type bloom")
+	}
+	return d.impl.Merge(o.impl)
+}
+
 /*
 Unmarshal ...
 */
 func Unmarshal(info *abstract.Info, data []byte) (*Sketch, error) {
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
 	sketch := &bloom.Filter{}
-	err := sketch.GobDecode(data)
+	err = sketch.GobDecode(data)
 
 	if err != nil {
 		return nil, err
 	}
-	return &Sketch{info, sketch}, nil
+	return &Sketch{info, sketch, hasher}, nil
 }
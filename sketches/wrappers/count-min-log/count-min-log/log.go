@@ -96,9 +96,32 @@ func NewForCapacity16(capacity uint64, e float64) (*Sketch, error) {
 	return NewSketch(uint(w), 1, true, 1.00026, true, true, 16)
 }
 
+func (sk *Sketch) pIncrease(c uint16) float64 {
+	return 1.0 / (fullValue16(c+1, sk.getExp(c+1)) - fullValue16(c, sk.getExp(c)))
+}
+
 func (sk *Sketch) randomLog(c uint16) bool {
-	pIncrease := 1.0 / (fullValue16(c+1, sk.getExp(c+1)) - fullValue16(c, sk.getExp(c)))
-	return randFloat() < pIncrease
+	return randFloat() < sk.pIncrease(c)
+}
+
+/*
+trialsUntilIncrease returns the number of increments it takes until a counter
+with value c gets increased (geometrically distributed)
+*/
+func (sk *Sketch) trialsUntilIncrease(c uint16) uint {
+	p := sk.pIncrease(c)
+	if p >= 1 {
+		return 1
+	}
+	u := randFloat()
+	trials := math.Ceil(math.Log(1-u) / math.Log(1-p))
+	if trials < 1 {
+		return 1
+	}
+	if trials > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint(trials)
 }
 
 func (sk *Sketch) getExp(c uint16) float64 {
@@ -139,12 +162,45 @@ func (sk *Sketch) Reset() {
 IncreaseCount increases the count of `s` by one, return true if added and the current count of `s`
 */
 func (sk *Sketch) IncreaseCount(s []byte) bool {
+	return sk.increaseCount(sk.positions(s))
+}
+
+/*
+IncreaseCountHash increases the count of an already computed 64-bit hash by one
+*/
+func (sk *Sketch) IncreaseCountHash(h uint64) bool {
+	return sk.increaseCount(sk.hashPositions(h))
+}
+
+/*
+positions returns the index of `s` in each row
+*/
+func (sk *Sketch) positions(s []byte) []uint {
+	pos := make([]uint, sk.k, sk.k)
+	for i := range pos {
+		pos[i] = hash(s, uint(i), sk.w)
+	}
+	return pos
+}
+
+/*
+hashPositions returns the index of an already computed 64-bit hash in each row
+*/
+func (sk *Sketch) hashPositions(h uint64) []uint {
+	pos := make([]uint, sk.k, sk.k)
+	for i := range pos {
+		pos[i] = hashIndex(h, uint(i), sk.w)
+	}
+	return pos
+}
+
+func (sk *Sketch) increaseCount(pos []uint) bool {
 	sk.totalCount++
 	v := make([]uint16, sk.k, sk.k)
 	vmin := uint16(math.MaxUint16)
 	vmax := uint16(0)
 	for i := range v {
-		v[i] = sk.store[i][hash(s, uint(i), sk.w)]
+		v[i] = sk.store[i][pos[i]]
 		if v[i] < vmin {
 			vmin = v[i]
 		}
@@ -167,19 +223,96 @@ func (sk *Sketch) IncreaseCount(s []byte) bool {
 	for i := uint(0); i < sk.k; i++ {
 		nc := v[i]
 		if !sk.conservative || vmin == nc {
-			sk.store[i][hash(s, i, sk.w)] = nc + 1
+			sk.store[i][pos[i]] = nc + 1
 		}
 	}
 	return true
 }
 
+/*
+IncreaseCountBy increases the count of `s` by n, this has the same outcome as
+calling IncreaseCount n times but only costs one step per counter increase
+*/
+func (sk *Sketch) IncreaseCountBy(s []byte, n uint) bool {
+	return sk.increaseCountBy(sk.positions(s), n)
+}
+
+/*
+IncreaseCountHashBy increases the count of an already computed 64-bit hash by n
+*/
+func (sk *Sketch) IncreaseCountHashBy(h uint64, n uint) bool {
+	return sk.increaseCountBy(sk.hashPositions(h), n)
+}
+
+func (sk *Sketch) increaseCountBy(pos []uint, n uint) bool {
+	sk.totalCount += n
+	v := make([]uint16, sk.k, sk.k)
+	for i := range v {
+		v[i] = sk.store[i][pos[i]]
+	}
+
+	increased := false
+	for n > 0 {
+		vmin := uint16(math.MaxUint16)
+		vmax := uint16(0)
+		for _, c := range v {
+			if c < vmin {
+				vmin = c
+			}
+			if c > vmax {
+				vmax = c
+			}
+		}
+
+		var c uint16
+		if sk.maxSample {
+			c = vmax
+		} else {
+			c = vmin
+		}
+		if float64(c) >= sk.cMax {
+			break
+		}
+
+		// skip the increments that would not increase the counters
+		trials := sk.trialsUntilIncrease(c)
+		if trials > n {
+			break
+		}
+		n -= trials
+
+		for i := range v {
+			if !sk.conservative || vmin == v[i] {
+				v[i]++
+			}
+		}
+		increased = true
+	}
+
+	for i := range v {
+		sk.store[i][pos[i]] = v[i]
+	}
+	return increased
+}
+
 /*
 Frequency returns the count of `s`
 */
 func (sk *Sketch) Frequency(s []byte) float64 {
+	return sk.frequency(sk.positions(s))
+}
+
+/*
+FrequencyHash returns the count of an already computed 64-bit hash
+*/
+func (sk *Sketch) FrequencyHash(h uint64) float64 {
+	return sk.frequency(sk.hashPositions(h))
+}
+
+func (sk *Sketch) frequency(pos []uint) float64 {
 	clmin := uint16(math.MaxUint16)
 	for i := uint(0); i < sk.k; i++ {
-		cl := sk.store[i][hash(s, i, sk.w)]
+		cl := sk.store[i][pos[i]]
 		if cl < clmin {
 			clmin = cl
 		}
@@ -134,3 +134,22 @@ func TestLogMarshall(t *testing.T) {
 		t.Errorf("expected 0, got %d", uint(count))
 	}
 }
+
+// Ensures that IncreaseCountBy approximates n calls to IncreaseCount.
+func TestLogIncreaseCountBy(t *testing.T) {
+	log, _ := NewDefaultSketch()
+
+	log.IncreaseCountBy([]byte("a"), 3)
+	if count := log.Frequency([]byte("a")); uint(count) != 3 {
+		t.Errorf("expected 3, got %d", uint(count))
+	}
+
+	log.IncreaseCountBy([]byte("b"), 100000)
+	if count := log.Frequency([]byte("b")); count < 90000 || count > 110000 {
+		t.Errorf("expected ~100000, got %d", uint(count))
+	}
+
+	if total := log.TotalCount(); total != 100003 {
+		t.Errorf("expected total count 100003, got %d", total)
+	}
+}
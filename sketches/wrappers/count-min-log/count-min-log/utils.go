@@ -14,3 +14,14 @@ func randFloat() float64 {
 func hash(s []byte, i, w uint) uint {
 	return uint(farm.Hash64WithSeed(s, uint64(i))) % w
 }
+
+// hashIndex derives the index in row i from an already computed 64-bit hash
+func hashIndex(h uint64, i, w uint) uint {
+	x := h + uint64(i)*0x9e3779b97f4a7c15
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return uint(x % uint64(w))
+}
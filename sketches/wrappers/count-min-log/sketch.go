@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
 	"github.com/seiflotfy/skizze/sketches/wrappers/count-min-log/count-min-log"
 	"github.com/seiflotfy/skizze/utils"
 )
@@ -17,18 +18,23 @@ Sketch is the toplevel Sketch to control the count-min-log implementation
 */
 type Sketch struct {
 	*abstract.Info
-	impl *cml.Sketch
+	impl   *cml.Sketch
+	hasher hashing.Hasher
 }
 
 /*
 NewSketch ...
 */
 func NewSketch(info *abstract.Info) (*Sketch, error) {
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
 	if info.Properties["capacity"] == 0 {
 		info.Properties["capacity"] = defaultCapacity
 	}
 	sketch, err := cml.NewForCapacity16(uint64(info.Properties["capacity"]), 0.01)
-	d := Sketch{info, sketch}
+	d := Sketch{info, sketch, hasher}
 	if err != nil {
 		logger.Error.Printf("an error has occurred while saving Sketch: %s", err.Error())
 	}
@@ -39,7 +45,11 @@ func NewSketch(info *abstract.Info) (*Sketch, error) {
 Add ...
 */
 func (d *Sketch) Add(value []byte) (bool, error) {
-	d.impl.IncreaseCount(value)
+	if d.hasher != nil {
+		d.impl.IncreaseCountHash(d.hasher.Sum64(value))
+	} else {
+		d.impl.IncreaseCount(value)
+	}
 	return true, nil
 }
 
@@ -48,11 +58,41 @@ AddMultiple ...
 */
 func (d *Sketch) AddMultiple(values [][]byte) (bool, error) {
 	for _, value := range values {
-		d.impl.IncreaseCount(value)
+		d.Add(value)
+	}
+	return true, nil
+}
+
+/*
+AddWeighted increases the count of value by count
+*/
+func (d *Sketch) AddWeighted(value []byte, count int64) (bool, error) {
+	if count <= 0 {
+		return false, errors.New("This Sketch type only supports positive counts")
+	}
+	if d.hasher != nil {
+		d.impl.IncreaseCountHashBy(d.hasher.Sum64(value), uint(count))
+	} else {
+		d.impl.IncreaseCountBy(value, uint(count))
 	}
 	return true, nil
 }
 
+/*
+AddHash increases the count of an already computed 64-bit hash
+*/
+func (d *Sketch) AddHash(hash uint64) (bool, error) {
+	d.impl.IncreaseCountHash(hash)
+	return true, nil
+}
+
+/*
+GetFrequencyForHash returns the count of an already computed 64-bit hash
+*/
+func (d *Sketch) GetFrequencyForHash(hash uint64) interface{} {
+	return uint(d.impl.FrequencyHash(hash))
+}
+
 /*
 Remove ...
 */
@@ -97,7 +137,12 @@ GetFrequency ...
 func (d *Sketch) GetFrequency(values [][]byte) interface{} {
 	res := make(map[string]uint)
 	for _, value := range values {
-		count := d.impl.Frequency(value)
+		var count float64
+		if d.hasher != nil {
+			count = d.impl.FrequencyHash(d.hasher.Sum64(value))
+		} else {
+			count = d.impl.Frequency(value)
+		}
 		res[string(value)] = uint(count)
 	}
 	return res
@@ -107,9 +152,13 @@ func (d *Sketch) GetFrequency(values [][]byte) interface{} {
 Unmarshal ...
 */
 func Unmarshal(info *abstract.Info, data []byte) (*Sketch, error) {
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
 	sketch, err := cml.Unmarshal(data)
 	if err != nil {
 		return nil, err
 	}
-	return &Sketch{info, sketch}, nil
+	return &Sketch{info, sketch, hasher}, nil
 }
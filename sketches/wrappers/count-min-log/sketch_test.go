@@ -23,7 +23,7 @@ func setupTests() {
 }
 
 func tearDownTests() {
-	storage.CloseInfoDB()
+	storage.Close()
 	os.RemoveAll(config.GetConfig().DataDir)
 	os.RemoveAll(config.GetConfig().InfoDir)
 	os.Mkdir(config.GetConfig().DataDir, 0777)
@@ -0,0 +1,186 @@
+package dict
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+const defaultBufferSize = 10000
+
+/*
+diskDict stores the counts of a dict in the KV of the sketch, e.g. an embedded
+on-disk B+tree. Changes are kept in a write buffer and written in one go once
+the buffer is full or the sketch is saved, so a save only writes what changed.
+*/
+type diskDict struct {
+	kv         storage.KV
+	buffer     map[string]uint // counts changed since the last flush, 0 means deleted
+	bufferSize int
+	length     uint
+}
+
+func openDiskDict(info *abstract.Info, store storage.Backend) (*diskDict, error) {
+	if store == nil {
+		return nil, fmt.Errorf("Dict %s is disk backed but has no storage", info.ID)
+	}
+	if info.Properties["buffer_size"] == 0 {
+		info.Properties["buffer_size"] = defaultBufferSize
+	}
+	kv, err := store.OpenKV(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	length, err := kv.Len()
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return &diskDict{
+		kv:         kv,
+		buffer:     make(map[string]uint),
+		bufferSize: int(info.Properties["buffer_size"]),
+		length:     uint(length),
+	}, nil
+}
+
+/*
+Count ...
+*/
+func (dict *diskDict) Count(name string) (uint, error) {
+	if count, ok := dict.buffer[name]; ok {
+		return count, nil
+	}
+	data, err := dict.kv.Get(name)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return uint(binary.BigEndian.Uint64(data)), nil
+}
+
+/*
+Len returns the number of values with a count
+*/
+func (dict *diskDict) Len() uint {
+	return dict.length
+}
+
+/*
+IncreaseCountBy ...
+*/
+func (dict *diskDict) IncreaseCountBy(name string, n uint) error {
+	if n == 0 {
+		return nil
+	}
+	count, err := dict.Count(name)
+	if err != nil {
+		return err
+	}
+	return dict.set(name, count, count+n)
+}
+
+/*
+DecreaseCountBy decreases the count of name by n, dropping it when reaching 0.
+Counts never go below 0, decreasing by more than the count leaves it unchanged.
+*/
+func (dict *diskDict) DecreaseCountBy(name string, n uint) error {
+	count, err := dict.Count(name)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("Value %s was not found", name)
+	}
+	if count < n {
+		return fmt.Errorf("Count of value %s is %d, can not decrease it by %d", name, count, n)
+	}
+	return dict.set(name, count, count-n)
+}
+
+/*
+set buffers the new count of name, flushing the buffer when it is full
+*/
+func (dict *diskDict) set(name string, old uint, count uint) error {
+	if old == 0 && count > 0 {
+		dict.length++
+	} else if old > 0 && count == 0 {
+		dict.length--
+	}
+	dict.buffer[name] = count
+	if len(dict.buffer) >= dict.bufferSize {
+		return dict.flush()
+	}
+	return nil
+}
+
+/*
+flush writes the buffered counts in one go
+*/
+func (dict *diskDict) flush() error {
+	if len(dict.buffer) == 0 {
+		return nil
+	}
+	changes := make(map[string][]byte, len(dict.buffer))
+	for name, count := range dict.buffer {
+		if count == 0 {
+			changes[name] = nil
+			continue
+		}
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(count))
+		changes[name] = data
+	}
+	if err := dict.kv.Write(changes); err != nil {
+		return err
+	}
+	dict.buffer = make(map[string]uint)
+	return nil
+}
+
+/*
+Reset ...
+*/
+func (dict *diskDict) Reset() error {
+	dict.buffer = make(map[string]uint)
+	dict.length = 0
+	return dict.kv.Clear()
+}
+
+/*
+Range calls fn for each value from on in ascending order until fn returns false
+*/
+func (dict *diskDict) Range(from string, fn func(key string, count uint) bool) error {
+	if err := dict.flush(); err != nil {
+		return err
+	}
+	return dict.kv.Range(from, func(key string, value []byte) bool {
+		return fn(key, uint(binary.BigEndian.Uint64(value)))
+	})
+}
+
+/*
+Marshal writes the buffered counts to disk, the counts are not part of the
+serialized sketch
+*/
+func (dict *diskDict) Marshal() ([]byte, error) {
+	return []byte{}, dict.flush()
+}
+
+/*
+MemorySize estimates the bytes the buffered counts take in memory
+*/
+func (dict *diskDict) MemorySize() uint64 {
+	return countsSize(dict.buffer)
+}
+
+/*
+Close writes the buffered counts to disk and closes the KV
+*/
+func (dict *diskDict) Close() error {
+	if err := dict.flush(); err != nil {
+		return err
+	}
+	return dict.kv.Close()
+}
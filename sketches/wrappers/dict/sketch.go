@@ -2,46 +2,127 @@ package dict
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
 )
 
 var logger = utils.GetLogger()
 
+const defaultPageSize = 1000
+
+// mapSize is about what an empty map takes, entrySize what a value takes in a
+// map besides its bytes: the string header, the count and the overhead of the map
+const (
+	mapSize   = 48
+	entrySize = 48
+)
+
 /*
-Dict ...
+counter stores the counts of a dict
+*/
+type counter interface {
+	Count(name string) (uint, error)
+	IncreaseCountBy(name string, n uint) error
+	DecreaseCountBy(name string, n uint) error
+	Len() uint
+	Reset() error
+	Range(from string, fn func(key string, count uint) bool) error
+	Marshal() ([]byte, error)
+	MemorySize() uint64
+	Close() error
+}
+
+/*
+Dict is an exact in-memory frequency table, values are dropped once their
+count reaches 0
 */
 type Dict struct {
-	hash map[string]uint
+	Counts map[string]uint
 }
 
 func makeDict() (dict *Dict) {
 	return &Dict{
-		hash: make(map[string]uint),
+		Counts: make(map[string]uint),
 	}
 }
 
 /*
 Reset ...
 */
-func (dict *Dict) Reset() {
-	dict.hash = make(map[string]uint)
+func (dict *Dict) Reset() error {
+	dict.Counts = make(map[string]uint)
+	return nil
+}
+
+/*
+Count ...
+*/
+func (dict *Dict) Count(name string) (uint, error) {
+	return dict.Counts[name], nil
+}
+
+/*
+Len returns the number of values with a count
+*/
+func (dict *Dict) Len() uint {
+	return uint(len(dict.Counts))
+}
+
+/*
+IncreaseCountBy ...
+*/
+func (dict *Dict) IncreaseCountBy(name string, n uint) error {
+	if n == 0 {
+		return nil
+	}
+	dict.Counts[name] += n
+	return nil
 }
 
 /*
-IncreaseCount ...
+DecreaseCountBy decreases the count of name by n, dropping it when reaching 0.
+Counts never go below 0, decreasing by more than the count leaves it unchanged.
 */
-func (dict *Dict) IncreaseCount(name string) {
-	dict.hash[name]++
+func (dict *Dict) DecreaseCountBy(name string, n uint) error {
+	count, ok := dict.Counts[name]
+	if !ok {
+		return fmt.Errorf("Value %s was not found", name)
+	}
+	if count < n {
+		return fmt.Errorf("Count of value %s is %d, can not decrease it by %d", name, count, n)
+	}
+	if count == n {
+		delete(dict.Counts, name)
+		return nil
+	}
+	dict.Counts[name] -= n
+	return nil
 }
 
 /*
-DecreaseCount ...
+Range calls fn for each value from on in ascending order until fn returns false
 */
-func (dict *Dict) DecreaseCount(name string) {
-	dict.hash[name]--
+func (dict *Dict) Range(from string, fn func(key string, count uint) bool) error {
+	keys := make([]string, 0, len(dict.Counts))
+	for key := range dict.Counts {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, dict.Counts[key]) {
+			break
+		}
+	}
+	return nil
 }
 
 /*
@@ -58,18 +139,48 @@ func (dict *Dict) Marshal() ([]byte, error) {
 	return network.Bytes(), nil
 }
 
+/*
+MemorySize estimates the bytes the counts take in memory
+*/
+func (dict *Dict) MemorySize() uint64 {
+	return countsSize(dict.Counts)
+}
+
+func countsSize(counts map[string]uint) uint64 {
+	size := uint64(mapSize)
+	for key := range counts {
+		size += uint64(len(key)) + entrySize
+	}
+	return size
+}
+
+/*
+Close ...
+*/
+func (dict *Dict) Close() error {
+	return nil
+}
+
 /*
 Sketch ...
 */
 type Sketch struct {
 	*abstract.Info
-	impl *Dict
+	impl counter
 }
 
 /*
-NewSketch ...
+NewSketch creates a dict, disk backed dicts keep their counts in the KV of the
+sketch in store
 */
-func NewSketch(info *abstract.Info) (*Sketch, error) {
+func NewSketch(info *abstract.Info, store storage.Backend) (*Sketch, error) {
+	if info.Properties["disk"] != 0 {
+		dict, err := openDiskDict(info, store)
+		if err != nil {
+			return nil, err
+		}
+		return &Sketch{info, dict}, nil
+	}
 	var dict = makeDict()
 	d := Sketch{info, dict}
 	return &d, nil
@@ -79,8 +190,9 @@ func NewSketch(info *abstract.Info) (*Sketch, error) {
 Add ...
 */
 func (d *Sketch) Add(value []byte) (bool, error) {
-	name := string(value)
-	d.impl.IncreaseCount(name)
+	if err := d.impl.IncreaseCountBy(string(value), 1); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -89,60 +201,238 @@ AddMultiple ...
 */
 func (d *Sketch) AddMultiple(values [][]byte) (bool, error) {
 	for _, value := range values {
-		name := string(value)
-		d.impl.IncreaseCount(name)
+		if err := d.impl.IncreaseCountBy(string(value), 1); err != nil {
+			return false, err
+		}
 	}
 	return true, nil
 }
 
 /*
-Remove ...
+AddWeighted increases the count of value by count, negative counts decrease it
 */
-func (d *Sketch) Remove(value []byte) (bool, error) {
+func (d *Sketch) AddWeighted(value []byte, count int64) (bool, error) {
 	name := string(value)
-	d.impl.DecreaseCount(name)
+	var err error
+	if count >= 0 {
+		err = d.impl.IncreaseCountBy(name, uint(count))
+	} else {
+		err = d.impl.DecreaseCountBy(name, uint(-count))
+	}
+	if err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
+/*
+Remove ...
+*/
+func (d *Sketch) Remove(value []byte) (bool, error) {
+	notFound, err := d.RemoveAndCount([][]byte{value})
+	return notFound == 0, err
+}
+
 /*
 RemoveMultiple ...
 */
 func (d *Sketch) RemoveMultiple(values [][]byte) (bool, error) {
+	notFound, err := d.RemoveAndCount(values)
+	return notFound == 0, err
+}
+
+/*
+RemoveAndCount decreases the count of each value by one and returns the number
+of values that were not found
+*/
+func (d *Sketch) RemoveAndCount(values [][]byte) (uint, error) {
+	notFound := uint(0)
 	for _, value := range values {
-		name := string(value)
-		d.impl.DecreaseCount(name)
+		count, err := d.impl.Count(string(value))
+		if err != nil {
+			return notFound, err
+		}
+		if count == 0 {
+			notFound++
+			continue
+		}
+		if err := d.impl.DecreaseCountBy(string(value), 1); err != nil {
+			return notFound, err
+		}
 	}
-	return true, nil
+	return notFound, nil
+}
+
+/*
+Range calls fn for each value in ascending order until fn returns false
+*/
+func (d *Sketch) Range(fn func(value string, count uint) bool) error {
+	return d.impl.Range("", fn)
+}
+
+/*
+SetCount sets the count of value, dropping it if count is 0
+*/
+func (d *Sketch) SetCount(value []byte, count uint) error {
+	name := string(value)
+	current, err := d.impl.Count(name)
+	if err != nil {
+		return err
+	}
+	if count > current {
+		return d.impl.IncreaseCountBy(name, count-current)
+	}
+	if count < current {
+		return d.impl.DecreaseCountBy(name, current-count)
+	}
+	return nil
 }
 
 /*
 GetCount ...
 */
 func (d *Sketch) GetCount() uint {
-	return uint(len(d.impl.hash))
+	return d.impl.Len()
 }
 
 /*
 Clear ...
 */
 func (d *Sketch) Clear() (bool, error) {
-	d.impl.Reset()
+	if err := d.impl.Reset(); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
 /*
-GetFrequency which is basically our hash
+GetFrequency returns the count of each value, or the first page of all values
+if no values are given
 */
 func (d *Sketch) GetFrequency(values [][]byte) interface{} {
-	if len(values) == 0 {
-		return d.impl.hash
+	return d.GetResult(values, abstract.Query{})
+}
+
+/*
+Entry is a value and its count
+*/
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint   `json:"count"`
+}
+
+/*
+Page is a part of the values of a dict, Next is the cursor to pass to get the
+following page and is empty on the last page
+*/
+type Page struct {
+	Entries []Entry `json:"entries"`
+	Next    string  `json:"next"`
+}
+
+/*
+GetResult returns the count of each value. Without values it returns the
+values matching the query: the top n values by count if N is set, or else a
+page of at most Limit values ordered by value starting after Cursor.
+*/
+func (d *Sketch) GetResult(values [][]byte, query abstract.Query) interface{} {
+	if len(values) > 0 {
+		res := make(map[string]uint)
+		for _, value := range values {
+			count, err := d.impl.Count(string(value))
+			if err != nil {
+				logger.Error.Println(err)
+			}
+			res[string(value)] = count
+		}
+		return res
 	}
-	res := make(map[string]uint)
-	for _, value := range values {
-		count, _ := d.impl.hash[string(value)]
-		res[string(value)] = uint(count)
+
+	// Values are visited in ascending order, so the scan stops after the prefix
+	from := query.Prefix
+	if query.N <= 0 && query.Cursor > from {
+		from = query.Cursor
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	entries := []Entry{}
+	top := &entryHeap{}
+	page := &Page{}
+	err := d.impl.Range(from, func(key string, count uint) bool {
+		if !strings.HasPrefix(key, query.Prefix) {
+			return false
+		}
+		if count < uint(query.MinCount) || (query.N <= 0 && key == query.Cursor) {
+			return true
+		}
+		if query.N > 0 {
+			top.offer(Entry{key, count}, query.N)
+			return true
+		}
+		if len(entries) == limit {
+			page.Next = entries[limit-1].Key
+			return false
+		}
+		entries = append(entries, Entry{key, count})
+		return true
+	})
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	if query.N > 0 {
+		entries = *top
+		sort.Sort(entriesByCountDescending(entries))
+	}
+	page.Entries = entries
+	return page
+}
+
+type entriesByCountDescending []Entry
+
+func (e entriesByCountDescending) Len() int { return len(e) }
+func (e entriesByCountDescending) Less(i, j int) bool {
+	return e[i].Count > e[j].Count || (e[i].Count == e[j].Count && e[i].Key < e[j].Key)
+}
+func (e entriesByCountDescending) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+/*
+entryHeap keeps the top entries by count with the lowest of them on top
+*/
+type entryHeap []Entry
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	return entriesByCountDescending(h).Less(j, i)
+}
+func (h entryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *entryHeap) Push(x interface{}) {
+	*h = append(*h, x.(Entry))
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+/*
+offer adds entry if it is among the top n entries seen so far
+*/
+func (h *entryHeap) offer(entry Entry, n int) {
+	if h.Len() < n {
+		heap.Push(h, entry)
+		return
+	}
+	if top := (*h)[0]; entry.Count > top.Count || (entry.Count == top.Count && entry.Key < top.Key) {
+		(*h)[0] = entry
+		heap.Fix(h, 0)
 	}
-	return res
 }
 
 /*
@@ -153,9 +443,46 @@ func (d *Sketch) Marshal() ([]byte, error) {
 }
 
 /*
-Unmarshal ...
+MemorySize estimates the bytes the dict takes in memory, disk backed dicts
+only hold their write buffer
+*/
+func (d *Sketch) MemorySize() uint64 {
+	return d.impl.MemorySize()
+}
+
+/*
+Export serializes all counts, including the ones of a disk backed dict
+*/
+func (d *Sketch) Export() ([]byte, error) {
+	if _, ok := d.impl.(*Dict); ok {
+		return d.impl.Marshal()
+	}
+	dict := makeDict()
+	err := d.impl.Range("", func(key string, count uint) bool {
+		dict.Counts[key] = count
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dict.Marshal()
+}
+
+/*
+Close closes the KV of a disk backed dict
 */
-func Unmarshal(info *abstract.Info, data []byte) (*Sketch, error) {
+func (d *Sketch) Close() error {
+	return d.impl.Close()
+}
+
+/*
+Unmarshal loads a dict from data, disk backed dicts from their KV in store
+*/
+func Unmarshal(info *abstract.Info, data []byte, store storage.Backend) (*Sketch, error) {
+	// The counts of a disk backed dict are in its KV, not in data
+	if info.Properties["disk"] != 0 && len(data) == 0 {
+		return NewSketch(info, store)
+	}
 	var network bytes.Buffer // Stand-in for a network connection
 	_, err := network.Write(data)
 	if err != nil {
@@ -169,5 +496,30 @@ func Unmarshal(info *abstract.Info, data []byte) (*Sketch, error) {
 	if err != nil {
 		return nil, err
 	}
+	if info.Properties["disk"] != 0 {
+		return importDiskDict(info, store, &counter)
+	}
 	return &Sketch{info, &counter}, nil
 }
+
+/*
+importDiskDict replaces the counts of a disk backed dict with the exported
+counts of a dict
+*/
+func importDiskDict(info *abstract.Info, store storage.Backend, counts *Dict) (*Sketch, error) {
+	d, err := NewSketch(info, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.impl.Reset(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	for key, count := range counts.Counts {
+		if err := d.impl.IncreaseCountBy(key, count); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
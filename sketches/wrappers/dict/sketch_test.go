@@ -23,7 +23,7 @@ func setupTests() {
 }
 
 func tearDownTests() {
-	storage.CloseInfoDB()
+	storage.Close()
 	os.RemoveAll(config.GetConfig().DataDir)
 	os.RemoveAll(config.GetConfig().InfoDir)
 	os.Mkdir(config.GetConfig().DataDir, 0777)
@@ -38,7 +38,7 @@ func TestAddMultiple(t *testing.T) {
 		ID:         "avengers",
 		Type:       abstract.Dict,
 		Properties: make(map[string]float64),
-		State:      make(map[string]uint64)})
+		State:      make(map[string]uint64)}, nil)
 
 	if err != nil {
 		t.Error("expected avengers to have no error, got", err)
@@ -69,7 +69,7 @@ func TestDecrease(t *testing.T) {
 		ID:         "avengers",
 		Type:       abstract.Dict,
 		Properties: make(map[string]float64),
-		State:      make(map[string]uint64)})
+		State:      make(map[string]uint64)}, nil)
 
 	if err != nil {
 		t.Error("expected avengers to have no error, got", err)
@@ -100,3 +100,251 @@ func TestDecrease(t *testing.T) {
 		t.Error("expected 'cyclops' count == 2, got", res["cyclops"])
 	}
 }
+
+func TestAddWeighted(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	sketch, err := NewSketch(&abstract.Info{
+		ID:         "avengers",
+		Type:       abstract.Dict,
+		Properties: make(map[string]float64),
+		State:      make(map[string]uint64)}, nil)
+
+	if err != nil {
+		t.Error("expected avengers to have no error, got", err)
+	}
+
+	sketch.AddWeighted([]byte("cyclops"), 1000)
+	sketch.AddWeighted([]byte("havoc"), 2)
+	sketch.AddWeighted([]byte("cyclops"), -10)
+	if _, err := sketch.AddWeighted([]byte("havoc"), -5); err == nil {
+		t.Error("expected error decreasing 'havoc' below 0")
+	}
+
+	res := sketch.GetFrequency([][]byte{[]byte("cyclops"), []byte("havoc")}).(map[string]uint)
+	if res["cyclops"] != 990 {
+		t.Error("expected 'cyclops' count == 990, got", res["cyclops"])
+	}
+	if res["havoc"] != 2 {
+		t.Error("expected 'havoc' count == 2, got", res["havoc"])
+	}
+
+	sketch.AddWeighted([]byte("havoc"), -2)
+	sketch.AddWeighted([]byte("polaris"), 0)
+	if sketch.GetCount() != 1 {
+		t.Error("expected 1 item, got", sketch.GetCount())
+	}
+}
+
+func TestRemoveNotFound(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	sketch, err := NewSketch(&abstract.Info{
+		ID:         "avengers",
+		Type:       abstract.Dict,
+		Properties: make(map[string]float64),
+		State:      make(map[string]uint64)}, nil)
+
+	if err != nil {
+		t.Error("expected avengers to have no error, got", err)
+	}
+
+	sketch.AddMultiple([][]byte{[]byte("havoc"), []byte("cyclops")})
+	notFound, err := sketch.RemoveAndCount([][]byte{
+		[]byte("havoc"),
+		[]byte("havoc"),
+		[]byte("sabertooth")})
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+	if notFound != 2 {
+		t.Error("expected 2 values not found, got", notFound)
+	}
+
+	res := sketch.GetFrequency([][]byte{[]byte("havoc"), []byte("sabertooth")}).(map[string]uint)
+	if res["havoc"] != 0 || res["sabertooth"] != 0 {
+		t.Error("expected counts of 0, got", res)
+	}
+	if sketch.GetCount() != 1 {
+		t.Error("expected 1 item, got", sketch.GetCount())
+	}
+}
+
+func TestSetCount(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	sketch, err := NewSketch(&abstract.Info{
+		ID:         "avengers",
+		Type:       abstract.Dict,
+		Properties: make(map[string]float64),
+		State:      make(map[string]uint64)}, nil)
+	if err != nil {
+		t.Error("expected avengers to have no error, got", err)
+	}
+
+	sketch.AddMultiple([][]byte{[]byte("havoc"), []byte("havoc"), []byte("cyclops")})
+	for value, count := range map[string]uint{"havoc": 1, "cyclops": 0, "storm": 4} {
+		if err := sketch.SetCount([]byte(value), count); err != nil {
+			t.Error("expected no error, got", err)
+		}
+	}
+
+	counts := make(map[string]uint)
+	sketch.Range(func(value string, count uint) bool {
+		counts[value] = count
+		return true
+	})
+	if len(counts) != 2 || counts["havoc"] != 1 || counts["storm"] != 4 {
+		t.Error("expected havoc 1 and storm 4, got", counts)
+	}
+	if sketch.GetCount() != 2 {
+		t.Error("expected 2 items, got", sketch.GetCount())
+	}
+}
+
+func TestQueries(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	sketch, err := NewSketch(&abstract.Info{
+		ID:         "avengers",
+		Type:       abstract.Dict,
+		Properties: make(map[string]float64),
+		State:      make(map[string]uint64)}, nil)
+
+	if err != nil {
+		t.Error("expected avengers to have no error, got", err)
+	}
+
+	sketch.AddWeighted([]byte("x-cyclops"), 3)
+	sketch.AddWeighted([]byte("x-havoc"), 5)
+	sketch.AddWeighted([]byte("x-storm"), 3)
+	sketch.AddWeighted([]byte("hulk"), 10)
+
+	page := sketch.GetResult(nil, abstract.Query{Prefix: "x-", Limit: 2}).(*Page)
+	if len(page.Entries) != 2 || page.Entries[0].Key != "x-cyclops" || page.Next != "x-havoc" {
+		t.Error("expected first page with x-cyclops and x-havoc, got", page)
+	}
+	page = sketch.GetResult(nil, abstract.Query{Prefix: "x-", Limit: 2, Cursor: page.Next}).(*Page)
+	if len(page.Entries) != 1 || page.Entries[0].Key != "x-storm" || page.Next != "" {
+		t.Error("expected last page with x-storm, got", page)
+	}
+
+	page = sketch.GetResult(nil, abstract.Query{N: 3}).(*Page)
+	expected := []string{"hulk", "x-havoc", "x-cyclops"}
+	if len(page.Entries) != len(expected) {
+		t.Fatal("expected the top 3 values, got", page)
+	}
+	for i, entry := range page.Entries {
+		if entry.Key != expected[i] {
+			t.Errorf("expected %s at position %d, got %s", expected[i], i, entry.Key)
+		}
+	}
+	page = sketch.GetResult(nil, abstract.Query{MinCount: 5}).(*Page)
+	if len(page.Entries) != 2 {
+		t.Error("expected 2 values with a count of at least 5, got", page)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	info := &abstract.Info{
+		ID:         "avengers",
+		Type:       abstract.Dict,
+		Properties: make(map[string]float64),
+		State:      make(map[string]uint64)}
+	sketch, _ := NewSketch(info, nil)
+	sketch.AddWeighted([]byte("cyclops"), 3)
+
+	data, err := sketch.Marshal()
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	sketch, err = Unmarshal(info, data, nil)
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	res := sketch.GetFrequency([][]byte{[]byte("cyclops")}).(map[string]uint)
+	if res["cyclops"] != 3 {
+		t.Error("expected 'cyclops' count == 3, got", res["cyclops"])
+	}
+}
+
+func TestDiskDict(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	for _, backend := range []string{storage.FileBackend, storage.BoltBackend, storage.MemoryBackend} {
+		store, err := storage.NewBackend(backend)
+		if err != nil {
+			t.Fatal("expected no error, got", err)
+		}
+		testDiskDict(t, store)
+		store.Close()
+	}
+}
+
+func testDiskDict(t *testing.T, store storage.Backend) {
+	info := &abstract.Info{
+		ID:         "avengers.dict",
+		Type:       abstract.Dict,
+		Properties: map[string]float64{"disk": 1, "buffer_size": 2},
+		State:      make(map[string]uint64)}
+	sketch, err := NewSketch(info, store)
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+
+	sketch.AddMultiple([][]byte{
+		[]byte("x-cyclops"),
+		[]byte("x-havoc"),
+		[]byte("x-havoc"),
+		[]byte("hulk")})
+	sketch.AddWeighted([]byte("x-storm"), 3)
+	if _, err := sketch.AddWeighted([]byte("hulk"), -2); err == nil {
+		t.Error("expected error decreasing 'hulk' below 0")
+	}
+	notFound, _ := sketch.RemoveAndCount([][]byte{[]byte("hulk"), []byte("thor")})
+	if notFound != 1 {
+		t.Error("expected 1 value not found, got", notFound)
+	}
+	if sketch.GetCount() != 3 {
+		t.Error("expected 3 items, got", sketch.GetCount())
+	}
+
+	page := sketch.GetResult(nil, abstract.Query{Prefix: "x-", Limit: 2}).(*Page)
+	if len(page.Entries) != 2 || page.Entries[1].Key != "x-havoc" || page.Next != "x-havoc" {
+		t.Error("expected first page with x-cyclops and x-havoc, got", page)
+	}
+	page = sketch.GetResult(nil, abstract.Query{N: 1}).(*Page)
+	if len(page.Entries) != 1 || page.Entries[0].Key != "x-storm" {
+		t.Error("expected x-storm as top value, got", page)
+	}
+
+	// The counts are kept in the database, not in the serialized sketch
+	data, err := sketch.Marshal()
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	sketch.AddWeighted([]byte("x-storm"), 1)
+	if err := sketch.Close(); err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	sketch, err = Unmarshal(info, data, store)
+	if err != nil {
+		t.Fatal("expected no error, got", err)
+	}
+	defer sketch.Close()
+	res := sketch.GetFrequency([][]byte{[]byte("x-havoc"), []byte("x-storm"), []byte("hulk")}).(map[string]uint)
+	if res["x-havoc"] != 2 || res["x-storm"] != 4 || res["hulk"] != 0 {
+		t.Error("expected counts to survive reopening, got", res)
+	}
+	if sketch.GetCount() != 3 {
+		t.Error("expected 3 items, got", sketch.GetCount())
+	}
+}
@@ -98,8 +98,12 @@ func NewWithConfig(c Config) (*HLLPP, error) {
 // Add will hash v and add the result to the HyperLogLog++ estimator h. hllpp
 // uses a built-in non-streaming implementation of murmur3.
 func (h *HLLPP) Add(v []byte) {
-	x := murmurSum64(v)
+	h.AddHash(murmurSum64(v))
+}
 
+// AddHash adds an already computed 64-bit hash x to the HyperLogLog++
+// estimator h. The hash must be uniformly distributed over all 64 bits.
+func (h *HLLPP) AddHash(x uint64) {
 	if h.sparse {
 		h.tmpSet = append(h.tmpSet, h.encodeHash(x))
 
@@ -171,6 +175,11 @@ func (h *HLLPP) Merge(other *HLLPP) error {
 		return errors.New("HLLPPs have different parameters")
 	}
 
+	// values still in tmpSet would be lost when switching to normal mode
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
 	if h.sparse && !other.sparse {
 		h.toNormal()
 	}
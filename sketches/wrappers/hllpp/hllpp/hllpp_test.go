@@ -211,6 +211,34 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestMergeDenseIntoUnflushedSparse(t *testing.T) {
+	h := New()
+	other := New()
+
+	for i := uint64(0); i < 500; i++ {
+		other.Add(intToBytes(i))
+	}
+	other.flushTmpSet()
+	other.toNormal()
+
+	// too few values to flush tmpSet before h switches to normal mode
+	for i := uint64(500); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if len(h.tmpSet) == 0 {
+		t.Fatal("Expected values in tmpSet")
+	}
+
+	err := h.Merge(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := estimateError(h.Count(), 1000); e > 0.01 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 1000, e)
+	}
+}
+
 func TestBitsPerRegister(t *testing.T) {
 	h := New()
 
@@ -0,0 +1,53 @@
+package hllpp
+
+import "fmt"
+
+// Precision returns the precision (p) of h.
+func (h *HLLPP) Precision() uint8 {
+	return h.p
+}
+
+// Registers returns the values of the 2^p registers of h, also while h is
+// still in sparse mode.
+func (h *HLLPP) Registers() []uint8 {
+	registers := make([]uint8, h.m)
+	if h.sparse {
+		h.flushTmpSet()
+		reader := newSparseReader(h.data)
+		for !reader.Done() {
+			idx, rho := h.decodeHash(reader.Next(), h.p)
+			if rho > registers[idx] {
+				registers[idx] = rho
+			}
+		}
+		return registers
+	}
+	for i := range registers {
+		registers[i] = getRegister(h.data, h.bitsPerRegister, uint32(i))
+	}
+	return registers
+}
+
+// NewFromRegisters creates a HyperLogLog++ estimator in normal (dense) mode
+// with the given register values, there must be one for each of the 2^p
+// registers of the Config.
+func NewFromRegisters(c Config, registers []uint8) (*HLLPP, error) {
+	h, err := NewWithConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(registers)) != h.m {
+		return nil, fmt.Errorf("expected %d registers, got %d", h.m, len(registers))
+	}
+	maxRho := 64 - h.p + 1
+	h.sparse = false
+	h.bitsPerRegister = 5
+	h.data = make([]byte, h.m*h.bitsPerRegister/8)
+	for i, rho := range registers {
+		if rho > maxRho {
+			return nil, fmt.Errorf("register %d has value %d, expected at most %d", i, rho, maxRho)
+		}
+		h.updateRegisterIfBigger(uint32(i), rho)
+	}
+	return h, nil
+}
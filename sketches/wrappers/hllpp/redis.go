@@ -0,0 +1,236 @@
+package hllpp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
+	"github.com/seiflotfy/skizze/sketches/wrappers/hllpp/hllpp"
+)
+
+/*
+RedisPrecision is the precision of all Redis HyperLogLogs
+*/
+const RedisPrecision = 14
+
+// Redis HyperLogLogs start with a 16 byte header: the magic, one byte for the
+// encoding, 3 unused bytes and the cached cardinality (little endian, the
+// highest bit set if it is invalid). Dense ones hold 6 bit registers packed
+// from the lowest bit on, sparse ones run length encoded registers.
+const (
+	redisRegisters  = 1 << RedisPrecision
+	redisHeaderSize = 16
+	redisDenseSize  = redisHeaderSize + redisRegisters*6/8
+	redisDense      = 0
+	redisSparse     = 1
+	redisMaxRho     = 64 - RedisPrecision + 1
+)
+
+var redisMagic = []byte("HYLL")
+
+/*
+MarshalRedis encodes the sketch as a dense Redis HyperLogLog. Sketches with a
+precision above that of Redis are folded down to it and sketches not hashed
+with the Redis hash function can not be merged with Redis ones without counting
+values twice, both are lossy and only allowed if lossy is set.
+*/
+func (d *Sketch) MarshalRedis(lossy bool) ([]byte, error) {
+	p := d.impl.Precision()
+	if p < RedisPrecision {
+		return nil, fmt.Errorf("Can not convert precision %d to the precision %d of Redis", p, RedisPrecision)
+	}
+	if err := checkRedisLoss(d.Info, p, lossy); err != nil {
+		return nil, err
+	}
+	registers := foldRegisters(d.impl.Registers(), p, RedisPrecision)
+
+	data := make([]byte, redisDenseSize)
+	copy(data, redisMagic)
+	data[4] = redisDense
+	// Invalidate the cached cardinality so Redis computes it
+	data[15] = 1 << 7
+	dense := data[redisHeaderSize:]
+	for i, rho := range registers {
+		setRedisRegister(dense, reverseIndex(uint32(i), RedisPrecision), rho)
+	}
+	return data, nil
+}
+
+/*
+UnmarshalRedis loads a sketch of info from a dense or sparse Redis
+HyperLogLog. Sketches with a precision below that of Redis get the registers
+folded down to their precision and sketches not hashed with the Redis hash
+function can not be merged with it without counting values twice, both are
+lossy and only allowed if lossy is set.
+*/
+func UnmarshalRedis(info *abstract.Info, data []byte, lossy bool) (*Sketch, error) {
+	sketch, err := NewSketch(info)
+	if err != nil {
+		return nil, err
+	}
+	p := sketch.impl.Precision()
+	if p > RedisPrecision {
+		return nil, fmt.Errorf("Can not convert the precision %d of Redis to precision %d", RedisPrecision, p)
+	}
+	if err := checkRedisLoss(info, p, lossy); err != nil {
+		return nil, err
+	}
+	redisRegisters, err := readRedisRegisters(data)
+	if err != nil {
+		return nil, err
+	}
+
+	registers := make([]uint8, len(redisRegisters))
+	for i, rho := range redisRegisters {
+		registers[reverseIndex(uint32(i), RedisPrecision)] = rho
+	}
+	registers = foldRegisters(registers, RedisPrecision, p)
+	impl, err := hllpp.NewFromRegisters(hllpp.Config{Precision: p}, registers)
+	if err != nil {
+		return nil, err
+	}
+	sketch.impl = impl
+	return sketch, nil
+}
+
+func checkRedisLoss(info *abstract.Info, p uint8, lossy bool) error {
+	if lossy {
+		return nil
+	}
+	if info.Hash != hashing.Redis || info.Seed != 0 {
+		return fmt.Errorf("Sketch %s is not hashed with %s (seed 0) like Redis, converting it is lossy", info.ID, hashing.Redis)
+	}
+	if p != RedisPrecision {
+		return fmt.Errorf("Sketch %s has precision %d instead of %d like Redis, converting it is lossy", info.ID, p, RedisPrecision)
+	}
+	return nil
+}
+
+/*
+readRedisRegisters returns the registers of a Redis HyperLogLog in the order
+of Redis
+*/
+func readRedisRegisters(data []byte) ([]uint8, error) {
+	if len(data) < redisHeaderSize || !bytes.HasPrefix(data, redisMagic) {
+		return nil, errors.New("Invalid Redis HyperLogLog: no HYLL header")
+	}
+	registers := make([]uint8, redisRegisters)
+	payload := data[redisHeaderSize:]
+
+	switch data[4] {
+	case redisDense:
+		if len(data) != redisDenseSize {
+			return nil, fmt.Errorf("Invalid Redis HyperLogLog: dense encoding of %d bytes, expected %d", len(data), redisDenseSize)
+		}
+		for i := range registers {
+			registers[i] = getRedisRegister(payload, uint32(i))
+		}
+	case redisSparse:
+		idx := 0
+		for i := 0; i < len(payload); i++ {
+			op := payload[i]
+			var rho uint8
+			var run int
+			switch {
+			case op&0x80 != 0: // VAL: 1vvvvvxx
+				rho = (op>>2)&0x1f + 1
+				run = int(op&0x03) + 1
+			case op&0x40 != 0: // XZERO: 01xxxxxx yyyyyyyy
+				if i+1 == len(payload) {
+					return nil, errors.New("Invalid Redis HyperLogLog: truncated sparse encoding")
+				}
+				i++
+				run = (int(op&0x3f)<<8 | int(payload[i])) + 1
+			default: // ZERO: 00xxxxxx
+				run = int(op&0x3f) + 1
+			}
+			if idx+run > redisRegisters {
+				return nil, errors.New("Invalid Redis HyperLogLog: sparse encoding has too many registers")
+			}
+			for end := idx + run; idx < end; idx++ {
+				registers[idx] = rho
+			}
+		}
+		if idx != redisRegisters {
+			return nil, fmt.Errorf("Invalid Redis HyperLogLog: sparse encoding has %d registers, expected %d", idx, redisRegisters)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid Redis HyperLogLog: unknown encoding %d", data[4])
+	}
+
+	for i, rho := range registers {
+		if rho > redisMaxRho {
+			return nil, fmt.Errorf("Invalid Redis HyperLogLog: register %d has value %d", i, rho)
+		}
+	}
+	return registers, nil
+}
+
+func getRedisRegister(dense []byte, idx uint32) uint8 {
+	bit := idx * 6
+	b, shift := bit/8, bit%8
+	value := dense[b] >> shift
+	if shift > 2 {
+		value |= dense[b+1] << (8 - shift)
+	}
+	return value & 63
+}
+
+func setRedisRegister(dense []byte, idx uint32, rho uint8) {
+	bit := idx * 6
+	b, shift := bit/8, bit%8
+	dense[b] &^= 63 << shift
+	dense[b] |= rho << shift
+	if shift > 2 {
+		dense[b+1] &^= 63 >> (8 - shift)
+		dense[b+1] |= rho >> (8 - shift)
+	}
+}
+
+/*
+reverseIndex maps a register index between Redis, which takes it from the low
+bits of a hash, and hllpp, which takes it from the high bits of the reversed
+hash (see hashing.Redis)
+*/
+func reverseIndex(idx uint32, p uint8) uint32 {
+	var reversed uint32
+	for i := uint8(0); i < p; i++ {
+		reversed = reversed<<1 | idx&1
+		idx >>= 1
+	}
+	return reversed
+}
+
+/*
+foldRegisters lowers the precision of hllpp registers from p to q, giving the
+registers the values had been added with at precision q. The low p-q bits of
+an index become the leading bits of the rest of the hash.
+*/
+func foldRegisters(registers []uint8, p uint8, q uint8) []uint8 {
+	if p == q {
+		return registers
+	}
+	shift := p - q
+	folded := make([]uint8, 1<<q)
+	for i, rho := range registers {
+		if rho == 0 {
+			continue
+		}
+		rest := uint32(i) & (1<<shift - 1)
+		if rest != 0 {
+			// Leading zeros of the rest within shift bits plus one
+			rho = shift
+			for ; rest > 1; rest >>= 1 {
+				rho--
+			}
+		} else {
+			rho += shift
+		}
+		if idx := i >> shift; rho > folded[idx] {
+			folded[idx] = rho
+		}
+	}
+	return folded
+}
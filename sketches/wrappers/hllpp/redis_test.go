@@ -0,0 +1,217 @@
+package hllpp
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
+)
+
+func newTestSketch(t *testing.T, hash string, precision float64) *Sketch {
+	sketch, err := NewSketch(&abstract.Info{
+		ID:         "marvel",
+		Type:       abstract.HLLPP,
+		Properties: map[string]float64{"precision": precision},
+		State:      make(map[string]uint64),
+		Hash:       hash,
+	})
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	return sketch
+}
+
+func addRange(sketch *Sketch, from int, to int) {
+	for i := from; i < to; i++ {
+		sketch.Add([]byte(fmt.Sprintf("hero-%d", i)))
+	}
+}
+
+func expectCount(t *testing.T, sketch *Sketch, expected float64) {
+	count := float64(sketch.GetCount())
+	if math.Abs(count-expected)/expected > 0.03 {
+		t.Errorf("Expected count of about %v, got %v", expected, count)
+	}
+}
+
+/*
+redisPFAdd adds the values to the registers the way PFADD of Redis does
+*/
+func redisPFAdd(registers []uint8, from int, to int) {
+	hasher, _ := hashing.New(hashing.Redis, 0)
+	for i := from; i < to; i++ {
+		// Undo the bit reversal to get the MurmurHash64A hash of Redis
+		reversed := hasher.Sum64([]byte(fmt.Sprintf("hero-%d", i)))
+		var hash uint64
+		for b := 0; b < 64; b++ {
+			hash = hash<<1 | reversed&1
+			reversed >>= 1
+		}
+		idx := hash & (redisRegisters - 1)
+		hash = hash>>RedisPrecision | 1<<(64-RedisPrecision)
+		count := uint8(1)
+		for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+			count++
+		}
+		if count > registers[idx] {
+			registers[idx] = count
+		}
+	}
+}
+
+func redisDenseHLL(registers []uint8) []byte {
+	data := make([]byte, redisDenseSize)
+	copy(data, redisMagic)
+	for i, rho := range registers {
+		setRedisRegister(data[redisHeaderSize:], uint32(i), rho)
+	}
+	return data
+}
+
+func redisSparseHLL(registers []uint8) []byte {
+	data := append([]byte(nil), redisMagic...)
+	data = append(data, redisSparse, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	for i := 0; i < len(registers); {
+		run := 1
+		for i+run < len(registers) && registers[i+run] == registers[i] {
+			run++
+		}
+		if registers[i] == 0 {
+			if run > 16384 {
+				run = 16384
+			}
+			data = append(data, 0x40|byte((run-1)>>8), byte(run-1))
+		} else {
+			if run > 4 {
+				run = 4
+			}
+			data = append(data, 0x80|(registers[i]-1)<<2|byte(run-1))
+		}
+		i += run
+	}
+	return data
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	sketch := newTestSketch(t, hashing.Redis, 14)
+	addRange(sketch, 0, 5000)
+
+	data, err := sketch.MarshalRedis(false)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	if len(data) != redisDenseSize || string(data[:4]) != "HYLL" {
+		t.Fatalf("Expected a dense Redis HyperLogLog of %d bytes, got %d", redisDenseSize, len(data))
+	}
+	loaded, err := UnmarshalRedis(sketch.Info, data, false)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	// The sketch is still sparse and more precise than its registers
+	expectCount(t, loaded, float64(sketch.GetCount()))
+}
+
+func TestRedisInterop(t *testing.T) {
+	registers := make([]uint8, redisRegisters)
+	redisPFAdd(registers, 0, 1000)
+
+	for _, data := range [][]byte{redisDenseHLL(registers), redisSparseHLL(registers)} {
+		sketch := newTestSketch(t, hashing.Redis, 14)
+		addRange(sketch, 500, 1500)
+
+		imported, err := UnmarshalRedis(sketch.Info, data, false)
+		if err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		expectCount(t, imported, 1000)
+		// Values added to both must only be counted once
+		if err := sketch.Merge(imported); err != nil {
+			t.Fatal("Expected no errors, got", err)
+		}
+		expectCount(t, sketch, 1500)
+	}
+
+	// Exported registers must be the ones Redis would have
+	sketch := newTestSketch(t, hashing.Redis, 14)
+	addRange(sketch, 0, 1000)
+	data, _ := sketch.MarshalRedis(false)
+	exported, err := readRedisRegisters(data)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	for i := range registers {
+		if exported[i] != registers[i] {
+			t.Fatalf("Expected register %d to be %d, got %d", i, registers[i], exported[i])
+		}
+	}
+}
+
+func TestRedisPrecision(t *testing.T) {
+	sketch := newTestSketch(t, "", 14)
+	addRange(sketch, 0, 5000)
+	if _, err := sketch.MarshalRedis(false); err == nil {
+		t.Error("Expected error converting a sketch with another hash function")
+	}
+	if _, err := sketch.MarshalRedis(true); err != nil {
+		t.Error("Expected no errors converting lossy, got", err)
+	}
+
+	low := newTestSketch(t, hashing.Redis, 12)
+	if _, err := low.MarshalRedis(true); err == nil {
+		t.Error("Expected error raising the precision")
+	}
+	high := newTestSketch(t, hashing.Redis, 16)
+	addRange(high, 0, 5000)
+	if _, err := high.MarshalRedis(false); err == nil {
+		t.Error("Expected error folding the precision without lossy")
+	}
+	data, err := high.MarshalRedis(true)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+
+	// Folding must give the registers of a sketch built at the lower precision
+	registers := make([]uint8, redisRegisters)
+	redisPFAdd(registers, 0, 5000)
+	folded, _ := readRedisRegisters(data)
+	for i := range registers {
+		if folded[i] != registers[i] {
+			t.Fatalf("Expected register %d to be %d, got %d", i, registers[i], folded[i])
+		}
+	}
+
+	if _, err := UnmarshalRedis(high.Info, data, true); err == nil {
+		t.Error("Expected error raising the precision")
+	}
+	if _, err := UnmarshalRedis(low.Info, data, false); err == nil {
+		t.Error("Expected error folding the precision without lossy")
+	}
+	loaded, err := UnmarshalRedis(low.Info, data, true)
+	if err != nil {
+		t.Fatal("Expected no errors, got", err)
+	}
+	expectCount(t, loaded, 5000)
+}
+
+func TestInvalidRedis(t *testing.T) {
+	info := newTestSketch(t, hashing.Redis, 14).Info
+	registers := make([]uint8, redisRegisters)
+	redisPFAdd(registers, 0, 100)
+	sparse := redisSparseHLL(registers)
+
+	tests := map[string][]byte{
+		"short":     []byte("HYLL"),
+		"magic":     append([]byte("HLL!"), sparse[4:]...),
+		"encoding":  append(append([]byte("HYLL"), 2), sparse[5:]...),
+		"dense":     redisDenseHLL(registers)[:redisDenseSize-1],
+		"truncated": sparse[:len(sparse)-1],
+		"overflow":  append(sparse, 0x00),
+	}
+	for name, data := range tests {
+		if _, err := UnmarshalRedis(info, data, false); err == nil {
+			t.Errorf("Expected error loading %s Redis HyperLogLog", name)
+		}
+	}
+}
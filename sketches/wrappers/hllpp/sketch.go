@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/seiflotfy/skizze/sketches/abstract"
+	"github.com/seiflotfy/skizze/sketches/hashing"
 	"github.com/seiflotfy/skizze/sketches/wrappers/hllpp/hllpp"
 	"github.com/seiflotfy/skizze/utils"
 )
@@ -15,14 +16,25 @@ Sketch is the toplevel sketch to control the HLL implementation
 */
 type Sketch struct {
 	*abstract.Info
-	impl *hllpp.HLLPP
+	impl   *hllpp.HLLPP
+	hasher hashing.Hasher
 }
 
 /*
 NewSketch ...
 */
 func NewSketch(info *abstract.Info) (*Sketch, error) {
-	d := Sketch{info, hllpp.New()}
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := hllpp.NewWithConfig(hllpp.Config{
+		Precision: uint8(info.Properties["precision"]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := Sketch{info, sketch, hasher}
 	return &d, nil
 }
 
@@ -30,7 +42,11 @@ func NewSketch(info *abstract.Info) (*Sketch, error) {
 Add ...
 */
 func (d *Sketch) Add(value []byte) (bool, error) {
-	d.impl.Add(value)
+	if d.hasher != nil {
+		d.impl.AddHash(d.hasher.Sum64(value))
+	} else {
+		d.impl.Add(value)
+	}
 	return true, nil
 }
 
@@ -39,11 +55,36 @@ AddMultiple ...
 */
 func (d *Sketch) AddMultiple(values [][]byte) (bool, error) {
 	for _, value := range values {
-		d.impl.Add(value)
+		d.Add(value)
+	}
+	return true, nil
+}
+
+/*
+AddWeighted adds value once, the count does not matter for this sketch type
+*/
+func (d *Sketch) AddWeighted(value []byte, count int64) (bool, error) {
+	if count <= 0 {
+		return false, errors.New("This Sketch type only supports positive counts")
 	}
+	return d.Add(value)
+}
+
+/*
+AddHash adds an already computed 64-bit hash
+*/
+func (d *Sketch) AddHash(hash uint64) (bool, error) {
+	d.impl.AddHash(hash)
 	return true, nil
 }
 
+/*
+GetFrequencyForHash ...
+*/
+func (d *Sketch) GetFrequencyForHash(hash uint64) interface{} {
+	return nil
+}
+
 /*
 Remove ...
 */
@@ -81,6 +122,17 @@ func (d *Sketch) GetFrequency(values [][]byte) interface{} {
 	return nil
 }
 
+/*
+Merge merges the registers of another hllpp sketch into this one
+*/
+func (d *Sketch) Merge(other abstract.Sketch) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Can only merge sketches of type hllpp")
+	}
+	return d.impl.Merge(o.impl)
+}
+
 /*
 Marshal ...
 */
@@ -92,9 +144,13 @@ func (d *Sketch) Marshal() ([]byte, error) {
 Unmarshal ...
 */
 func Unmarshal(info *abstract.Info, data []byte) (*Sketch, error) {
+	hasher, err := hashing.New(info.Hash, info.Seed)
+	if err != nil {
+		return nil, err
+	}
 	counter, err := hllpp.Unmarshal(data)
 	if err != nil {
 		return nil, err
 	}
-	return &Sketch{info, counter}, nil
+	return &Sketch{info, counter, hasher}, nil
 }
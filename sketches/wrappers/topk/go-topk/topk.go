@@ -34,7 +34,7 @@ type elementsByCountDescending []Element
 
 func (elts elementsByCountDescending) Len() int { return len(elts) }
 func (elts elementsByCountDescending) Less(i, j int) bool {
-	return (elts[i].Count >= elts[j].Count) || (elts[i].Count == elts[j].Count && elts[i].Key < elts[i].Key)
+	return (elts[i].Count > elts[j].Count) || (elts[i].Count == elts[j].Count && elts[i].Key < elts[j].Key)
 }
 func (elts elementsByCountDescending) Swap(i, j int) { elts[i], elts[j] = elts[j], elts[i] }
 
@@ -97,14 +97,16 @@ func New(n int) *Stream {
 	}
 }
 
+// alphaIndex returns the index of x in the alpha table
+func (s *Stream) alphaIndex(x string) int {
+	h := fnv.New32a()
+	h.Write([]byte(x))
+	return int(h.Sum32() % uint32(len(s.Alphas)))
+}
+
 // Insert adds an element to the stream to be tracked
 func (s *Stream) Insert(x string, count int) error {
-	h := fnv.New32a()
-	_, err := h.Write([]byte(x))
-	if err != nil {
-		return err
-	}
-	xhash := int(h.Sum32()) % len(s.Alphas)
+	xhash := s.alphaIndex(x)
 
 	// are we tracking this element?
 	if idx, ok := s.K.M[x]; ok {
@@ -127,14 +129,7 @@ func (s *Stream) Insert(x string, count int) error {
 
 	// replace the current minimum element
 	minKey := s.K.Elts[0].Key
-
-	h.Reset()
-	_, err = h.Write([]byte(minKey))
-	if err != nil {
-		return err
-	}
-	mkhash := int(h.Sum32()) % len(s.Alphas)
-	s.Alphas[mkhash] = s.K.Elts[0].Count
+	s.Alphas[s.alphaIndex(minKey)] = s.K.Elts[0].Count
 
 	s.K.Elts[0].Key = x
 	s.K.Elts[0].Error = s.Alphas[xhash]
@@ -155,3 +150,49 @@ func (s *Stream) Keys() []Element {
 	sort.Sort(elementsByCountDescending(elts))
 	return elts
 }
+
+// Estimate returns the estimated count of x. Tracked elements are returned as
+// is, for untracked elements the count and error are the value of the alpha
+// table, an upper bound of their true count.
+func (s *Stream) Estimate(x string) Element {
+	if idx, ok := s.K.M[x]; ok {
+		return s.K.Elts[idx]
+	}
+	alpha := s.Alphas[s.alphaIndex(x)]
+	return Element{Key: x, Count: alpha, Error: alpha}
+}
+
+// Top returns the n most frequent elements (all tracked elements if n <= 0)
+// with a count of at least minCount. If guaranteed is set only elements whose
+// Count - Error beats the count of the (n+1)th element are returned, these
+// are guaranteed to be in the true top n.
+func (s *Stream) Top(n int, minCount int, guaranteed bool) []Element {
+	elts := s.Keys()
+	if n <= 0 || n > len(elts) {
+		n = len(elts)
+	}
+
+	// the count any element outside the top n can have at most
+	threshold := 0
+	if n < len(elts) {
+		threshold = elts[n].Count
+	} else {
+		for _, alpha := range s.Alphas {
+			if alpha > threshold {
+				threshold = alpha
+			}
+		}
+	}
+
+	top := make([]Element, 0, n)
+	for _, e := range elts[:n] {
+		if e.Count < minCount {
+			break
+		}
+		if guaranteed && e.Count-e.Error <= threshold {
+			continue
+		}
+		top = append(top, e)
+	}
+	return top
+}
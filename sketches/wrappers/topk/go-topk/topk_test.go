@@ -66,3 +66,46 @@ func TestTopK(t *testing.T) {
 		}
 	}
 }
+
+func TestKeysOrder(t *testing.T) {
+	tk := New(10)
+	for _, x := range []string{"c", "b", "a", "d", "d"} {
+		tk.Insert(x, 1)
+	}
+	expected := []string{"d", "a", "b", "c"}
+	for i, e := range tk.Keys() {
+		if e.Key != expected[i] {
+			t.Errorf("Expected %s at position %d, got %s", expected[i], i, e.Key)
+		}
+	}
+}
+
+func TestTop(t *testing.T) {
+	tk := New(3)
+	tk.Insert("a", 10)
+	tk.Insert("b", 5)
+	tk.Insert("c", 2)
+	// d is not tracked at first, then evicts c with its first count as error
+	tk.Insert("d", 1)
+	tk.Insert("d", 2)
+
+	top := tk.Top(2, 0, false)
+	if len(top) != 2 || top[0].Key != "a" || top[1].Key != "b" {
+		t.Errorf("Expected a and b as top 2, got %v", top)
+	}
+	top = tk.Top(0, 5, false)
+	if len(top) != 2 {
+		t.Errorf("Expected 2 elements with a count of at least 5, got %v", top)
+	}
+	top = tk.Top(3, 0, true)
+	if len(top) != 2 || top[0].Key != "a" || top[1].Key != "b" {
+		t.Errorf("Expected only a and b to be guaranteed, got %v", top)
+	}
+
+	if e := tk.Estimate("a"); e.Count != 10 || e.Error != 0 {
+		t.Errorf("Expected estimate 10 without error for a, got %v", e)
+	}
+	if e := tk.Estimate("c"); e.Count != 2 || e.Error != 2 {
+		t.Errorf("Expected estimate 2 with error 2 for evicted c, got %v", e)
+	}
+}
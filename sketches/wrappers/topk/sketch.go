@@ -14,6 +14,10 @@ var logger = utils.GetLogger()
 
 const defaultCapacity = 100.0
 
+// elementSize is about what a tracked value takes besides its bytes: its
+// element in the heap and its entry in the map of positions
+const elementSize = 80
+
 /*
 Sketch is the toplevel sketch to control the HLL implementation
 */
@@ -68,6 +72,21 @@ func (d *Sketch) AddMultiple(values [][]byte) (bool, error) {
 	return true, nil
 }
 
+/*
+AddWeighted inserts value with the given count
+*/
+func (d *Sketch) AddWeighted(value []byte, count int64) (bool, error) {
+	if count <= 0 {
+		return false, errors.New("This sketch type only supports positive counts")
+	}
+	err := d.impl.Insert(string(value), int(count))
+	if err != nil {
+		logger.Error.Println("an error has occurred while populating sketch: " + err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
 /*
 Remove ...
 */
@@ -113,10 +132,25 @@ func (d *Sketch) GetID() string {
 }
 
 /*
-GetFrequency ...
+GetFrequency returns all tracked values ordered by count, values are ignored
 */
 func (d *Sketch) GetFrequency(values [][]byte) interface{} {
-	keys := d.impl.Keys()
+	return d.GetResult(values, abstract.Query{})
+}
+
+/*
+GetResult returns the top values matching the query, or the estimated count
+of each value for lookups
+*/
+func (d *Sketch) GetResult(values [][]byte, query abstract.Query) interface{} {
+	if query.Lookup {
+		result := make(map[string]ResultElement)
+		for _, value := range values {
+			result[string(value)] = ResultElement(d.impl.Estimate(string(value)))
+		}
+		return result
+	}
+	keys := d.impl.Top(query.N, query.MinCount, query.Guaranteed)
 	result := make([]ResultElement, len(keys), len(keys))
 	for i, k := range keys {
 		result[i] = ResultElement(k)
@@ -138,6 +172,17 @@ func (d *Sketch) Marshal() ([]byte, error) {
 	return network.Bytes(), nil
 }
 
+/*
+MemorySize estimates the bytes the tracked values take in memory
+*/
+func (d *Sketch) MemorySize() uint64 {
+	size := uint64(len(d.impl.Alphas)) * 8
+	for _, elt := range d.impl.K.Elts {
+		size += uint64(len(elt.Key)) + elementSize
+	}
+	return size
+}
+
 /*
 Unmarshal ...
 */
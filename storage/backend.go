@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/seiflotfy/skizze/config"
+	"github.com/seiflotfy/skizze/utils"
+)
+
+/*
+Storage backends selectable with storage in the config
+*/
+const (
+	FileBackend   = "file"
+	BoltBackend   = "bolt"
+	MemoryBackend = "memory"
+)
+
+/*
+Backend stores the info of sketches and domains, the data of sketches and their
+replica state
+*/
+type Backend interface {
+	LoadAllInfo() ([][]byte, error)
+	SaveInfo(ID string, infoData []byte) error
+	DeleteInfo(ID string) error
+	LoadAllDomains() ([][]byte, error)
+	SaveDomain(ID string, domainData []byte) error
+	DeleteDomain(ID string) error
+	// The replica state of sketches kept by multi-master nodes to merge
+	// the writes of their peers
+	LoadAllReplicas() ([][]byte, error)
+	SaveReplicas(ID string, replicaData []byte) error
+	DeleteReplicas(ID string) error
+
+	// Create prepares the storage for the data of a new sketch
+	Create(ID string) error
+	// SaveSlices stores data and returns the number of slices written, only
+	// slices that changed since they were last saved or loaded are written
+	SaveSlices(ID string, data []byte) (int, error)
+	// Save stores the data of a sketch like SaveSlices together with its
+	// info, in one transaction where the backend has them
+	Save(ID string, data []byte, infoData []byte) (int, error)
+	LoadSlices(ID string) ([]byte, error)
+	DeleteData(ID string) error
+	// QuarantineData moves the data of a sketch that can not be loaded out
+	// of the way, next to its serialized info
+	QuarantineData(ID string, infoData []byte) error
+	// DataIDs returns the ids of all sketches with stored data
+	DataIDs() ([]string, error)
+	// OpenKV opens the KV holding the data of a sketch that is too big to be
+	// serialized as a whole, creating it if needed. It is deleted and
+	// quarantined with the data of the sketch, the caller must close it.
+	OpenKV(ID string) (KV, error)
+
+	Close() error
+}
+
+var backend Backend
+
+/*
+Manager returns the singleton storage backend selected in the config
+*/
+func Manager() Backend {
+	if backend == nil {
+		var err error
+		backend, err = NewBackend(config.GetConfig().Storage)
+		utils.PanicOnError(err)
+	}
+	return backend
+}
+
+/*
+NewBackend opens the storage backend with the given name besides the one of
+Manager, e.g. to keep the sketches of several managers in one process apart
+*/
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", FileBackend:
+		return newManager(), nil
+	case BoltBackend:
+		return newBoltBackend()
+	case MemoryBackend:
+		return newMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage backend %s, expected one of %s, %s or %s", name, FileBackend, BoltBackend, MemoryBackend)
+}
+
+/*
+Close closes the storage backend, the next call to Manager opens it again
+*/
+func Close() error {
+	if backend == nil {
+		return nil
+	}
+	err := backend.Close()
+	backend = nil
+	return err
+}
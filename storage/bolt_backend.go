@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	dataBucket       = "data"
+	quarantineBucket = "quarantine"
+	boltFile         = "skizze.db"
+
+	// The database is compacted on open when more than compactRatio of a
+	// file of at least minCompactSize bytes is free
+	compactRatio   = 0.5
+	minCompactSize = 1 << 20
+	// Compacting commits every compactTxSize bytes copied
+	compactTxSize = 64 << 20
+)
+
+/*
+boltBackend keeps the info and the data of all sketches in a single BoltDB
+file in the data dir. The data of each sketch is a bucket of slices keyed by
+their big endian index, its KV another bucket of the same id.
+*/
+type boltBackend struct {
+	db        *bolt.DB
+	sliceSize int
+	lock      sync.RWMutex // write locked while compacting
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newBoltBackend() (*boltBackend, error) {
+	setupDataPath()
+	db, err := openBolt(filepath.Join(dataPath, boltFile))
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range []string{infoBucket, domainBucket, replicaBucket, dataBucket, string(kvBucket), quarantineBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	b := &boltBackend{db: db, sliceSize: sliceSize(conf.SliceSize)}
+	if fragmented(db) {
+		if err := b.Compact(); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	if conf.CompactInterval > 0 {
+		b.stop, b.done = make(chan struct{}), make(chan struct{})
+		go b.compactEvery(time.Duration(conf.CompactInterval) * time.Second)
+	}
+	return b, nil
+}
+
+/*
+compactEvery compacts the database when it is fragmented every interval until
+the backend is closed
+*/
+func (b *boltBackend) compactEvery(interval time.Duration) {
+	defer close(b.done)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(interval):
+			b.lock.RLock()
+			compact := fragmented(b.db)
+			b.lock.RUnlock()
+			if !compact {
+				continue
+			}
+			if err := b.Compact(); err != nil {
+				logger.Error.Println("Error compacting database:", err)
+			}
+		}
+	}
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	dbOptions := &bolt.Options{Timeout: 1 * time.Second}
+	return bolt.Open(path, 0600, dbOptions)
+}
+
+func (b *boltBackend) view(fn func(*bolt.Tx) error) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.db.View(fn)
+}
+
+func (b *boltBackend) update(fn func(*bolt.Tx) error) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.db.Update(fn)
+}
+
+func sliceIndex(i int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(i))
+	return key
+}
+
+func (b *boltBackend) loadAll(bucketName string) ([][]byte, error) {
+	var values [][]byte
+	err := b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).ForEach(func(k, v []byte) error {
+			// Values are only valid during the transaction
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (b *boltBackend) put(bucketName string, ID string, value []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).Put([]byte(ID), value)
+	})
+}
+
+func (b *boltBackend) delete(bucketName string, ID string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).Delete([]byte(ID))
+	})
+}
+
+/*
+LoadAllInfo ...
+*/
+func (b *boltBackend) LoadAllInfo() ([][]byte, error) {
+	return b.loadAll(infoBucket)
+}
+
+/*
+SaveInfo ...
+*/
+func (b *boltBackend) SaveInfo(ID string, infoData []byte) error {
+	return b.put(infoBucket, ID, infoData)
+}
+
+/*
+DeleteInfo ...
+*/
+func (b *boltBackend) DeleteInfo(ID string) error {
+	return b.delete(infoBucket, ID)
+}
+
+/*
+LoadAllDomains ...
+*/
+func (b *boltBackend) LoadAllDomains() ([][]byte, error) {
+	return b.loadAll(domainBucket)
+}
+
+/*
+SaveDomain ...
+*/
+func (b *boltBackend) SaveDomain(ID string, domainData []byte) error {
+	return b.put(domainBucket, ID, domainData)
+}
+
+/*
+DeleteDomain ...
+*/
+func (b *boltBackend) DeleteDomain(ID string) error {
+	return b.delete(domainBucket, ID)
+}
+
+/*
+LoadAllReplicas ...
+*/
+func (b *boltBackend) LoadAllReplicas() ([][]byte, error) {
+	return b.loadAll(replicaBucket)
+}
+
+/*
+SaveReplicas ...
+*/
+func (b *boltBackend) SaveReplicas(ID string, replicaData []byte) error {
+	return b.put(replicaBucket, ID, replicaData)
+}
+
+/*
+DeleteReplicas ...
+*/
+func (b *boltBackend) DeleteReplicas(ID string) error {
+	return b.delete(replicaBucket, ID)
+}
+
+/*
+Create does nothing, the data bucket of a sketch is created when it is first
+saved which saves one transaction per new sketch
+*/
+func (b *boltBackend) Create(ID string) error {
+	return nil
+}
+
+/*
+SaveSlices ...
+*/
+func (b *boltBackend) SaveSlices(ID string, data []byte) (int, error) {
+	written := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		var err error
+		written, err = b.saveSlices(tx, ID, data)
+		return err
+	})
+	return written, err
+}
+
+/*
+Save writes the slices and the info in one transaction, every transaction
+syncs the whole file
+*/
+func (b *boltBackend) Save(ID string, data []byte, infoData []byte) (int, error) {
+	written := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		var err error
+		if written, err = b.saveSlices(tx, ID, data); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(infoBucket)).Put([]byte(ID), infoData)
+	})
+	return written, err
+}
+
+func (b *boltBackend) saveSlices(tx *bolt.Tx, ID string, data []byte) (int, error) {
+	bucket, err := tx.Bucket([]byte(dataBucket)).CreateBucketIfNotExists([]byte(ID))
+	if err != nil {
+		return 0, err
+	}
+	written, i := 0, 0
+	for offset := 0; offset < len(data); i, offset = i+1, offset+b.sliceSize {
+		end := offset + b.sliceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		key := sliceIndex(i)
+		if bytes.Equal(bucket.Get(key), data[offset:end]) {
+			continue
+		}
+		if err := bucket.Put(key, data[offset:end]); err != nil {
+			return written, err
+		}
+		written++
+	}
+	// Drop the slices beyond the end of the data
+	c := bucket.Cursor()
+	for k, _ := c.Seek(sliceIndex(i)); k != nil; k, _ = c.Seek(sliceIndex(i)) {
+		if err := bucket.Delete(k); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+/*
+LoadSlices ...
+*/
+func (b *boltBackend) LoadSlices(ID string) ([]byte, error) {
+	var data []byte
+	err := b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dataBucket)).Bucket([]byte(ID))
+		if bucket == nil {
+			return errors.New("No data for sketch " + ID)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			data = append(data, v...)
+			return nil
+		})
+	})
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+/*
+DeleteData ...
+*/
+func (b *boltBackend) DeleteData(ID string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(kvBucket).DeleteBucket([]byte(ID))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket([]byte(dataBucket)).DeleteBucket([]byte(ID))
+	})
+}
+
+/*
+QuarantineData moves the data bucket of the sketch into the quarantine
+bucket, its info is stored under the "info" key and its KV in the "kv" bucket
+*/
+func (b *boltBackend) QuarantineData(ID string, infoData []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		quarantine, err := tx.Bucket([]byte(quarantineBucket)).CreateBucketIfNotExists([]byte(ID))
+		if err != nil {
+			return err
+		}
+		if err := quarantine.Put([]byte("info"), infoData); err != nil {
+			return err
+		}
+		if kv := tx.Bucket(kvBucket).Bucket([]byte(ID)); kv != nil {
+			moved, err := quarantine.CreateBucketIfNotExists(kvBucket)
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(moved, kv); err != nil {
+				return err
+			}
+			if err := tx.Bucket(kvBucket).DeleteBucket([]byte(ID)); err != nil {
+				return err
+			}
+		}
+		data := tx.Bucket([]byte(dataBucket))
+		bucket := data.Bucket([]byte(ID))
+		if bucket == nil {
+			return nil
+		}
+		err = bucket.ForEach(func(k, v []byte) error {
+			return quarantine.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+		})
+		if err != nil {
+			return err
+		}
+		return data.DeleteBucket([]byte(ID))
+	})
+}
+
+/*
+DataIDs ...
+*/
+func (b *boltBackend) DataIDs() ([]string, error) {
+	var ids []string
+	err := b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(dataBucket)).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+/*
+OpenKV opens the KV of a sketch in a bucket of the database, closing it does
+nothing
+*/
+func (b *boltBackend) OpenKV(ID string) (KV, error) {
+	err := b.update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(kvBucket).CreateBucketIfNotExists([]byte(ID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltKV{
+		view:   b.view,
+		update: b.update,
+		bucket: func(tx *bolt.Tx) *bolt.Bucket { return tx.Bucket(kvBucket).Bucket([]byte(ID)) },
+		close:  func() error { return nil },
+	}, nil
+}
+
+/*
+Close ...
+*/
+func (b *boltBackend) Close() error {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+		b.stop = nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Close()
+}
+
+/*
+fragmented tells if more than compactRatio of the pages of the database are
+free, BoltDB reuses free pages but never shrinks its file
+*/
+func fragmented(db *bolt.DB) bool {
+	info, err := os.Stat(db.Path())
+	if err != nil || info.Size() < minCompactSize {
+		return false
+	}
+	stats := db.Stats()
+	free := float64(stats.FreePageN+stats.PendingPageN) * float64(db.Info().PageSize)
+	return free/float64(info.Size()) > compactRatio
+}
+
+/*
+Compact rewrites the database into a new file without the free pages left
+behind by deleted and shrunk sketches and replaces the old file with it
+*/
+func (b *boltBackend) Compact() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	path := b.db.Path()
+	compacted := path + ".compact"
+	if err := os.Remove(compacted); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dst, err := openBolt(compacted)
+	if err != nil {
+		return err
+	}
+	err = b.copyTo(dst)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return err
+	}
+
+	if err := b.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(compacted, path); err != nil {
+		// Keep serving from the original database
+		os.Remove(compacted)
+		if db, oerr := openBolt(path); oerr == nil {
+			b.db = db
+		}
+		return err
+	}
+	b.db, err = openBolt(path)
+	return err
+}
+
+/*
+copyTo copies all buckets of the database into dst, committing every
+compactTxSize bytes so big databases do not need one huge transaction
+*/
+func (b *boltBackend) copyTo(dst *bolt.DB) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+	size := 0
+	err = b.db.View(func(src *bolt.Tx) error {
+		return src.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+			return walkBucket(bucket, [][]byte{name}, func(path [][]byte, k, v []byte) error {
+				if size += len(k) + len(v); size > compactTxSize {
+					if err := tx.Commit(); err != nil {
+						return err
+					}
+					if tx, err = dst.Begin(true); err != nil {
+						return err
+					}
+					size = 0
+				}
+				// Buckets are looked up again as the transaction may be new
+				parent := tx.Bucket(path[0])
+				for _, name := range path[1:] {
+					parent = parent.Bucket(name)
+				}
+				if v == nil {
+					_, err := parent.CreateBucket(k)
+					return err
+				}
+				return parent.Put(k, v)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+walkBucket calls fn for every key of bucket and its nested buckets, which have
+nil values, with the names of the buckets leading to it
+*/
+func walkBucket(bucket *bolt.Bucket, path [][]byte, fn func(path [][]byte, k, v []byte) error) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		if err := fn(path, k, v); err != nil {
+			return err
+		}
+		if v != nil {
+			return nil
+		}
+		return walkBucket(bucket.Bucket(k), append(path[:len(path):len(path)], k), fn)
+	})
+}
+
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		// Nil values are nested buckets
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
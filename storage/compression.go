@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+/*
+Compression codecs for the data of sketches, CompressionNone stores the raw data
+*/
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+)
+
+// Compressed data starts with the magic followed by one byte for the codec,
+// data without the magic is raw (as written before compression existed)
+var compressionMagic = []byte{0xff, 'S', 'K', 'Z'}
+
+var codecs = []string{CompressionNone, CompressionSnappy}
+
+/*
+ValidCompression returns an error if codec is not a known compression codec,
+the empty codec means the default is used
+*/
+func ValidCompression(codec string) error {
+	if codec == "" || codecIndex(codec) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("Unknown compression %s, expected one of %v", codec, codecs)
+}
+
+func codecIndex(codec string) int {
+	for i, c := range codecs {
+		if c == codec {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Compress encodes data with codec and prepends a header naming the codec so
+Decompress can detect it
+*/
+func Compress(codec string, data []byte) ([]byte, error) {
+	if err := ValidCompression(codec); err != nil {
+		return nil, err
+	}
+	switch codec {
+	case CompressionSnappy:
+		data = snappy.Encode(nil, data)
+	default:
+		// Raw data only needs a header if it could be mistaken for one
+		if !bytes.HasPrefix(data, compressionMagic) {
+			return data, nil
+		}
+		codec = CompressionNone
+	}
+	out := make([]byte, 0, len(compressionMagic)+1+len(data))
+	out = append(out, compressionMagic...)
+	out = append(out, byte(codecIndex(codec)))
+	return append(out, data...), nil
+}
+
+/*
+Decompress decodes data written by Compress
+*/
+func Decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressionMagic) {
+		return data, nil
+	}
+	header := len(compressionMagic) + 1
+	if len(data) < header {
+		return nil, errors.New("Truncated compression header")
+	}
+	if int(data[header-1]) >= len(codecs) {
+		return nil, fmt.Errorf("Unknown compression codec %d", data[header-1])
+	}
+	switch codecs[data[header-1]] {
+	case CompressionSnappy:
+		return snappy.Decode(nil, data[header:])
+	default:
+		return data[header:], nil
+	}
+}
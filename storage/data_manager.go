@@ -1,14 +1,23 @@
 package storage
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
+// quarantineDir is the directory in the data dir holding the data of sketches
+// that could not be loaded
+const quarantineDir = "quarantine"
+
 /*
 Create storage
 */
 func (m *ManagerStruct) Create(ID string) error {
+	m.forgetSlices(ID)
 	f, err := os.OpenFile(filepath.Join(dataPath, ID), os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
@@ -33,17 +42,32 @@ func (m *ManagerStruct) SaveData(ID string, data []byte, offset int64) error {
 DeleteData ...
 */
 func (m *ManagerStruct) DeleteData(ID string) error {
-	v, ok := m.cache.Peek(ID)
-	if ok {
-		err := v.(*os.File).Close()
-		if err != nil {
-			logger.Error.Println(err)
-		}
-	}
+	m.forgetSlices(ID)
+	// Removing the file from the cache closes it
+	m.cache.Remove(ID)
 	path := filepath.Join(dataPath, ID)
+	if err := os.Remove(dbPath(ID)); err != nil && !os.IsNotExist(err) {
+		logger.Error.Println(err)
+	}
 	return os.Remove(path)
 }
 
+/*
+OpenKV opens the KV of a sketch in a database file next to its data file
+*/
+func (m *ManagerStruct) OpenKV(ID string) (KV, error) {
+	return openFileKV(ID)
+}
+
+func openDB(ID string) (*bolt.DB, error) {
+	dbOptions := &bolt.Options{Timeout: 1 * time.Second}
+	return bolt.Open(dbPath(ID), 0600, dbOptions)
+}
+
+func dbPath(ID string) string {
+	return filepath.Join(dataPath, ID+".db")
+}
+
 /*
 LoadData ...
 */
@@ -74,8 +98,33 @@ func (m *ManagerStruct) getFileFromCache(ID string) (*os.File, error) {
 		if err != nil {
 			return nil, err
 		}
+		m.cache.Add(ID, f)
 	} else {
 		f = v.(*os.File)
 	}
 	return f, nil
 }
+
+/*
+QuarantineData moves the data of a sketch that can not be loaded out of the
+way into the quarantine directory, next to its serialized info
+*/
+func (m *ManagerStruct) QuarantineData(ID string, infoData []byte) error {
+	m.forgetSlices(ID)
+	m.cache.Remove(ID)
+	dir := filepath.Join(dataPath, quarantineDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ID+".info"), infoData, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(dbPath(ID), filepath.Join(dir, ID+".db")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Rename(filepath.Join(dataPath, ID), filepath.Join(dir, ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+FormatVersion is the version of the envelope data files are written with.
+Version 0 are files written before the envelope existed.
+*/
+const FormatVersion = 1
+
+// Data files start with the magic, followed by one byte for the format
+// version, the length of the header as uvarint, the JSON header and the payload
+var envelopeMagic = []byte{0x89, 'S', 'K', 'Z', 'E', 'N', 'V', '\n'}
+
+/*
+Header describes the sketch a data file belongs to
+*/
+type Header struct {
+	Type       string             `json:"type"`
+	InnerType  string             `json:"inner_type,omitempty"`
+	Hash       string             `json:"hash,omitempty"`
+	Seed       uint64             `json:"seed,omitempty"`
+	Properties map[string]float64 `json:"properties,omitempty"`
+}
+
+/*
+Wrap puts payload into an envelope of the current format version
+*/
+func Wrap(header Header, payload []byte) ([]byte, error) {
+	js, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(envelopeMagic)+1+binary.MaxVarintLen64+len(js)+len(payload))
+	out = append(out, envelopeMagic...)
+	out = append(out, FormatVersion)
+	size := make([]byte, binary.MaxVarintLen64)
+	out = append(out, size[:binary.PutUvarint(size, uint64(len(js)))]...)
+	out = append(out, js...)
+	return append(out, payload...), nil
+}
+
+/*
+Version returns the format version of a data file
+*/
+func Version(data []byte) int {
+	if !bytes.HasPrefix(data, envelopeMagic) || len(data) == len(envelopeMagic) {
+		return 0
+	}
+	return int(data[len(envelopeMagic)])
+}
+
+/*
+Unwrap returns the header and the payload of a data file of the current format
+version
+*/
+func Unwrap(data []byte) (Header, []byte, error) {
+	var header Header
+	if version := Version(data); version != FormatVersion {
+		return header, nil, fmt.Errorf("Unsupported format version %d, expected %d", version, FormatVersion)
+	}
+	data = data[len(envelopeMagic)+1:]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return header, nil, errors.New("Truncated envelope header")
+	}
+	if err := json.Unmarshal(data[n:n+int(size)], &header); err != nil {
+		return header, nil, fmt.Errorf("Invalid envelope header: %s", err)
+	}
+	return header, data[n+int(size):], nil
+}
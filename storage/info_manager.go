@@ -10,17 +10,83 @@ import (
 
 var db *bolt.DB
 
+const (
+	infoBucket    = "info"
+	domainBucket  = "domains"
+	replicaBucket = "replicas"
+)
+
 /*
 LoadAllInfo ...
 */
 func (m *ManagerStruct) LoadAllInfo() ([][]byte, error) {
+	return loadAll(infoBucket)
+}
+
+/*
+SaveInfo ...
+*/
+func (m *ManagerStruct) SaveInfo(id string, infoData []byte) error {
+	return save(infoBucket, id, infoData)
+}
+
+/*
+DeleteInfo ...
+*/
+func (m *ManagerStruct) DeleteInfo(id string) error {
+	return remove(infoBucket, id)
+}
+
+/*
+LoadAllDomains returns the serialized info of all domains
+*/
+func (m *ManagerStruct) LoadAllDomains() ([][]byte, error) {
+	return loadAll(domainBucket)
+}
+
+/*
+SaveDomain stores the serialized info of a domain
+*/
+func (m *ManagerStruct) SaveDomain(id string, domainData []byte) error {
+	return save(domainBucket, id, domainData)
+}
+
+/*
+DeleteDomain removes the info of a domain
+*/
+func (m *ManagerStruct) DeleteDomain(id string) error {
+	return remove(domainBucket, id)
+}
+
+/*
+LoadAllReplicas returns the serialized replica state of all sketches
+*/
+func (m *ManagerStruct) LoadAllReplicas() ([][]byte, error) {
+	return loadAll(replicaBucket)
+}
+
+/*
+SaveReplicas stores the serialized replica state of a sketch
+*/
+func (m *ManagerStruct) SaveReplicas(id string, replicaData []byte) error {
+	return save(replicaBucket, id, replicaData)
+}
+
+/*
+DeleteReplicas removes the replica state of a sketch
+*/
+func (m *ManagerStruct) DeleteReplicas(id string) error {
+	return remove(replicaBucket, id)
+}
+
+func loadAll(bucketName string) ([][]byte, error) {
 	db, err := getInfoDB()
 	if err != nil {
 		return nil, err
 	}
 	var infoDatas [][]byte
 	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("info"))
+		bucket := tx.Bucket([]byte(bucketName))
 
 		infoDatas = make([][]byte, bucket.Stats().KeyN)
 		c := bucket.Cursor()
@@ -43,16 +109,13 @@ func (m *ManagerStruct) LoadAllInfo() ([][]byte, error) {
 	return infoDatas, nil
 }
 
-/*
-SaveInfo ...
-*/
-func (m *ManagerStruct) SaveInfo(id string, infoData []byte) error {
+func save(bucketName string, id string, infoData []byte) error {
 	db, err := getInfoDB()
+	if err != nil {
+		return err
+	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("info"))
-		if err != nil {
-			return err
-		}
+		bucket := tx.Bucket([]byte(bucketName))
 		key := []byte(id)
 		err = bucket.Put(key, infoData)
 		if err != nil {
@@ -63,16 +126,13 @@ func (m *ManagerStruct) SaveInfo(id string, infoData []byte) error {
 	return err
 }
 
-/*
-DeleteInfo ...
-*/
-func (m *ManagerStruct) DeleteInfo(id string) error {
+func remove(bucketName string, id string) error {
 	db, err := getInfoDB()
+	if err != nil {
+		return err
+	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("info"))
-		if err != nil {
-			return err
-		}
+		bucket := tx.Bucket([]byte(bucketName))
 		key := []byte(id)
 		err = bucket.Delete(key)
 		if err != nil {
@@ -83,10 +143,7 @@ func (m *ManagerStruct) DeleteInfo(id string) error {
 	return err
 }
 
-/*
-CloseInfoDB ...
-*/
-func CloseInfoDB() error {
+func closeInfoDB() error {
 	if db != nil {
 		err := db.Close()
 		db = nil
@@ -115,9 +172,11 @@ func getInfoDB() (*bolt.DB, error) {
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("info"))
-		if err != nil {
-			return err
+		for _, bucketName := range []string{infoBucket, domainBucket, replicaBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+KV is an ordered key value store holding the data of a sketch that is too big
+to be serialized as a whole, like the counts of a disk backed dict
+*/
+type KV interface {
+	Get(key string) ([]byte, error)
+	// Write stores all changes in one go, nil values delete their key
+	Write(changes map[string][]byte) error
+	// Range calls fn for each key from on in ascending order until fn returns
+	// false, value is only valid during the call
+	Range(from string, fn func(key string, value []byte) bool) error
+	Len() (int, error)
+	Clear() error
+	Close() error
+}
+
+var kvBucket = []byte("kv")
+
+var errKVDeleted = errors.New("The KV was deleted")
+
+/*
+boltKV is a KV in a bucket of a BoltDB database, view and update run the
+transactions and bucket returns the bucket within them, nil once it is deleted
+*/
+type boltKV struct {
+	view   func(func(*bolt.Tx) error) error
+	update func(func(*bolt.Tx) error) error
+	bucket func(*bolt.Tx) *bolt.Bucket
+	close  func() error
+}
+
+/*
+openFileKV opens the KV of a sketch in a database file of its own
+*/
+func openFileKV(ID string) (*boltKV, error) {
+	db, err := openDB(ID)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltKV{
+		view:   db.View,
+		update: db.Update,
+		bucket: func(tx *bolt.Tx) *bolt.Bucket { return tx.Bucket(kvBucket) },
+		close:  db.Close,
+	}, nil
+}
+
+func (kv *boltKV) get(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if bucket := kv.bucket(tx); bucket != nil {
+		return bucket, nil
+	}
+	return nil, errKVDeleted
+}
+
+/*
+Get ...
+*/
+func (kv *boltKV) Get(key string) ([]byte, error) {
+	var value []byte
+	err := kv.view(func(tx *bolt.Tx) error {
+		bucket, err := kv.get(tx)
+		if err != nil {
+			return err
+		}
+		if data := bucket.Get([]byte(key)); data != nil {
+			value = append([]byte(nil), data...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+/*
+Write stores all changes in one transaction
+*/
+func (kv *boltKV) Write(changes map[string][]byte) error {
+	return kv.update(func(tx *bolt.Tx) error {
+		bucket, err := kv.get(tx)
+		if err != nil {
+			return err
+		}
+		for key, value := range changes {
+			var err error
+			if value == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+Range ...
+*/
+func (kv *boltKV) Range(from string, fn func(key string, value []byte) bool) error {
+	return kv.view(func(tx *bolt.Tx) error {
+		bucket, err := kv.get(tx)
+		if err != nil {
+			return err
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil; k, v = c.Next() {
+			if !fn(string(k), v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+/*
+Len ...
+*/
+func (kv *boltKV) Len() (int, error) {
+	var n int
+	err := kv.view(func(tx *bolt.Tx) error {
+		bucket, err := kv.get(tx)
+		if err != nil {
+			return err
+		}
+		n = bucket.Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+/*
+Clear ...
+*/
+func (kv *boltKV) Clear() error {
+	return kv.update(func(tx *bolt.Tx) error {
+		bucket, err := kv.get(tx)
+		if err != nil {
+			return err
+		}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+Close ...
+*/
+func (kv *boltKV) Close() error {
+	return kv.close()
+}
+
+/*
+memoryKV is a KV of the memory backend, it outlives being closed and opened
+again like the KVs of the other backends
+*/
+type memoryKV struct {
+	lock   sync.RWMutex
+	values map[string][]byte
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{values: make(map[string][]byte)}
+}
+
+/*
+Get ...
+*/
+func (kv *memoryKV) Get(key string) ([]byte, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return append([]byte(nil), kv.values[key]...), nil
+}
+
+/*
+Write ...
+*/
+func (kv *memoryKV) Write(changes map[string][]byte) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for key, value := range changes {
+		if value == nil {
+			delete(kv.values, key)
+		} else {
+			kv.values[key] = append([]byte(nil), value...)
+		}
+	}
+	return nil
+}
+
+/*
+Range sorts the keys from on, the memory backend is not meant for big sketches
+*/
+func (kv *memoryKV) Range(from string, fn func(key string, value []byte) bool) error {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	keys := make([]string, 0, len(kv.values))
+	for key := range kv.values {
+		if key >= from {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, kv.values[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+Len ...
+*/
+func (kv *memoryKV) Len() (int, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return len(kv.values), nil
+}
+
+/*
+Clear ...
+*/
+func (kv *memoryKV) Clear() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.values = make(map[string][]byte)
+	return nil
+}
+
+/*
+Close ...
+*/
+func (kv *memoryKV) Close() error {
+	return nil
+}
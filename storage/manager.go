@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/utils"
@@ -13,19 +16,21 @@ var conf *config.Config
 var dataPath string
 var logger = utils.GetLogger()
 
-// ManagerStruct the storage should deal with 2 types of on disk files, info and data
+// ManagerStruct is the file storage backend, it should deal with 2 types of on
+// disk files, info and data
 // info describes a domain and can be used to load back from disk the settings
 // of a counter to reinitialize it
-// the data is to refill the counters from disk
+// the data is to refill the counters from disk, one file per sketch
 type ManagerStruct struct {
-	cache *lru.Cache
+	cache     *lru.Cache
+	slices    *lru.Cache // of sliceKey to []byte
+	checksums map[string][]uint64
+	sliceSize int
+	lock      sync.Mutex
 }
 
-var manager *ManagerStruct
-
 func newManager() *ManagerStruct {
-	conf = config.GetConfig()
-	dataPath = conf.DataDir
+	setupDataPath()
 	cacheSize := int(conf.CacheSize)
 	if cacheSize == 0 {
 		cacheSize = 250 // default cache size
@@ -38,17 +43,49 @@ func newManager() *ManagerStruct {
 		}
 	})
 	utils.PanicOnError(err)
-	err = os.MkdirAll(dataPath, 0777)
+	sliceCacheSize := int(conf.SliceCacheSize)
+	if sliceCacheSize == 0 {
+		sliceCacheSize = 1 // default slice cache size
+	}
+	slices, err := lru.New(sliceCacheSize)
+	utils.PanicOnError(err)
+	return &ManagerStruct{
+		cache:     cache,
+		slices:    slices,
+		checksums: make(map[string][]uint64),
+		sliceSize: sliceSize(conf.SliceSize),
+	}
+}
+
+func setupDataPath() {
+	conf = config.GetConfig()
+	dataPath = conf.DataDir
+	err := os.MkdirAll(dataPath, 0777)
 	utils.PanicOnError(err)
-	return &ManagerStruct{cache}
 }
 
 /*
-Manager ...
+DataIDs returns the ids of all sketches with a data file
 */
-func Manager() *ManagerStruct {
-	if manager == nil {
-		manager = newManager()
+func (m *ManagerStruct) DataIDs() ([]string, error) {
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if !file.Mode().IsRegular() || filepath.Ext(file.Name()) == ".db" {
+			continue
+		}
+		ids = append(ids, file.Name())
 	}
-	return manager
+	return ids, nil
+}
+
+/*
+Close closes the open data files and the info db
+*/
+func (m *ManagerStruct) Close() error {
+	m.cache.Purge()
+	return closeInfoDB()
 }
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/utils"
@@ -24,6 +26,7 @@ func setupTests() {
 }
 
 func tearDownTests() {
+	closeInfoDB()
 	os.RemoveAll(config.GetConfig().DataDir)
 	os.RemoveAll(config.GetConfig().InfoDir)
 	os.Mkdir(config.GetConfig().DataDir, 0777)
@@ -151,3 +154,258 @@ func TestSaveAndDeleteData(t *testing.T) {
 		t.Error("Expected no data in,", path, "got", err)
 	}
 }
+
+func TestSaveSlices(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	conf.SliceSize = 1
+	defer func() { conf.SliceSize = 0 }()
+
+	m1 := newManager()
+	m1.Create("cerebro")
+	data := bytes.Repeat([]byte("xavier"), 1<<19) // 3MB
+	if n, err := m1.SaveSlices("cerebro", data); err != nil || n != 3 {
+		t.Error("Expected 3 slices written, got", n, err)
+	}
+	data[1<<20+42] = 'X'
+	if n, err := m1.SaveSlices("cerebro", data); err != nil || n != 1 {
+		t.Error("Expected 1 slice written, got", n, err)
+	}
+
+	// A fresh manager only knows the slices it loaded
+	m2 := newManager()
+	loaded, err := m2.LoadSlices("cerebro")
+	if err != nil {
+		t.Error("Expected no error loading slices, got", err)
+	}
+	if !bytes.Equal(data, loaded) {
+		t.Error("Expected loaded data to equal saved data")
+	}
+	if n, err := m2.SaveSlices("cerebro", data); err != nil || n != 0 {
+		t.Error("Expected no slices written, got", n, err)
+	}
+
+	data = data[:1<<20+10]
+	if n, err := m2.SaveSlices("cerebro", data); err != nil || n != 1 {
+		t.Error("Expected 1 slice written, got", n, err)
+	}
+	loaded, err = newManager().LoadSlices("cerebro")
+	if err != nil {
+		t.Error("Expected no error loading slices, got", err)
+	}
+	if !bytes.Equal(data, loaded) {
+		t.Errorf("Expected %d bytes after shrinking, got %d", len(data), len(loaded))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	zeros := make([]byte, 1<<16)
+	for _, codec := range []string{"", CompressionNone, CompressionSnappy} {
+		compressed, err := Compress(codec, zeros)
+		if err != nil {
+			t.Error("Expected no error compressing, got", err)
+		}
+		data, err := Decompress(compressed)
+		if err != nil {
+			t.Error("Expected no error decompressing, got", err)
+		}
+		if !bytes.Equal(zeros, data) {
+			t.Errorf("Expected %s round trip to return the data", codec)
+		}
+	}
+	if compressed, _ := Compress(CompressionSnappy, zeros); len(compressed) > len(zeros)/10 {
+		t.Error("Expected zeros to compress well, got", len(compressed))
+	}
+
+	// Raw data looking like a header must survive
+	raw := append(append([]byte{}, compressionMagic...), 1, 2, 3)
+	compressed, _ := Compress(CompressionNone, raw)
+	if data, err := Decompress(compressed); err != nil || !bytes.Equal(raw, data) {
+		t.Error("Expected raw data starting with the magic to round trip, got", data, err)
+	}
+
+	if _, err := Compress("gzip", zeros); err == nil {
+		t.Error("Expected error compressing with unknown codec")
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	header := Header{Type: "hllpp", Hash: "xxhash", Seed: 7}
+	data, err := Wrap(header, []byte("wolverine"))
+	if err != nil {
+		t.Error("Expected no error wrapping, got", err)
+	}
+	if v := Version(data); v != FormatVersion {
+		t.Errorf("Expected format version %d, got %d", FormatVersion, v)
+	}
+	got, payload, err := Unwrap(data)
+	if err != nil {
+		t.Error("Expected no error unwrapping, got", err)
+	}
+	if got.Type != "hllpp" || got.Hash != "xxhash" || got.Seed != 7 || string(payload) != "wolverine" {
+		t.Error("Expected the header and payload to round trip, got", got, string(payload))
+	}
+
+	if v := Version([]byte("wolverine")); v != 0 {
+		t.Error("Expected files without envelope to be version 0, got", v)
+	}
+	if _, _, err := Unwrap(data[:len(envelopeMagic)+3]); err == nil {
+		t.Error("Expected error unwrapping truncated envelope")
+	}
+}
+
+func TestBackends(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	conf := config.GetConfig()
+	conf.SliceSize = 1
+	defer func() { conf.SliceSize = 0 }()
+
+	for _, name := range []string{FileBackend, BoltBackend, MemoryBackend} {
+		b, err := NewBackend(name)
+		if err != nil {
+			t.Fatal("Expected no error opening backend, got", err)
+		}
+		if err := b.SaveInfo("marvel", []byte("wolverine")); err != nil {
+			t.Error("Expected no error saving info, got", err)
+		}
+		if infos, _ := b.LoadAllInfo(); len(infos) != 1 || string(infos[0]) != "wolverine" {
+			t.Errorf("Expected info wolverine from %s, got %s", name, infos)
+		}
+		b.DeleteInfo("marvel")
+		if infos, _ := b.LoadAllInfo(); len(infos) != 0 {
+			t.Errorf("Expected no info from %s, got %d", name, len(infos))
+		}
+
+		b.Create("marvel")
+		data := bytes.Repeat([]byte("xavier"), 1<<19) // 3MB
+		if _, err := b.SaveSlices("marvel", data); err != nil {
+			t.Error("Expected no error saving slices, got", err)
+		}
+		data[42] = 'X'
+		data = data[:2<<20+10]
+		n, err := b.SaveSlices("marvel", data)
+		if err != nil {
+			t.Error("Expected no error saving slices, got", err)
+		}
+		if name == BoltBackend && n != 2 {
+			t.Error("Expected 2 slices written, got", n)
+		}
+		loaded, err := b.LoadSlices("marvel")
+		if err != nil {
+			t.Error("Expected no error loading slices, got", err)
+		}
+		if !bytes.Equal(data, loaded) {
+			t.Errorf("Expected %d bytes from %s, got %d", len(data), name, len(loaded))
+		}
+		if ids, _ := b.DataIDs(); len(ids) != 1 || ids[0] != "marvel" {
+			t.Errorf("Expected data of marvel in %s, got %v", name, ids)
+		}
+
+		if err := b.QuarantineData("marvel", []byte("wolverine")); err != nil {
+			t.Error("Expected no error quarantining data, got", err)
+		}
+		if ids, _ := b.DataIDs(); len(ids) != 0 {
+			t.Errorf("Expected no data in %s, got %v", name, ids)
+		}
+		if err := b.Close(); err != nil {
+			t.Error("Expected no error closing backend, got", err)
+		}
+	}
+
+	if _, err := NewBackend("s3"); err == nil {
+		t.Error("Expected error opening unknown backend")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+
+	b, err := newBoltBackend()
+	if err != nil {
+		t.Fatal("Expected no error opening backend, got", err)
+	}
+	data := bytes.Repeat([]byte("xavier"), 1<<20)
+	for i := 0; i < 4; i++ {
+		b.SaveSlices(fmt.Sprintf("marvel-%d", i), data)
+	}
+	for i := 1; i < 4; i++ {
+		b.DeleteData(fmt.Sprintf("marvel-%d", i))
+	}
+	b.Close()
+
+	path := filepath.Join(config.GetConfig().DataDir, boltFile)
+	before, _ := os.Stat(path)
+	// Opening a mostly free database compacts it
+	b, err = newBoltBackend()
+	if err != nil {
+		t.Fatal("Expected no error opening backend, got", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/2 {
+		t.Errorf("Expected database of %d bytes to shrink, got %d bytes", before.Size(), after.Size())
+	}
+	loaded, err := b.LoadSlices("marvel-0")
+	if err != nil || !bytes.Equal(data, loaded) {
+		t.Error("Expected data to survive compaction, got", err)
+	}
+	b.Close()
+
+	// Running backends compact every compact_interval
+	conf := config.GetConfig()
+	conf.CompactInterval = 1
+	defer func() { conf.CompactInterval = 0 }()
+	b, err = newBoltBackend()
+	if err != nil {
+		t.Fatal("Expected no error opening backend, got", err)
+	}
+	defer b.Close()
+	for i := 1; i < 4; i++ {
+		b.SaveSlices(fmt.Sprintf("marvel-%d", i), data)
+	}
+	for i := 1; i < 4; i++ {
+		b.DeleteData(fmt.Sprintf("marvel-%d", i))
+	}
+	before, _ = os.Stat(path)
+	time.Sleep(1500 * time.Millisecond)
+	after, _ = os.Stat(path)
+	if after.Size() >= before.Size()/2 {
+		t.Errorf("Expected database of %d bytes to shrink, got %d bytes", before.Size(), after.Size())
+	}
+	loaded, err = b.LoadSlices("marvel-0")
+	if err != nil || !bytes.Equal(data, loaded) {
+		t.Error("Expected data to survive compaction, got", err)
+	}
+}
+
+func benchmarkCreateAndSave(b *testing.B, name string) {
+	setupTests()
+	defer tearDownTests()
+	backend, err := NewBackend(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backend.Close()
+	data := bytes.Repeat([]byte{42}, 256) // about the size of a small sparse hllpp
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ID := fmt.Sprintf("users-%d.hllpp", i)
+		if err := backend.Create(ID); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := backend.Save(ID, data, data[:64]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateAndSaveFile(b *testing.B) {
+	benchmarkCreateAndSave(b, FileBackend)
+}
+
+func BenchmarkCreateAndSaveBolt(b *testing.B) {
+	benchmarkCreateAndSave(b, BoltBackend)
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+memoryBackend keeps everything in memory, for tests and ephemeral deployments
+where losing all sketches on restart is fine
+*/
+type memoryBackend struct {
+	lock        sync.RWMutex
+	info        map[string][]byte
+	domains     map[string][]byte
+	replicas    map[string][]byte
+	data        map[string][]byte
+	kvs         map[string]*memoryKV
+	quarantined map[string][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		info:        make(map[string][]byte),
+		domains:     make(map[string][]byte),
+		replicas:    make(map[string][]byte),
+		data:        make(map[string][]byte),
+		kvs:         make(map[string]*memoryKV),
+		quarantined: make(map[string][]byte),
+	}
+}
+
+func (mb *memoryBackend) loadAll(values map[string][]byte) ([][]byte, error) {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	all := make([][]byte, 0, len(values))
+	for _, value := range values {
+		all = append(all, value)
+	}
+	return all, nil
+}
+
+func (mb *memoryBackend) put(values map[string][]byte, ID string, value []byte) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	values[ID] = append([]byte(nil), value...)
+	return nil
+}
+
+func (mb *memoryBackend) delete(values map[string][]byte, ID string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	delete(values, ID)
+	return nil
+}
+
+/*
+LoadAllInfo ...
+*/
+func (mb *memoryBackend) LoadAllInfo() ([][]byte, error) {
+	return mb.loadAll(mb.info)
+}
+
+/*
+SaveInfo ...
+*/
+func (mb *memoryBackend) SaveInfo(ID string, infoData []byte) error {
+	return mb.put(mb.info, ID, infoData)
+}
+
+/*
+DeleteInfo ...
+*/
+func (mb *memoryBackend) DeleteInfo(ID string) error {
+	return mb.delete(mb.info, ID)
+}
+
+/*
+LoadAllDomains ...
+*/
+func (mb *memoryBackend) LoadAllDomains() ([][]byte, error) {
+	return mb.loadAll(mb.domains)
+}
+
+/*
+SaveDomain ...
+*/
+func (mb *memoryBackend) SaveDomain(ID string, domainData []byte) error {
+	return mb.put(mb.domains, ID, domainData)
+}
+
+/*
+DeleteDomain ...
+*/
+func (mb *memoryBackend) DeleteDomain(ID string) error {
+	return mb.delete(mb.domains, ID)
+}
+
+/*
+LoadAllReplicas ...
+*/
+func (mb *memoryBackend) LoadAllReplicas() ([][]byte, error) {
+	return mb.loadAll(mb.replicas)
+}
+
+/*
+SaveReplicas ...
+*/
+func (mb *memoryBackend) SaveReplicas(ID string, replicaData []byte) error {
+	return mb.put(mb.replicas, ID, replicaData)
+}
+
+/*
+DeleteReplicas ...
+*/
+func (mb *memoryBackend) DeleteReplicas(ID string) error {
+	return mb.delete(mb.replicas, ID)
+}
+
+/*
+Create ...
+*/
+func (mb *memoryBackend) Create(ID string) error {
+	return mb.put(mb.data, ID, nil)
+}
+
+/*
+SaveSlices stores data as a single slice
+*/
+func (mb *memoryBackend) SaveSlices(ID string, data []byte) (int, error) {
+	return 1, mb.put(mb.data, ID, data)
+}
+
+/*
+Save ...
+*/
+func (mb *memoryBackend) Save(ID string, data []byte, infoData []byte) (int, error) {
+	if err := mb.put(mb.info, ID, infoData); err != nil {
+		return 0, err
+	}
+	return mb.SaveSlices(ID, data)
+}
+
+/*
+LoadSlices ...
+*/
+func (mb *memoryBackend) LoadSlices(ID string) ([]byte, error) {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	data, ok := mb.data[ID]
+	if !ok {
+		return nil, errors.New("No data for sketch " + ID)
+	}
+	return append([]byte{}, data...), nil
+}
+
+/*
+DeleteData ...
+*/
+func (mb *memoryBackend) DeleteData(ID string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	delete(mb.data, ID)
+	delete(mb.kvs, ID)
+	return nil
+}
+
+/*
+QuarantineData forgets the data of the sketch, keeping only its info
+*/
+func (mb *memoryBackend) QuarantineData(ID string, infoData []byte) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	delete(mb.data, ID)
+	delete(mb.kvs, ID)
+	mb.quarantined[ID] = append([]byte(nil), infoData...)
+	return nil
+}
+
+/*
+DataIDs ...
+*/
+func (mb *memoryBackend) DataIDs() ([]string, error) {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	ids := make([]string, 0, len(mb.data))
+	for ID := range mb.data {
+		ids = append(ids, ID)
+	}
+	return ids, nil
+}
+
+/*
+OpenKV ...
+*/
+func (mb *memoryBackend) OpenKV(ID string) (KV, error) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	kv, ok := mb.kvs[ID]
+	if !ok {
+		kv = newMemoryKV()
+		mb.kvs[ID] = kv
+	}
+	return kv, nil
+}
+
+/*
+Close ...
+*/
+func (mb *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/seiflotfy/skizze/config"
+
+	"github.com/dgryski/go-farm"
+)
+
+const defaultSliceSize = 5 // in MB
+
+/*
+sliceKey identifies a slice of the data of a sketch in the slice cache
+*/
+type sliceKey struct {
+	ID    string
+	Index int
+}
+
+/*
+Save stores the data file of a sketch and then its info in the info database
+*/
+func (m *ManagerStruct) Save(ID string, data []byte, infoData []byte) (int, error) {
+	written, err := m.SaveSlices(ID, data)
+	if err != nil {
+		return written, err
+	}
+	return written, m.SaveInfo(ID, infoData)
+}
+
+/*
+SaveSlices stores data split into slices of slice_size MB, only slices that
+changed since they were last saved or loaded are written. It returns the
+number of slices written.
+*/
+func (m *ManagerStruct) SaveSlices(ID string, data []byte) (int, error) {
+	f, err := m.getFileFromCache(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old := m.checksums[ID]
+	checksums := make([]uint64, 0, len(data)/m.sliceSize+1)
+	written := 0
+	for i, offset := 0, 0; offset < len(data); i, offset = i+1, offset+m.sliceSize {
+		end := offset + m.sliceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		slice := data[offset:end]
+		checksum := farm.Hash64(slice)
+		checksums = append(checksums, checksum)
+		if i < len(old) && old[i] == checksum {
+			continue
+		}
+		if _, err := f.WriteAt(slice, int64(offset)); err != nil {
+			delete(m.checksums, ID)
+			return written, err
+		}
+		m.slices.Add(sliceKey{ID, i}, append([]byte(nil), slice...))
+		written++
+	}
+	for i := len(checksums); i < len(old); i++ {
+		m.slices.Remove(sliceKey{ID, i})
+	}
+	if err := f.Truncate(int64(len(data))); err != nil {
+		delete(m.checksums, ID)
+		return written, err
+	}
+	m.checksums[ID] = checksums
+	return written, nil
+}
+
+/*
+LoadSlices returns the data of a sketch stored with SaveSlices, slices are
+read from the slice cache if possible
+*/
+func (m *ManagerStruct) LoadSlices(ID string) ([]byte, error) {
+	f, err := m.getFileFromCache(ID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	size := int(info.Size())
+	data := make([]byte, size)
+	checksums := make([]uint64, 0, size/m.sliceSize+1)
+	for i, offset := 0, 0; offset < size; i, offset = i+1, offset+m.sliceSize {
+		end := offset + m.sliceSize
+		if end > size {
+			end = size
+		}
+		if v, ok := m.slices.Get(sliceKey{ID, i}); ok && len(v.([]byte)) == end-offset {
+			copy(data[offset:end], v.([]byte))
+		} else {
+			if _, err := f.ReadAt(data[offset:end], int64(offset)); err != nil {
+				return nil, fmt.Errorf("Error reading slice %d of %s: %s", i, ID, err)
+			}
+			m.slices.Add(sliceKey{ID, i}, append([]byte(nil), data[offset:end]...))
+		}
+		checksums = append(checksums, farm.Hash64(data[offset:end]))
+	}
+	m.checksums[ID] = checksums
+	return data, nil
+}
+
+/*
+forgetSlices drops the cached slices and checksums of a sketch
+*/
+func (m *ManagerStruct) forgetSlices(ID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := range m.checksums[ID] {
+		m.slices.Remove(sliceKey{ID, i})
+	}
+	delete(m.checksums, ID)
+}
+
+/*
+SliceSize returns the size in bytes of the slices the data of sketches is
+split into
+*/
+func SliceSize() int {
+	return sliceSize(config.GetConfig().SliceSize)
+}
+
+func sliceSize(conf uint) int {
+	if conf == 0 {
+		conf = defaultSliceSize
+	}
+	return int(conf) << 20
+}